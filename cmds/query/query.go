@@ -3,57 +3,113 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/jeffwilliams/wwwmp3/scan"
 	_ "github.com/mattn/go-sqlite3"
 	"os"
+	"strings"
 )
 
 var artist = flag.String("artist", "", "Artist search criteria")
 var album = flag.String("album", "", "Album search criteria")
 var title = flag.String("title", "", "Title search criteria")
+var library = flag.String("library", "", "Only output mp3s in the library with this name")
 var dbflag = flag.String("db", "mp3db", "database containing mp3 info")
 var field = flag.String("field", "", "Only output the specified field (album, artist, or title)")
 var page = flag.Int("page", -1, "The page in results to return")
 var pageSize = flag.Int("pageSize", 10, "Size of a page")
+var match = flag.String("match", "substring", "How the search criteria are matched: substring, exact or prefix")
+var order = flag.String("order", "artist,album,title", "Comma separated fields to order by. Prefix a field with - to order descending")
+var text = flag.String("q", "", "Free text to search for in the artist, album, title, genre, path and lyrics. Unless -order is given the best matches are output first")
+var fuzzy = flag.Bool("fuzzy", false, "Allow a few typing mistakes in the words of -q and of substring search criteria")
+var stats = flag.Bool("stats", false, "Output statistics about the mp3s (in -library if given) instead of querying")
+var jsonflag = flag.Bool("json", false, "Output the -stats as JSON")
+var top = flag.Int("top", 10, "Number of albums and of mp3s missing tags that -stats lists")
 
-func output(db scan.Mp3Db, filt map[string]string) {
-	ch := make(chan map[string]string)
+func outputStats(db scan.Mp3Db) {
+	opts := &scan.StatsOptions{Top: *top}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "library" {
+			opts.Libraries = []string{*library}
+		}
+	})
+
+	s, err := scan.LibraryStats(db, opts)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
-	var paging *scan.Paging
+	if *jsonflag {
+		d, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(string(d))
+	} else {
+		s.WriteText(os.Stdout)
+	}
+}
+
+func output(db scan.Mp3Db, filt map[string]string) {
+	q := &scan.Query{Fields: []string{"artist", "album", "title", "path"}}
 
 	if *page >= 0 {
-		paging = &scan.Paging{PageSize: *pageSize, Page: *page}
+		q.Paging = &scan.Paging{PageSize: *pageSize, Page: *page}
 	}
 
-	fields := []string{"artist", "album", "title", "path"}
 	if len(*field) > 0 {
-		fields = []string{*field}
-	}
-
-	go scan.FindMp3sInDb(
-		db,
-		fields,
-		filt,
-		[]string{"artist", "album", "title"},
-		ch,
-		paging,
-		os.Stderr)
-
-	for meta := range ch {
-		if _, ok := meta["eof"]; ok {
-			fmt.Println("<final page>")
-			break
+		q.Fields = []string{*field}
+	}
+
+	m, err := scan.ParseMatch(*match)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for k, v := range filt {
+		if len(v) > 0 {
+			q.Where = append(q.Where, scan.Condition{Field: k, Match: m, Value: v})
+		}
+	}
+	if len(*library) > 0 {
+		q.Where = append(q.Where, scan.Condition{Field: "library", Match: scan.Exact, Value: *library})
+	}
+
+	q.Text = *text
+	q.Fuzzy = *fuzzy
+
+	orderSet := false
+	flag.Visit(func(f *flag.Flag) {
+		orderSet = orderSet || f.Name == "order"
+	})
+	if len(q.Text) == 0 || orderSet {
+		for _, o := range strings.Split(*order, ",") {
+			q.Order = append(q.Order, scan.ParseSort(o))
+		}
+	}
+
+	tracks, hasMore, err := scan.FindTracks(db, q)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	for _, t := range tracks {
+		if len(*field) > 0 {
+			fmt.Println(t.Map(q.Fields)[*field])
 		} else {
-			if len(*field) > 0 {
-				fmt.Println(meta[*field])
-			} else {
-				fmt.Printf("    {artist: \"%s\", album: \"%s\", title: \"%s\", path: \"%s\"},\n",
-					meta["artist"], meta["album"], meta["title"], meta["path"])
-			}
+			fmt.Printf("    {artist: \"%s\", album: \"%s\", title: \"%s\", path: \"%s\"},\n",
+				t.Artist, t.Album, t.Title, t.Path)
 		}
 	}
+
+	if !hasMore {
+		fmt.Println("<final page>")
+	}
 }
 
 func main() {
@@ -77,6 +133,12 @@ func main() {
 		"title":  *title,
 	}
 
+	// Opening a database file that doesn't exist would create it.
+	if _, err := os.Stat(*dbflag); err != nil {
+		fmt.Println("Error opening database:", err)
+		os.Exit(1)
+	}
+
 	db, err := sql.Open("sqlite3", *dbflag)
 	if err != nil {
 		return
@@ -89,6 +151,11 @@ func main() {
 	}
 	defer mp3db.Close()
 
+	if *stats {
+		outputStats(mp3db)
+		return
+	}
+
 	output(mp3db, c)
 
 }
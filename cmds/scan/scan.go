@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"flag"
@@ -11,6 +12,8 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -18,6 +21,46 @@ import (
 
 var dbflag = flag.String("db", "", "If set, store data in the mentioned database")
 var dump = flag.Bool("dump", false, "If set, print out all id3 information contained in the files")
+var full = flag.Bool("full", false, "If set, re-read all files even if their size and modification time are unchanged since the last scan")
+var pruneOnly = flag.Bool("prune", false, "If set, only remove mp3s from the database whose files no longer exist; don't scan for new or changed files. Requires -db")
+var noPrune = flag.Bool("noprune", false, "If set, don't remove mp3s from the database whose files no longer exist after scanning")
+var workers = flag.Int("workers", 0, "Number of files to read tags from concurrently. Defaults to the number of CPUs")
+var batchSize = flag.Int("batch", 100, "Maximum number of mp3s to write to the database per transaction")
+var errorReport = flag.Bool("error-report", false, "If set, list the files and directories that could not be scanned")
+var fallbackReport = flag.Bool("fallback-report", false, "If set, list the files whose metadata was derived from their path because of missing id3 tags")
+var dryRunMigrate = flag.Bool("migrate-dry-run", false, "If set, print the schema migrations that opening the database would apply, then exit without changing it. Requires -db")
+var minSize = flag.Int64("minsize", 0, "Don't scan mp3s smaller than this many bytes")
+var noPlaylists = flag.Bool("noplaylists", false, "If set, don't import the M3U, M3U8, PLS and XSPF playlist files found as saved playlists")
+var fingerprint = flag.Bool("fingerprint", false, "If set, compute an acoustic fingerprint of each mp3 read, so that -dupes finds different rips "+
+	"of the same recording. This decodes every mp3 and is slow")
+var dupes = flag.Bool("dupes", false, "If set, list the groups of identical or similar mp3s in the database, then exit. Requires -db")
+var similarity = flag.Float64("similarity", scan.DefaultSimilarity, "With -dupes, the fraction of their fingerprints that must match for mp3s to be similar")
+var library = flag.String("library", "", "If set, the directory is the root of the library with this name, and mp3s are stored with paths "+
+	"relative to it so that the library may be mounted at a different path on other hosts")
+var templates stringList
+var includes stringList
+var excludes stringList
+
+func init() {
+	flag.Var(&templates, "template", "Path template used to derive metadata for files with missing id3 tags, "+
+		"for example '{artist}/{album}/{track} - {title}.mp3'. May be repeated; the first matching template is used.")
+	flag.Var(&includes, "include", "Only scan mp3s matching this glob pattern. May be repeated.")
+	flag.Var(&excludes, "exclude", "Don't scan files or directories matching this glob pattern, for example '@eaDir' or 'Podcasts/old'. "+
+		"May be repeated. Directories containing a "+scan.NoMediaFile+" file, and entries matching the patterns in "+
+		scan.IgnoreFile+" files, are always skipped.")
+}
+
+// stringList is a flag.Value for flags that may be passed more than once.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
 
 func openOrCreateDb(name string) (mp3db scan.Mp3Db, err error) {
 	_, err = os.Stat(name)
@@ -43,6 +86,7 @@ func openOrCreateDb(name string) (mp3db scan.Mp3Db, err error) {
 			return
 		}
 	} else {
+		printMigrations(db, "Migrating database")
 		mp3db, err = scan.OpenMp3Db(db)
 		if err != nil {
 			return
@@ -52,6 +96,52 @@ func openOrCreateDb(name string) (mp3db scan.Mp3Db, err error) {
 	return
 }
 
+// printMigrations prints the schema migrations that are pending for the database `db`, after `msg`.
+// It returns false if the pending migrations can't be determined.
+func printMigrations(db *sql.DB, msg string) bool {
+	version, err := scan.SchemaVersion(db)
+	if err != nil {
+		fmt.Println("Error reading schema version:", err)
+		return false
+	}
+
+	pending, err := scan.PendingMigrations(db)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+
+	if len(pending) > 0 {
+		fmt.Printf("%s from schema version %d:\n", msg, version)
+		for _, m := range pending {
+			fmt.Printf("    %d: %s\n", m.Version, m.Description)
+		}
+	}
+	return true
+}
+
+// migrateDryRun prints the schema migrations that opening the database `name` would apply.
+func migrateDryRun(name string) {
+	if _, err := os.Stat(name); err != nil {
+		fmt.Println("Error opening database:", err)
+		os.Exit(1)
+	}
+
+	db, err := sql.Open("sqlite3", name)
+	if err != nil {
+		fmt.Println("Error opening database:", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	if !printMigrations(db, "Would migrate database") {
+		os.Exit(1)
+	}
+	if pending, _ := scan.PendingMigrations(db); len(pending) == 0 {
+		fmt.Println("The database schema is up to date")
+	}
+}
+
 // ttyCols gets the number of columns in the terminal. This is horribly non-portable.
 func ttyCols() (int, error) {
 	cmd := exec.Command("stty", "size")
@@ -73,7 +163,10 @@ func ttyCols() (int, error) {
 
 type ScanResult struct {
 	Meta *scan.Metadata
-	Err  error
+	Sum  scan.Summary
+	// Time since the scan started
+	Elapsed time.Duration
+	Err     error
 }
 
 func printProg(c chan ScanResult) {
@@ -87,7 +180,11 @@ func printProg(c chan ScanResult) {
 			fmt.Printf(" ")
 		}
 		fmt.Printf("\r")
-		msg := r.Meta.Path
+		msg := fmt.Sprintf("%d/%d ", r.Sum.Total(), r.Sum.Found)
+		if eta := r.Sum.Remaining(r.Elapsed); eta >= 0 {
+			msg += "(" + eta.Round(time.Second).String() + " left) "
+		}
+		msg += r.Meta.Path
 		if r.Err != nil {
 			msg = r.Err.Error() + ":" + msg
 		}
@@ -98,19 +195,21 @@ func printProg(c chan ScanResult) {
 			msg = string(runes[:cols])
 			lastLen = cols
 		}
-		fmt.Printf(msg)
+		fmt.Print(msg)
 		os.Stdout.Sync()
 	}
 }
 
-func printProgNonblocking() func(m *scan.Metadata, err error) {
+func printProgNonblocking() scan.ScanCallback {
 
 	c := make(chan ScanResult)
 
 	go printProg(c)
 
-	return func(m *scan.Metadata, err error) {
-		r := ScanResult{m, err}
+	start := time.Now()
+
+	return func(m *scan.Metadata, sum *scan.Summary, err error) {
+		r := ScanResult{m, *sum, time.Now().Sub(start), err}
 		if err != nil {
 			// Don't drop errors
 			c <- r
@@ -124,9 +223,56 @@ func printProgNonblocking() func(m *scan.Metadata, err error) {
 	}
 }
 
+// printDuplicates prints the groups of identical or similar mp3s in the database.
+func printDuplicates(db scan.Library) {
+	groups, err := scan.FindDuplicates(db, *similarity)
+	if err != nil {
+		fmt.Println("Finding duplicates failed:", err)
+		os.Exit(1)
+	}
+
+	for _, g := range groups {
+		fmt.Printf("%v:\n", g)
+		for _, t := range g.Tracks {
+			p := t.Path
+			if len(t.Library) > 0 {
+				p = t.Library + ": " + p
+			}
+			d := time.Duration(t.Duration * float64(time.Second)).Round(time.Second)
+			fmt.Printf("    %s (%d kbps, %v)\n", p, t.BitRate, d)
+		}
+	}
+	fmt.Printf("%d groups of duplicates\n", len(groups))
+}
+
+// printPruneReport prints the mp3s that were pruned from the database.
+func printPruneReport(r *scan.PruneReport) {
+	if r.Err != nil {
+		fmt.Println(r.Err)
+		return
+	}
+
+	for _, p := range r.Removed {
+		fmt.Printf("    removed %s\n", p)
+	}
+	for from, to := range r.Moved {
+		fmt.Printf("    moved %s -> %s\n", from, to)
+	}
+	fmt.Printf("Pruned %d mp3s (%d moved)\n", len(r.Removed)+len(r.Moved), len(r.Moved))
+}
+
 func main() {
 	flag.Parse()
 
+	if *dryRunMigrate {
+		if dbflag == nil || len(*dbflag) == 0 {
+			fmt.Println("-migrate-dry-run requires -db")
+			os.Exit(1)
+		}
+		migrateDryRun(*dbflag)
+		return
+	}
+
 	var db scan.Mp3Db
 	usedb := false
 
@@ -145,22 +291,86 @@ func main() {
 		defer db.Close()
 	}
 
+	if *dupes {
+		if !usedb {
+			fmt.Println("-dupes requires -db")
+			os.Exit(1)
+		}
+		printDuplicates(db)
+		return
+	}
+
 	if len(flag.Args()) < 1 {
 		fmt.Println("Pass the directory to scan")
 		os.Exit(1)
 	}
 
+	pathTemplates, err := scan.ParsePathTemplates(templates)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for _, p := range [][]string{includes, excludes} {
+		if err := scan.CheckPatterns(p); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	opts := &scan.Options{
+		PathTemplates:   pathTemplates,
+		Full:            *full,
+		Prune:           !*noPrune,
+		Workers:         *workers,
+		BatchSize:       *batchSize,
+		Include:         includes,
+		Exclude:         excludes,
+		MinSize:         *minSize,
+		Fingerprint:     *fingerprint,
+		IgnorePlaylists: *noPlaylists,
+	}
+
+	if len(*library) > 0 {
+		dir, err := filepath.Abs(flag.Arg(0))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		opts.Root = &scan.Root{Name: *library, Path: dir}
+	}
+
+	if *pruneOnly {
+		if !usedb {
+			fmt.Println("-prune requires -db")
+			os.Exit(1)
+		}
+		r := scan.PruneMp3sInDbWithOptions(flag.Arg(0), db, nil, opts)
+		printPruneReport(&r)
+		if r.Err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
 	startTime := time.Now()
 
-	succCnt := 0
-	errCnt := 0
+	var sum scan.Summary
+	var report scan.ScanReport
+
+	// Files for which some metadata was derived from the path
+	fallbacks := make([]scan.Metadata, 0)
+	checkFallback := func(m *scan.Metadata) {
+		if m != nil && len(m.PathFields) > 0 {
+			fallbacks = append(fallbacks, *m)
+		}
+	}
 
 	if !usedb {
 		c := make(chan scan.Metadata)
-		go scan.ScanMp3s(flag.Arg(0), c)
+		go scan.ScanMp3sWithOptions(flag.Arg(0), c, opts)
 
 		for meta := range c {
-			succCnt++
+			sum.Added++
+			checkFallback(&meta)
 			if *dump {
 				fmt.Println("====", meta.Path)
 				play.DebugMetadata(meta.Path)
@@ -173,14 +383,43 @@ func main() {
 	} else {
 
 		printer := printProgNonblocking()
+		callback := report.Callback(func(m *scan.Metadata, sum *scan.Summary, err error) {
+			checkFallback(m)
+			printer(m, sum, err)
+		})
 
-		succCnt, errCnt = scan.ScanMp3sToDb(flag.Arg(0), db, nil, printer)
+		// Stop scanning cleanly on interrupt, keeping the mp3s scanned so far.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		sum = scan.ScanMp3sToDbWithOptions(ctx, flag.Arg(0), db, nil, callback, opts)
+		if ctx.Err() != nil {
+			fmt.Printf("\nScan interrupted")
+		}
+		stop()
 	}
 	fmt.Printf("\r")
 	fmt.Printf("\n")
 
 	diff := time.Now().Sub(startTime)
 
-	fmt.Printf("\nScanned %d mp3s (%d errors) in %s\n", succCnt+errCnt, errCnt, diff)
+	fmt.Printf("\nScanned %d mp3s in %s\n", sum.Total(), diff)
+	if usedb {
+		fmt.Printf("%v\n", sum)
+		if sum.Prune != nil {
+			printPruneReport(sum.Prune)
+		}
+		fmt.Printf("%v\n", report)
+		if *errorReport {
+			for _, e := range report.Errors {
+				fmt.Printf("    %v\n", e)
+			}
+		}
+	}
+	fmt.Printf("%d mp3s had metadata derived from their path\n", len(fallbacks))
+
+	if *fallbackReport {
+		for _, m := range fallbacks {
+			fmt.Printf("    %s: %s\n", m.Path, strings.Join(m.PathFields, ", "))
+		}
+	}
 
 }
@@ -22,15 +22,29 @@ func queryVal(r *http.Request, key string) (rs string) {
 	return
 }
 
-// prependPrefix prepents the configured prefix to the MP3 path
-func prependPrefix(fields map[string]string) {
-	if v, ok := fields["path"]; ok {
-		fields["path"] = prefix.apply(v)
+// libraryHandler is an http handler that uses the mp3 library `lib`.
+type libraryHandler func(lib scan.Library, w http.ResponseWriter, r *http.Request)
+
+// withLibrary returns a handler that calls `h` with the mp3 library `lib`. Handlers are given the
+// library rather than using a global so that they can be tested with a scan.MemLibrary.
+func withLibrary(lib scan.Library, h libraryHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(lib, w, r)
 	}
 }
 
+// containsString returns true if the list `l` contains `s`.
+func containsString(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 // Respond to requests for mp3 metadata: lists of artists, titles, song paths, etc.
-func serveMeta(w http.ResponseWriter, r *http.Request) {
+func serveMeta(lib scan.Library, w http.ResponseWriter, r *http.Request) {
 	timer := time.Now()
 
 	trc := TraceEnter("/serveMeta", nil)
@@ -48,76 +62,917 @@ func serveMeta(w http.ResponseWriter, r *http.Request) {
 		// Query string Format:
 		//  filter:
 		//    artist=blah&album=blah&title=blah
+		//  how filter values are matched (substring if not present):
+		//    match=substring|exact|prefix
+		//  only mp3s in one of these library roots:
+		//    library=music,audiobooks
+		//  OR groups; at least one condition in each group must match (may be repeated):
+		//    or=artist:blah|title:blah
+		//  free text, matching the start of words in the artist, album, title, genre, path or lyrics:
+		//    q=beatles abbey
+		//  allow a few typing mistakes in the words of q and the filter (only for substring matches):
+		//    fuzzy=1
+		//  numeric ranges (either bound may be omitted), for example only favorites rated 4 or 5 stars:
+		//    duration_min=300&duration_max=600
+		//    rating_min=4&favorite_min=1
 		//  paging:
 		//    page=0&pagesize=10
 		//  fields (not present or the following:)
 		//    fields=artist,album,...
-		//  order (not present or the following:)
-		//    order=artist,album,...
+		//  order (not present or the following; prefix a field with - to order descending.
+		//  If not present and q is, the best matches come first:)
+		//    order=artist,-album,...
+
+		badRequest := func(msg string) {
+			log.Info("serveMeta: bad request: %s", msg)
+			w.WriteHeader(400)
+			w.Write([]byte("400 Bad Request: " + msg))
+		}
+
+		page, err := strconv.Atoi(queryVal(r, "page"))
+		if err != nil {
+			badRequest("The 'page' parameter is missing or invalid.")
+			return
+		}
+
+		pageSize, err := strconv.Atoi(queryVal(r, "pagesize"))
+		if err != nil {
+			badRequest("The 'pagesize' parameter is missing or invalid.")
+			return
+		}
+
+		q := &scan.Query{
+			Fields: queryList("fields"),
+			Text:   queryVal(r, "q"),
+			Fuzzy:  queryVal(r, "fuzzy") == "1",
+			Paging: &scan.Paging{PageSize: pageSize, Page: page},
+		}
+
+		match := scan.Substring
+		if v := queryVal(r, "match"); len(v) > 0 {
+			if match, err = scan.ParseMatch(v); err != nil {
+				badRequest(err.Error())
+				return
+			}
+		}
 
 		// Calculate the filter
-		filt := make(map[string]string)
-		if v := queryVal(r, "artist"); len(v) > 0 {
-			filt["artist"] = v
+		for _, f := range []string{"artist", "album", "title"} {
+			if v := queryVal(r, f); len(v) > 0 {
+				q.Where = append(q.Where, scan.Condition{Field: f, Match: match, Value: v})
+			}
 		}
-		if v := queryVal(r, "album"); len(v) > 0 {
-			filt["album"] = v
+
+		if l := queryList("library"); len(l) > 0 {
+			group := make([]scan.Condition, 0, len(l))
+			for _, name := range l {
+				group = append(group, scan.Condition{Field: "library", Match: scan.Exact, Value: name})
+			}
+			q.Any = append(q.Any, group)
 		}
-		if v := queryVal(r, "title"); len(v) > 0 {
-			filt["title"] = v
+
+		for _, g := range r.URL.Query()["or"] {
+			group := make([]scan.Condition, 0)
+			for _, c := range strings.Split(g, "|") {
+				parts := strings.SplitN(c, ":", 2)
+				if len(parts) != 2 {
+					badRequest("The 'or' parameter must be of the form field:value|field:value")
+					return
+				}
+				group = append(group, scan.Condition{Field: parts[0], Match: match, Value: parts[1]})
+			}
+			q.Any = append(q.Any, group)
 		}
 
-		page, err := strconv.Atoi(queryVal(r, "page"))
+		for k, v := range r.URL.Query() {
+			isMin := strings.HasSuffix(k, "_min")
+			if !isMin && !strings.HasSuffix(k, "_max") {
+				continue
+			}
+
+			f, err := strconv.ParseFloat(v[0], 64)
+			if err != nil {
+				badRequest(fmt.Sprintf("The '%s' parameter must be a number.", k))
+				return
+			}
+
+			rng := scan.Range{Field: k[:len(k)-len("_min")]}
+			if isMin {
+				rng.Min = &f
+			} else {
+				rng.Max = &f
+			}
+			q.Ranges = append(q.Ranges, rng)
+		}
+
+		for _, o := range queryList("order") {
+			q.Order = append(q.Order, scan.ParseSort(o))
+		}
+
+		// The library root is needed to find the path of an mp3 on this host.
+		if containsString(q.Fields, "path") && !containsString(q.Fields, "library") {
+			q.Fields = append(q.Fields, "library")
+		}
+
+		if _, _, err := q.Build(); err != nil {
+			badRequest(err.Error())
+			return
+		}
+
+		t := TraceEnter("/serveMeta/scan.FindTracks", nil)
+		tracks, hasMore, err := scan.FindTracks(lib, q)
+		t.Leave()
+		if err != nil {
+			log.Error("serveMeta: finding mp3s failed: %v", err)
+			w.WriteHeader(500)
+			w.Write([]byte("500 Internal Server Error: " + err.Error()))
+			return
+		}
+
+		result := make([]map[string]string, 0, len(tracks)+1)
+		for i := range tracks {
+			m := tracks[i].Map(q.Fields)
+			setLocalPath(m)
+			result = append(result, m)
+		}
+		if !hasMore {
+			// Tells the client this is the last page
+			result = append(result, map[string]string{"eof": "eof"})
+		}
+
+		d, err := json.Marshal(result)
+		if err != nil {
+			log.Error("serveMeta: encoding mp3s failed: %v", err)
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(d)
+	}
+
+	d := time.Now().Sub(timer)
+	log.Info("serveMeta completed in %v", d)
+}
+
+// Get or set the rating and favorite flag of an mp3.
+func serveRate(lib scan.Library, w http.ResponseWriter, r *http.Request) {
+	logPrefix := "serveRate: " + r.Method + " " + r.URL.Path + " - "
+	log.Notice("%s requested", logPrefix)
+
+	badRequest := func(msg string) {
+		log.Info("%s bad request: %s", logPrefix, msg)
+		w.WriteHeader(400)
+		w.Write([]byte("400 Bad Request: " + msg))
+	}
+
+	// rating returns the rating and favorite flag of the mp3 with the path `path` on this host,
+	// or nil if it isn't in the library.
+	rating := func(path string) map[string]string {
+		m := findMp3ByPath(lib, path)
+		if m == nil {
+			return nil
+		}
+		return map[string]string{"path": path, "rating": m["rating"], "favorite": m["favorite"]}
+	}
+
+	writeRating := func(path string) {
+		m := rating(path)
+		if m == nil {
+			w.WriteHeader(404)
+			w.Write([]byte("404 Not Found: the mp3 is not in the library"))
+			return
+		}
+		d, err := json.Marshal(m)
+		if err != nil {
+			log.Error("%s encoding rating failed: %v", logPrefix, err)
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(d)
+	}
+
+	if r.Method == "GET" {
+		// Query string Format:
+		//  the mp3:
+		//    path=/mnt/music/song.mp3
+		path := queryVal(r, "path")
+		if len(path) == 0 {
+			badRequest("The 'path' parameter is missing.")
+			return
+		}
+		writeRating(path)
+	} else if r.Method == "POST" {
+		// Body format; Rating (0 to 5 stars) and Favorite may be omitted to leave them unchanged:
+		//   {"Path": "/mnt/music/song.mp3", "Rating": 4, "Favorite": true}
+		req := struct {
+			Path     string
+			Rating   *int
+			Favorite *bool
+		}{}
+		if r.Body == nil || json.NewDecoder(r.Body).Decode(&req) != nil {
+			badRequest("invalid JSON")
+			return
+		}
+		if len(req.Path) == 0 {
+			badRequest("The Path is missing.")
+			return
+		}
+		if req.Rating != nil && (*req.Rating < 0 || *req.Rating > scan.MaxRating) {
+			badRequest(fmt.Sprintf("The Rating must be from 0 to %d.", scan.MaxRating))
+			return
+		}
+
+		library := ""
+		root, path := roots.find(req.Path)
+		if root != nil {
+			library = root.Name
+		}
+
+		var err error
+		if req.Rating != nil {
+			err = lib.Rate(library, path, *req.Rating)
+		}
+		if err == nil && req.Favorite != nil {
+			err = lib.SetFavorite(library, path, *req.Favorite)
+		}
+		if err == scan.ErrNoTrack {
+			w.WriteHeader(404)
+			w.Write([]byte("404 Not Found: the mp3 is not in the library"))
+			return
+		} else if err != nil {
+			log.Error("%s rating %s failed: %v", logPrefix, req.Path, err)
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		if req.Rating != nil && writeRatings {
+			t := TraceEnter("/serveRate/play.SetRating", nil)
+			err = play.SetRating(req.Path, *req.Rating)
+			t.Leave()
+			if err != nil {
+				log.Error("%s writing the rating of %s to its tags failed: %v", logPrefix, req.Path, err)
+				w.WriteHeader(500)
+				w.Write([]byte(err.Error()))
+				return
+			}
+		}
+
+		// If the mp3 is the one loaded, tell the clients its new rating.
+		if m := rating(req.Path); m != nil {
+			metaLock.Lock()
+			loaded := meta != nil && metaPath == req.Path
+			if loaded {
+				// The websocket goroutines may be encoding meta, so change a copy of it.
+				changed := make(map[string]string, len(meta))
+				for k, v := range meta {
+					changed[k] = v
+				}
+				changed["rating"] = m["rating"]
+				changed["favorite"] = m["favorite"]
+				meta = changed
+			}
+			metaLock.Unlock()
+
+			if loaded {
+				t := TraceEnter("/serveRate/metaTee.In.write", nil)
+				metaTee.In <- struct{}{}
+				t.Leave()
+			}
+		}
+
+		writeRating(req.Path)
+	} else {
+		w.WriteHeader(405)
+	}
+}
+
+// Respond to requests for completions of the artist, album or title being typed.
+func serveSuggest(lib scan.Library, w http.ResponseWriter, r *http.Request) {
+	trc := TraceEnter("/serveSuggest", nil)
+	defer trc.Leave()
+
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+
+	// Query string Format:
+	//  text typed so far:
+	//    q=radiohe
+	//  fields to complete (all of artist, album and title if not present):
+	//    fields=artist,album
+	//  maximum number of suggestions (10 if not present):
+	//    limit=10
+
+	badRequest := func(msg string) {
+		log.Info("serveSuggest: bad request: %s", msg)
+		w.WriteHeader(400)
+		w.Write([]byte("400 Bad Request: " + msg))
+	}
+
+	limit := 10
+	if v := queryVal(r, "limit"); len(v) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			badRequest("The 'limit' parameter must be a positive number.")
+			return
+		}
+	}
+
+	var fields []string
+	if v := queryVal(r, "fields"); len(v) > 0 {
+		fields = strings.Split(v, ",")
+	}
+
+	suggestions, err := lib.Suggest(queryVal(r, "q"), fields, limit)
+	if err != nil {
+		badRequest(err.Error())
+		return
+	}
+
+	l := make([]map[string]string, 0, len(suggestions))
+	for _, s := range suggestions {
+		l = append(l, map[string]string{
+			"field":    s.Field,
+			"value":    s.Value,
+			"count":    strconv.Itoa(s.Count),
+			"distance": strconv.Itoa(s.Distance),
+		})
+	}
+
+	d, err := json.Marshal(l)
+	if err != nil {
+		log.Error("serveSuggest: encoding suggestions failed: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(d)
+}
+
+// Respond to requests for information about the library as a whole.
+func serveLibrary(lib scan.Library, w http.ResponseWriter, r *http.Request) {
+	logPrefix := "serveLibrary: " + r.Method + " " + r.URL.Path + " - "
+	log.Notice("%s requested", logPrefix)
+
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+
+	if r.URL.Path == "/library/duplicates" {
+		// Query string Format:
+		//  fraction of their fingerprints that must match for mp3s to be similar (optional):
+		//    similarity=0.85
+		var similarity float64
+		if v := queryVal(r, "similarity"); len(v) > 0 {
+			var err error
+			if similarity, err = strconv.ParseFloat(v, 64); err != nil || similarity <= 0 || similarity > 1 {
+				w.WriteHeader(400)
+				w.Write([]byte("400 Bad Request: The 'similarity' parameter must be a number between 0 and 1."))
+				return
+			}
+		}
+
+		groups, err := scan.FindDuplicates(lib, similarity)
+		if err != nil {
+			log.Error("%s finding duplicates failed: %v", logPrefix, err)
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		l := make([]map[string]interface{}, 0, len(groups))
+		for _, g := range groups {
+			tracks := make([]map[string]string, 0, len(g.Tracks))
+			for i := range g.Tracks {
+				m := g.Tracks[i].Map(nil)
+				setLocalPath(m)
+				tracks = append(tracks, m)
+			}
+
+			exact := "0"
+			if g.Exact {
+				exact = "1"
+			}
+			l = append(l, map[string]interface{}{
+				"exact":      exact,
+				"similarity": strconv.FormatFloat(g.Similarity, 'f', 3, 64),
+				"tracks":     tracks,
+			})
+		}
+
+		d, err := json.Marshal(l)
+		if err != nil {
+			log.Error("%s encoding duplicates failed: %v", logPrefix, err)
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(d)
+	} else if r.URL.Path == "/library/stats" {
+		// Query string Format:
+		//  only count mp3s in one of these library roots (optional; empty for mp3s not under a root):
+		//    library=music,audiobooks
+		//  number of albums, of mp3s missing tags and of most played mp3s to list (optional):
+		//    top=10
+		//  only count plays in the listening history that started in this range (optional; see serveHistory):
+		//    from=2024-01-01&to=2024-02-01
+		opts := &scan.StatsOptions{}
+		if v := queryVal(r, "library"); len(v) > 0 {
+			opts.Libraries = strings.Split(v, ",")
+		}
+		if v := queryVal(r, "top"); len(v) > 0 {
+			var err error
+			if opts.Top, err = strconv.Atoi(v); err != nil || opts.Top < 1 {
+				w.WriteHeader(400)
+				w.Write([]byte("400 Bad Request: The 'top' parameter must be a positive number."))
+				return
+			}
+		}
+		var err error
+		if opts.From, err = parseTime(queryVal(r, "from")); err == nil {
+			opts.To, err = parseTime(queryVal(r, "to"))
+		}
 		if err != nil {
 			w.WriteHeader(400)
-			w.Write([]byte("400 Bad Request: The 'page' parameter is missing or invalid."))
+			w.Write([]byte("400 Bad Request: The 'from' and 'to' parameters must be unix times, dates or RFC 3339 times."))
+			return
 		}
 
-		pageSize, err := strconv.Atoi(queryVal(r, "pagesize"))
+		stats, err := scan.LibraryStats(lib, opts)
+		if err != nil {
+			log.Error("%s calculating statistics failed: %v", logPrefix, err)
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		for i := range stats.MissingTracks {
+			m := &stats.MissingTracks[i]
+			m.Path = roots.apply(m.Library, m.Path)
+		}
+		for i := range stats.Listening.MostPlayed {
+			c := &stats.Listening.MostPlayed[i]
+			c.Path = roots.apply(c.Library, c.Path)
+		}
+
+		d, err := json.Marshal(stats)
+		if err != nil {
+			log.Error("%s encoding statistics failed: %v", logPrefix, err)
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(d)
+	} else {
+		w.WriteHeader(404)
+	}
+}
+
+// Respond to requests for the listening history.
+func serveHistory(lib scan.Library, w http.ResponseWriter, r *http.Request) {
+	logPrefix := "serveHistory: " + r.Method + " " + r.URL.Path + " - "
+	log.Notice("%s requested", logPrefix)
+
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+
+	badRequest := func(msg string) {
+		log.Info("%s bad request: %s", logPrefix, msg)
+		w.WriteHeader(400)
+		w.Write([]byte("400 Bad Request: " + msg))
+	}
+
+	writeJson := func(v interface{}) {
+		d, err := json.Marshal(v)
+		if err != nil {
+			log.Error("%s encoding history failed: %v", logPrefix, err)
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(d)
+	}
+
+	// Query string Format (for all paths):
+	//  only plays that started in this range (optional; unix times, dates like 2006-01-02, or RFC 3339 times):
+	//    from=2024-01-01&to=2024-02-01
+	q := &scan.PlayQuery{}
+	var err error
+	if q.From, err = parseTime(queryVal(r, "from")); err != nil {
+		badRequest("The 'from' parameter must be a unix time, a date or an RFC 3339 time.")
+		return
+	}
+	if q.To, err = parseTime(queryVal(r, "to")); err != nil {
+		badRequest("The 'to' parameter must be a unix time, a date or an RFC 3339 time.")
+		return
+	}
+
+	if r.URL.Path == "/history" || r.URL.Path == "/history/" {
+		// Query string Format:
+		//  only plays of this mp3 (optional):
+		//    path=/mnt/music/song.mp3
+		//  paging (optional; all plays if not present):
+		//    page=0&pagesize=10
+		// Plays are returned most recent first.
+		if v := queryVal(r, "path"); len(v) > 0 {
+			root, rel := roots.find(v)
+			if root != nil {
+				q.Library = root.Name
+			}
+			q.Path = rel
+		}
+
+		if v := queryVal(r, "page"); len(v) > 0 {
+			p := &scan.Paging{}
+			if p.Page, err = strconv.Atoi(v); err != nil || p.Page < 0 {
+				badRequest("The 'page' parameter is invalid.")
+				return
+			}
+			if p.PageSize, err = strconv.Atoi(queryVal(r, "pagesize")); err != nil || p.PageSize < 1 {
+				badRequest("The 'pagesize' parameter is missing or invalid.")
+				return
+			}
+			q.Paging = p
+		}
+
+		plays, hasMore, err := lib.Plays(q)
+		if err != nil {
+			log.Error("%s reading history failed: %v", logPrefix, err)
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		result := make([]map[string]string, 0, len(plays)+1)
+		for i := range plays {
+			result = append(result, playMap(&plays[i]))
+		}
+		if !hasMore {
+			// Tells the client this is the last page
+			result = append(result, map[string]string{"eof": "eof"})
+		}
+		writeJson(result)
+	} else if r.URL.Path == "/history/top" {
+		// Query string Format:
+		//  maximum number of mp3s (10 if not present):
+		//    limit=10
+		// The mp3s played most often are returned, most played first. Skips aren't counted.
+		limit := 10
+		if v := queryVal(r, "limit"); len(v) > 0 {
+			if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+				badRequest("The 'limit' parameter must be a positive number.")
+				return
+			}
+		}
+
+		counts, err := scan.MostPlayed(lib, q, limit)
+		if err != nil {
+			log.Error("%s reading history failed: %v", logPrefix, err)
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		result := make([]map[string]string, 0, len(counts))
+		for _, c := range counts {
+			result = append(result, map[string]string{
+				"library": c.Library,
+				"path":    roots.apply(c.Library, c.Path),
+				"artist":  c.Artist,
+				"album":   c.Album,
+				"title":   c.Title,
+				"plays":   strconv.Itoa(c.Plays),
+			})
+		}
+		writeJson(result)
+	} else {
+		w.WriteHeader(404)
+	}
+}
+
+// Read and change saved playlists.
+func servePlaylists(lib scan.Library, w http.ResponseWriter, r *http.Request) {
+	logPrefix := "servePlaylists: " + r.Method + " " + r.URL.Path + " - "
+	log.Notice("%s requested", logPrefix)
+
+	writeJson := func(v interface{}) {
+		d, err := json.Marshal(v)
 		if err != nil {
+			log.Error("%s encoding response failed: %v", logPrefix, err)
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(d)
+	}
+
+	// writeErr writes the response for the error `err` returned by the library.
+	writeErr := func(err error) {
+		if err == scan.ErrNoPlaylist {
+			w.WriteHeader(404)
+			w.Write([]byte("404 Not Found: no such playlist"))
+		} else if err == scan.ErrPlaylistExists {
+			w.WriteHeader(409)
+			w.Write([]byte("409 Conflict: a playlist with that name already exists"))
+		} else if err == scan.ErrSmartPlaylist || err == scan.ErrNotSmart {
 			w.WriteHeader(400)
-			w.Write([]byte("400 Bad Request: The 'pagesize' parameter is missing or invalid."))
+			w.Write([]byte("400 Bad Request: " + err.Error()))
+		} else {
+			log.Error("%s failed: %v", logPrefix, err)
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
 		}
+	}
 
-		fields := queryList("fields")
+	badRequest := func(msg string) {
+		log.Info("%s bad request: %s", logPrefix, msg)
+		w.WriteHeader(400)
+		w.Write([]byte("400 Bad Request: " + msg))
+	}
+
+	decodeReq := func(i interface{}) bool {
+		if r.Body == nil || json.NewDecoder(r.Body).Decode(i) != nil {
+			badRequest("invalid JSON")
+			return false
+		}
+		return true
+	}
 
-		order := queryList("order")
+	// Paths are /playlists, /playlists/<action> or /playlists/<id>[/<action>]
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/playlists"), "/"), "/")
+	if len(parts) == 1 && len(parts[0]) == 0 {
+		parts = nil
+	}
 
-		ch := make(chan map[string]string)
+	if len(parts) == 0 {
+		if r.Method != "GET" {
+			w.WriteHeader(405)
+			return
+		}
 
-		t := TraceEnter("/serveMeta/scan.FindMp3sInDb", nil)
-		go scan.FindMp3sInDb(
-			db,
-			fields,
-			filt,
-			order,
-			ch,
-			&scan.Paging{PageSize: pageSize, Page: page},
-			nil)
-		t.Leave()
+		playlists, err := lib.Playlists()
+		if err != nil {
+			writeErr(err)
+			return
+		}
+		l := make([]map[string]interface{}, 0, len(playlists))
+		for i := range playlists {
+			l = append(l, playlistMap(&playlists[i]))
+		}
+		writeJson(l)
+		return
+	}
 
-		enc := json.NewEncoder(w)
-		w.Write([]byte("[\n"))
-		j := 0
-		for m := range ch {
-			if j > 0 {
-				w.Write([]byte(",\n"))
+	// parseRules parses the rules of a smart playlist, writing an error response if they aren't valid.
+	parseRules := func(data json.RawMessage) (*scan.SmartRules, bool) {
+		if len(data) == 0 {
+			badRequest("The Rules are missing.")
+			return nil, false
+		}
+		rules, err := scan.ParseSmartRules(data)
+		if err != nil {
+			badRequest(err.Error())
+			return nil, false
+		}
+		return rules, true
+	}
+
+	if parts[0] == "schema" {
+		// The JSON schema of the rules of smart playlists
+		w.Header().Set("Content-Type", "application/schema+json")
+		w.Write([]byte(scan.SmartRulesSchema))
+		return
+	}
+
+	if parts[0] == "create" || parts[0] == "save_queue" {
+		// Body format; Paths and Rules are only used by create. If Rules are given a smart playlist
+		// is created, whose mp3s are selected by the rules (see /playlists/schema) instead of Paths:
+		//   {"Name": "Mix", "Paths": ["/mnt/music/a.mp3", "/mnt/music/b.mp3"]}
+		//   {"Name": "Jazz", "Rules": {"rules": [{"field": "genre", "op": "is", "value": "Jazz"}], "order": "random", "limit": 50}}
+		if r.Method != "POST" {
+			w.WriteHeader(405)
+			return
+		}
+		req := struct {
+			Name  string
+			Paths []string
+			Rules json.RawMessage
+		}{}
+		if !decodeReq(&req) {
+			return
+		}
+		if len(strings.TrimSpace(req.Name)) == 0 {
+			badRequest("The Name is missing.")
+			return
+		}
+
+		paths := req.Paths
+		if parts[0] == "save_queue" {
+			paths = make([]string, 0)
+			for _, e := range queue.List() {
+				paths = append(paths, e.Filename)
 			}
+		}
 
-			prependPrefix(m)
+		var id int64
+		var err error
+		if parts[0] == "create" && len(req.Rules) > 0 {
+			rules, ok := parseRules(req.Rules)
+			if !ok {
+				return
+			}
+			id, err = scan.CreateSmartPlaylist(lib, req.Name, rules)
+		} else {
+			id, err = lib.CreatePlaylist(req.Name, pathsToTracks(paths))
+		}
+		if err != nil {
+			writeErr(err)
+			return
+		}
+		notifyPlaylistChange(id, "created")
+		writeJson(map[string]string{"id": strconv.FormatInt(id, 10)})
+		return
+	}
+
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) > 2 {
+		w.WriteHeader(404)
+		return
+	}
 
-			enc.Encode(m)
-			j++
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+
+	if action == "" && r.Method == "GET" {
+		p, err := lib.Playlist(id)
+		if err != nil {
+			writeErr(err)
+			return
 		}
-		w.Write([]byte("\n]\n"))
+		writeJson(playlistMap(p))
+		return
 	}
 
-	d := time.Now().Sub(timer)
-	log.Info("serveMeta completed in %v", d)
+	if action == "export" && r.Method == "GET" {
+		// Query string Format:
+		//  the format of the playlist file, one of m3u, m3u8 (the default), pls or xspf:
+		//    format=xspf
+		p, err := lib.Playlist(id)
+		if err != nil {
+			writeErr(err)
+			return
+		}
+		entries := make([]scan.PlaylistEntry, len(p.Tracks))
+		for i := range p.Tracks {
+			entries[i] = trackEntry(&p.Tracks[i])
+		}
+		writePlaylistFile(w, r, p.Name, entries)
+		return
+	}
+
+	if action == "" && r.Method == "DELETE" {
+		action = "delete"
+	} else if r.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+
+	if action == "delete" {
+		if err = lib.DeletePlaylist(id); err != nil {
+			writeErr(err)
+			return
+		}
+		notifyPlaylistChange(id, "deleted")
+	} else if action == "enqueue" {
+		p, err := lib.Playlist(id)
+		if err == nil && len(p.Rules) > 0 {
+			// Enqueue what the rules select now.
+			if err = scan.RefreshSmartPlaylist(lib, id); err == nil {
+				notifyPlaylistChange(id, "changed")
+				p, err = lib.Playlist(id)
+			}
+		}
+		if err != nil {
+			writeErr(err)
+			return
+		}
+		enqueuePlaylist(p)
+	} else if action == "refresh" {
+		if err = scan.RefreshSmartPlaylist(lib, id); err != nil {
+			writeErr(err)
+			return
+		}
+		notifyPlaylistChange(id, "changed")
+	} else if action == "rules" {
+		// Body format; see /playlists/schema for the format of the Rules:
+		//   {"Rules": {"rules": [{"field": "rating", "op": "at_least", "value": 4}], "order": "-rating"}}
+		req := struct {
+			Rules json.RawMessage
+		}{}
+		if !decodeReq(&req) {
+			return
+		}
+		rules, ok := parseRules(req.Rules)
+		if !ok {
+			return
+		}
+		if err = scan.SetSmartRules(lib, id, rules); err != nil {
+			writeErr(err)
+			return
+		}
+		notifyPlaylistChange(id, "changed")
+	} else if action == "rename" || action == "duplicate" {
+		// Body format:
+		//   {"Name": "Mix"}
+		req := struct {
+			Name string
+		}{}
+		if !decodeReq(&req) {
+			return
+		}
+		if len(strings.TrimSpace(req.Name)) == 0 {
+			badRequest("The Name is missing.")
+			return
+		}
+
+		if action == "rename" {
+			if err = lib.RenamePlaylist(id, req.Name); err != nil {
+				writeErr(err)
+				return
+			}
+			notifyPlaylistChange(id, "changed")
+		} else {
+			copyId, err := scan.DuplicatePlaylist(lib, id, req.Name)
+			if err != nil {
+				writeErr(err)
+				return
+			}
+			notifyPlaylistChange(copyId, "created")
+			writeJson(map[string]string{"id": strconv.FormatInt(copyId, 10)})
+		}
+	} else if action == "add" {
+		// Body format; the Paths are inserted before Position, or appended if it is omitted:
+		//   {"Paths": ["/mnt/music/a.mp3"], "Position": 0}
+		req := struct {
+			Paths    []string
+			Position *int
+		}{}
+		if !decodeReq(&req) {
+			return
+		}
+		pos := -1
+		if req.Position != nil {
+			pos = *req.Position
+		}
+
+		if err = scan.AddToPlaylist(lib, id, pathsToTracks(req.Paths), pos); err != nil {
+			writeErr(err)
+			return
+		}
+		notifyPlaylistChange(id, "changed")
+	} else if action == "remove" || action == "move" {
+		// Body format; Delta is only used by move:
+		//   {"Indexes": [0, 2], "Delta": -1}
+		req := struct {
+			Indexes []int
+			Delta   int
+		}{}
+		if !decodeReq(&req) {
+			return
+		}
+
+		if action == "remove" {
+			err = scan.RemoveFromPlaylist(lib, id, req.Indexes)
+		} else {
+			err = scan.MovePlaylistTracks(lib, id, req.Indexes, req.Delta)
+		}
+		if err != nil {
+			writeErr(err)
+			return
+		}
+		notifyPlaylistChange(id, "changed")
+	} else {
+		w.WriteHeader(404)
+	}
 }
 
 // Perform functions on the mp3 player like play and pause.
-func servePlayer(w http.ResponseWriter, r *http.Request) {
+func servePlayer(lib scan.Library, w http.ResponseWriter, r *http.Request) {
 	logPrefix := "servePlayer: " + r.Method + " " + r.URL.Path + " - "
 	log.Notice("%s requested", logPrefix)
 
@@ -145,6 +1000,14 @@ func servePlayer(w http.ResponseWriter, r *http.Request) {
 			t := TraceEnter("/servePlayer/player.Stop", nil)
 			player.Stop()
 			t.Leave()
+		} else if r.URL.Path == "/player/next" {
+			t := TraceEnter("/servePlayer/queue.Next", nil)
+			queue.Next()
+			t.Leave()
+		} else if r.URL.Path == "/player/previous" {
+			t := TraceEnter("/servePlayer/queue.Previous", nil)
+			queue.Previous(previousRestart)
+			t.Leave()
 		} else if r.URL.Path == "/player/volume" {
 			t := TraceEnter("/servePlayer/play.GetVolume", nil)
 			v, err := play.GetVolume()
@@ -159,6 +1022,19 @@ func servePlayer(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(strconv.Itoa(int(v))))
 			w.Write([]byte("}"))
 			log.Notice("%s returning %d", logPrefix, int(v))
+		} else if r.URL.Path == "/player/queue.export" {
+			// Query string Format:
+			//  the format of the playlist file, one of m3u, m3u8 (the default), pls or xspf:
+			//    format=xspf
+			t := TraceEnter("/servePlayer/queue.List", nil)
+			l := queue.List()
+			t.Leave()
+
+			entries := make([]scan.PlaylistEntry, len(l))
+			for i, e := range l {
+				entries[i] = pathEntry(lib, e.Filename)
+			}
+			writePlaylistFile(w, r, "Queue", entries)
 		}
 
 	} else if r.Method == "POST" {
@@ -234,6 +1110,72 @@ func servePlayer(w http.ResponseWriter, r *http.Request) {
 			t := TraceEnter("/servePlayer/queue.Remove", nil)
 			queue.Remove(req.Indexes)
 			t.Leave()
+		} else if r.URL.Path == "/player/queue.shuffle" {
+			t := TraceEnter("/servePlayer/queue.Shuffle", nil)
+			queue.Shuffle()
+			t.Leave()
+		} else if r.URL.Path == "/player/queue.shuffle_mode" {
+			req := struct {
+				Shuffle bool
+			}{}
+
+			if !decodeReq(&req) {
+				return
+			}
+
+			shuffle = req.Shuffle
+
+			t := TraceEnter("/servePlayer/queue.SetShuffle", nil)
+			queue.SetShuffle(shuffle)
+			t.Leave()
+
+			t = TraceEnter("/servePlayer/shuffleTee.In.write", nil)
+			shuffleTee.In <- struct{}{}
+			t.Leave()
+		} else if r.URL.Path == "/player/queue.enqueue_random" {
+			// Enqueue Count random mp3s. If Rules are given only mp3s matching them are picked;
+			// they have the format of the rules of smart playlists (see /playlists/schema), but
+			// their order and limit are ignored:
+			//   {"Count": 10, "Rules": {"rules": [{"field": "genre", "op": "is", "value": "Jazz"}]}}
+			req := struct {
+				Count int
+				Rules json.RawMessage
+			}{}
+
+			if !decodeReq(&req) {
+				return
+			}
+
+			rules := &scan.SmartRules{}
+			if len(req.Rules) > 0 {
+				var err error
+				if rules, err = scan.ParseSmartRules(req.Rules); err != nil {
+					w.WriteHeader(400)
+					w.Write([]byte("400 Bad Request: " + err.Error()))
+					return
+				}
+			}
+			if req.Count < 1 {
+				w.WriteHeader(400)
+				w.Write([]byte("400 Bad Request: The Count must be at least 1"))
+				return
+			}
+			rules.Order, rules.Limit = scan.RandomOrder, req.Count
+
+			tracks, err := scan.SmartTracks(lib, rules, time.Now())
+			if err != nil {
+				log.Error("%s finding random mp3s failed: %v", logPrefix, err)
+				w.WriteHeader(500)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			t := TraceEnter("/servePlayer/queue.Enqueue", nil)
+			for _, track := range tracks {
+				queue.Enqueue(roots.apply(track.Library, track.Path))
+			}
+			t.Leave()
+			log.Notice("%s enqueued %d random mp3s", logPrefix, len(tracks))
 		} else if r.URL.Path == "/player/volume" {
 			req := struct {
 				Volume int
@@ -286,6 +1228,11 @@ func servePlayer(w http.ResponseWriter, r *http.Request) {
 			}
 			t.Leave()
 
+			// The queue puts played songs back at its end when repeating all.
+			t = TraceEnter("/servePlayer/queue.SetRepeatAll", nil)
+			queue.SetRepeatAll(repeatMode == RepeatAll)
+			t.Leave()
+
 			t = TraceEnter("/servePlayer/repeatModeTee.In.write", nil)
 			repeatModeTee.In <- struct{}{}
 			t.Leave()
@@ -293,39 +1240,65 @@ func servePlayer(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func enterScanning() bool {
-	t := TraceEnter("/enterScanning", nil)
-	scanMutex.Lock()
-	defer t.Leave()
-	defer scanMutex.Unlock()
-
-	if scanning {
-		return false
-	} else {
-		scanning = true
-		return true
-	}
-}
-
 // Perform functions related to mp3 scanning
-func serveScan(w http.ResponseWriter, r *http.Request) {
+func serveScan(lib scan.Library, w http.ResponseWriter, r *http.Request) {
 	logPrefix := "serveScan: " + r.Method + " " + r.URL.Path + " - "
 	log.Notice("%s requested", logPrefix)
 
 	if r.Method == "GET" {
 		if r.URL.Path == "/scan/all" {
 			if mp3Dirs != nil {
-				scanMutex.Lock()
-				defer scanMutex.Unlock()
-				if !scanning {
-					scanning = true
-					go scanDirs(mp3Dirs)
+				if ctx, ok := enterScanning(mp3Dirs); ok {
+					go scanDirs(ctx, mp3Dirs)
 				}
 			} else {
 				log.Notice("serveScan: scan requested but no directories to scan")
 				w.WriteHeader(404)
 				w.Write([]byte("404 Not Found: no directories to scan"))
 			}
+		} else if r.URL.Path == "/scan/cancel" {
+			if !cancelScan() {
+				w.WriteHeader(409)
+				w.Write([]byte("409 Conflict: no scan in progress"))
+			}
+		} else if r.URL.Path == "/scan/status" {
+			d, err := json.Marshal(getScanProgress())
+			if err != nil {
+				log.Error("%s encoding scan progress failed: %v", logPrefix, err)
+				w.WriteHeader(500)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(d)
+		} else if r.URL.Path == "/scan/errors" {
+			errs, err := lib.ScanErrors()
+			if err != nil {
+				log.Error("%s reading scan errors failed: %v", logPrefix, err)
+				w.WriteHeader(500)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			l := make([]map[string]string, 0, len(errs))
+			for _, e := range errs {
+				l = append(l, map[string]string{
+					"path":  roots.apply(e.Library, e.Path),
+					"phase": string(e.Phase),
+					"error": e.Err.Error(),
+					"time":  strconv.FormatInt(e.Time, 10),
+				})
+			}
+
+			d, err := json.Marshal(l)
+			if err != nil {
+				log.Error("%s encoding scan errors failed: %v", logPrefix, err)
+				w.WriteHeader(500)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(d)
 		}
 	} else if r.Method == "POST" {
 		decoder := (*json.Decoder)(nil)
@@ -358,8 +1331,9 @@ func serveScan(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			if enterScanning() {
-				go scanDirs([]string{req.Path})
+			dirs := []string{req.Path}
+			if ctx, ok := enterScanning(dirs); ok {
+				go scanDirs(ctx, dirs)
 			}
 		}
 	}
@@ -391,7 +1365,7 @@ State is an enumeration with the values:
 
 Meta may be null if there is no loaded mp3.
 */
-func serveWebsock(w http.ResponseWriter, r *http.Request) {
+func serveWebsock(lib scan.Library, w http.ResponseWriter, r *http.Request) {
 	trc := TraceEnter("/serveWebsock", nil)
 	defer trc.Leave()
 
@@ -418,7 +1392,7 @@ func serveWebsock(w http.ResponseWriter, r *http.Request) {
 	defer ws.Close()
 
 	// Send the full status to the browser
-	d, err := jsonFullStatus(player.GetStatus(), meta, listQueue(queue), pathsToMetadatas(recent.Slice()), repeatMode)
+	d, err := jsonFullStatus(player.GetStatus(), currentMeta(), listQueue(lib, queue), pathsToMetadatas(lib, recent.Slice()), repeatMode, shuffle)
 	if err != nil {
 		log.Error("Websock %v: Error encoding Player event as JSON: %v", ws.RemoteAddr(), err)
 		return
@@ -465,6 +1439,39 @@ func serveWebsock(w http.ResponseWriter, r *http.Request) {
 		t.Leave()
 	}()
 
+	shuffleChanged := make(chan interface{})
+	t2 = TraceEnter("/shuffleTee.Add", nil)
+	shuffleTee.Add(shuffleChanged)
+	t2.Leave()
+
+	defer func() {
+		t := TraceEnter("/shuffleTee.Del", nil)
+		shuffleTee.Del(shuffleChanged)
+		t.Leave()
+	}()
+
+	playlistChanged := make(chan interface{})
+	t2 = TraceEnter("/playlistTee.Add", nil)
+	playlistTee.Add(playlistChanged)
+	t2.Leave()
+
+	defer func() {
+		t := TraceEnter("/playlistTee.Del", nil)
+		playlistTee.Del(playlistChanged)
+		t.Leave()
+	}()
+
+	metaChanged := make(chan interface{})
+	t2 = TraceEnter("/metaTee.Add", nil)
+	metaTee.Add(metaChanged)
+	t2.Leave()
+
+	defer func() {
+		t := TraceEnter("/metaTee.Del", nil)
+		metaTee.Del(metaChanged)
+		t.Leave()
+	}()
+
 	//ws.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
 
 loop:
@@ -477,7 +1484,7 @@ loop:
 				break loop
 			}
 
-			if !websockHandlePlayerEvent(ws, e.(play.Event)) {
+			if !websockHandlePlayerEvent(lib, ws, e.(play.Event)) {
 				break loop
 			}
 
@@ -489,7 +1496,12 @@ loop:
 				break loop
 			}
 
-			d, err = jsonScan(e.(*scan.Metadata))
+			switch v := e.(type) {
+			case ScanProgress:
+				d, err = jsonScanProgress(v)
+			case LibraryChange:
+				d, err = jsonLibraryChange(v)
+			}
 			if err != nil {
 				log.Error("Websock %v: Error encoding metadata as JSON: %v", ws.RemoteAddr(), err)
 				// Hopefully the next one works...
@@ -514,12 +1526,54 @@ loop:
 				// Client is probably gone. Close our channel and exit.
 				break loop
 			}
+		case _ = <-shuffleChanged:
+			m, err := jsonShuffle(shuffle)
+			if err != nil {
+				log.Error("Websock %v: Error encoding shuffle mode as JSON: %v", ws.RemoteAddr(), err)
+				// Hopefully the next one works...
+				continue loop
+			}
+			err = websockWrite(ws, m)
+			if err != nil {
+				log.Error("Websock %v: Error writing to websocket: %v", ws.RemoteAddr(), err)
+				// Client is probably gone. Close our channel and exit.
+				break loop
+			}
+		case e := <-playlistChanged:
+			m, err := jsonPlaylistChange(e.(PlaylistChange))
+			if err != nil {
+				log.Error("Websock %v: Error encoding playlist change as JSON: %v", ws.RemoteAddr(), err)
+				// Hopefully the next one works...
+				continue loop
+			}
+			err = websockWrite(ws, m)
+			if err != nil {
+				log.Error("Websock %v: Error writing to websocket: %v", ws.RemoteAddr(), err)
+				// Client is probably gone. Close our channel and exit.
+				break loop
+			}
+		case _ = <-metaChanged:
+			m, err := jsonMeta(currentMeta())
+			if err != nil {
+				log.Error("Websock %v: Error encoding metadata as JSON: %v", ws.RemoteAddr(), err)
+				// Hopefully the next one works...
+				continue loop
+			}
+			err = websockWrite(ws, m)
+			if err != nil {
+				log.Error("Websock %v: Error writing to websocket: %v", ws.RemoteAddr(), err)
+				// Client is probably gone. Close our channel and exit.
+				break loop
+			}
 		}
 	}
 
 	eventTee.Del(c)
 	scanTee.Del(scanEvents)
 	repeatModeTee.Del(repeatModeChanged)
+	shuffleTee.Del(shuffleChanged)
+	metaTee.Del(metaChanged)
+	playlistTee.Del(playlistChanged)
 }
 
 // Respond to requests for internal debug tracing info
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/jeffwilliams/go-logging"
+	"github.com/jeffwilliams/wwwmp3/scan"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func init() {
+	log = logging.MustGetLogger("test")
+	if level, err := logging.LogLevel("ERROR"); err == nil {
+		logging.SetLevel(level, "")
+	}
+}
+
+// request sends a request to the handler `h` and returns the response.
+func request(h http.HandlerFunc, method, url, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+	return w
+}
+
+func TestServePlaylists(test *testing.T) {
+	lib := scan.NewMemLibrary()
+	err := lib.PutTracks([]scan.Track{{Path: "a.mp3", Title: "One"}, {Path: "b.mp3", Title: "Two"}})
+	if err != nil {
+		test.Fatal("Adding tracks failed: ", err)
+	}
+	h := withLibrary(lib, servePlaylists)
+
+	w := request(h, "POST", "/playlists/create", `{"Name": "Mix", "Paths": ["b.mp3", "a.mp3"]}`)
+	var created map[string]string
+	if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &created) != nil || len(created["id"]) == 0 {
+		test.Fatalf("Creating a playlist failed: %d %s", w.Code, w.Body)
+	}
+	if w = request(h, "POST", "/playlists/create", `{"Name": "Mix"}`); w.Code != 409 {
+		test.Fatalf("Expected a conflict creating a playlist with the same name but got %d %s", w.Code, w.Body)
+	}
+
+	w = request(h, "GET", "/playlists/"+created["id"], "")
+	var p struct {
+		Name   string              `json:"name"`
+		Tracks []map[string]string `json:"tracks"`
+	}
+	if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &p) != nil || p.Name != "Mix" || len(p.Tracks) != 2 ||
+		p.Tracks[0]["title"] != "Two" || p.Tracks[1]["title"] != "One" {
+		test.Fatalf("Unexpected playlist: %d %s", w.Code, w.Body)
+	}
+
+	if w = request(h, "GET", "/playlists/12345", ""); w.Code != 404 {
+		test.Fatalf("Expected a missing playlist to not be found but got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestServeSuggest(test *testing.T) {
+	lib := scan.NewMemLibrary()
+	err := lib.PutTracks([]scan.Track{{Path: "a.mp3", Artist: "Radiohead"}, {Path: "b.mp3", Artist: "Ramones"}})
+	if err != nil {
+		test.Fatal("Adding tracks failed: ", err)
+	}
+
+	w := request(withLibrary(lib, serveSuggest), "GET", "/songmeta/suggest?q=radio&fields=artist", "")
+	var l []map[string]string
+	if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &l) != nil || len(l) == 0 ||
+		l[0]["field"] != "artist" || l[0]["value"] != "Radiohead" {
+		test.Fatalf("Unexpected suggestions: %d %s", w.Code, w.Body)
+	}
+
+	if w = request(withLibrary(lib, serveSuggest), "GET", "/songmeta/suggest?q=radio&limit=x", ""); w.Code != 400 {
+		test.Fatalf("Expected a bad request for an invalid limit but got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/jeffwilliams/wwwmp3/play"
+	"github.com/jeffwilliams/wwwmp3/scan"
+)
+
+// Listening follows the mp3 being played so that each play can be recorded in the listening history
+// when it stops. It is only used by handlePlayerEvents.
+type Listening struct {
+	// Path of the mp3 on this host, or empty if nothing is being listened to
+	Path    string
+	Started time.Time
+	// Offset and size of the mp3 in samples, as last reported by the player
+	Offset int
+	Size   int
+	// Percentage of an mp3 that must play for it to count as played rather than skipped
+	SkipPercent float64
+	// The library the plays are recorded in
+	Library scan.Library
+}
+
+// Start notes that the player is playing the mp3 with the status `s`. If it is a different mp3
+// than before, the play of the previous one is ended.
+func (l *Listening) Start(s play.PlayerStatus) {
+	if s.Path == l.Path {
+		return
+	}
+	l.End()
+	l.Path = s.Path
+	l.Started = time.Now()
+	l.Offset = s.Offset
+	l.Size = s.Size
+}
+
+// End records the play of the mp3 being listened to, if any, in the listening history.
+func (l *Listening) End() {
+	if len(l.Path) == 0 {
+		return
+	}
+
+	completion := 0.0
+	if l.Size > 0 {
+		completion = float64(l.Offset) / float64(l.Size)
+	}
+	if completion > 1 {
+		completion = 1
+	}
+
+	root, rel := roots.find(l.Path)
+	p := scan.Play{
+		Path:       rel,
+		Started:    l.Started.Unix(),
+		Ended:      time.Now().Unix(),
+		Completion: completion,
+		Skipped:    completion*100 < l.SkipPercent,
+	}
+	if root != nil {
+		p.Library = root.Name
+	}
+
+	log.Debug("Recording play of '%s' (%.0f%% played)", l.Path, completion*100)
+	if err := l.Library.AddPlay(p); err != nil {
+		log.Error("Recording play of '%s' failed: %v", l.Path, err)
+	}
+	l.Path = ""
+}
+
+// parseTime parses a time given in a query string, either as a unix time, a date (2006-01-02, local
+// time) or an RFC 3339 time. An empty string is the zero time, 0.
+func parseTime(s string) (int64, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t.Unix(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	return t.Unix(), err
+}
+
+// playMap returns the play `p` as the map sent to clients.
+func playMap(p *scan.Play) map[string]string {
+	skipped := "0"
+	if p.Skipped {
+		skipped = "1"
+	}
+	return map[string]string{
+		"library":    p.Library,
+		"path":       roots.apply(p.Library, p.Path),
+		"artist":     p.Artist,
+		"album":      p.Album,
+		"title":      p.Title,
+		"started":    strconv.FormatInt(p.Started, 10),
+		"ended":      strconv.FormatInt(p.Ended, 10),
+		"completion": strconv.FormatFloat(p.Completion, 'f', 3, 64),
+		"skipped":    skipped,
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jeffwilliams/wwwmp3/scan"
+)
+
+// PlaylistChange describes a change to a saved playlist. It is sent to clients when a playlist is
+// created, changed or deleted.
+type PlaylistChange struct {
+	// Id of the playlist, or 0 if several playlists may have changed, like when a scan imported
+	// playlist files.
+	Id int64
+	// One of "created", "changed" or "deleted"
+	Action string
+}
+
+// notifyPlaylistChange tells the clients that the playlist with id `id` changed.
+func notifyPlaylistChange(id int64, action string) {
+	t := TraceEnter("/playlistTee.In.write", nil)
+	playlistTee.In <- PlaylistChange{id, action}
+	t.Leave()
+}
+
+// pathsToTracks returns the mp3s with the paths `paths` on this host, as stored in playlists.
+func pathsToTracks(paths []string) []scan.Track {
+	tracks := make([]scan.Track, len(paths))
+	for i, p := range paths {
+		root, rel := roots.find(p)
+		tracks[i].Path = rel
+		if root != nil {
+			tracks[i].Library = root.Name
+		}
+	}
+	return tracks
+}
+
+// playlistMap returns the playlist `p` as the map sent to clients. Its tracks are included if they were read.
+func playlistMap(p *scan.Playlist) map[string]interface{} {
+	m := map[string]interface{}{
+		"id":       strconv.FormatInt(p.Id, 10),
+		"name":     p.Name,
+		"created":  strconv.FormatInt(p.Created, 10),
+		"modified": strconv.FormatInt(p.Modified, 10),
+		"length":   strconv.Itoa(p.Length),
+		"smart":    "0",
+	}
+	if len(p.Rules) > 0 {
+		m["smart"] = "1"
+		m["rules"] = json.RawMessage(p.Rules)
+	}
+	if p.Tracks != nil {
+		tracks := make([]map[string]string, 0, len(p.Tracks))
+		for i := range p.Tracks {
+			t := p.Tracks[i].Map([]string{"library", "path", "artist", "album", "title", "tracknum", "duration"})
+			setLocalPath(t)
+			tracks = append(tracks, t)
+		}
+		m["tracks"] = tracks
+	}
+	return m
+}
+
+// enqueuePlaylist adds the tracks of the playlist `p` to the play queue.
+func enqueuePlaylist(p *scan.Playlist) {
+	t := TraceEnter("/enqueuePlaylist/queue.Enqueue", nil)
+	for _, track := range p.Tracks {
+		queue.Enqueue(roots.apply(track.Library, track.Path))
+	}
+	t.Leave()
+}
+
+// trackEntry returns the mp3 `t` of a saved playlist as an entry of an exported playlist file.
+func trackEntry(t *scan.Track) scan.PlaylistEntry {
+	return scan.PlaylistEntry{
+		Path:     roots.apply(t.Library, t.Path),
+		Artist:   t.Artist,
+		Album:    t.Album,
+		Title:    t.Title,
+		Tracknum: t.Tracknum,
+		Duration: t.Duration,
+	}
+}
+
+// pathEntry returns the mp3 with the path `path` on this host as an entry of an exported playlist file.
+func pathEntry(lib scan.Library, path string) scan.PlaylistEntry {
+	e := scan.PlaylistEntry{Path: path, Tracknum: -1}
+	if m := findMp3ByPath(lib, path); m != nil {
+		e.Artist, e.Album, e.Title = m["artist"], m["album"], m["title"]
+		if n, err := strconv.Atoi(m["tracknum"]); err == nil {
+			e.Tracknum = n
+		}
+		e.Duration, _ = strconv.ParseFloat(m["duration"], 64)
+	}
+	return e
+}
+
+// writePlaylistFile writes the playlist titled `title` holding `entries` as the response `w` to
+// the request `r`, in the format named by its format parameter: one of scan.PlaylistFormats. The
+// default is m3u8.
+func writePlaylistFile(w http.ResponseWriter, r *http.Request, title string, entries []scan.PlaylistEntry) {
+	format := strings.ToLower(queryVal(r, "format"))
+	if len(format) == 0 {
+		format = scan.FormatM3U8
+	}
+	if !containsString(scan.PlaylistFormats, format) {
+		w.WriteHeader(400)
+		w.Write([]byte("400 Bad Request: The format must be one of " + strings.Join(scan.PlaylistFormats, ", ")))
+		return
+	}
+
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == '"' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, title)
+	w.Header().Set("Content-Type", scan.PlaylistContentType(format))
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"."+format+"\"")
+	if err := scan.WritePlaylist(w, format, title, entries); err != nil {
+		log.Error("Writing playlist '%s' as %s failed: %v", title, format, err)
+	}
+}
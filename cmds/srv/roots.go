@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jeffwilliams/wwwmp3/scan"
+)
+
+// LibraryRoots maps the names of library roots to the directories they are mounted at on this host.
+// The paths of mp3s that aren't under a named root are mapped using the prefix instead.
+type LibraryRoots map[string]string
+
+// loadLibraryRoots returns the library roots stored in `db`, at the directories they were scanned
+// from, overridden by the directories in `config` (the libraries config setting).
+func loadLibraryRoots(db scan.Library, config map[string]string) (LibraryRoots, error) {
+	stored, err := db.Roots()
+	if err != nil {
+		return nil, err
+	}
+
+	r := make(LibraryRoots)
+	for _, root := range stored {
+		r[root.Name] = root.Path
+	}
+	for name, dir := range config {
+		r[name] = filepath.Clean(dir)
+	}
+	return r, nil
+}
+
+// dirs returns the directories of the roots in `names`, ordered by name.
+func (r LibraryRoots) dirs(names []string) []string {
+	sort.Strings(names)
+	d := make([]string, 0, len(names))
+	for _, n := range names {
+		if dir, ok := r[n]; ok {
+			d = append(d, dir)
+		}
+	}
+	return d
+}
+
+// apply returns the path on this host of the mp3 in the library root `library` with the path `path`.
+func (r LibraryRoots) apply(library, path string) string {
+	if len(library) == 0 {
+		return prefix.apply(path)
+	}
+	dir, ok := r[library]
+	if !ok {
+		return path
+	}
+	return scan.Root{Name: library, Path: dir}.Join(path)
+}
+
+// find returns the library root that the path `path` on this host is under, or nil if it isn't under
+// one, and the path of the mp3 as stored in the database. If roots are nested the innermost is used.
+func (r LibraryRoots) find(path string) (root *scan.Root, rel string) {
+	for name, dir := range r {
+		if (path == dir || strings.HasPrefix(path, strings.TrimRight(dir, "/")+"/")) &&
+			(root == nil || len(dir) > len(root.Path)) {
+			root = &scan.Root{Name: name, Path: dir}
+		}
+	}
+
+	if root == nil {
+		return nil, prefix.remove(path)
+	}
+	return root, root.Relative(path)
+}
+
+// setLocalPath replaces the path in the mp3 information `fields` with the path of the mp3 on this host.
+func setLocalPath(fields map[string]string) {
+	if v, ok := fields["path"]; ok {
+		fields["path"] = roots.apply(fields["library"], v)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jeffwilliams/wwwmp3/scan"
+)
+
+// ScanProgress describes the progress of the current (or last) scan started by the server.
+type ScanProgress struct {
+	// Is a scan in progress?
+	Scanning bool
+	// Was the last scan cancelled?
+	Cancelled bool
+	// The directory being scanned, its index in the list of directories to scan, and the number of directories.
+	Dir      string
+	DirIndex int
+	Dirs     int
+	// Number of mp3s scanned so far in Dir, and the number of mp3s found in Dir.
+	// Found is zero while the directory is being listed.
+	Done  int
+	Found int
+	// Counts of what was done with the mp3s scanned so far in Dir. Errors includes directories that couldn't be read.
+	Added     int
+	Updated   int
+	Unchanged int
+	Errors    int
+	// Estimated number of seconds left to scan Dir, or -1 if unknown.
+	Eta float64
+	// Path of the most recently scanned mp3.
+	Path string
+}
+
+// update sets the counts in the progress from the summary of the directory being scanned.
+func (p *ScanProgress) update(sum *scan.Summary, elapsed time.Duration) {
+	p.Done = sum.Total()
+	p.Found = sum.Found
+	p.Added = sum.Added
+	p.Updated = sum.Updated
+	p.Unchanged = sum.Unchanged
+	p.Errors = sum.Errors + sum.ListErrors
+
+	p.Eta = -1
+	if eta := sum.Remaining(elapsed); eta >= 0 {
+		p.Eta = eta.Seconds()
+	}
+}
+
+// enterScanning marks that a scan of `dirs` is starting. It returns false if a scan is already in progress.
+// Otherwise it returns a context that is cancelled when cancelScan is called.
+func enterScanning(dirs []string) (ctx context.Context, ok bool) {
+	t := TraceEnter("/enterScanning", nil)
+	scanMutex.Lock()
+	defer t.Leave()
+	defer scanMutex.Unlock()
+
+	if scanProgress.Scanning {
+		return
+	}
+
+	ctx, scanCancel = context.WithCancel(context.Background())
+	scanProgress = ScanProgress{Scanning: true, Dirs: len(dirs), Eta: -1}
+	ok = true
+	return
+}
+
+// leaveScanning marks that the current scan has completed and returns the final progress.
+func leaveScanning(ctx context.Context) ScanProgress {
+	scanMutex.Lock()
+	defer scanMutex.Unlock()
+
+	scanProgress.Scanning = false
+	scanProgress.Cancelled = ctx.Err() != nil
+	scanProgress.Eta = -1
+	scanCancel()
+	scanCancel = nil
+	return scanProgress
+}
+
+// cancelScan cancels the current scan. It returns false if there is no scan in progress.
+func cancelScan() bool {
+	scanMutex.Lock()
+	defer scanMutex.Unlock()
+
+	if scanCancel == nil {
+		return false
+	}
+	scanCancel()
+	return true
+}
+
+// getScanProgress returns a copy of the progress of the current (or last) scan.
+func getScanProgress() ScanProgress {
+	scanMutex.Lock()
+	defer scanMutex.Unlock()
+
+	return scanProgress
+}
+
+// modifyScanProgress calls `f` to modify the scan progress and returns a copy of the result.
+func modifyScanProgress(f func(p *ScanProgress)) ScanProgress {
+	scanMutex.Lock()
+	defer scanMutex.Unlock()
+
+	f(&scanProgress)
+	return scanProgress
+}
@@ -13,6 +13,7 @@ package main
 */
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
@@ -40,17 +41,19 @@ const (
 var (
 	helpFlag      = pflag.BoolP("help", "h", false, "Print help then exit.")
 	genConfigFlag = pflag.BoolP("gen", "g", false, "Generate a sample configuration file in the current directory then exit.")
-	db            scan.Mp3Db
-
 	// The mp3 player
 	player play.Player = play.NewPlayer()
 	// The queue for the mp3 player.
 	queue play.Queue
 	// Recently played songs
 	recent Recent
+	// The mp3 being listened to, for the listening history
+	listening Listening
 
-	// Metadata for the currently playing mp3
+	// Metadata for the currently playing mp3, and the path of the mp3 it was found for. The map is
+	// replaced rather than changed while the websocket goroutines may be encoding it; see setMeta.
 	meta     map[string]string
+	metaPath string
 	metaLock sync.Mutex
 
 	upgrader websocket.Upgrader
@@ -66,14 +69,18 @@ var (
 	// Directories to scan recursively to find mp3s.
 	mp3Dirs []string
 
-	// When a scan is performed, the metadata of mp3s scanned are written to this tee.
-	// A nil is written to the channel when the current scan completes.
+	// When a scan is performed, the ScanProgress is periodically written to this tee.
+	// The final progress (with Scanning set to false) is written when the current scan completes,
+	// followed by a LibraryChange if the scan changed the database.
 	scanTee = tee.New()
 
-	// scanning: Are we currently scanning for mp3s?
-	scanning bool = false
+	// Progress of the current or last scan.
+	scanProgress = ScanProgress{Eta: -1}
+
+	// Cancels the current scan. Nil if there is no scan in progress.
+	scanCancel context.CancelFunc
 
-	// scanMutex protects `scanning`.
+	// scanMutex protects `scanProgress` and `scanCancel`.
 	scanMutex sync.Mutex
 
 	// Current repeat mode of the player
@@ -82,67 +89,111 @@ var (
 	// When the repeatMode is changed, this tee is written to.
 	repeatModeTee = tee.New()
 
-	// prefix to prepend to MP3 paths before playing them
+	// True if the queue is in shuffle mode
+	shuffle bool
+
+	// When the shuffle mode is changed, this tee is written to.
+	shuffleTee = tee.New()
+
+	// /player/previous restarts the current mp3 if it has played for longer than this
+	previousRestart time.Duration
+
+	// When the metadata of the current mp3 is changed (like its rating), this tee is written to.
+	metaTee = tee.New()
+
+	// When a saved playlist is created, changed or deleted, a PlaylistChange is written to this tee.
+	playlistTee = tee.New()
+
+	// prefix to prepend to MP3 paths before playing them, for mp3s that aren't under a named library root
 	prefix Prefix
-)
 
-// findMp3ByPath returns the mp3 information for the mp3 with the specified path.
-func findMp3ByPath(path string) map[string]string {
-	ch := make(chan map[string]string)
+	// The directories that the named library roots are mounted at on this host
+	roots LibraryRoots
 
-	path = prefix.remove(path)
+	// Options used when scanning for mp3s
+	scanOptions scan.Options
 
-	go scan.FindMp3sInDb(
-		db,
-		nil,
-		map[string]string{"path": path},
-		nil,
-		ch,
-		&scan.Paging{PageSize: 1, Page: 0},
-		nil)
+	// Write ratings to the POPM frames of mp3s as well as to the database
+	writeRatings bool
+)
 
-	r := <-ch
+// findMp3ByPath returns the mp3 information for the mp3 with the specified path, or nil if it is not found.
+func findMp3ByPath(lib scan.Library, path string) map[string]string {
+	library := ""
+	root, path := roots.find(path)
+	if root != nil {
+		library = root.Name
+	}
 
-	// Drain channel
-	for _ = range ch {
+	tracks, _, err := scan.FindTracks(lib, &scan.Query{
+		Where: []scan.Condition{
+			{Field: "library", Match: scan.Exact, Value: library},
+			{Field: "path", Match: scan.Exact, Value: path},
+		},
+		Paging: &scan.Paging{PageSize: 1, Page: 0},
+	})
+	if err != nil {
+		log.Error("Finding mp3 %v failed: %v", path, err)
+		return nil
+	}
+	if len(tracks) == 0 {
+		return nil
 	}
 
-	return r
+	return tracks[0].Map(nil)
 }
 
 // findMp3ByPathWithPrefix returns the mp3 information for the mp3 with the specified path,
-// but also appends the prefix
-func findMp3ByPathWithPrefix(path string) map[string]string {
-	m := findMp3ByPath(path)
-	prependPrefix(m)
+// with the path of the mp3 on this host
+func findMp3ByPathWithPrefix(lib scan.Library, path string) map[string]string {
+	m := findMp3ByPath(lib, path)
+	setLocalPath(m)
 	return m
 }
 
-func setMetainfo() {
-	if meta == nil {
-		meta = make(map[string]string)
+// addMetainfo adds the properties of the loaded mp3 (like bitrate) to the metadata `m`, which is
+// created if it is nil, and returns it.
+func addMetainfo(m map[string]string) map[string]string {
+	if m == nil {
+		m = make(map[string]string)
 	}
 
 	// Set the current mp3 info into the metadata struct
 	info := player.GetInfo()
 	if info != nil {
-		meta["bitrate"] = strconv.Itoa(info.BitRate)
-		meta["rate"] = strconv.Itoa(info.Rate)
-		meta["duration"] = strconv.FormatFloat(info.Duration, 'f', -1, 64)
-		meta["sec_per_sample"] = strconv.FormatFloat(info.Sps, 'f', -1, 64)
+		m["bitrate"] = strconv.Itoa(info.BitRate)
+		m["rate"] = strconv.Itoa(info.Rate)
+		m["duration"] = strconv.FormatFloat(info.Duration, 'f', -1, 64)
+		m["sec_per_sample"] = strconv.FormatFloat(info.Sps, 'f', -1, 64)
 
-		log.Debug("Setting metainfo for current song to %v", meta)
+		log.Debug("Setting metainfo for current song to %v", m)
 	} else {
 		log.Error("Getting loaded mp3 info (like bitrate) failed")
 	}
+	return m
+}
+
+// currentMeta returns the metadata for the currently playing mp3. The map must not be changed.
+func currentMeta() map[string]string {
+	metaLock.Lock()
+	defer metaLock.Unlock()
+	return meta
+}
+
+// setMeta sets the metadata for the currently playing mp3 to `m`, found for the mp3 at `path`.
+// `m` must not be changed afterwards.
+func setMeta(path string, m map[string]string) {
+	metaLock.Lock()
+	defer metaLock.Unlock()
+	meta, metaPath = m, path
 }
 
 // Given an list of paths to mp3 files, return a list of metadata maps
-func pathsToMetadatas(list []string) (result []map[string]string) {
+func pathsToMetadatas(lib scan.Library, list []string) (result []map[string]string) {
 	result = make([]map[string]string, 0)
 
 	for _, path := range list {
-		m := findMp3ByPathWithPrefix(path)
+		m := findMp3ByPathWithPrefix(lib, path)
 		if m == nil {
 			m = map[string]string{
 				"artist": "?",
@@ -157,11 +208,11 @@ func pathsToMetadatas(list []string) (result []map[string]string) {
 }
 
 // Give a list of QueueElems, return a list of metadata maps
-func queueElemsToMetadatas(list []play.QueueElem) (result []map[string]string) {
+func queueElemsToMetadatas(lib scan.Library, list []play.QueueElem) (result []map[string]string) {
 	result = make([]map[string]string, 0)
 
 	for _, elem := range list {
-		m := findMp3ByPathWithPrefix(elem.Filename)
+		m := findMp3ByPathWithPrefix(lib, elem.Filename)
 		if m == nil {
 			m = map[string]string{
 				"artist": "?",
@@ -178,8 +229,8 @@ func queueElemsToMetadatas(list []play.QueueElem) (result []map[string]string) {
 
 // listQueue returns a slice containing the metainfo of the tracks in the play queue.
 // The metainfo entries are typed as maps of names to values.
-func listQueue(queue play.Queue) []map[string]string {
-	return queueElemsToMetadatas(queue.List())
+func listQueue(lib scan.Library, queue play.Queue) []map[string]string {
+	return queueElemsToMetadatas(lib, queue.List())
 }
 
 // websockWrite writes bytes to a websocket with a timeout.
@@ -188,7 +239,7 @@ func websockWrite(ws *websocket.Conn, payload []byte) error {
 	return ws.WriteMessage(websocket.TextMessage, payload)
 }
 
-func websockHandlePlayerEvent(ws *websocket.Conn, event play.Event) (wsValid bool) {
+func websockHandlePlayerEvent(lib scan.Library, ws *websocket.Conn, event play.Event) (wsValid bool) {
 	wsValid = true
 
 	log.Info("Got player event %v", event.Type.String())
@@ -205,12 +256,12 @@ func websockHandlePlayerEvent(ws *websocket.Conn, event play.Event) (wsValid boo
 		if event.Data.(play.PlayerState) == play.Paused || event.Data.(play.PlayerState) == play.Empty {
 			// If we just changed to Paused then we may have loaded a new song, and if we changed to
 			// Empty we have no song. In these cases send _all_ the information (including song metainfo).
-			d, err = jsonFullStatus(s, meta, listQueue(queue), pathsToMetadatas(recent.Slice()), repeatMode)
+			d, err = jsonFullStatus(s, currentMeta(), listQueue(lib, queue), pathsToMetadatas(lib, recent.Slice()), repeatMode, shuffle)
 		} else {
 			d, err = jsonPlayerEvent(event, nil)
 		}
 	} else if event.Type == play.QueueChange {
-		d, err = jsonPlayerEvent(event, listQueue(queue))
+		d, err = jsonPlayerEvent(event, listQueue(lib, queue))
 	} else if event.Type == play.Error {
 		log.Error("%v", event.Data.(error))
 		d, err = jsonPlayerEvent(event, nil)
@@ -277,11 +328,21 @@ func openDb(path, timeout string) (mp3db scan.Mp3Db, err error) {
 		return
 	}
 
+	if pending, err := scan.PendingMigrations(db); err == nil {
+		for _, m := range pending {
+			log.Notice("Migrating database schema to version %d: %s", m.Version, m.Description)
+		}
+	}
+
 	mp3db, err = scan.OpenMp3Db(db)
 	if err != nil {
 		return
 	}
 
+	if !mp3db.FullText() {
+		log.Notice("The full-text index isn't available (build with -tags sqlite_fts5); searches won't be ranked")
+	}
+
 	return
 }
 
@@ -332,22 +393,19 @@ func setFileLogBackend(logfilePath string) error {
 
 // Read events from the player and pass them to the tee.
 // If the player events affect our internal state, change state based on the events
-// (If repeat mode is set to repeat all, re-enqueue completed songs)
-func handlePlayerEvents() {
+func handlePlayerEvents(lib scan.Library) {
 	for e := range player.Events {
 		if e.Type == play.StateChange {
 			if e.Data.(play.PlayerState) == play.Empty {
-				if repeatMode == RepeatAll {
-					// Re-enqueue this sucker
-					t := TraceEnter("/handlePlayerEvents/queue.Enqueue", nil)
-					queue.Enqueue(recent.Held)
-					t.Leave()
-				}
 				// Commit the mp3 that just finished to the recent list
 				t := TraceEnter("/handlePlayerEvents/recent.Commit", nil)
 				recent.Commit()
 				t.Leave()
 
+				t = TraceEnter("/handlePlayerEvents/listening.End", nil)
+				listening.End()
+				t.Leave()
+
 			} else if e.Data.(play.PlayerState) == play.Paused {
 				t := TraceEnter("/handlePlayerEvents/player.GetStatus.1", nil)
 				s := player.GetStatus()
@@ -355,21 +413,28 @@ func handlePlayerEvents() {
 
 				log.Debug("Player changed to paused. Status is %v", s)
 				// If we just changed to Paused then we may have loaded a new song.
+				if s.Path != listening.Path {
+					t := TraceEnter("/handlePlayerEvents/listening.End", nil)
+					listening.End()
+					t.Leave()
+				}
+				var m map[string]string
 				if len(s.Path) != 0 {
 					t := TraceEnter("/handlePlayerEvents/findMp3ByPath", nil)
-					meta = findMp3ByPath(s.Path)
+					m = findMp3ByPath(lib, s.Path)
 					t.Leave()
 
-					if meta == nil {
+					if m == nil {
 						log.Error("Loaded mp3, but can't find metainformation for it...")
 					}
 				}
-				t = TraceEnter("/handlePlayerEvents/setMetainfo", nil)
-				setMetainfo()
+				t = TraceEnter("/handlePlayerEvents/addMetainfo", nil)
+				m = addMetainfo(m)
 				t.Leave()
+				setMeta(s.Path, m)
 			} else if e.Data.(play.PlayerState) == play.Empty {
 				// If we changed to Empty we have no song.
-				meta = nil
+				setMeta("", nil)
 			} else if e.Data.(play.PlayerState) == play.Playing {
 				t := TraceEnter("/handlePlayerEvents/player.GetStatus.2", nil)
 				s := player.GetStatus()
@@ -379,7 +444,13 @@ func handlePlayerEvents() {
 				log.Debug("Adding path '%s' to recently played Hold.", s.Path)
 				recent.Hold(s.Path)
 				t.Leave()
+
+				t = TraceEnter("/handlePlayerEvents/listening.Start", nil)
+				listening.Start(s)
+				t.Leave()
 			}
+		} else if e.Type == play.OffsetChange {
+			listening.Offset = e.Data.(int)
 		}
 
 		t := TraceEnter("/handlePlayerEvents/eventTee.In.write", nil)
@@ -408,12 +479,17 @@ func adaptor() chan play.Event {
 	return out
 }
 
-// Scan the specified directories for mp3s.
-func scanDirs(dirs []string) {
+// openScanLibrary opens the Library that scans write to.
+var openScanLibrary = func() (scan.Library, error) {
 	// Since we are running in a separate goroutine we need our own connection to the database:
 	// "Multi-thread. In this mode, SQLite can be safely used by multiple threads provided that
 	// no single database connection is used simultaneously in two or more threads."
-	db, err := openDb(viper.GetString("db"), "0")
+	return openDb(viper.GetString("db"), "0")
+}
+
+// Scan the specified directories for mp3s. The scan stops early if ctx is cancelled.
+func scanDirs(ctx context.Context, dirs []string) {
+	db, err := openScanLibrary()
 
 	if err != nil {
 		log.Fatalf("Error opening scanner connection to database: %v", err)
@@ -422,25 +498,86 @@ func scanDirs(dirs []string) {
 	defer db.Close()
 
 	var lastSend time.Time
+	var start time.Time
 
-	callback := func(m *scan.Metadata, err error) {
+	callback := func(m *scan.Metadata, sum *scan.Summary, err error) {
 		log.Debug("Scanned %v", m)
+		if m != nil && len(m.PathFields) > 0 {
+			log.Info("Tags missing for %v; derived %v from its path", m.Path, m.PathFields)
+		}
+		if err != nil {
+			log.Error("%v", err)
+		}
+
+		p := modifyScanProgress(func(p *ScanProgress) {
+			p.update(sum, time.Now().Sub(start))
+			p.Path = m.Path
+		})
+
 		now := time.Now()
 		if lastSend.IsZero() || now.Sub(lastSend) > scanEventPeriod {
-			scanTee.In <- m
+			scanTee.In <- p
 			lastSend = now
 		}
 	}
 
-	for _, d := range dirs {
+	change := LibraryChange{Dirs: dirs}
+	playlists := 0
+
+	for i, d := range dirs {
+		if ctx.Err() != nil {
+			break
+		}
+
 		log.Info("Scanning directory %v", d)
-		scan.ScanMp3sToDb(d, db, nil, callback)
-		log.Info("Done scanning directory %v", d)
+		scanTee.In <- modifyScanProgress(func(p *ScanProgress) {
+			*p = ScanProgress{Scanning: true, Dir: d, DirIndex: i, Dirs: len(dirs), Eta: -1}
+		})
+
+		opts := scanOptions
+		opts.Root, _ = roots.find(d)
+
+		start = time.Now()
+		sum := scan.ScanMp3sToDbWithOptions(ctx, d, db, nil, callback, &opts)
+		log.Info("Done scanning directory %v: %v", d, sum)
+		change.Added += sum.Added
+		change.Updated += sum.Updated
+		playlists += sum.Playlists
+		if sum.Prune != nil {
+			logPruneReport(sum.Prune)
+			change.Removed += len(sum.Prune.Removed)
+			change.Moved += len(sum.Prune.Moved)
+		}
+		modifyScanProgress(func(p *ScanProgress) {
+			p.update(&sum, time.Now().Sub(start))
+		})
+	}
+
+	if ctx.Err() != nil {
+		log.Notice("Scan cancelled")
+	}
+	scanTee.In <- leaveScanning(ctx)
+
+	if change.Added+change.Updated+change.Removed+change.Moved > 0 {
+		scanTee.In <- change
+	}
+	if playlists > 0 {
+		notifyPlaylistChange(0, "changed")
+	}
+}
+
+// logPruneReport logs the mp3s that were pruned from the database.
+func logPruneReport(r *scan.PruneReport) {
+	if r.Err != nil {
+		log.Error("%v", r.Err)
+		return
+	}
+	for _, p := range r.Removed {
+		log.Info("Removed missing mp3 %v from the database", p)
+	}
+	for from, to := range r.Moved {
+		log.Info("Mp3 %v was moved to %v", from, to)
 	}
-	scanTee.In <- (*scan.Metadata)(nil)
-	scanMutex.Lock()
-	scanning = false
-	scanMutex.Unlock()
 }
 
 func showHelp() {
@@ -495,21 +632,36 @@ func findWwwDir() string {
 func initViper() {
 	pflag.IntP("port", "p", 2001, "TCP Port to listen on")
 	pflag.StringP("db", "d", "", "Database containing mp3 info")
-	pflag.StringP("prefix", "x", "", "Prefix to prepend to paths read from the database")
+	pflag.StringP("prefix", "x", "", "Prefix to prepend to paths read from the database that aren't under a named library root")
 	pflag.StringP("db-open-timeout", "", "1m", "If the database file doesn't exist, keep trying to open it for this long before exiting")
 	pflag.StringP("log", "l", "", "File to write log messages to. Defaults to stdout if not specified.")
 	pflag.StringP("loglevel", "e", "", "Minimum severity of log messages to write. One of DEBUG, INFO, NOTICE, WARNING, ERROR, or CRITICAL")
 	pflag.IntP("max-recent", "r", 100, "Maximum number of songs in the Recently Played list.")
+	pflag.Float64P("skip-percent", "", 50, "Songs stopped before this percentage of them has played are recorded as skipped in the listening history.")
 
 	viper.BindPFlags(pflag.CommandLine)
 
 	viper.SetDefault("db", "mp3.db")
 	viper.SetDefault("prefix", "")
+	viper.SetDefault("libraries", map[string]string{})
 	viper.SetDefault("port", 2001)
 	viper.SetDefault("log", "")
 	viper.SetDefault("loglevel", "DEBUG")
 	viper.SetDefault("max-recent", 100)
+	viper.SetDefault("skip-percent", 50)
+	viper.SetDefault("previous-restart", "3s")
+	viper.SetDefault("write-ratings", false)
 	viper.SetDefault("db-open-timeout", 100)
+	viper.SetDefault("path-templates", []string{})
+	viper.SetDefault("prune", true)
+	viper.SetDefault("scan-workers", 0)
+	viper.SetDefault("scan-include", []string{})
+	viper.SetDefault("scan-exclude", []string{})
+	viper.SetDefault("scan-min-size", 0)
+	viper.SetDefault("scan-fingerprint", false)
+	viper.SetDefault("scan-playlists", true)
+	viper.SetDefault("watch", true)
+	viper.SetDefault("watch-delay", "5s")
 
 	// Config file basename. Actual config file is config.yaml, .toml, etc.
 	viper.SetConfigName("config")
@@ -538,9 +690,17 @@ func genConfig() {
 	fmt.Fprintln(file, "## Path to the sqlite3 database that contains the mp3 information.")
 	fmt.Fprintln(file, "db: 'mp3.db'")
 	fmt.Fprintln(file, "")
-	fmt.Fprintln(file, "## Prefix to prepend to paths read from the database")
+	fmt.Fprintln(file, "## Prefix to prepend to paths read from the database that aren't under a named library root")
 	fmt.Fprintln(file, "prefix: ''")
 	fmt.Fprintln(file, "")
+	fmt.Fprintln(file, "## Named library roots and the directories they are mounted at on this host. Mp3s under a root")
+	fmt.Fprintln(file, "## are stored relative to it, so the same database can be used on hosts that mount the library")
+	fmt.Fprintln(file, "## at different paths. The roots are scanned along with the directories passed on the command line.")
+	fmt.Fprintln(file, "## Names must be lower case.")
+	fmt.Fprintln(file, "# libraries:")
+	fmt.Fprintln(file, "#   music: '/mnt/music'")
+	fmt.Fprintln(file, "#   audiobooks: '/mnt/audiobooks'")
+	fmt.Fprintln(file, "")
 	fmt.Fprintln(file, "## File to write logs to. If this is not specified, stdout is used.")
 	fmt.Fprintln(file, "# log: '/var/log/wwwmp3/wwwmp3.log'")
 	fmt.Fprintln(file, "")
@@ -550,9 +710,65 @@ func genConfig() {
 	fmt.Fprintln(file, "## Maximum number of songs in the Recently Played list.")
 	fmt.Fprintln(file, "max-recent: 100")
 	fmt.Fprintln(file, "")
+	fmt.Fprintln(file, "## Songs stopped before this percentage of them has played are recorded as skipped, rather")
+	fmt.Fprintln(file, "## than played, in the listening history.")
+	fmt.Fprintln(file, "skip-percent: 50")
+	fmt.Fprintln(file, "")
+	fmt.Fprintln(file, "## /player/previous restarts the current song if it has played for longer than this, and")
+	fmt.Fprintln(file, "## otherwise goes back to the song played before it.")
+	fmt.Fprintln(file, "previous-restart: 3s")
+	fmt.Fprintln(file, "")
+	fmt.Fprintln(file, "## Write ratings set with /songmeta/rate to the POPM frame of the mp3's id3 tags, as well as")
+	fmt.Fprintln(file, "## to the database. Ratings in the tags are read when scanning either way.")
+	fmt.Fprintln(file, "write-ratings: false")
+	fmt.Fprintln(file, "")
 	fmt.Fprintln(file, "## If the database file doesn't exist, keep trying to open it for this long before exiting. ")
 	fmt.Fprintln(file, "db-open-timeout: 1m")
 	fmt.Fprintln(file, "")
+	fmt.Fprintln(file, "## When scanning, mp3s with missing id3 tags have their metadata derived from their path using")
+	fmt.Fprintln(file, "## the first of these templates that matches. Supported placeholders are {artist}, {album},")
+	fmt.Fprintln(file, "## {title}, {track} and {*} (ignored).")
+	fmt.Fprintln(file, "# path-templates:")
+	fmt.Fprintln(file, "#   - '{artist}/{album}/{track} - {title}.mp3'")
+	fmt.Fprintln(file, "#   - '{artist}/{album}/{title}.mp3'")
+	fmt.Fprintln(file, "")
+	fmt.Fprintln(file, "## When scanning, remove mp3s from the database whose files no longer exist.")
+	fmt.Fprintln(file, "prune: true")
+	fmt.Fprintln(file, "")
+	fmt.Fprintln(file, "## Number of files to read tags from concurrently when scanning. 0 means the number of CPUs.")
+	fmt.Fprintln(file, "scan-workers: 0")
+	fmt.Fprintln(file, "")
+	fmt.Fprintln(file, "## When scanning, only scan mp3s that match one of these glob patterns. Playlist files are")
+	fmt.Fprintln(file, "## always scanned unless scan-playlists is false.")
+	fmt.Fprintln(file, "# scan-include:")
+	fmt.Fprintln(file, "#   - '*.mp3'")
+	fmt.Fprintln(file, "")
+	fmt.Fprintln(file, "## When scanning, skip files and directories that match one of these glob patterns. Patterns")
+	fmt.Fprintln(file, "## with a '/' match the end of a path. Directories containing a .nomedia file, and entries")
+	fmt.Fprintln(file, "## matching the patterns in .wwwmp3ignore files, are always skipped.")
+	fmt.Fprintln(file, "# scan-exclude:")
+	fmt.Fprintln(file, "#   - '@eaDir'")
+	fmt.Fprintln(file, "#   - 'Podcasts/old'")
+	fmt.Fprintln(file, "")
+	fmt.Fprintln(file, "## When scanning, skip mp3s smaller than this many bytes.")
+	fmt.Fprintln(file, "scan-min-size: 0")
+	fmt.Fprintln(file, "")
+	fmt.Fprintln(file, "## When scanning, compute an acoustic fingerprint of each mp3 read, so that /library/duplicates")
+	fmt.Fprintln(file, "## finds different rips of the same recording as well as identical files. This decodes every")
+	fmt.Fprintln(file, "## mp3 and makes scans much slower.")
+	fmt.Fprintln(file, "scan-fingerprint: false")
+	fmt.Fprintln(file, "")
+	fmt.Fprintln(file, "## When scanning, import the M3U, M3U8, PLS and XSPF playlist files found as saved playlists.")
+	fmt.Fprintln(file, "## Relative entries are looked for in the playlist's directory, then in the library roots.")
+	fmt.Fprintln(file, "## Rescanning a changed playlist file updates its saved playlist.")
+	fmt.Fprintln(file, "scan-playlists: true")
+	fmt.Fprintln(file, "")
+	fmt.Fprintln(file, "## Watch the mp3 directories for changes and update the database automatically.")
+	fmt.Fprintln(file, "watch: true")
+	fmt.Fprintln(file, "")
+	fmt.Fprintln(file, "## When watching, wait until there have been no changes for this long before rescanning.")
+	fmt.Fprintln(file, "watch-delay: 5s")
+	fmt.Fprintln(file, "")
 
 	file.Close()
 
@@ -582,28 +798,84 @@ func main() {
 
 	var err error
 
+	scanOptions.Prune = viper.GetBool("prune")
+	scanOptions.Workers = viper.GetInt("scan-workers")
+	scanOptions.Include = viper.GetStringSlice("scan-include")
+	scanOptions.Exclude = viper.GetStringSlice("scan-exclude")
+	scanOptions.MinSize = viper.GetInt64("scan-min-size")
+	scanOptions.Fingerprint = viper.GetBool("scan-fingerprint")
+	scanOptions.IgnorePlaylists = !viper.GetBool("scan-playlists")
+	writeRatings = viper.GetBool("write-ratings")
+	for _, p := range [][]string{scanOptions.Include, scanOptions.Exclude} {
+		if err := scan.CheckPatterns(p); err != nil {
+			log.Fatalf("Error parsing scan-include or scan-exclude: %v", err)
+			os.Exit(1)
+		}
+	}
+	scanOptions.PathTemplates, err = scan.ParsePathTemplates(viper.GetStringSlice("path-templates"))
+	if err != nil {
+		log.Fatalf("Error parsing path-templates: %v", err)
+		os.Exit(1)
+	}
+
 	// Open database
-	db, err = openDb(viper.GetString("db"), viper.GetString("db-open-timeout"))
+	db, err := openDb(viper.GetString("db"), viper.GetString("db-open-timeout"))
 	if err != nil {
 		log.Fatalf("Error opening database %v: %v", viper.GetString("db"), err)
 		os.Exit(1)
 	}
 	defer db.Close()
 
+	libraries := viper.GetStringMapString("libraries")
+	roots, err = loadLibraryRoots(db, libraries)
+	if err != nil {
+		log.Fatalf("Error reading library roots: %v", err)
+		os.Exit(1)
+	}
+	for name, dir := range roots {
+		log.Info("Library %v is at %v", name, dir)
+	}
+
+	names := make([]string, 0, len(libraries))
+	for name := range libraries {
+		names = append(names, name)
+	}
+	mp3Dirs = append(mp3Dirs, roots.dirs(names)...)
+
 	// Set up the play queue
 	queue = play.NewQueueWithEvents(player, adaptor())
+	previousRestart = viper.GetDuration("previous-restart")
 
-	go handlePlayerEvents()
+	listening.Library = db
+	listening.SkipPercent = viper.GetFloat64("skip-percent")
+	go handlePlayerEvents(db)
 
 	go handleSignals()
 
 	recent.Max = viper.GetInt("max_recent")
 
+	if viper.GetBool("watch") && len(mp3Dirs) > 0 {
+		watcher, err := NewWatcher(mp3Dirs, viper.GetDuration("watch-delay"), &scanOptions)
+		if err != nil {
+			log.Error("Watching mp3 directories failed: %v", err)
+		} else {
+			defer watcher.Close()
+			go watcher.Run()
+		}
+	}
+
 	// Setup http server
-	http.HandleFunc("/songmeta", serveMeta)
-	http.HandleFunc("/player/", servePlayer)
-	http.HandleFunc("/scan/", serveScan)
-	http.HandleFunc("/playerEvents", serveWebsock)
+	http.HandleFunc("/songmeta", withLibrary(db, serveMeta))
+	http.HandleFunc("/songmeta/suggest", withLibrary(db, serveSuggest))
+	http.HandleFunc("/songmeta/rate", withLibrary(db, serveRate))
+	http.HandleFunc("/player/", withLibrary(db, servePlayer))
+	http.HandleFunc("/scan/", withLibrary(db, serveScan))
+	http.HandleFunc("/library/", withLibrary(db, serveLibrary))
+	http.HandleFunc("/history", withLibrary(db, serveHistory))
+	http.HandleFunc("/history/", withLibrary(db, serveHistory))
+	http.HandleFunc("/playlists", withLibrary(db, servePlaylists))
+	http.HandleFunc("/playlists/", withLibrary(db, servePlaylists))
+	http.HandleFunc("/playerEvents", withLibrary(db, serveWebsock))
 	http.HandleFunc("/trace", serveTrace)
 
 	if wwwDir := findWwwDir(); len(wwwDir) > 0 {
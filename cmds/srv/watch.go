@@ -0,0 +1,218 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jeffwilliams/wwwmp3/scan"
+)
+
+// LibraryChange describes the changes a scan made to the database. It is written to the scanTee
+// after a scan that changed something, so that clients can refresh their lists.
+type LibraryChange struct {
+	// Directories that were scanned
+	Dirs    []string
+	Added   int
+	Updated int
+	Removed int
+	Moved   int
+}
+
+// Watcher watches directory trees using inotify and rescans the parts of the trees that change.
+// Bursts of changes (like an album being copied in) are debounced: a rescan is started only
+// once no changes have been seen for the watcher's delay. Files and directories that scans
+// exclude are not watched, and changes to them are ignored.
+type Watcher struct {
+	roots   []string
+	delay   time.Duration
+	opts    *scan.Options
+	watcher *fsnotify.Watcher
+	// Directories that contain changes that have not been scanned yet
+	dirty map[string]bool
+}
+
+// NewWatcher creates a Watcher that watches the directory trees `roots`, which are scanned with the options `opts`.
+func NewWatcher(roots []string, delay time.Duration, opts *scan.Options) (*Watcher, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		delay:   delay,
+		opts:    opts,
+		watcher: fw,
+		dirty:   make(map[string]bool),
+	}
+
+	for _, r := range roots {
+		r = filepath.Clean(r)
+		w.roots = append(w.roots, r)
+		w.addTree(r)
+	}
+
+	return w, nil
+}
+
+// addTree adds watches for the directory `dir` and all its subdirectories that scans don't exclude.
+// inotify only reports changes to the immediate contents of a watched directory.
+func (w *Watcher) addTree(dir string) {
+	root := w.root(dir)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Warning("Watcher: can't read %v: %v", path, err)
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if w.opts.Excluded(root, path) {
+			return filepath.SkipDir
+		}
+		if err := w.watcher.Add(path); err != nil {
+			// Most likely the inotify watch limit (fs.inotify.max_user_watches) was reached.
+			log.Error("Watcher: watching %v failed: %v", path, err)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// Run handles filesystem events until the watcher is closed.
+func (w *Watcher) Run() {
+	var flush <-chan time.Time
+
+	for {
+		select {
+		case e, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if !w.relevant(e) {
+				continue
+			}
+			log.Debug("Watcher: %v", e)
+
+			if e.Op&fsnotify.Create != 0 {
+				if fi, err := os.Stat(e.Name); err == nil && fi.IsDir() {
+					w.addTree(e.Name)
+				}
+			}
+
+			w.dirty[filepath.Dir(e.Name)] = true
+			// Restart the quiet period
+			flush = time.After(w.delay)
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error("Watcher: %v", err)
+
+		case <-flush:
+			flush = nil
+			dirs := w.scanDirs()
+			if len(dirs) == 0 {
+				continue
+			}
+
+			if ctx, ok := enterScanning(dirs); ok {
+				log.Info("Watcher: rescanning changed directories %v", dirs)
+				w.dirty = make(map[string]bool)
+				go scanDirs(ctx, dirs)
+			} else {
+				// Try again once the current scan is done.
+				flush = time.After(w.delay)
+			}
+		}
+	}
+}
+
+// Close stops watching.
+func (w *Watcher) Close() error {
+	return w.watcher.Close()
+}
+
+// root returns the watched root that contains `path`. If roots are nested the innermost is returned.
+func (w *Watcher) root(path string) (root string) {
+	for _, r := range w.roots {
+		if (path == r || strings.HasPrefix(path, r+"/")) && len(r) > len(root) {
+			root = r
+		}
+	}
+	return
+}
+
+// relevant returns true if the event `e` may affect the mp3s or playlists in the database.
+func (w *Watcher) relevant(e fsnotify.Event) bool {
+	if e.Op == fsnotify.Chmod {
+		return false
+	}
+	root := w.root(e.Name)
+	if name := filepath.Base(e.Name); name == scan.IgnoreFile || name == scan.NoMediaFile {
+		// The ignore files change which mp3s in their directory are scanned.
+		return !w.opts.Excluded(root, filepath.Dir(e.Name))
+	}
+	if w.opts.Excluded(root, e.Name) {
+		return false
+	}
+	if strings.EqualFold(filepath.Ext(e.Name), ".mp3") || scan.PlaylistFormat(e.Name) != "" {
+		return true
+	}
+	if e.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		// The entry no longer exists so we can't tell if it was a directory.
+		return true
+	}
+	fi, err := os.Stat(e.Name)
+	return err == nil && fi.IsDir()
+}
+
+// scanDirs returns the directories to rescan for the dirty directories: for each root, the
+// deepest existing directory that contains all the dirty directories under that root. Scanning
+// them together lets mp3s moved between directories be detected as moves.
+func (w *Watcher) scanDirs() (dirs []string) {
+	for _, r := range w.roots {
+		common := ""
+		for d := range w.dirty {
+			if d != r && !strings.HasPrefix(d, r+"/") {
+				continue
+			}
+			if common == "" {
+				common = d
+			} else {
+				common = commonDir(common, d)
+			}
+		}
+		if common == "" {
+			continue
+		}
+
+		// The directory may have been removed along with its contents.
+		for common != r {
+			if _, err := os.Stat(common); err == nil {
+				break
+			}
+			common = filepath.Dir(common)
+		}
+		dirs = append(dirs, common)
+	}
+	return
+}
+
+// commonDir returns the deepest directory that contains both the directories `a` and `b`.
+func commonDir(a, b string) string {
+	as := strings.Split(a, "/")
+	bs := strings.Split(b, "/")
+
+	i := 0
+	for i < len(as) && i < len(bs) && as[i] == bs[i] {
+		i++
+	}
+	if i == 1 && as[0] == "" {
+		return "/"
+	}
+	return strings.Join(as[:i], "/")
+}
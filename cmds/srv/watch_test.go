@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/jeffwilliams/wwwmp3/scan"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCommonDir(test *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected string
+	}{
+		{"/music/a", "/music/a", "/music/a"},
+		{"/music/a", "/music/b", "/music"},
+		{"/music/a/x", "/music/a", "/music/a"},
+		{"/music/ab", "/music/a", "/music"},
+		{"/music", "/books", "/"},
+		{"/", "/music", "/"},
+	}
+
+	for _, c := range cases {
+		if d := commonDir(c.a, c.b); d != c.expected {
+			test.Errorf("commonDir(%s, %s): expected %s but got %s", c.a, c.b, c.expected, d)
+		}
+	}
+}
+
+// createWatchTree creates the directories `dirs` under a temporary directory and returns it.
+func createWatchTree(test *testing.T, dirs ...string) string {
+	root, err := ioutil.TempDir("", "wwwmp3-watch")
+	if err != nil {
+		test.Fatal("Creating temp dir failed: ", err)
+	}
+	for _, d := range dirs {
+		if err := os.MkdirAll(filepath.Join(root, d), 0755); err != nil {
+			test.Fatal("Creating directory failed: ", err)
+		}
+	}
+	return root
+}
+
+func TestWatcherScanDirs(test *testing.T) {
+	music := createWatchTree(test, "a/x", "a/y", "b")
+	defer os.RemoveAll(music)
+	books := createWatchTree(test, "c")
+	defer os.RemoveAll(books)
+
+	cases := []struct {
+		dirty    []string
+		expected []string
+	}{
+		{nil, nil},
+		{[]string{"music/a/x"}, []string{"music/a/x"}},
+		{[]string{"music/a/x", "music/a/y"}, []string{"music/a"}},
+		{[]string{"music/a/x", "music/b"}, []string{"music"}},
+		{[]string{"music/a/x", "books/c"}, []string{"books/c", "music/a/x"}},
+		// Directories that no longer exist are scanned from their deepest existing parent.
+		{[]string{"music/a/gone/deeper"}, []string{"music/a"}},
+		{[]string{"music/gone"}, []string{"music"}},
+	}
+
+	for _, c := range cases {
+		w := &Watcher{roots: []string{music, books}, dirty: make(map[string]bool)}
+		for _, d := range c.dirty {
+			w.dirty[strings.Replace(strings.Replace(d, "music", music, 1), "books", books, 1)] = true
+		}
+
+		dirs := w.scanDirs()
+		for i, d := range dirs {
+			dirs[i] = strings.Replace(strings.Replace(d, music, "music", 1), books, "books", 1)
+		}
+		sort.Strings(dirs)
+		if strings.Join(dirs, ",") != strings.Join(c.expected, ",") {
+			test.Errorf("Dirty %v: expected to scan %v but got %v", c.dirty, c.expected, dirs)
+		}
+	}
+}
+
+func TestWatcherRelevant(test *testing.T) {
+	music := createWatchTree(test, "a", "@eaDir", "hidden")
+	defer os.RemoveAll(music)
+	if err := ioutil.WriteFile(filepath.Join(music, "hidden", scan.NoMediaFile), nil, 0644); err != nil {
+		test.Fatal("Creating file failed: ", err)
+	}
+
+	w := &Watcher{roots: []string{music}, opts: &scan.Options{Exclude: []string{"@eaDir"}}}
+
+	cases := []struct {
+		op       fsnotify.Op
+		path     string
+		expected bool
+	}{
+		{fsnotify.Create, "a/one.mp3", true},
+		{fsnotify.Chmod, "a/one.mp3", false},
+		{fsnotify.Create, "a/notes.txt", false},
+		{fsnotify.Create, "a/list.m3u", true},
+		{fsnotify.Create, "a", true},
+		{fsnotify.Remove, "a/gone", true},
+		{fsnotify.Create, "@eaDir/one.mp3", false},
+		{fsnotify.Remove, "@eaDir", false},
+		{fsnotify.Remove, "@eaDir/gone", false},
+		{fsnotify.Create, "hidden/one.mp3", false},
+		{fsnotify.Remove, "hidden/gone", false},
+		{fsnotify.Create, "hidden/" + scan.NoMediaFile, true},
+		{fsnotify.Create, "a/" + scan.IgnoreFile, true},
+		{fsnotify.Create, "@eaDir/" + scan.IgnoreFile, false},
+	}
+
+	for _, c := range cases {
+		e := fsnotify.Event{Name: filepath.Join(music, c.path), Op: c.op}
+		if r := w.relevant(e); r != c.expected {
+			test.Errorf("%v %s: expected relevant to be %v but got %v", c.op, c.path, c.expected, r)
+		}
+	}
+}
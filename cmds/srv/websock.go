@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"github.com/jeffwilliams/wwwmp3/play"
-	"github.com/jeffwilliams/wwwmp3/scan"
 	"strconv"
 )
 
@@ -34,14 +33,15 @@ func jsonPlayerStatus(status play.PlayerStatus) ([]byte, error) {
 }
 
 // jsonFullStatus creates a JSON message that contains the player status and the meta information
-func jsonFullStatus(status play.PlayerStatus, meta map[string]string, queue []map[string]string, recent []map[string]string, repeatMode RepeatMode) ([]byte, error) {
+func jsonFullStatus(status play.PlayerStatus, meta map[string]string, queue []map[string]string, recent []map[string]string, repeatMode RepeatMode, shuffle bool) ([]byte, error) {
 	a := struct {
 		play.PlayerStatus
 		Meta       map[string]string
 		Queue      []map[string]string
 		Recent     []map[string]string
 		RepeatMode string
-	}{status, meta, queue, recent, repeatMode.String()}
+		Shuffle    bool
+	}{status, meta, queue, recent, repeatMode.String(), shuffle}
 	return json.Marshal(a)
 }
 
@@ -53,11 +53,19 @@ func jsonMeta(meta map[string]string) ([]byte, error) {
 	return json.Marshal(a)
 }
 
-// jsonScan creates a JSON message with the current scan event's data
-func jsonScan(meta *scan.Metadata) ([]byte, error) {
+// jsonScanProgress creates a JSON message with the progress of the current scan
+func jsonScanProgress(p ScanProgress) ([]byte, error) {
 	a := struct {
-		Scan *scan.Metadata
-	}{Scan: meta}
+		ScanProgress ScanProgress
+	}{ScanProgress: p}
+	return json.Marshal(a)
+}
+
+// jsonLibraryChange creates a JSON message describing the changes a scan made to the database
+func jsonLibraryChange(c LibraryChange) ([]byte, error) {
+	a := struct {
+		LibraryChange LibraryChange
+	}{LibraryChange: c}
 	return json.Marshal(a)
 }
 
@@ -76,3 +84,19 @@ func jsonRepeat(repeatMode RepeatMode) ([]byte, error) {
 	}{RepeatMode: repeatMode.String()}
 	return json.Marshal(a)
 }
+
+// jsonShuffle creates a JSON message with the current shuffle mode
+func jsonShuffle(shuffle bool) ([]byte, error) {
+	a := struct {
+		Shuffle bool
+	}{Shuffle: shuffle}
+	return json.Marshal(a)
+}
+
+// jsonPlaylistChange creates a JSON message describing a change to a saved playlist
+func jsonPlaylistChange(c PlaylistChange) ([]byte, error) {
+	a := struct {
+		PlaylistChange PlaylistChange
+	}{PlaylistChange: c}
+	return json.Marshal(a)
+}
@@ -26,10 +26,10 @@ func TestJsonPlayerEvent(t *testing.T) {
 		Volume: 2,
 	}
 
-	j, _ := jsonPlayerEvent(s, play.OffsetChange)
+	j, _ := jsonPlayerEvent(play.Event{Type: play.OffsetChange, Data: s.Offset}, nil)
 	t.Log(string(j))
-	j, _ = jsonPlayerEvent(s, play.StateChange)
+	j, _ = jsonPlayerEvent(play.Event{Type: play.StateChange, Data: s.State}, nil)
 	t.Log(string(j))
-	j, _ = jsonPlayerEvent(s, play.VolumeChange)
+	j, _ = jsonPlayerEvent(play.Event{Type: play.VolumeChange, Data: s.Volume}, nil)
 	t.Log(string(j))
 }
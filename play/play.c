@@ -448,6 +448,32 @@ double play_seconds_per_sample(play_reader_t* reader) {
   return d / ((double) spf);
 }
 
+/*
+Make the reader decode to signed 16 bit samples, at the sampling rate and with the number of channels of
+the mp3, and get that rate and number of channels. Must be called before the first call to play_read.
+This function sets errno to 0 on success, and -1 on error (for use with CGOs multiple assignment).
+*/
+void play_decode_s16(play_reader_t* reader, long* rate, int* channels) {
+  const long *rates;
+  size_t count, i;
+  int encoding, err;
+
+  play_clear_last_error();
+  errno = 0;
+
+  mpg123_rates(&rates, &count);
+  mpg123_format_none(reader->mh);
+  for (i = 0; i < count; i++) {
+    mpg123_format(reader->mh, rates[i], MPG123_MONO | MPG123_STEREO, MPG123_ENC_SIGNED_16);
+  }
+
+  err = mpg123_getformat(reader->mh, rate, channels, &encoding);
+  if (err != MPG123_OK) {
+    errno = -1;
+    snprintf(play_last_error, MAX_ERROR_LEN, "mpg123 get format failed: %s", mpg123_plain_strerror(err));
+  }
+}
+
 /*
 Seek.
 */
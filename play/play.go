@@ -102,6 +102,13 @@ type Metadata struct {
 	Artist   string
 	Album    string
 	Tracknum int
+	Genre    string
+	// Unsynchronised lyrics
+	Lyrics string
+	// Year of release
+	Year int
+	// Rating in stars, from 0 (unrated) to 5, from the POPM frame; -1 if there is none
+	Rating int
 }
 
 // Information about an mp3 determined once the mp3 is loaded.
@@ -117,12 +124,117 @@ type Info struct {
 
 	// Seconds per sample (if available) or zero otherwise
 	Sps float64
+
+	// Number of audio channels
+	Channels int
+
+	// True if the mp3 is encoded with a variable (or average) bitrate
+	Vbr bool
+}
+
+// channels returns the number of audio channels for an mpg123 channel mode.
+func channels(mode C.enum_mpg123_mode) int {
+	if mode == C.MPG123_M_MONO {
+		return 1
+	}
+	return 2
+}
+
+// GetFileInfo decodes the mp3 file `filename` and returns information about it (like the
+// bitrate and duration) without loading it into a Player. The whole file is scanned so that
+// the duration is accurate for variable bitrate files.
+func GetFileInfo(filename string) (info Info, err error) {
+	n := C.CString(filename)
+	defer C.free(unsafe.Pointer(n))
+
+	reader := C.play_new_reader(n)
+	if reader == nil {
+		err = makePlayError("Creating reader failed: ")
+		return
+	}
+	defer C.play_delete_reader(reader)
+
+	i, e := C.play_getinfo(reader)
+	if e != nil {
+		err = makePlayError("Getting track info failed: ")
+		return
+	}
+
+	info.BitRate = int(i.bitrate)
+	info.Rate = int(i.rate)
+	info.Channels = channels(i.mode)
+	info.Vbr = i.vbr != C.MPG123_CBR
+
+	d, e := C.play_seconds_per_sample(reader)
+	if e != nil {
+		err = makePlayError("Getting seconds-per-sample failed: ")
+		return
+	}
+	info.Sps = float64(d)
+	if size := int(C.play_length(reader)); size > 0 {
+		info.Duration = float64(d) * float64(size)
+	}
+
+	return
+}
+
+// DecodeSamples decodes the mp3 file `filename` to signed 16 bit samples and calls `f` with each block
+// of samples in order. The samples of each channel are interleaved. `rate` is the sampling rate in Hz.
+// Decoding stops early if f returns false. The samples passed to f are only valid until it returns.
+func DecodeSamples(filename string, f func(samples []int16, rate, channels int) bool) error {
+	n := C.CString(filename)
+	defer C.free(unsafe.Pointer(n))
+
+	reader := C.play_new_reader(n)
+	if reader == nil {
+		return makePlayError("Creating reader failed: ")
+	}
+	defer C.play_delete_reader(reader)
+
+	var rate C.long
+	var channels C.int
+	if _, e := C.play_decode_s16(reader, &rate, &channels); e != nil {
+		return makePlayError("Setting the decoding format failed: ")
+	}
+
+	for {
+		done, e := C.play_read(reader)
+		if done > 0 {
+			samples := unsafe.Slice((*int16)(unsafe.Pointer(reader.buffer)), int(done)/2)
+			if !f(samples, int(rate), int(channels)) {
+				return nil
+			}
+		}
+		if e != nil {
+			// Like the player, treat any failure to read as the end of the mp3.
+			return nil
+		}
+	}
 }
 
 // GetMetadata extracts the id3 information from the mp3 file `filename`.
 // For integer fields (like Tracknum) for which there is no data the field
-// is set to -1.
+// is set to -1. If the title is not set, it is set to the filename without
+// the directory or extension.
 func GetMetadata(filename string) Metadata {
+	m := GetTags(filename)
+	if len(m.Title) == 0 {
+		m.Title = TitleFromFilename(filename)
+	}
+	return m
+}
+
+// TitleFromFilename returns the last element of the path `filename` up to the first '.'.
+func TitleFromFilename(filename string) string {
+	base := filename[strings.LastIndex(filename, "/")+1:]
+	if i := strings.Index(base, "."); i >= 0 {
+		base = base[:i]
+	}
+	return base
+}
+
+// GetTags is like GetMetadata, but fields that are not set in the id3 tags are left empty.
+func GetTags(filename string) Metadata {
 	meta := C.play_meta(C.CString(filename))
 
 	tracknum := -1
@@ -133,16 +245,71 @@ func GetMetadata(filename string) Metadata {
 		}
 	}
 
+	year := -1
+	digits = initialNum(strings.TrimSpace(C.GoString(meta.year)))
+	if len(digits) > 0 {
+		if i, err := strconv.Atoi(digits); err == nil {
+			year = i
+		}
+	}
+
 	r := Metadata{
 		Title:    strings.Trim(C.GoString(meta.title), " "),
 		Artist:   strings.Trim(C.GoString(meta.artist), " "),
 		Album:    strings.Trim(C.GoString(meta.album), " "),
 		Tracknum: tracknum,
+		Genre:    strings.Trim(C.GoString(meta.genre), " "),
+		Lyrics:   C.GoString(meta.lyrics),
+		Year:     year,
+		Rating:   -1,
+	}
+	if meta.rating >= 0 {
+		r.Rating = PopmToStars(int(meta.rating))
 	}
 	C.play_delete_meta(meta)
 	return r
 }
 
+// PopmToStars converts a rating stored in a POPM frame, from 0 to 255, to stars from 0 (unrated)
+// to 5. Players disagree on how stars are stored, so ranges are used; 1, 64, 128, 196 and 255 (as
+// written by StarsToPopm) are 1 to 5 stars.
+func PopmToStars(popm int) int {
+	switch {
+	case popm <= 0:
+		return 0
+	case popm < 32:
+		return 1
+	case popm < 96:
+		return 2
+	case popm < 160:
+		return 3
+	case popm < 224:
+		return 4
+	}
+	return 5
+}
+
+// StarsToPopm converts a rating in stars, from 0 (unrated) to 5, to the value stored in a POPM frame.
+func StarsToPopm(stars int) int {
+	if stars < 0 {
+		stars = 0
+	} else if stars > 5 {
+		stars = 5
+	}
+	return []int{0, 1, 64, 128, 196, 255}[stars]
+}
+
+// SetRating writes the rating `stars`, from 0 (unrated) to 5, to the POPM frame of the ID3v2 tag of
+// the mp3 file `filename`.
+func SetRating(filename string, stars int) error {
+	f := C.CString(filename)
+	defer C.free(unsafe.Pointer(f))
+	if C.play_set_rating(f, C.int(StarsToPopm(stars))) < 0 {
+		return fmt.Errorf("Writing the rating of %s failed", filename)
+	}
+	return nil
+}
+
 // Print debugging information about the metadata in `filename` to stdout.
 func DebugMetadata(filename string) {
 	C.play_debug_meta(C.CString(filename))
@@ -335,7 +502,7 @@ func NewPlayer() (p Player) {
 					return nil
 				}
 
-				info := &Info{BitRate: int(i.bitrate), Rate: int(i.rate)}
+				info := &Info{BitRate: int(i.bitrate), Rate: int(i.rate), Channels: channels(i.mode), Vbr: i.vbr != C.MPG123_CBR}
 				d, err := C.play_seconds_per_sample(reader)
 				size := int(C.play_length(reader))
 				if err == nil {
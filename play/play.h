@@ -9,6 +9,11 @@ typedef struct {
   char* artist;
   char* album;
   char* tracknum;
+  char* genre;
+  char* lyrics;
+  char* year;
+  // Rating from the POPM frame, 0 to 255, or -1 if there is none
+  int rating;
 } play_metadata_t;
 
 typedef struct {
@@ -32,6 +37,7 @@ int play_offset(play_reader_t* reader);
 int play_seek(play_reader_t* reader, int offset);
 struct mpg123_frameinfo play_getinfo(play_reader_t* reader);
 double play_seconds_per_sample(play_reader_t* reader);
+void play_decode_s16(play_reader_t* reader, long* rate, int* channels);
 
 ao_device* play_new_writer(play_reader_t* reader);
 void play_delete_writer(ao_device* writer);
@@ -43,6 +49,7 @@ extern "C" {
 #endif
   play_metadata_t play_meta(char* filename);
   void play_delete_meta(play_metadata_t meta);
+  int play_set_rating(char* filename, int rating);
   void play_debug_meta(char* filename);
 #ifdef __cplusplus
 }
@@ -2,6 +2,7 @@
 #include <iconv.h>
 #include "play.h"
 #include "string.h"
+#include <stdlib.h>
 
 static char* empty_string() {
   char* rc = new char[1];
@@ -12,8 +13,6 @@ static char* empty_string() {
 // Caller must delete [] dst after use.
 static void field_text(char** dst, ID3_Frame* frame) {
   iconv_t cd = iconv_open("UTF8","UTF16BE");
-  const int bufsize = 1000;
-  char buf[bufsize];
 
   if (NULL != frame) {
     ID3_Field* field = frame->GetField(ID3FN_TEXT);
@@ -27,6 +26,10 @@ static void field_text(char** dst, ID3_Frame* frame) {
           char* in = (char*) field->GetRawUnicodeText();
           size_t insize = field->Size();
 
+          // Each UTF-16 code unit becomes at most 3 bytes of UTF-8. Lyrics may be long,
+          // so the buffer is sized for the field.
+          const size_t bufsize = insize/2*3 + 1;
+          char* buf = new char[bufsize];
           char* bufptr = buf;
           size_t bufbytes = bufsize;
           size_t rc = 0;
@@ -34,17 +37,18 @@ static void field_text(char** dst, ID3_Frame* frame) {
           // Initialize iconv state
           if( iconv(cd, NULL, NULL, &bufptr, &bufbytes) == (size_t) -1 ){
             *dst = empty_string();
+            delete [] buf;
             break;
           }
 
           if ( (rc = iconv(cd, &in, &insize, &bufptr, &bufbytes)) != (size_t) -1 ) {
-            *bufptr = '\0';
             *dst = new char[bufsize-bufbytes+1];
             memcpy(*dst, buf, bufsize-bufbytes);
             (*dst)[bufsize-bufbytes] = '\0';
           } else {
             *dst = empty_string();
           }
+          delete [] buf;
         } else {
           *dst = empty_string();
         }
@@ -62,24 +66,29 @@ static void field_text(char** dst, ID3_Frame* frame) {
   iconv_close(cd);
 }
 
-static void set_title_from_filename(char** dst, char* filename){
-  int flen = strlen(filename);
-
-  *dst = new char[flen+1];
-
-  int i;
-  for(i = flen-1; i >= 0 && filename[i] != '/'; i--){
-    //  
+// Like field_text, but a genre given as an ID3v1 genre number in parentheses, like "(17)", is
+// replaced by the genre name. If a name follows the number, like "(17)Rock", the name is used.
+static void genre_text(char** dst, ID3_Frame* frame) {
+  field_text(dst, frame);
+  if ( NULL == *dst || (*dst)[0] != '(' )
+    return;
+
+  char* end = NULL;
+  long n = strtol(*dst + 1, &end, 10);
+  if ( end == *dst + 1 || *end != ')' )
+    return;
+
+  const char* name = end + 1;
+  if ( *name == '\0' ) {
+    name = ID3_V1GENRE2DESCRIPTION(n);
+    if ( NULL == name )
+      return;
   }
 
-  if(filename[i] == '/') 
-    i++;
-
-  int j;
-  for(j = 0; filename[i] != '\0' && filename[i] != '.'; i++,j++){
-    (*dst)[j] = filename[i];
-  }
-  (*dst)[j] = '\0';
+  char* genre = new char[strlen(name)+1];
+  strcpy(genre, name);
+  delete [] *dst;
+  *dst = genre;
 }
 
 extern "C"
@@ -92,15 +101,41 @@ play_metadata_t play_meta(char* filename){
   field_text(&result.album, tag.Find(ID3FID_ALBUM));
   field_text(&result.artist, tag.Find(ID3FID_LEADARTIST));
   field_text(&result.tracknum, tag.Find(ID3FID_TRACKNUM));
-
-  // If title is not set, set it to the filename (without extension)
-  if(!result.title || strlen(result.title) == 0) {
-    set_title_from_filename(&result.title, filename);
+  genre_text(&result.genre, tag.Find(ID3FID_CONTENTTYPE));
+  field_text(&result.lyrics, tag.Find(ID3FID_UNSYNCEDLYRICS));
+  field_text(&result.year, tag.Find(ID3FID_YEAR));
+
+  result.rating = -1;
+  ID3_Frame* popm = tag.Find(ID3FID_POPULARIMETER);
+  if ( NULL != popm ) {
+    ID3_Field* field = popm->GetField(ID3FN_RATING);
+    if ( NULL != field )
+      result.rating = (int) field->Get();
   }
 
   return result;
 }
 
+// Set the rating (0 to 255) in the POPM frame of the ID3v2 tag of the file, adding the frame
+// if there is none. Returns 0 on success and -1 on failure.
+extern "C"
+int play_set_rating(char* filename, int rating){
+  ID3_Tag tag(filename);
+
+  ID3_Frame* popm = tag.Find(ID3FID_POPULARIMETER);
+  if ( NULL == popm ) {
+    popm = new ID3_Frame(ID3FID_POPULARIMETER);
+    popm->GetField(ID3FN_EMAIL)->Set("wwwmp3");
+    popm->GetField(ID3FN_COUNTER)->Set((uint32) 0);
+    tag.AttachFrame(popm);
+  }
+  popm->GetField(ID3FN_RATING)->Set((uint32) rating);
+
+  if ( tag.Update(ID3TT_ID3V2) == ID3TT_NONE )
+    return -1;
+  return 0;
+}
+
 extern "C"
 void play_debug_meta(char* filename){
   ID3_Tag tag(filename);
@@ -201,4 +236,12 @@ void play_delete_meta(play_metadata_t meta) {
     delete [] meta.artist;
   if ( meta.album )
     delete [] meta.album;
+  if ( meta.tracknum )
+    delete [] meta.tracknum;
+  if ( meta.genre )
+    delete [] meta.genre;
+  if ( meta.lyrics )
+    delete [] meta.lyrics;
+  if ( meta.year )
+    delete [] meta.year;
 }
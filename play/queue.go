@@ -3,7 +3,9 @@ package play
 import (
 	"container/list"
 	"fmt"
+	"math/rand"
 	"sort"
+	"time"
 )
 
 type queueCmdType int
@@ -13,8 +15,21 @@ const (
 	MoveToTop
 	Remove
 	Clear
+	// Shuffle the elements of the queue once
+	Shuffle
+	// Turn the shuffle mode on or off
+	SetShuffle
+	// Skip to the next file
+	Next
+	// Restart the current file or go back to the previously played one
+	Previous
+	// Turn repeating the whole queue on or off
+	SetRepeatAll
 )
 
+// The number of played files the queue remembers for Previous
+const historySize = 100
+
 // Sort ints
 type Asc []int
 
@@ -32,6 +47,10 @@ type queueCmd struct {
 	Type    queueCmdType
 	Indexes []int
 	Delta   int
+	// For SetShuffle and SetRepeatAll, whether the mode is on
+	On bool
+	// For Previous, how long the current file must have played for to be restarted
+	RestartAfter time.Duration
 }
 
 // QueueElem is an element in the play queue.
@@ -44,6 +63,14 @@ type QueueElem struct {
 
 // Queue implements a queue of metadata for a player. Items from the queue
 // are added to the player when the player is Empty.
+//
+// Normally the first item is added. In shuffle mode a random item is added instead, avoiding
+// files that have already been played in shuffle mode until every file in the queue has been.
+//
+// The queue remembers the files it played, so that Previous can go back to them. Going back puts
+// the current file at the front of the queue again, to be played after the previous one.
+//
+// When repeating the whole queue, files are put back at the end of the queue after they are played.
 type Queue struct {
 	player  Player
 	files   *list.List
@@ -58,6 +85,22 @@ func NewQueue(player Player) Queue {
 }
 
 func NewQueueWithEvents(player Player, events chan Event) Queue {
+	return newQueue(player, events, player.Events)
+}
+
+// queuePlayer is the part of a Player used by a Queue.
+type queuePlayer interface {
+	Load(filename string) (int, error)
+	Play() error
+	Stop()
+	Seek(offset int)
+	GetStatus() PlayerStatus
+	GetInfo() *Info
+}
+
+// newQueue creates a Queue for `player`, which reads the player's events from `events` and
+// sends its own events to `out`.
+func newQueue(player queuePlayer, events, out chan Event) Queue {
 	q := Queue{
 		files:   list.New(),
 		enqueue: make(chan string),
@@ -66,6 +109,21 @@ func NewQueueWithEvents(player Player, events chan Event) Queue {
 		nextId:  0,
 	}
 
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	shuffle := false
+	// Files played since shuffle mode was turned on, or since every file in the queue had been played
+	shufflePlayed := make(map[string]bool)
+
+	repeatAll := false
+
+	// The file the queue last added to the player, until it stops playing, and the files played
+	// before it, most recent first
+	var current *QueueElem
+	history := list.New()
+	// The number of files at the front of the queue that were put back by Previous. These are
+	// played next in order, even in shuffle mode.
+	rewound := 0
+
 	nth := func(list *list.List, n int) *list.Element {
 		e := list.Front()
 		for i := 0; e != nil && i < n; i, e = i+1, e.Next() {
@@ -79,35 +137,133 @@ func NewQueueWithEvents(player Player, events chan Event) Queue {
 		// they also send commands to the player. If the player is sending an event
 		// while the event reader is sending a command to the player we have a deadlock.
 		select {
-		case player.Events <- e:
+		case out <- e:
 		default:
 		}
 	}
 
+	// next returns the element to play next.
+	next := func() *list.Element {
+		if !shuffle || rewound > 0 {
+			if rewound > 0 {
+				rewound--
+			}
+			return q.files.Front()
+		}
+
+		candidates := make([]*list.Element, 0, q.files.Len())
+		for e := q.files.Front(); e != nil; e = e.Next() {
+			if !shufflePlayed[e.Value.(QueueElem).Filename] {
+				candidates = append(candidates, e)
+			}
+		}
+		if len(candidates) == 0 {
+			// Everything has been played; start another round.
+			shufflePlayed = make(map[string]bool)
+			for e := q.files.Front(); e != nil; e = e.Next() {
+				candidates = append(candidates, e)
+			}
+		}
+
+		e := candidates[rnd.Intn(len(candidates))]
+		shufflePlayed[e.Value.(QueueElem).Filename] = true
+		return e
+	}
+
+	// load loads elem into the player and plays it.
+	load := func(elem QueueElem) {
+		current = &elem
+
+		_, err := player.Load(elem.Filename)
+		if err != nil {
+			// TODO: If we get an error here, we'll stop trying to play stuff until
+			// something is added to the queue. Should we start a timer to retry here? It could be
+			// a temporary condition like something (youtube) stole the audio device.
+			sendEvent(Event{Type: Error, Data: fmt.Errorf("Queue failed to load file %s: %t", elem.Filename, err)})
+			return
+		}
+		err = player.Play()
+		if err != nil {
+			sendEvent(Event{Type: Error, Data: fmt.Errorf("Queue failed to play file %s: %t", elem.Filename, err)})
+			return
+		}
+	}
+
+	// finish records that the current file stopped playing.
+	finish := func() {
+		if current == nil {
+			return
+		}
+
+		history.PushFront(*current)
+		if history.Len() > historySize {
+			history.Remove(history.Back())
+		}
+		if repeatAll {
+			q.files.PushBack(*current)
+		}
+		current = nil
+	}
+
 	addToPlayer := func() {
+		s := player.GetStatus()
+		if s.State != Empty {
+			return
+		}
+
+		finish()
 		if q.files.Len() == 0 {
 			return
 		}
 
+		load(q.files.Remove(next()).(QueueElem))
+	}
+
+	// skip stops the current file. When the player becomes Empty the next file is added to it.
+	skip := func() {
+		player.Stop()
+	}
+
+	previous := func(restartAfter time.Duration) {
 		s := player.GetStatus()
 		if s.State == Empty {
+			finish()
+		}
 
-			elem := q.files.Remove(q.files.Front()).(QueueElem)
-
-			_, err := player.Load(elem.Filename)
-			if err != nil {
-				// TODO: If we get an error here, we'll stop trying to play stuff until
-				// something is added to the queue. Should we start a timer to retry here? It could be
-				// a temporary condition like something (youtube) stole the audio device.
-				sendEvent(Event{Type: Error, Data: fmt.Errorf("Queue failed to load file %s: %t", elem.Filename, err)})
-				return
+		var played time.Duration
+		if s.State != Empty {
+			if info := player.GetInfo(); info != nil {
+				played = time.Duration(float64(s.Offset) * info.Sps * float64(time.Second))
 			}
-			err = player.Play()
-			if err != nil {
-				sendEvent(Event{Type: Error, Data: fmt.Errorf("Queue failed to play file %s: %t", elem.Filename, err)})
-				return
+		}
+
+		if s.State != Empty && (played > restartAfter || history.Len() == 0) {
+			player.Seek(0)
+			return
+		}
+
+		if history.Len() == 0 {
+			return
+		}
+
+		// Put the current file back. It didn't finish playing, so it isn't in the history.
+		if current != nil {
+			q.files.PushFront(*current)
+			rewound++
+			current = nil
+		}
+		elem := history.Remove(history.Front()).(QueueElem)
+
+		// When repeating, the previous file was put back at the end of the queue when it finished.
+		for e := q.files.Back(); e != nil; e = e.Prev() {
+			if e.Value.(QueueElem).Id == elem.Id {
+				q.files.Remove(e)
+				break
 			}
 		}
+
+		player.Stop()
+		load(elem)
 	}
 
 	move := func(indexes []int, delta int) {
@@ -175,7 +331,30 @@ func NewQueueWithEvents(player Player, events chan Event) Queue {
 		}
 	}
 
+	shuffleAll := func() {
+		a := make([]interface{}, 0, q.files.Len())
+		for q.files.Len() > 0 {
+			a = append(a, q.files.Remove(q.files.Front()))
+		}
+		rnd.Shuffle(len(a), func(i, j int) { a[i], a[j] = a[j], a[i] })
+		for _, v := range a {
+			q.files.PushBack(v)
+		}
+	}
+
+	setShuffle := func(on bool) {
+		if on && !shuffle {
+			shufflePlayed = make(map[string]bool)
+		}
+		shuffle = on
+	}
+
 	modify := func(cmd queueCmd) {
+		if cmd.Type != Next && cmd.Type != Previous && cmd.Type != SetShuffle && cmd.Type != SetRepeatAll {
+			// The files put back by Previous may have moved.
+			rewound = 0
+		}
+
 		if cmd.Type == Move {
 			move(cmd.Indexes, cmd.Delta)
 		} else if cmd.Type == MoveToTop {
@@ -184,6 +363,16 @@ func NewQueueWithEvents(player Player, events chan Event) Queue {
 			remove(cmd.Indexes)
 		} else if cmd.Type == Clear {
 			clear()
+		} else if cmd.Type == Shuffle {
+			shuffleAll()
+		} else if cmd.Type == SetShuffle {
+			setShuffle(cmd.On)
+		} else if cmd.Type == Next {
+			skip()
+		} else if cmd.Type == Previous {
+			previous(cmd.RestartAfter)
+		} else if cmd.Type == SetRepeatAll {
+			repeatAll = cmd.On
 		}
 	}
 
@@ -251,3 +440,32 @@ func (q Queue) Remove(indexes []int) {
 func (q Queue) Clear() {
 	q.modify <- queueCmd{Type: Clear}
 }
+
+// Shuffle puts the elements of the queue in a random order.
+func (q Queue) Shuffle() {
+	q.modify <- queueCmd{Type: Shuffle}
+}
+
+// SetShuffle turns shuffle mode on or off. In shuffle mode the next file played is picked at
+// random from the queue, without repeating files until all of them have been played.
+func (q Queue) SetShuffle(on bool) {
+	q.modify <- queueCmd{Type: SetShuffle, On: on}
+}
+
+// Next stops the current file, so that the player moves on to the next file in the queue.
+func (q Queue) Next() {
+	q.modify <- queueCmd{Type: Next}
+}
+
+// Previous restarts the current file if it has played for longer than restartAfter, and
+// otherwise plays the file the queue played before it. The current file is put back at the
+// front of the queue.
+func (q Queue) Previous(restartAfter time.Duration) {
+	q.modify <- queueCmd{Type: Previous, RestartAfter: restartAfter}
+}
+
+// SetRepeatAll turns repeating the whole queue on or off. When it's on, files are put back at the
+// end of the queue after they are played.
+func (q Queue) SetRepeatAll(on bool) {
+	q.modify <- queueCmd{Type: SetRepeatAll, On: on}
+}
@@ -0,0 +1,258 @@
+package play
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePlayer plays files instantly. It sends state changes to `events` like a Player.
+type fakePlayer struct {
+	mu     sync.Mutex
+	status PlayerStatus
+	seeks  int
+	events chan Event
+}
+
+func newFakePlayer() *fakePlayer {
+	return &fakePlayer{events: make(chan Event, 1000)}
+}
+
+func (p *fakePlayer) setState(s PlayerState) {
+	if p.status.State != s {
+		p.status.State = s
+		p.events <- Event{Type: StateChange, Data: s}
+	}
+}
+
+func (p *fakePlayer) Load(filename string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status = PlayerStatus{State: p.status.State, Path: filename, Size: 1000}
+	p.setState(Paused)
+	return 1000, nil
+}
+
+func (p *fakePlayer) Play() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.setState(Playing)
+	return nil
+}
+
+func (p *fakePlayer) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.Path = ""
+	p.setState(Empty)
+}
+
+func (p *fakePlayer) Seek(offset int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.Offset = offset
+	p.seeks++
+}
+
+// seekCount returns the number of times Seek was called.
+func (p *fakePlayer) seekCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.seeks
+}
+
+func (p *fakePlayer) GetStatus() PlayerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// GetInfo returns info for files of 1000 samples that play for 10 seconds.
+func (p *fakePlayer) GetInfo() *Info {
+	return &Info{Sps: 0.01, Duration: 10}
+}
+
+// setOffset moves to the sample `offset` of the current file, which is at 100 samples a second.
+func (p *fakePlayer) setOffset(offset int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.Offset = offset
+}
+
+// waitFor waits for the queue `q` to handle the player's events, until the player is playing
+// `path`, or is empty if path is empty, and the queue holds `queued`, separated by commas.
+func waitFor(test *testing.T, q Queue, p *fakePlayer, path, queued string) {
+	var l []string
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		l = l[:0]
+		for _, e := range q.List() {
+			l = append(l, e.Filename)
+		}
+		if s := p.GetStatus(); s.Path == path && (s.State == Playing) == (path != "") && strings.Join(l, ",") == queued {
+			return
+		}
+	}
+	test.Fatalf("Expected %s playing with %s queued, but %s is playing with %v queued", path, queued, p.GetStatus().Path, l)
+}
+
+// played finishes the file being played by `p` and returns the file the queue `q` plays next.
+func played(test *testing.T, q Queue, p *fakePlayer) string {
+	p.Stop()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		q.List()
+		if s := p.GetStatus(); s.State == Playing {
+			return s.Path
+		}
+	}
+	test.Fatal("The queue didn't play the next file")
+	return ""
+}
+
+func TestQueueShuffle(test *testing.T) {
+	p := newFakePlayer()
+	q := newQueue(p, p.events, make(chan Event, 1000))
+	q.SetRepeatAll(true)
+	q.SetShuffle(true)
+	for _, f := range []string{"a", "b", "c", "d"} {
+		q.Enqueue(f)
+	}
+	waitFor(test, q, p, "a", "b,c,d")
+
+	// Every file is played once in each round.
+	for round := 0; round < 3; round++ {
+		seen := map[string]bool{p.GetStatus().Path: true}
+		if round > 0 {
+			seen = map[string]bool{}
+		}
+		for len(seen) < 4 {
+			f := played(test, q, p)
+			if seen[f] {
+				test.Fatalf("%s was played twice in round %d", f, round)
+			}
+			seen[f] = true
+		}
+	}
+
+	// Shuffling the queue keeps its files.
+	q.Shuffle()
+	l := q.List()
+	if len(l) != 3 {
+		test.Fatalf("Unexpected shuffled queue %v", l)
+	}
+}
+
+func TestQueueShuffleRewound(test *testing.T) {
+	p := newFakePlayer()
+	q := newQueue(p, p.events, make(chan Event, 1000))
+	q.SetShuffle(true)
+	q.Enqueue("a")
+	waitFor(test, q, p, "a", "")
+	for _, f := range []string{"b", "c", "d", "e"} {
+		q.Enqueue(f)
+	}
+
+	// A file put back by Previous is played next, even in shuffle mode.
+	x := played(test, q, p)
+	q.Previous(time.Second)
+	if l := q.List(); len(l) != 4 || l[0].Filename != x {
+		test.Fatalf("Expected %s at the front of the queue but it holds %v", x, l)
+	}
+	if f := played(test, q, p); f != x {
+		test.Fatalf("Expected %s to be played after going back, but %s was", x, f)
+	}
+
+	// Unless the queue changed since.
+	y := played(test, q, p)
+	q.Previous(time.Second)
+	q.Move([]int{0}, 1)
+	q.Move([]int{1}, -1)
+	if l := q.List(); len(l) != 3 || l[0].Filename != y {
+		test.Fatalf("Expected %s at the front of the queue but it holds %v", y, l)
+	}
+	if f := played(test, q, p); f == y {
+		test.Fatalf("Expected a file that wasn't played yet after changing the queue, but %s was played", f)
+	}
+}
+
+func TestQueuePrevious(test *testing.T) {
+	p := newFakePlayer()
+	q := newQueue(p, p.events, make(chan Event, 1000))
+	q.Enqueue("a")
+	q.Enqueue("b")
+	q.Enqueue("c")
+	waitFor(test, q, p, "a", "b,c")
+
+	// Next skips, and Previous goes back, putting the current file back.
+	q.Next()
+	waitFor(test, q, p, "b", "c")
+	q.Previous(3 * time.Second)
+	waitFor(test, q, p, "a", "b,c")
+
+	// Past the restart time, or without a previous file, Previous restarts the current file.
+	p.setOffset(200)
+	q.Previous(time.Second)
+	waitFor(test, q, p, "a", "b,c")
+	q.Previous(time.Second)
+	waitFor(test, q, p, "a", "b,c")
+	if s := p.GetStatus(); s.Offset != 0 || p.seekCount() != 2 {
+		test.Fatalf("Expected the file to be restarted twice but the status is %+v after %d seeks", s, p.seekCount())
+	}
+
+	// Going back after the queue ran out plays the last file again.
+	played(test, q, p)
+	played(test, q, p)
+	p.Stop()
+	waitFor(test, q, p, "", "")
+	q.Previous(time.Second)
+	waitFor(test, q, p, "c", "")
+}
+
+func TestQueuePreviousRepeatAll(test *testing.T) {
+	p := newFakePlayer()
+	q := newQueue(p, p.events, make(chan Event, 1000))
+	q.SetRepeatAll(true)
+	q.Enqueue("a")
+	q.Enqueue("b")
+	q.Enqueue("c")
+	waitFor(test, q, p, "a", "b,c")
+
+	q.Next()
+	waitFor(test, q, p, "b", "c,a")
+
+	// Going back doesn't repeat the files twice.
+	q.Previous(time.Second)
+	waitFor(test, q, p, "a", "b,c")
+	q.Next()
+	waitFor(test, q, p, "b", "c,a")
+	q.Next()
+	waitFor(test, q, p, "c", "a,b")
+}
+
+func TestQueueHistory(test *testing.T) {
+	p := newFakePlayer()
+	q := newQueue(p, p.events, make(chan Event, 1000))
+	n := historySize + 10
+	for i := 0; i < n; i++ {
+		q.Enqueue(strconv.Itoa(i))
+	}
+	for i := 1; i < n; i++ {
+		if f := played(test, q, p); f != strconv.Itoa(i) {
+			test.Fatalf("Expected %d to be played but %s was", i, f)
+		}
+	}
+
+	// Only the last historySize files can be gone back to.
+	for i := 0; i <= historySize; i++ {
+		q.Previous(time.Second)
+	}
+	expected := make([]string, 0)
+	for i := n - historySize; i < n; i++ {
+		expected = append(expected, strconv.Itoa(i))
+	}
+	waitFor(test, q, p, strconv.Itoa(n-1-historySize), strings.Join(expected, ","))
+	if p.seekCount() != 1 {
+		test.Fatalf("Expected the first file to be restarted once but it was %d times", p.seekCount())
+	}
+}
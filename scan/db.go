@@ -2,14 +2,17 @@ package scan
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
 	"io"
-	"strconv"
+	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
-// Mp3Db abstracts a sqlite3 database containing mp3 metainformation.
+// Mp3Db abstracts a sqlite3 database containing mp3 metainformation. It implements Library.
 type Mp3Db struct {
 	DB *sql.DB
 
@@ -17,40 +20,60 @@ type Mp3Db struct {
 
 	stmtUpdateMp3 *sql.Stmt
 
-	stmtPathExists *sql.Stmt
-
 	stmtGetMp3sOrderAlbum *sql.Stmt
 
 	stmtCleaners []func()
+
+	// Is the full-text index available? See ensureFullText.
+	fullText bool
+
+	// Shared by copies of the Mp3Db, like its statements.
+	fuzzy *fuzzyIndex
 }
 
 func (m *Mp3Db) prepare() (err error) {
-	m.stmtAddMp3, err = m.DB.Prepare("insert into mp3(artist, album, title, tracknum, path) values(?,?,?,?,?)")
+	m.stmtAddMp3, err = m.DB.Prepare("insert into mp3(artist, album, title, tracknum, genre, lyrics, year, duration, bitrate, rate, channels, vbr, size, mtime, audio_hash, fingerprint, rating, library, path) values(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,max(?, 0),?,?)")
 	if err != nil {
 		return
 	}
 	m.stmtCleaners = append(m.stmtCleaners, func() { m.stmtAddMp3.Close() })
 
-	m.stmtUpdateMp3, err = m.DB.Prepare("update mp3 set artist = ?, album = ?, title = ?, tracknum = ? where path = ?")
+	m.stmtUpdateMp3, err = m.DB.Prepare("update mp3 set artist = ?, album = ?, title = ?, tracknum = ?, genre = ?, lyrics = ?, year = ?, duration = ?, bitrate = ?, rate = ?, channels = ?, vbr = ?, size = ?, mtime = ?, audio_hash = ?, fingerprint = ?, rating = coalesce(nullif(?, -1), rating) where library = ? and path = ?")
 	if err != nil {
 		return
 	}
 	m.stmtCleaners = append(m.stmtCleaners, func() { m.stmtUpdateMp3.Close() })
 
-	m.stmtPathExists, err = m.DB.Prepare("select count(*) from mp3 where path = ?")
-	if err != nil {
-		return
-	}
-	m.stmtCleaners = append(m.stmtCleaners, func() { m.stmtPathExists.Close() })
-
 	return
 }
 
 // Open an existing database and return the open Mp3Db struct. Expects db to be set to a valid, opened sql.DB.
+// If the database schema is out of date it is migrated to the latest version (see Migrate). If the
+// database has no schema at all ErrNoSchema is returned, rather than creating one.
 func OpenMp3Db(db *sql.DB) (r Mp3Db, err error) {
 	r = Mp3Db{
 		DB:           db,
 		stmtCleaners: make([]func(), 0),
+		fuzzy:        newFuzzyIndex(),
+	}
+
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return
+	}
+	if version == 0 {
+		err = ErrNoSchema
+		return
+	}
+
+	_, err = Migrate(db)
+	if err != nil {
+		return
+	}
+
+	r.fullText, err = ensureFullText(db)
+	if err != nil {
+		return
 	}
 
 	err = r.prepare()
@@ -61,6 +84,12 @@ func OpenMp3Db(db *sql.DB) (r Mp3Db, err error) {
 	return
 }
 
+// FullText returns true if the database has a full-text index, which is used to rank the results
+// of queries with free text. See Query.Text.
+func (m Mp3Db) FullText() bool {
+	return m.fullText
+}
+
 // Close the database.
 func (m Mp3Db) Close() {
 	for _, f := range m.stmtCleaners {
@@ -70,15 +99,30 @@ func (m Mp3Db) Close() {
 	m.DB.Close()
 }
 
-// Create the database schema and return the open Mp3Db struct. Expects db to be set to a valid, opened sql.DB.
+// Create the database schema and return the open Mp3Db struct. Expects db to be set to a valid, opened sql.DB
+// that is empty.
 func CreateMp3Db(db *sql.DB) (r Mp3Db, err error) {
 	r = Mp3Db{
 		DB:           db,
 		stmtCleaners: make([]func(), 0),
+		fuzzy:        newFuzzyIndex(),
+	}
+
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return
+	}
+	if version != 0 {
+		err = fmt.Errorf("The database already has a schema")
+		return
 	}
 
-	sql := `create table mp3(path text not null primary key, artist text, album text, title text, tracknum int);`
-	_, err = r.DB.Exec(sql)
+	_, err = Migrate(db)
+	if err != nil {
+		return
+	}
+
+	r.fullText, err = ensureFullText(db)
 	if err != nil {
 		return
 	}
@@ -88,77 +132,475 @@ func CreateMp3Db(db *sql.DB) (r Mp3Db, err error) {
 }
 
 type StringTransform func(string) string
-type ScanCallback func(m *Metadata, err error)
+
+// ScanCallback is called by ScanMp3sToDb once for each mp3 found. `sum` holds the counts for
+// the scan so far, including the mp3 `m`. If scanning the mp3 failed `err` is a *ScanError.
+// A ScanError with Phase PhaseDecode doesn't prevent the mp3 from being stored.
+//
+// The callback is also called with a *ScanError for each directory that can't be read; in
+// that case only m.Path is set.
+type ScanCallback func(m *Metadata, sum *Summary, err error)
+
+// Summary counts what a scan did with the mp3s it found.
+type Summary struct {
+	// Number of mp3s found to scan. This is known before any mp3s are scanned.
+	Found int
+	// Number of mp3s that were not in the database and were added
+	Added int
+	// Number of mp3s that had changed since the last scan and were updated
+	Updated int
+	// Number of mp3s whose size and modification time were the same as the last scan.
+	// The tags of these files are not read.
+	Unchanged int
+	// Number of mp3s, and of playlist files, that could not be stored
+	Errors int
+	// Number of directories that could not be read
+	ListErrors int
+	// Number of playlist files that were imported as new saved playlists or changed the playlist
+	// imported from them before
+	Playlists int
+	// If the scan pruned missing mp3s from the database, what was pruned.
+	Prune *PruneReport
+}
+
+// Total returns the number of mp3s that were scanned.
+func (s Summary) Total() int {
+	return s.Added + s.Updated + s.Unchanged + s.Errors
+}
+
+// Remaining estimates the time left to complete a scan that has been running for `elapsed`,
+// based on the rate at which mp3s have been scanned so far. If no estimate can be made yet -1 is returned.
+func (s Summary) Remaining(elapsed time.Duration) time.Duration {
+	done := s.Total()
+	if done == 0 || s.Found == 0 {
+		return -1
+	}
+	return time.Duration(float64(elapsed) * float64(s.Found-done) / float64(done))
+}
+
+// Add adds the counts in `o` to the counts in s.
+func (s *Summary) Add(o Summary) {
+	s.Found += o.Found
+	s.Added += o.Added
+	s.Updated += o.Updated
+	s.Unchanged += o.Unchanged
+	s.Errors += o.Errors
+	s.ListErrors += o.ListErrors
+	s.Playlists += o.Playlists
+}
+
+func (s Summary) String() string {
+	r := fmt.Sprintf("%d added, %d updated, %d unchanged, %d errors", s.Added, s.Updated, s.Unchanged, s.Errors)
+	if s.ListErrors > 0 {
+		r += fmt.Sprintf(", %d unreadable directories", s.ListErrors)
+	}
+	if s.Playlists > 0 {
+		r += fmt.Sprintf(", %d playlists imported", s.Playlists)
+	}
+	if s.Prune != nil {
+		r += "; pruning: " + s.Prune.String()
+	}
+	return r
+}
 
 // ScanMp3sToDb scans a directory tree for mp3 files and updates `db` with the new mp3 information found.
-// If `callback` is not nil, it is called each metadata.
-func ScanMp3sToDb(basedir string, db Mp3Db, pathTransform StringTransform, callback ScanCallback) (succCnt, errCnt int) {
-	c := make(chan Metadata)
+// Files whose size and modification time match those stored in the library are skipped.
+// If `callback` is not nil, it is called each metadata. The callback is always called from
+// the goroutine that called ScanMp3sToDb.
+//
+// The directory tree is listed before any files are scanned so that the number of mp3s to scan
+// is known (see Summary.Found). If `ctx` is done the scan stops early; the mp3s scanned so
+// far are kept but no pruning is done.
+func ScanMp3sToDb(ctx context.Context, basedir string, db Library, pathTransform StringTransform, callback ScanCallback) Summary {
+	return ScanMp3sToDbWithOptions(ctx, basedir, db, pathTransform, callback, nil)
+}
 
-	go ScanMp3s(basedir, c)
+// fileAttrs are the attributes of an mp3 file used to tell if it has changed since it was last scanned.
+type fileAttrs struct {
+	size, mtime int64
+}
 
-	doCallback := func(m *Metadata, err error) {
-		if callback != nil {
-			callback(m, err)
-		}
+// scanResult is the result of scanning one mp3 file.
+type scanResult struct {
+	m Metadata
+	// Is the mp3 already in the database?
+	exists bool
+	// Is the file unchanged since the last scan? If so only m.Path, m.Size and m.Mtime are set.
+	unchanged bool
+	// Set if the mp3 can't be stored
+	err *ScanError
+	// Set if the audio stream couldn't be decoded. The mp3 is still stored.
+	decodeErr *ScanError
+}
+
+// ScanMp3sToDbWithOptions is the same as ScanMp3sToDb, but scans using the specified options.
+// If opts is nil the defaults are used.
+func ScanMp3sToDbWithOptions(ctx context.Context, basedir string, db Library, pathTransform StringTransform, callback ScanCallback, opts *Options) (sum Summary) {
+	if opts == nil {
+		opts = &Options{}
 	}
 
-	for m := range c {
+	library, pathTransform := opts.target(pathTransform)
 
-		var cnt int
-		err := db.stmtPathExists.QueryRow(m.Path).Scan(&cnt)
+	// The errors of the scan, and the paths of the mp3s that were read without error.
+	errs := make([]*ScanError, 0)
+	ok := make([]string, 0)
 
+	doCallback := func(m *Metadata, err *ScanError) {
 		if err != nil {
-			doCallback(&m, fmt.Errorf("ScanMp3sToDb: querying for existence failed: %v", err))
-			errCnt++
-			continue
+			errs = append(errs, err)
 		}
+		if callback != nil {
+			if err != nil {
+				callback(m, &sum, err)
+			} else {
+				callback(m, &sum, nil)
+			}
+		}
+	}
 
-		tx, err := db.DB.Begin()
-		// Don't call the callback since we are not returning, and we want the callback called
-		// once per metadata.
-		if err != nil {
-			//doCallback(&m, fmt.Errorf("ScanMp3sToDb: creating transaction failed: %v", err))
-			errCnt++
-			continue
+	root := basedir
+	if pathTransform != nil {
+		root = pathTransform(root)
+	}
+
+	if opts.Root != nil {
+		if err := db.PutRoot(*opts.Root); err != nil {
+			sum.Errors++
+			doCallback(&Metadata{Path: basedir}, newScanError(basedir, PhaseStore, fmt.Errorf("storing the library root failed: %v", err)))
+			return
 		}
+	}
 
-		var stmt *sql.Stmt
-		if cnt == 0 {
-			// No rows with that path.
-			stmt = tx.Stmt(db.stmtAddMp3)
-		} else {
-			// Row exists.
-			stmt = tx.Stmt(db.stmtUpdateMp3)
+	known, err := loadFileAttrs(library, root, db)
+	if err != nil {
+		sum.Errors++
+		doCallback(&Metadata{Path: basedir}, newScanError(basedir, PhaseStore, fmt.Errorf("reading stored file attributes failed: %v", err)))
+		return
+	}
+
+	// The paths in the database of all mp3s found, and of those that weren't in the database before
+	seen := make(map[string]bool)
+	added := make(map[string]bool)
+
+	if opts.Prune {
+		defer func() {
+			// If the scan was cancelled not all the mp3s were seen.
+			if ctx.Err() == nil {
+				r := prune(basedir, db, library, pathTransform, seen, added, sum.ListErrors)
+				sum.Prune = &r
+			}
+		}()
+	}
+
+	defer func() {
+		complete := seen
+		if ctx.Err() != nil {
+			complete = nil
+		}
+		if err := db.StoreScanErrors(library, root, errs, ok, complete); err != nil {
+			doCallback(&Metadata{Path: basedir}, newScanError(basedir, PhaseStore, fmt.Errorf("storing scan errors failed: %v", err)))
 		}
+	}()
+
+	list, playlists, listErrs := listFiles(ctx, basedir, opts)
+	sum.Found = len(list)
 
+	for _, e := range listErrs {
 		if pathTransform != nil {
-			m.Path = pathTransform(m.Path)
+			e.Path = pathTransform(e.Path)
 		}
+		sum.ListErrors++
+		doCallback(&Metadata{Path: e.Path}, e)
+	}
 
-		_, err = stmt.Exec(m.Artist, m.Album, m.Title, m.Tracknum, m.Path)
+	paths := make(chan string)
+	go func() {
+		defer close(paths)
+		for _, p := range list {
+			select {
+			case paths <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Read the tags of changed files using a pool of workers.
+	results := make(chan scanResult)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				results <- scanFile(path, known, pathTransform, opts)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Write changed mp3s to the database in batches.
+	batch := make([]scanResult, 0, opts.batchSize())
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		writeErrs := writeBatch(db, library, batch)
+		for i := range batch {
+			r := &batch[i]
+			if writeErrs[i] != nil {
+				sum.Errors++
+				doCallback(&r.m, newScanError(r.m.Path, PhaseStore, writeErrs[i]))
+			} else {
+				if r.exists {
+					sum.Updated++
+				} else {
+					sum.Added++
+					added[r.m.Path] = true
+				}
+				if r.decodeErr == nil {
+					ok = append(ok, r.m.Path)
+				}
+				doCallback(&r.m, r.decodeErr)
+			}
+		}
+		batch = batch[:0]
+	}
+
+	for r := range results {
+		seen[r.m.Path] = true
+
+		if r.err != nil {
+			sum.Errors++
+			doCallback(&r.m, r.err)
+		} else if r.unchanged {
+			sum.Unchanged++
+			doCallback(&r.m, nil)
+		} else {
+			batch = append(batch, r)
+			if len(batch) >= opts.batchSize() {
+				flush()
+			}
+		}
+	}
+	flush()
+
+	if !opts.IgnorePlaylists && ctx.Err() == nil && len(playlists) > 0 {
+		imp, err := newPlaylistImport(db, basedir, root, library, pathTransform, opts)
 		if err != nil {
-			doCallback(&m, fmt.Errorf("ScanMp3sToDb: inserting or updating failed: %v\n", err))
-			errCnt++
-			continue
+			sum.Errors++
+			doCallback(&Metadata{Path: basedir}, newScanError(basedir, PhasePlaylist, fmt.Errorf("reading imported playlist files failed: %v", err)))
+			return
+		}
+		for _, p := range playlists {
+			stored, changed, err := imp.importFile(p)
+			if err != nil {
+				sum.Errors++
+				doCallback(&Metadata{Path: stored}, newScanError(stored, PhasePlaylist, err))
+				continue
+			}
+			ok = append(ok, stored)
+			seen[stored] = true
+			if changed {
+				sum.Playlists++
+			}
+		}
+	}
+
+	return
+}
+
+// loadFileAttrs returns the stored attributes of all the mp3s in the library root `library` under `dir`, keyed by path.
+func loadFileAttrs(library, dir string, db Library) (attrs map[string]fileAttrs, err error) {
+	tracks, err := db.TracksUnder(library, dir)
+	if err != nil {
+		return
+	}
+
+	attrs = make(map[string]fileAttrs, len(tracks))
+	for _, t := range tracks {
+		attrs[t.Path] = fileAttrs{size: t.Size, mtime: t.Mtime}
+	}
+	return
+}
+
+// underDir returns an sql condition and its arguments that selects the mp3s that are under the
+// directory `dir` (or are dir itself, if it is a file). If dir is empty all mp3s are selected.
+func underDir(dir string) (where string, args []interface{}) {
+	if dir == "" {
+		return "1", nil
+	}
+
+	// '0' is the character after '/', so the range covers all paths beginning with d.
+	d := strings.TrimRight(dir, "/") + "/"
+	end := d[:len(d)-1] + "0"
+
+	return "(path = ? or (path > ? and path < ?))", []interface{}{dir, d, end}
+}
+
+// scanFile checks if the mp3 `path` has changed since it was last stored in the database and if so reads its metadata.
+// `known` holds the stored attributes of the mp3s in the database.
+func scanFile(path string, known map[string]fileAttrs, pathTransform StringTransform, opts *Options) (r scanResult) {
+	dbPath := path
+	if pathTransform != nil {
+		dbPath = pathTransform(path)
+	}
+	r.m.Path = dbPath
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		r.err = newScanError(dbPath, PhaseStat, err)
+		return
+	}
+
+	var a fileAttrs
+	a, r.exists = known[dbPath]
+	if r.exists && !opts.Full && a.size == fi.Size() && a.mtime == fi.ModTime().Unix() {
+		r.unchanged = true
+		r.m.Size = a.size
+		r.m.Mtime = a.mtime
+		return
+	}
+
+	r.m, err = readMetadata(path, opts)
+	r.m.Path = dbPath
+	if err != nil {
+		r.decodeErr = err.(*ScanError)
+		r.decodeErr.Path = dbPath
+	}
+	return
+}
+
+// writeBatch adds or updates the mp3s in `batch` in the library root `library` in a single transaction. If that fails each
+// mp3 is written in its own transaction so that only the mp3s that can't be written fail.
+// The returned slice holds the error (or nil) for each mp3.
+func writeBatch(db Library, library string, batch []scanResult) []error {
+	errs := make([]error, len(batch))
+
+	tracks := make([]Track, len(batch))
+	for i := range batch {
+		tracks[i] = batch[i].m.track()
+		tracks[i].Library = library
+	}
+
+	err := db.PutTracks(tracks)
+	if err == nil {
+		return errs
+	}
+
+	if len(batch) == 1 {
+		errs[0] = err
+		return errs
+	}
+
+	for i := range tracks {
+		errs[i] = db.PutTracks(tracks[i : i+1])
+	}
+	return errs
+}
+
+// PutTracks adds the mp3s to the database in one transaction, replacing any with the same library root and path.
+// Play counts and favorites are kept, and so is the rating if the Rating of the new mp3 is -1.
+func (m Mp3Db) PutTracks(tracks []Track) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("creating transaction failed: %v", err)
+	}
+
+	add := tx.Stmt(m.stmtAddMp3)
+	update := tx.Stmt(m.stmtUpdateMp3)
+
+	for _, t := range tracks {
+		args := []interface{}{t.Artist, t.Album, t.Title, t.Tracknum, t.Genre, t.Lyrics, t.Year, t.Duration, t.BitRate, t.Rate, t.Channels, t.Vbr, t.Size, t.Mtime, t.AudioHash, t.Fingerprint, t.Rating, t.Library, t.Path}
+
+		var r sql.Result
+		r, err = update.Exec(args...)
+		if err == nil {
+			var n int64
+			if n, err = r.RowsAffected(); err == nil && n == 0 {
+				_, err = add.Exec(args...)
+			}
 		}
-		err = tx.Commit()
-		// Don't call the callback since we are not returning, and we want the callback called
-		// once per metadata.
 		if err != nil {
-			//	doCallback(&m, fmt.Errorf("ScanMp3sToDb: commit failed: %v", err))
-			errCnt++
+			tx.Rollback()
+			return fmt.Errorf("inserting or updating failed: %v", err)
 		}
+	}
 
-		succCnt++
-		if callback != nil {
-			doCallback(&m, nil)
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit failed: %v", err)
+	}
+	return nil
+}
+
+// TracksUnder returns the mp3s in the library root `library` whose path is `dir`, or is under the
+// directory dir, ordered by path. All the fields except Lyrics are set.
+func (m Mp3Db) TracksUnder(library, dir string) ([]Track, error) {
+	where, args := underDir(dir)
+	args = append([]interface{}{library}, args...)
+	stored := append(allFields[:len(allFields):len(allFields)], "fingerprint")
+	fields := make([]string, 0, len(stored))
+	for _, f := range stored {
+		if columns[f] == textColumn {
+			fields = append(fields, "coalesce("+f+", '')")
+		} else {
+			fields = append(fields, "coalesce("+f+", 0)")
 		}
 	}
 
+	rows, err := m.DB.Query("select "+makelist(fields, ", ")+" from mp3 where library = ? and "+where+" order by path", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tracks := make([]Track, 0)
+	for rows.Next() {
+		var t Track
+		ptrs := make([]interface{}, len(stored))
+		for i, f := range stored {
+			ptrs[i] = t.field(f)
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks, rows.Err()
+}
+
+// Roots returns the named library roots that have been scanned, ordered by name.
+func (m Mp3Db) Roots() (roots []Root, err error) {
+	rows, err := m.DB.Query("select name, path from library_roots order by name")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	roots = make([]Root, 0)
+	for rows.Next() {
+		var r Root
+		if err = rows.Scan(&r.Name, &r.Path); err != nil {
+			return
+		}
+		roots = append(roots, r)
+	}
+	err = rows.Err()
 	return
 }
 
+// PutRoot stores the library root `r`, replacing any with the same name.
+func (m Mp3Db) PutRoot(r Root) error {
+	_, err := m.DB.Exec("insert or replace into library_roots(name, path) values(?,?)", r.Name, r.Path)
+	return err
+}
+
 // Paging describes what page of data to return.
 type Paging struct {
 	// Number of items in a page
@@ -178,132 +620,54 @@ func makelist(a []string, sep string) string {
 	return buf.String()
 }
 
-// Escape the ticks (') in the string
-func escape(s string) string {
-	return strings.Replace(s, "'", "''", -1)
-}
-
-// Database fields that are textual and not numeric.
-var stringFields map[string]bool = map[string]bool{"artist": true, "album": true, "title": true, "path": true}
+// Database fields returned by FindMp3sInDb when no fields are requested. Lyrics and fingerprints are only returned when requested.
+var allFields []string = []string{"artist", "album", "title", "tracknum", "genre", "year", "library", "path", "duration", "bitrate", "rate", "channels", "vbr", "size", "mtime", "audio_hash", "plays", "skips", "last_played", "rating", "favorite"}
 
 // FindMp3sInDb passes mp3 metainformation to channel `ch` for all mp3s matching the specified criteria.
-// `fields` should be a list of field names to return; allowed fields are "artist", "album", "title", "tracknum", "path". If fields is nil, all fields are returned.
+// `fields` should be a list of field names to return; allowed fields are "artist", "album", "title", "tracknum", "genre",
+// "lyrics", "year", "library", "path", "duration", "bitrate", "rate", "channels", "vbr", "size", "mtime", "audio_hash", "fingerprint", "plays", "skips", "last_played", "rating" and "favorite".
+// If fields is nil, all fields except lyrics and fingerprint are returned.
 // `filt` should be a simple filter whos keys are fieldnames, and values are substrings of that field to match against. If filt is nil, no filter is applied.
-// `order` should be a list of field names to order ascending by, or nil for no ordering.
+// `order` should be a list of field names to order by, or nil for the default ordering. A field name prefixed with '-' orders descending.
 // `p` describes what page of data to return; PageSize rows are returned, starting at row Page*PageSize.
 // Results are written to `ch` as maps where the keys are fieldnames and values are field values.
-func FindMp3sInDb(db Mp3Db, fields []string, filt map[string]string, order []string, ch chan map[string]string, p *Paging, errWriter io.Writer) {
-	defer close(ch)
+// See FindMp3s for more flexible queries.
+func FindMp3sInDb(db Library, fields []string, filt map[string]string, order []string, ch chan map[string]string, p *Paging, errWriter io.Writer) {
+	q := &Query{Fields: fields, Paging: p}
 
-	var sql bytes.Buffer
-
-	if fields == nil || len(fields) == 0 {
-		fields = []string{"artist", "album", "title", "tracknum", "path"}
-	}
-
-	sql.WriteString("select distinct ")
-	sql.WriteString(makelist(fields, ", "))
-	sql.WriteString(" from mp3 ")
-
-	clauses := make([]string, 0)
-	var where bytes.Buffer
-	if filt != nil {
-		for k, v := range filt {
-			if len(v) > 0 {
-				where.WriteString("instr(lower(")
-				where.WriteString(k)
-				where.WriteString("),'")
-				where.WriteString(strings.ToLower(escape(v)))
-				// Initial substring match:
-				//where.WriteString("') = 1")
-				// Anywhere match:
-				where.WriteString("') > 0")
-				clauses = append(clauses, where.String())
-				where.Reset()
-			}
+	for k, v := range filt {
+		if len(v) > 0 {
+			q.Where = append(q.Where, Condition{Field: k, Match: Substring, Value: v})
 		}
 	}
 
-	if len(clauses) != 0 {
-		sql.WriteString("where ")
-		sql.WriteString(makelist(clauses, " and "))
+	for _, o := range order {
+		q.Order = append(q.Order, ParseSort(o))
 	}
 
-	if order == nil || len(order) == 0 {
-		order = []string{"artist", "album", "tracknum", "title", "path"}
-	}
+	FindMp3s(db, q, ch, errWriter)
+}
 
-	sql.WriteString(" order by ")
-	for i, _ := range order {
-		var buf bytes.Buffer
+// FindMp3s passes mp3 metainformation to channel `ch` for all mp3s matching the query `q`.
+// Results are written to `ch` as maps where the keys are fieldnames and values are field values.
+// If the results include the last matching mp3, a map with the key "eof" is written after them.
+// Errors are written to `errWriter` if it is not nil. It is a wrapper around Library.FindTracks.
+func FindMp3s(db Library, q *Query, ch chan map[string]string, errWriter io.Writer) {
+	defer close(ch)
 
-		// Only use the lower() function on string fields
-		if _, ok := stringFields[order[i]]; ok {
-			buf.WriteString("lower(")
-		}
-		buf.WriteString(order[i])
-		if _, ok := stringFields[order[i]]; ok {
-			buf.WriteString(")")
+	tracks, hasMore, err := db.FindTracks(q)
+	if err != nil {
+		if errWriter != nil {
+			fmt.Fprintln(errWriter, "scan.FindMp3s:", err)
 		}
-		order[i] = buf.String()
-	}
-	sql.WriteString(makelist(order, ", "))
-
-	if p != nil {
-		sql.WriteString(" limit ")
-		// Read one more row than the requested size.
-		// If we end up reading an actual PageSize+1 rows of data, then
-		// we know we are not at EOF, otherwise we are.
-		sql.WriteString(strconv.Itoa(p.PageSize + 1))
-		sql.WriteString(" offset ")
-		sql.WriteString(strconv.Itoa(p.Page * p.PageSize))
-	}
-
-	fmt.Println("Query: ", sql.String())
-
-	rows, err := db.DB.Query(sql.String())
-	if err != nil && errWriter != nil {
-		fmt.Fprintln(errWriter, "scan.FindMp3sInDb: query failed:", err)
 		return
 	}
-	defer rows.Close()
-
-	fieldVals := make([]string, len(fields))
-	fieldValPtrs := make([]interface{}, len(fields))
-	for i, _ := range fieldVals {
-		fieldValPtrs[i] = &fieldVals[i]
-	}
 
-	i := 0
-	eof := true
-	for rows.Next() {
-		i++
-		if i > p.PageSize {
-			// There is still more data after this page. We are not at eof.
-			eof = false
-			break
-		}
-
-		if err := rows.Scan(fieldValPtrs...); err != nil && errWriter != nil {
-			fmt.Fprintln(errWriter, "scan.FindMp3sInDb: db read failed:", err)
-		} else {
-			m := make(map[string]string)
-
-			for i, v := range fields {
-				m[v] = fieldVals[i]
-			}
-
-			ch <- m
-		}
+	for i := range tracks {
+		ch <- tracks[i].Map(q.Fields)
 	}
 
-	if eof {
+	if !hasMore {
 		ch <- map[string]string{"eof": "eof"}
 	}
-
-	if err := rows.Err(); err != nil && errWriter != nil {
-		fmt.Fprintln(errWriter, "scan.FindMp3sInDb: query error:", err)
-	}
-
-	return
 }
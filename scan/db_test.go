@@ -0,0 +1,408 @@
+package scan
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// createTestDb creates an empty in-memory mp3 database.
+func createTestDb(test testing.TB) Mp3Db {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		test.Fatal("Opening database failed: ", err)
+	}
+	// Each connection to :memory: is a separate database.
+	db.SetMaxOpenConns(1)
+
+	mp3db, err := CreateMp3Db(db)
+	if err != nil {
+		test.Fatal("Creating database failed: ", err)
+	}
+	return mp3db
+}
+
+// createTestTree creates a directory containing the named (empty) files.
+func createTestTree(test testing.TB, names ...string) string {
+	dir, err := ioutil.TempDir("", "wwwmp3-test")
+	if err != nil {
+		test.Fatal("Creating temp dir failed: ", err)
+	}
+
+	for _, n := range names {
+		p := filepath.Join(dir, n)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			test.Fatal("Creating directory failed: ", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(n), 0644); err != nil {
+			test.Fatal("Creating file failed: ", err)
+		}
+	}
+	return dir
+}
+
+func TestScanIncremental(test *testing.T) {
+	dir := createTestTree(test, "a/one.mp3", "a/two.mp3", "b/notes.txt")
+	defer os.RemoveAll(dir)
+
+	db := createTestDb(test)
+	defer db.Close()
+
+	sum := ScanMp3sToDb(context.Background(), dir, db, nil, nil)
+	if sum != (Summary{Found: 2, Added: 2}) {
+		test.Fatalf("First scan: unexpected summary %v", sum)
+	}
+
+	sum = ScanMp3sToDb(context.Background(), dir, db, nil, nil)
+	if sum != (Summary{Found: 2, Unchanged: 2}) {
+		test.Fatalf("Second scan: unexpected summary %v", sum)
+	}
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "a/two.mp3"), later, later); err != nil {
+		test.Fatal("Chtimes failed: ", err)
+	}
+
+	sum = ScanMp3sToDb(context.Background(), dir, db, nil, nil)
+	if sum != (Summary{Found: 2, Updated: 1, Unchanged: 1}) {
+		test.Fatalf("Third scan: unexpected summary %v", sum)
+	}
+
+	sum = ScanMp3sToDbWithOptions(context.Background(), dir, db, nil, nil, &Options{Full: true})
+	if sum != (Summary{Found: 2, Updated: 2}) {
+		test.Fatalf("Full scan: unexpected summary %v", sum)
+	}
+}
+
+func TestScanPrune(test *testing.T) {
+	dir := createTestTree(test, "a/one.mp3", "a/two.mp3", "a/three.mp3")
+	defer os.RemoveAll(dir)
+
+	db := createTestDb(test)
+	defer db.Close()
+
+	sum := ScanMp3sToDbWithOptions(context.Background(), dir, db, nil, nil, &Options{Prune: true})
+	if sum.Added != 3 || sum.Prune == nil || len(sum.Prune.Removed) != 0 {
+		test.Fatalf("First scan: unexpected summary %v", sum)
+	}
+
+	os.Remove(filepath.Join(dir, "a/one.mp3"))
+	os.MkdirAll(filepath.Join(dir, "b"), 0755)
+	os.Rename(filepath.Join(dir, "a/two.mp3"), filepath.Join(dir, "b/two.mp3"))
+
+	sum = ScanMp3sToDbWithOptions(context.Background(), dir, db, nil, nil, &Options{Prune: true})
+	if sum.Added != 1 || sum.Unchanged != 1 {
+		test.Fatalf("Second scan: unexpected summary %v", sum)
+	}
+
+	r := sum.Prune
+	if r.Err != nil || len(r.Removed) != 1 || r.Removed[0] != filepath.Join(dir, "a/one.mp3") {
+		test.Fatalf("Unexpected prune report %v %v", r, r.Removed)
+	}
+	if r.Moved[filepath.Join(dir, "a/two.mp3")] != filepath.Join(dir, "b/two.mp3") {
+		test.Fatalf("Move not detected: %v", r.Moved)
+	}
+
+	var cnt int
+	db.DB.QueryRow("select count(*) from mp3").Scan(&cnt)
+	if cnt != 2 {
+		test.Fatalf("Expected 2 mp3s in the database but there are %d", cnt)
+	}
+
+	// Pruning a directory that doesn't exist must not remove anything.
+	r2 := PruneMp3sInDb(filepath.Join(dir, "missing"), db, nil)
+	if r2.Err == nil {
+		test.Fatal("Expected an error pruning a missing directory")
+	}
+
+	// Nor must pruning when a directory couldn't be read.
+	seen := map[string]bool{filepath.Join(dir, "a/three.mp3"): true}
+	if r2 = prune(dir, db, "", nil, seen, nil, 1); r2.Err == nil || len(r2.Removed) != 0 {
+		test.Fatalf("Expected an error pruning with unreadable directories but got %v", r2)
+	}
+	if os.Geteuid() != 0 {
+		// Root can read the directory anyway.
+		os.Chmod(filepath.Join(dir, "b"), 0)
+		defer os.Chmod(filepath.Join(dir, "b"), 0755)
+		sum = ScanMp3sToDbWithOptions(context.Background(), dir, db, nil, nil, &Options{Prune: true})
+		if sum.ListErrors != 1 || sum.Prune == nil || sum.Prune.Err == nil {
+			test.Fatalf("Scan with an unreadable directory: unexpected summary %v", sum)
+		}
+	}
+	db.DB.QueryRow("select count(*) from mp3").Scan(&cnt)
+	if cnt != 2 {
+		test.Fatalf("Expected 2 mp3s in the database after pruning with an unreadable directory but there are %d", cnt)
+	}
+	os.Chmod(filepath.Join(dir, "b"), 0755)
+
+	// Mp3s whose size isn't known are recognized by their audio.
+	db.DB.Exec("update mp3 set size = 0")
+	os.Rename(filepath.Join(dir, "a/three.mp3"), filepath.Join(dir, "b/three.mp3"))
+	sum = ScanMp3sToDbWithOptions(context.Background(), dir, db, nil, nil, &Options{Prune: true})
+	if r = sum.Prune; r == nil || r.Err != nil || r.Moved[filepath.Join(dir, "a/three.mp3")] != filepath.Join(dir, "b/three.mp3") {
+		test.Fatalf("Move of an mp3 without a size not detected: %v", r)
+	}
+}
+
+func TestScanPruneCopies(test *testing.T) {
+	dir := createTestTree(test)
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"a", "b", "c"} {
+		os.MkdirAll(filepath.Join(dir, d), 0755)
+	}
+	for _, p := range []string{"a/song.mp3", "b/song.mp3"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, p), []byte("the same song"), 0644); err != nil {
+			test.Fatal("Creating file failed: ", err)
+		}
+	}
+
+	db := createTestDb(test)
+	defer db.Close()
+
+	sum := ScanMp3sToDbWithOptions(context.Background(), dir, db, nil, nil, &Options{Prune: true})
+	if sum.Added != 2 {
+		test.Fatalf("First scan: unexpected summary %v", sum)
+	}
+	a, b, c := filepath.Join(dir, "a/song.mp3"), filepath.Join(dir, "b/song.mp3"), filepath.Join(dir, "c/song.mp3")
+	if err := db.AddPlay(Play{Path: a, Started: 100, Ended: 200, Completion: 1}); err != nil {
+		test.Fatal("Adding play failed: ", err)
+	}
+
+	// Removing one of the copies doesn't move its plays to the other.
+	os.Remove(a)
+	sum = ScanMp3sToDbWithOptions(context.Background(), dir, db, nil, nil, &Options{Prune: true})
+	if r := sum.Prune; r == nil || r.Err != nil || len(r.Removed) != 1 || r.Removed[0] != a || len(r.Moved) != 0 {
+		test.Fatalf("Unexpected prune report removing a copy: %v", r)
+	}
+
+	// But moving it does.
+	if err := db.AddPlay(Play{Path: b, Started: 300, Ended: 400, Completion: 1}); err != nil {
+		test.Fatal("Adding play failed: ", err)
+	}
+	os.Rename(b, c)
+	sum = ScanMp3sToDbWithOptions(context.Background(), dir, db, nil, nil, &Options{Prune: true})
+	if r := sum.Prune; r == nil || r.Err != nil || len(r.Removed) != 0 || r.Moved[b] != c {
+		test.Fatalf("Unexpected prune report moving a copy: %v", r)
+	}
+	found, _, err := db.FindTracks(&Query{Fields: []string{"path", "plays"}})
+	if err != nil || len(found) != 1 || found[0].Path != c || found[0].Plays != 1 {
+		test.Fatalf("Unexpected mp3s %+v (%v)", found, err)
+	}
+}
+
+func TestScanRoots(test *testing.T) {
+	music := createTestTree(test, "a/one.mp3", "a/two.mp3")
+	defer os.RemoveAll(music)
+	books := createTestTree(test, "a/one.mp3")
+	defer os.RemoveAll(books)
+
+	db := createTestDb(test)
+	defer db.Close()
+
+	for _, r := range []struct {
+		root  Root
+		added int
+	}{{Root{"music", music}, 2}, {Root{"books", books}, 1}} {
+		sum := ScanMp3sToDbWithOptions(context.Background(), r.root.Path, db, nil, nil, &Options{Prune: true, Root: &r.root})
+		if sum.Added != r.added {
+			test.Fatalf("Scanning %s: unexpected summary %v", r.root.Name, sum)
+		}
+	}
+
+	roots, err := db.Roots()
+	if err != nil || len(roots) != 2 || roots[0] != (Root{"books", books}) || roots[1] != (Root{"music", music}) {
+		test.Fatalf("Unexpected roots %v (%v)", roots, err)
+	}
+
+	tracks, _, err := db.FindTracks(&Query{Fields: []string{"library", "path"}, Order: []Sort{{Field: "library"}, {Field: "path"}}})
+	if err != nil || len(tracks) != 3 {
+		test.Fatalf("Unexpected mp3s %v (%v)", tracks, err)
+	}
+	expected := []Track{{Library: "books", Path: "a/one.mp3"}, {Library: "music", Path: "a/one.mp3"}, {Library: "music", Path: "a/two.mp3"}}
+	for i := range expected {
+		if tracks[i] != expected[i] {
+			test.Fatalf("Expected %v but found %v", expected[i], tracks[i])
+		}
+	}
+
+	// Rescan part of a root, after moving it.
+	os.MkdirAll(filepath.Join(music, "b"), 0755)
+	os.Rename(filepath.Join(music, "a/two.mp3"), filepath.Join(music, "b/two.mp3"))
+
+	root := Root{"music", music}
+	sum := ScanMp3sToDbWithOptions(context.Background(), filepath.Join(music, "b"), db, nil, nil, &Options{Root: &root})
+	if sum.Added != 1 {
+		test.Fatalf("Scanning b: unexpected summary %v", sum)
+	}
+
+	// Without a scan of both directories the move isn't recognized.
+	r := PruneMp3sInDbWithOptions(music, db, nil, &Options{Root: &root})
+	if r.Err != nil || len(r.Removed) != 1 || r.Removed[0] != "a/two.mp3" || len(r.Moved) != 0 {
+		test.Fatalf("Unexpected prune report %v %v", r, r.Removed)
+	}
+	if titles := findTitles(test, db, &Query{Where: []Condition{{"library", Exact, "music"}}}); len(titles) != 2 {
+		test.Fatalf("Unexpected mp3s in music: %v", titles)
+	}
+
+	titles := findTitles(test, db, &Query{Where: []Condition{{"library", Exact, "books"}}})
+	if len(titles) != 1 || titles[0] != "one" {
+		test.Fatalf("Unexpected mp3s in books: %v", titles)
+	}
+}
+
+func TestScanBatches(test *testing.T) {
+	names := make([]string, 0)
+	for i := 0; i < 25; i++ {
+		names = append(names, fmt.Sprintf("d%d/%d.mp3", i%3, i))
+	}
+	dir := createTestTree(test, names...)
+	defer os.RemoveAll(dir)
+
+	db := createTestDb(test)
+	defer db.Close()
+
+	calls := 0
+	callback := func(m *Metadata, sum *Summary, err error) {
+		calls++
+		if sum.Total() != calls {
+			test.Fatalf("Summary total %d doesn't match the number of callbacks %d", sum.Total(), calls)
+		}
+	}
+
+	sum := ScanMp3sToDbWithOptions(context.Background(), dir, db, nil, callback, &Options{Workers: 4, BatchSize: 7})
+	if sum != (Summary{Found: 25, Added: 25}) || calls != 25 {
+		test.Fatalf("Unexpected summary %v after %d callbacks", sum, calls)
+	}
+
+	var cnt int
+	db.DB.QueryRow("select count(*) from mp3").Scan(&cnt)
+	if cnt != 25 {
+		test.Fatalf("Expected 25 mp3s in the database but there are %d", cnt)
+	}
+}
+
+// BenchmarkScanMp3sToDb measures the throughput of scanning a generated tree of files into
+// an empty database using different numbers of workers.
+func BenchmarkScanMp3sToDb(b *testing.B) {
+	const files = 2000
+
+	names := make([]string, files)
+	for i := range names {
+		names[i] = fmt.Sprintf("artist%d/album%d/%d.mp3", i%20, i%100, i)
+	}
+	dir := createTestTree(b, names...)
+	defer os.RemoveAll(dir)
+
+	counts := []int{1, 4}
+	if n := runtime.NumCPU(); n != 1 && n != 4 {
+		counts = append(counts, n)
+	}
+
+	for _, workers := range counts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			opts := &Options{Workers: workers}
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				db := createTestDb(b)
+				b.StartTimer()
+
+				sum := ScanMp3sToDbWithOptions(context.Background(), dir, db, nil, nil, opts)
+
+				b.StopTimer()
+				db.Close()
+				if sum.Added != files {
+					b.Fatalf("Unexpected summary %v", sum)
+				}
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(files*b.N)/b.Elapsed().Seconds(), "files/s")
+		})
+	}
+}
+
+func TestScanCancel(test *testing.T) {
+	dir := createTestTree(test, "a/one.mp3", "a/two.mp3", "a/three.mp3")
+	defer os.RemoveAll(dir)
+
+	db := createTestDb(test)
+	defer db.Close()
+
+	ScanMp3sToDb(context.Background(), dir, db, nil, nil)
+
+	// Cancel after the first mp3. Nothing may be pruned even though not all mp3s were seen.
+	ctx, cancel := context.WithCancel(context.Background())
+	callback := func(m *Metadata, sum *Summary, err error) {
+		cancel()
+	}
+
+	sum := ScanMp3sToDbWithOptions(ctx, dir, db, nil, callback, &Options{Workers: 1, Prune: true})
+	if sum.Found != 3 || sum.Total() >= 3 || sum.Prune != nil {
+		test.Fatalf("Unexpected summary for cancelled scan %v", sum)
+	}
+
+	var cnt int
+	db.DB.QueryRow("select count(*) from mp3").Scan(&cnt)
+	if cnt != 3 {
+		test.Fatalf("Expected 3 mp3s in the database but there are %d", cnt)
+	}
+}
+
+func TestScanErrors(test *testing.T) {
+	dir := createTestTree(test, "a/one.mp3", "a/bad.mp3", "a/two.mp3")
+	defer os.RemoveAll(dir)
+
+	db := createTestDb(test)
+	defer db.Close()
+
+	// Make storing one of the mp3s fail.
+	_, err := db.DB.Exec(`create trigger fail before insert on mp3 when new.path like '%bad.mp3'
+		begin select raise(abort, 'bad file'); end`)
+	if err != nil {
+		test.Fatal("Creating trigger failed: ", err)
+	}
+
+	// The test files aren't real mp3s, so depending on the decoder there may also be PhaseDecode errors.
+	storeErrors := func(errs []*ScanError) (r []*ScanError) {
+		for _, e := range errs {
+			if e.Phase != PhaseDecode {
+				r = append(r, e)
+			}
+		}
+		return
+	}
+
+	var report ScanReport
+	sum := ScanMp3sToDb(context.Background(), dir, db, nil, report.Callback(nil))
+	if sum.Added != 2 || sum.Errors != 1 {
+		test.Fatalf("Unexpected summary %v", sum)
+	}
+
+	bad := filepath.Join(dir, "a/bad.mp3")
+	if e := storeErrors(report.Errors); len(e) != 1 || e[0].Path != bad || e[0].Phase != PhaseStore {
+		test.Fatalf("Unexpected report %v: %v", report, report.Errors)
+	}
+
+	errs, err := db.ScanErrors()
+	if e := storeErrors(errs); err != nil || len(e) != 1 || e[0].Path != bad || e[0].Phase != PhaseStore {
+		test.Fatalf("Unexpected stored errors %v (%v)", errs, err)
+	}
+
+	// Once the file can be stored its error is removed.
+	db.DB.Exec("drop trigger fail")
+	sum = ScanMp3sToDb(context.Background(), dir, db, nil, nil)
+	if sum.Added != 1 || sum.Errors != 0 {
+		test.Fatalf("Unexpected summary for second scan %v", sum)
+	}
+
+	errs, err = db.ScanErrors()
+	if err != nil || len(storeErrors(errs)) != 0 {
+		test.Fatalf("Expected no stored errors but got %v (%v)", errs, err)
+	}
+}
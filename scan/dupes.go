@@ -0,0 +1,390 @@
+package scan
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/jeffwilliams/wwwmp3/play"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+)
+
+// Duplicates are found in two ways. The audio hash is a hash of an mp3 file without its tags, so
+// mp3s with the same audio hash are copies of the same rip whose tags may differ. The fingerprint
+// describes how the loudness of the audio changes over time, so it is similar for different rips
+// (or encodings at different bitrates) of the same recording. Computing it requires decoding the
+// whole mp3, so it is only done if Options.Fingerprint is set.
+
+// audioHash returns the hex encoded SHA-1 hash of the mp3 file `path`, excluding any ID3v2 tags at
+// the start of the file and any APEv2 and ID3v1 tags at its end.
+func audioHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	start, end, err := audioRange(f, fi.Size())
+	if err != nil {
+		return "", err
+	}
+
+	h := sha1.New()
+	if _, err = io.Copy(h, io.NewSectionReader(f, start, end-start)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// audioRange returns the offsets of the start and end of the audio data in the mp3 file `f` of
+// `size` bytes, skipping the tags.
+func audioRange(f io.ReaderAt, size int64) (start, end int64, err error) {
+	end = size
+	buf := make([]byte, 32)
+
+	// ID3v2 tags. A file may have more than one.
+	for start+10 <= end {
+		if _, err = f.ReadAt(buf[:10], start); err != nil {
+			return
+		}
+		if string(buf[:3]) != "ID3" {
+			break
+		}
+		n := int64(buf[6])<<21 | int64(buf[7])<<14 | int64(buf[8])<<7 | int64(buf[9])
+		start += 10 + n
+		if buf[5]&0x10 != 0 {
+			// Footer
+			start += 10
+		}
+	}
+
+	// ID3v1 tag
+	if end-128 >= start {
+		if _, err = f.ReadAt(buf[:3], end-128); err != nil {
+			return
+		}
+		if string(buf[:3]) == "TAG" {
+			end -= 128
+		}
+	}
+
+	// APEv2 tag. The size in its footer includes the footer but not the header.
+	if end-32 >= start {
+		if _, err = f.ReadAt(buf, end-32); err != nil {
+			return
+		}
+		if string(buf[:8]) == "APETAGEX" {
+			n := int64(binary.LittleEndian.Uint32(buf[12:]))
+			if binary.LittleEndian.Uint32(buf[20:])&(1<<31) != 0 {
+				// Header
+				n += 32
+			}
+			if end-n >= start {
+				end -= n
+			}
+		}
+	}
+
+	if start > end {
+		start = end
+	}
+	return
+}
+
+const (
+	// Number of fingerprint frames per second
+	fingerprintRate = 8
+	// Frames quieter than this (mean square of 16 bit samples) at the start of an mp3 are silence,
+	// and are skipped so that rips with different lengths of leading silence line up.
+	silenceEnergy = 100.0
+	// The greatest number of frames the fingerprints of two mp3s are shifted by to line them up
+	maxShift = 2
+)
+
+// fingerprinter computes the fingerprint of decoded audio. The audio is divided into frames of
+// 1/fingerprintRate seconds, and each bit of the fingerprint is set if a frame is louder than
+// the frame before it.
+type fingerprinter struct {
+	// The energy of the frame being read so far, and the number of samples it covers
+	energy float64
+	n      int
+	// The energy of the previous frame, or -1 if still in the leading silence
+	prev float64
+	bits []byte
+	// Number of bits in the fingerprint
+	nbits int
+}
+
+func newFingerprinter() *fingerprinter {
+	return &fingerprinter{prev: -1}
+}
+
+// add adds decoded samples to the fingerprint.
+func (f *fingerprinter) add(samples []int16, rate, channels int) {
+	if channels < 1 {
+		channels = 1
+	}
+	frame := rate / fingerprintRate
+	if frame < 1 {
+		frame = 1
+	}
+
+	for i := 0; i+channels <= len(samples); i += channels {
+		// Mix the channels down to mono
+		var s float64
+		for c := 0; c < channels; c++ {
+			s += float64(samples[i+c])
+		}
+		s /= float64(channels)
+
+		f.energy += s * s
+		f.n++
+		if f.n == frame {
+			f.endFrame()
+		}
+	}
+}
+
+func (f *fingerprinter) endFrame() {
+	e := f.energy / float64(f.n)
+	f.energy, f.n = 0, 0
+
+	if f.prev < 0 {
+		if e >= silenceEnergy {
+			f.prev = e
+		}
+		return
+	}
+
+	if f.nbits%8 == 0 {
+		f.bits = append(f.bits, 0)
+	}
+	if e > f.prev {
+		f.bits[f.nbits/8] |= 1 << uint(f.nbits%8)
+	}
+	f.nbits++
+	f.prev = e
+}
+
+// String returns the fingerprint, hex encoded. A partial frame at the end is ignored.
+func (f *fingerprinter) String() string {
+	return hex.EncodeToString(f.bits)
+}
+
+// fingerprint decodes the mp3 file `path` and returns its hex encoded fingerprint.
+func fingerprint(path string) (string, error) {
+	f := newFingerprinter()
+	err := play.DecodeSamples(path, func(samples []int16, rate, channels int) bool {
+		f.add(samples, rate, channels)
+		return true
+	})
+	return f.String(), err
+}
+
+// fingerprintWords returns the hex encoded fingerprint `fp` as 64 bit words, shifted by each number
+// of frames from -maxShift to maxShift. It returns nil if the fingerprint can't be decoded.
+func fingerprintWords(fp string) [][]uint64 {
+	b, err := hex.DecodeString(fp)
+	if err != nil || len(b) == 0 {
+		return nil
+	}
+
+	shifts := make([][]uint64, 0, 2*maxShift+1)
+	for s := -maxShift; s <= maxShift; s++ {
+		nbits := len(b)*8 - s
+		w := make([]uint64, (nbits+63)/64)
+		for i := 0; i < nbits; i++ {
+			// Bit i of the shifted fingerprint is bit i+s of the fingerprint.
+			j := i + s
+			if j >= 0 && j < len(b)*8 && b[j/8]&(1<<uint(j%8)) != 0 {
+				w[i/64] |= 1 << uint(i%64)
+			}
+		}
+		shifts = append(shifts, w)
+	}
+	return shifts
+}
+
+// similarity returns the fraction of the bits of the fingerprints `a` and `b` (as returned by
+// fingerprintWords) that are the same, for the shift that lines them up best. Only the part of
+// the fingerprints that overlaps is compared.
+func similarity(a, b [][]uint64) float64 {
+	if a == nil || b == nil {
+		return 0
+	}
+
+	unshifted := b[maxShift]
+	best := 0.0
+	for _, w := range a {
+		n := len(w)
+		if len(unshifted) < n {
+			n = len(unshifted)
+		}
+		if n == 0 {
+			continue
+		}
+
+		diff := 0
+		for i := 0; i < n; i++ {
+			diff += bits.OnesCount64(w[i] ^ unshifted[i])
+		}
+		if s := 1 - float64(diff)/float64(n*64); s > best {
+			best = s
+		}
+	}
+	return best
+}
+
+// DuplicateGroup is a set of mp3s that are copies of each other, or that sound the same.
+type DuplicateGroup struct {
+	// True if all the mp3s have the same audio data; only their tags differ.
+	Exact bool
+	// The lowest similarity of the fingerprints of two mp3s that put them in the group, from 0
+	// to 1. It is 1 if all the mp3s were grouped by their audio hash.
+	Similarity float64
+	// The mp3s, ordered by library and path. Lyrics may not be set.
+	Tracks []Track
+}
+
+// DefaultSimilarity is the similarity of fingerprints above which mp3s are considered to sound the same.
+const DefaultSimilarity = 0.85
+
+// FindDuplicates returns the groups of mp3s in `lib` that have the same audio hash, or whose
+// fingerprints are at least `minSimilarity` similar. If minSimilarity is 0 DefaultSimilarity is
+// used. Only mp3s whose durations differ by less than 2% are compared by fingerprint.
+// The groups are ordered by the library and path of their first mp3.
+func FindDuplicates(lib Library, minSimilarity float64) ([]DuplicateGroup, error) {
+	if minSimilarity <= 0 {
+		minSimilarity = DefaultSimilarity
+	}
+
+	roots, err := lib.Roots()
+	if err != nil {
+		return nil, err
+	}
+
+	tracks := make([]Track, 0)
+	for _, library := range append([]string{""}, rootNames(roots)...) {
+		t, err := lib.TracksUnder(library, "")
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, t...)
+	}
+
+	// Union-find over the indexes of tracks
+	parent := make([]int, len(tracks))
+	sim := make([]float64, len(tracks))
+	for i := range parent {
+		parent[i] = i
+		sim[i] = 1
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	union := func(i, j int, s float64) {
+		ri, rj := find(i), find(j)
+		if ri != rj {
+			parent[rj] = ri
+			sim[ri] = math.Min(sim[ri], sim[rj])
+		}
+		sim[ri] = math.Min(sim[ri], s)
+	}
+
+	byHash := make(map[string]int)
+	for i := range tracks {
+		if h := tracks[i].AudioHash; len(h) > 0 {
+			if j, ok := byHash[h]; ok {
+				union(j, i, 1)
+			} else {
+				byHash[h] = i
+			}
+		}
+	}
+
+	// Compare the fingerprints of mp3s of about the same duration.
+	order := make([]int, 0, len(tracks))
+	words := make([][][]uint64, len(tracks))
+	for i := range tracks {
+		if words[i] = fingerprintWords(tracks[i].Fingerprint); words[i] != nil {
+			order = append(order, i)
+		}
+	}
+	sort.Slice(order, func(a, b int) bool { return tracks[order[a]].Duration < tracks[order[b]].Duration })
+
+	for a, i := range order {
+		for _, j := range order[a+1:] {
+			if tracks[j].Duration > tracks[i].Duration*1.02 {
+				break
+			}
+			if find(i) == find(j) {
+				continue
+			}
+			if s := similarity(words[i], words[j]); s >= minSimilarity {
+				union(i, j, s)
+			}
+		}
+	}
+
+	members := make(map[int][]int)
+	for i := range tracks {
+		r := find(i)
+		members[r] = append(members[r], i)
+	}
+
+	groups := make([]DuplicateGroup, 0)
+	for r, m := range members {
+		if len(m) < 2 {
+			continue
+		}
+		g := DuplicateGroup{Exact: true, Similarity: sim[r]}
+		for _, i := range m {
+			g.Exact = g.Exact && len(tracks[i].AudioHash) > 0 && tracks[i].AudioHash == tracks[m[0]].AudioHash
+			g.Tracks = append(g.Tracks, tracks[i])
+		}
+		if g.Exact {
+			g.Similarity = 1
+		}
+		sort.Slice(g.Tracks, func(a, b int) bool { return trackLess(&g.Tracks[a], &g.Tracks[b]) })
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(a, b int) bool { return trackLess(&groups[a].Tracks[0], &groups[b].Tracks[0]) })
+
+	return groups, nil
+}
+
+// trackLess orders mp3s by library and path.
+func trackLess(a, b *Track) bool {
+	if a.Library != b.Library {
+		return a.Library < b.Library
+	}
+	return a.Path < b.Path
+}
+
+func rootNames(roots []Root) []string {
+	names := make([]string, len(roots))
+	for i, r := range roots {
+		names[i] = r.Name
+	}
+	return names
+}
+
+func (g DuplicateGroup) String() string {
+	if g.Exact {
+		return fmt.Sprintf("%d identical mp3s", len(g.Tracks))
+	}
+	return fmt.Sprintf("%d similar mp3s (%.0f%% similar)", len(g.Tracks), g.Similarity*100)
+}
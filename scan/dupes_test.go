@@ -0,0 +1,144 @@
+package scan
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAudioHash(test *testing.T) {
+	dir, err := os.MkdirTemp("", "dupes")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	audio := []byte("\xff\xfbaudio frames")
+	id3v2 := func(size int) []byte {
+		t := append([]byte("ID3\x03\x00\x00\x00\x00\x00"), byte(size))
+		return append(t, make([]byte, size)...)
+	}
+	id3v1 := append([]byte("TAG"), make([]byte, 125)...)
+	ape := append([]byte("APETAGEX\xd0\x07\x00\x00\x28\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), make([]byte, 8)...)
+	ape = append(make([]byte, 8), ape...)
+
+	files := map[string][]byte{
+		"plain.mp3":  audio,
+		"tagged.mp3": append(append(id3v2(20), audio...), id3v1...),
+		"twice.mp3":  append(append(id3v2(5), id3v2(3)...), audio...),
+		"ape.mp3":    append(append([]byte{}, audio...), append(ape, id3v1...)...),
+		"other.mp3":  append(id3v2(20), []byte("\xff\xfbother frames")...),
+	}
+
+	hashes := make(map[string]string)
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			test.Fatal(err)
+		}
+		if hashes[name], err = audioHash(p); err != nil {
+			test.Fatalf("Hashing %s failed: %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"tagged.mp3", "twice.mp3", "ape.mp3"} {
+		if hashes[name] != hashes["plain.mp3"] {
+			test.Errorf("Expected %s to have the same audio hash as plain.mp3", name)
+		}
+	}
+	if hashes["other.mp3"] == hashes["plain.mp3"] {
+		test.Error("Expected other.mp3 to have a different audio hash")
+	}
+}
+
+// testAudio returns `seconds` of audio whose loudness changes randomly, as determined by `seed`,
+// at the sampling rate `rate`, with `channels` channels, and with noise of amplitude `noise` added.
+func testAudio(seed int64, seconds, rate, channels int, noise float64) []int16 {
+	envelope := rand.New(rand.NewSource(seed))
+	r := rand.New(rand.NewSource(seed + 1))
+
+	samples := make([]int16, 0, seconds*rate*channels)
+	// Change the loudness every 1/20th of a second
+	amp := 0.0
+	for i := 0; i < seconds*rate; i++ {
+		if i%(rate/20) == 0 {
+			amp = 1000 + envelope.Float64()*10000
+		}
+		v := amp*math.Sin(float64(i)*440*2*math.Pi/float64(rate)) + (r.Float64()*2-1)*noise
+		for c := 0; c < channels; c++ {
+			samples = append(samples, int16(v))
+		}
+	}
+	return samples
+}
+
+func testFingerprint(samples []int16, rate, channels int) [][]uint64 {
+	f := newFingerprinter()
+	// Leading silence
+	f.add(make([]int16, rate*channels/3), rate, channels)
+	for len(samples) > 0 {
+		n := 1152 * channels
+		if n > len(samples) {
+			n = len(samples)
+		}
+		f.add(samples[:n], rate, channels)
+		samples = samples[n:]
+	}
+	return fingerprintWords(f.String())
+}
+
+func TestFingerprint(test *testing.T) {
+	a := testFingerprint(testAudio(1, 60, 44100, 2, 0), 44100, 2)
+	if len(a) != 2*maxShift+1 || len(a[maxShift]) != (60*fingerprintRate+63)/64 {
+		test.Fatalf("Unexpected fingerprint size %d", len(a[maxShift]))
+	}
+
+	// The same recording, but mono at a different rate, and noisier, as from a lower bitrate encoding.
+	b := testFingerprint(testAudio(1, 60, 22050, 1, 300), 22050, 1)
+	if s := similarity(a, b); s < DefaultSimilarity {
+		test.Errorf("Expected the fingerprints of the same recording to be similar, but the similarity is %v", s)
+	}
+
+	c := testFingerprint(testAudio(2, 60, 44100, 2, 0), 44100, 2)
+	if s := similarity(a, c); s >= DefaultSimilarity {
+		test.Errorf("Expected the fingerprints of different recordings to differ, but the similarity is %v", s)
+	}
+}
+
+func TestFindDuplicates(test *testing.T) {
+	fp := func(seed int64) string {
+		f := newFingerprinter()
+		f.add(testAudio(seed, 30, 8000, 1, 0), 8000, 1)
+		return f.String()
+	}
+
+	lib := NewMemLibrary()
+	lib.PutRoot(Root{"music", "/music"})
+	lib.PutTracks([]Track{
+		{Path: "/old/a.mp3", Duration: 30, AudioHash: "aa", Fingerprint: fp(1)},
+		{Library: "music", Path: "a.mp3", Duration: 30, AudioHash: "aa"},
+		{Library: "music", Path: "a 128k.mp3", Duration: 30.2, AudioHash: "ab", Fingerprint: fp(1)},
+		{Library: "music", Path: "b.mp3", Duration: 30, AudioHash: "bb", Fingerprint: fp(2)},
+		{Library: "music", Path: "c.mp3", Duration: 60, AudioHash: "cc", Fingerprint: fp(1)},
+		{Library: "music", Path: "d.mp3", Duration: 60, AudioHash: "dd"},
+		{Library: "music", Path: "d copy.mp3", Duration: 60, AudioHash: "dd"},
+	})
+
+	groups, err := FindDuplicates(lib, 0)
+	if err != nil || len(groups) != 2 {
+		test.Fatalf("Unexpected duplicates %v (%v)", groups, err)
+	}
+
+	g := groups[0]
+	if g.Exact || g.Similarity < DefaultSimilarity || len(g.Tracks) != 3 ||
+		g.Tracks[0].Path != "/old/a.mp3" || g.Tracks[1].Path != "a 128k.mp3" || g.Tracks[2].Path != "a.mp3" {
+		test.Fatalf("Unexpected first group %v: %v", g, g.Tracks)
+	}
+
+	g = groups[1]
+	if !g.Exact || g.Similarity != 1 || len(g.Tracks) != 2 || g.Tracks[0].Path != "d copy.mp3" {
+		test.Fatalf("Unexpected second group %v: %v", g, g.Tracks)
+	}
+}
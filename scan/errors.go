@@ -0,0 +1,167 @@
+package scan
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Phase identifies the step of scanning in which an error occurred.
+type Phase string
+
+const (
+	// Reading a directory
+	PhaseList Phase = "list"
+	// Getting the size and modification time of a file
+	PhaseStat Phase = "stat"
+	// Decoding the audio stream of a file to find its properties, like the duration. The tags
+	// may still have been read, so unlike the other phases the mp3 is still stored in the database.
+	PhaseDecode Phase = "decode"
+	// Reading from or writing to the database
+	PhaseStore Phase = "store"
+	// Reading a playlist file to import it as a saved playlist
+	PhasePlaylist Phase = "playlist"
+)
+
+// ScanError describes a failure to scan a file or directory.
+type ScanError struct {
+	// Name of the library root the file or directory is under, if it was scanned under a named root.
+	// This is only set for errors returned by Library.ScanErrors.
+	Library string
+	// Path of the file or directory. For mp3s this is the path as stored in the database.
+	Path  string
+	Phase Phase
+	// The underlying error
+	Err error
+	// When the error occurred, in seconds since the Unix epoch
+	Time int64
+}
+
+func newScanError(path string, phase Phase, err error) *ScanError {
+	return &ScanError{Path: path, Phase: phase, Err: err, Time: time.Now().Unix()}
+}
+
+func (e *ScanError) Error() string {
+	return string(e.Phase) + " " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *ScanError) Unwrap() error {
+	return e.Err
+}
+
+// ScanReport collects the errors that occur during scans.
+type ScanReport struct {
+	Errors []*ScanError
+}
+
+// Callback returns a ScanCallback that records errors in the report and then calls `next`, if it is not nil.
+func (r *ScanReport) Callback(next ScanCallback) ScanCallback {
+	return func(m *Metadata, sum *Summary, err error) {
+		var e *ScanError
+		if errors.As(err, &e) {
+			r.Errors = append(r.Errors, e)
+		} else if err != nil {
+			r.Errors = append(r.Errors, newScanError(m.Path, PhaseStore, err))
+		}
+		if next != nil {
+			next(m, sum, err)
+		}
+	}
+}
+
+// String returns the number of errors in each phase.
+func (r ScanReport) String() string {
+	counts := make(map[Phase]int)
+	for _, e := range r.Errors {
+		counts[e.Phase]++
+	}
+
+	phases := make([]string, 0, len(counts))
+	for p, n := range counts {
+		phases = append(phases, fmt.Sprintf("%d %s", n, p))
+	}
+	sort.Strings(phases)
+
+	s := fmt.Sprintf("%d errors", len(r.Errors))
+	if len(phases) > 0 {
+		s += " (" + strings.Join(phases, ", ") + ")"
+	}
+	return s
+}
+
+// StoreScanErrors updates the stored errors for the paths in the library root `library` under `dir`
+// after a scan. `errs` are the errors of the scan and `ok` are the paths that were read without error;
+// their old errors are removed. Files that were unchanged since the last scan weren't read, so their
+// old errors are kept. If the scan was complete `seen` holds the paths of all mp3s found, and errors
+// for other paths are removed too.
+func (m Mp3Db) StoreScanErrors(library, dir string, errs []*ScanError, ok []string, seen map[string]bool) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	if seen != nil {
+		where, args := underDir(dir)
+		var rows *sql.Rows
+		rows, err = tx.Query("select path from scan_errors where library = ? and "+where, append([]interface{}{library}, args...)...)
+		if err == nil {
+			for rows.Next() {
+				var p string
+				if err = rows.Scan(&p); err != nil {
+					break
+				}
+				if !seen[p] {
+					ok = append(ok, p)
+				}
+			}
+			rows.Close()
+		}
+	}
+
+	for _, p := range ok {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec("delete from scan_errors where library = ? and path = ?", library, p)
+	}
+
+	for _, e := range errs {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec("insert or replace into scan_errors(library, path, phase, message, time) values(?,?,?,?,?)",
+			library, e.Path, string(e.Phase), e.Err.Error(), e.Time)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// ScanErrors returns the errors stored by the most recent scans, ordered by library and path.
+func (m Mp3Db) ScanErrors() (errs []*ScanError, err error) {
+	rows, err := m.DB.Query("select library, path, phase, message, time from scan_errors order by library, path")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	errs = make([]*ScanError, 0)
+	for rows.Next() {
+		var e ScanError
+		var phase, msg string
+		if err = rows.Scan(&e.Library, &e.Path, &phase, &msg, &e.Time); err != nil {
+			return
+		}
+		e.Phase = Phase(phase)
+		e.Err = errors.New(msg)
+		errs = append(errs, &e)
+	}
+	err = rows.Err()
+	return
+}
@@ -0,0 +1,192 @@
+package scan
+
+import (
+	"bytes"
+	"database/sql"
+	"strings"
+)
+
+// The full-text index of the mp3 table is an FTS5 table. go-sqlite3 only includes FTS5 when built with
+// the sqlite_fts5 build tag; without it free-text searches fall back to matching each word as a
+// substring of the text fields, without ranking or diacritic folding.
+//
+// The index is an external content table, so the text is stored only in the mp3 table. It is kept up
+// to date by triggers on the mp3 table, and refers to mp3s by their id, which unlike an implicit rowid
+// isn't renumbered by VACUUM. The index isn't part of the versioned schema (see Migrate)
+// since whether it can exist depends on how the program was built.
+
+// textFields are the fields searched by Query.Text, with the bm25 weight of each in the ranking.
+var textFields = []struct {
+	name   string
+	weight string
+}{
+	{"artist", "10.0"},
+	{"album", "5.0"},
+	{"title", "10.0"},
+	{"genre", "2.0"},
+	{"path", "1.0"},
+	{"lyrics", "1.0"},
+}
+
+// fullTextTriggers are the names of the triggers that keep mp3_fts in sync with the mp3 table.
+var fullTextTriggers = []string{"mp3_fts_insert", "mp3_fts_delete", "mp3_fts_update_text"}
+
+// oldFullTextTriggers are the names of triggers replaced by fullTextTriggers. mp3_fts_update ran on
+// every update of the mp3 table, including counting plays, and reindexed the text of the mp3 each time.
+var oldFullTextTriggers = []string{"mp3_fts_update"}
+
+// fullTextAvailable returns true if the sqlite library includes FTS5.
+func fullTextAvailable(db *sql.DB) (bool, error) {
+	var used bool
+	err := db.QueryRow("select sqlite_compileoption_used('ENABLE_FTS5')").Scan(&used)
+	return used, err
+}
+
+// ensureFullText creates the full-text index of the mp3 table if FTS5 is available, and returns
+// whether it is. If the index was created, or wasn't being kept up to date, it is rebuilt.
+//
+// If FTS5 isn't available the triggers that update the index are removed, since they would make
+// changes to the mp3 table fail. The index is rebuilt when the database is next opened with FTS5.
+func ensureFullText(db *sql.DB) (available bool, err error) {
+	available, err = fullTextAvailable(db)
+	if err != nil {
+		return
+	}
+
+	if !available {
+		for _, t := range append(fullTextTriggers, oldFullTextTriggers...) {
+			if _, err = db.Exec("drop trigger if exists " + t); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	var n int
+	err = db.QueryRow("select count(*) from sqlite_master where type = 'trigger' and name in (?,?,?)",
+		fullTextTriggers[0], fullTextTriggers[1], fullTextTriggers[2]).Scan(&n)
+	if err != nil || n == len(fullTextTriggers) {
+		return
+	}
+
+	names := make([]string, len(textFields))
+	for i, f := range textFields {
+		names[i] = f.name
+	}
+	cols := makelist(names, ", ")
+	newCols := "new." + makelist(names, ", new.")
+	oldCols := "old." + makelist(names, ", old.")
+
+	stmts := []string{
+		// The index is rebuilt anyway, and recreating it replaces one keyed on the rowid of the mp3
+		// table from before mp3s had an id (see migration 17).
+		`drop table if exists mp3_fts`,
+		`create virtual table mp3_fts using fts5(` + cols + `, content='mp3', content_rowid='id',
+			tokenize='unicode61 remove_diacritics 2', prefix='2 3')`,
+		`drop trigger if exists mp3_fts_insert`,
+		`drop trigger if exists mp3_fts_delete`,
+		`drop trigger if exists mp3_fts_update`,
+		`drop trigger if exists mp3_fts_update_text`,
+		`create trigger mp3_fts_insert after insert on mp3 begin
+			insert into mp3_fts(rowid, ` + cols + `) values(new.id, ` + newCols + `);
+		end`,
+		`create trigger mp3_fts_delete after delete on mp3 begin
+			insert into mp3_fts(mp3_fts, rowid, ` + cols + `) values('delete', old.id, ` + oldCols + `);
+		end`,
+		`create trigger mp3_fts_update_text after update of ` + cols + ` on mp3 begin
+			insert into mp3_fts(mp3_fts, rowid, ` + cols + `) values('delete', old.id, ` + oldCols + `);
+			insert into mp3_fts(rowid, ` + cols + `) values(new.id, ` + newCols + `);
+		end`,
+		`insert into mp3_fts(mp3_fts) values('rebuild')`,
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	for _, s := range stmts {
+		if _, err = tx.Exec(s); err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+	err = tx.Commit()
+	return
+}
+
+// textTerms splits the free text `text` into the words to search for.
+func textTerms(text string) []string {
+	terms := make([]string, 0)
+	for _, w := range strings.Fields(text) {
+		// Quotes would end the FTS5 string the word is placed in.
+		w = strings.Replace(w, `"`, "", -1)
+		if len(w) > 0 {
+			terms = append(terms, w)
+		}
+	}
+	return terms
+}
+
+// alternatives returns the words to search for in place of `term`: the term itself, followed by its
+// fuzzy variants if `variants` is not nil.
+func alternatives(term string, variants func(string) []string) []string {
+	a := []string{term}
+	if variants != nil {
+		a = append(a, variants(strings.ToLower(term))...)
+	}
+	return a
+}
+
+// fullTextMatch returns the FTS5 query that matches rows containing all the words in `terms`,
+// each as a prefix of a word. If `variants` is not nil, a word may instead be one of the variants of a term.
+func fullTextMatch(terms []string, variants func(string) []string) string {
+	m := make([]string, len(terms))
+	for i, t := range terms {
+		// Each word is a string so that it is never interpreted as FTS5 query syntax.
+		alts := alternatives(t, variants)
+		for j, a := range alts {
+			alts[j] = `"` + a + `"`
+		}
+		alts[0] += "*"
+		m[i] = alts[0]
+		if len(alts) > 1 {
+			m[i] = "(" + makelist(alts, " OR ") + ")"
+		}
+	}
+	return makelist(m, " AND ")
+}
+
+// fullTextJoin returns the join of the mp3 table with the full-text index that selects the mp3s
+// that match all of `terms`, along with their rank as fts_rank, and its arguments.
+func fullTextJoin(terms []string, variants func(string) []string) (string, []interface{}) {
+	weights := make([]string, len(textFields))
+	for i, f := range textFields {
+		weights[i] = f.weight
+	}
+	join := " join (select rowid as fts_rowid, bm25(mp3_fts, " + makelist(weights, ", ") + ") as fts_rank" +
+		" from mp3_fts where mp3_fts match ?) on mp3.id = fts_rowid"
+	return join, []interface{}{fullTextMatch(terms, variants)}
+}
+
+// substringText writes the SQL that matches mp3s where each of `terms` (or one of its variants) is
+// a substring of one of the text fields to `buf`, and returns its arguments. It is used when FTS5 isn't available.
+func substringText(buf *bytes.Buffer, terms []string, variants func(string) []string) []interface{} {
+	args := make([]interface{}, 0, len(terms)*len(textFields))
+	for i, t := range terms {
+		if i > 0 {
+			buf.WriteString(" and ")
+		}
+		buf.WriteString("(")
+		for k, a := range alternatives(t, variants) {
+			for j, f := range textFields {
+				if j > 0 || k > 0 {
+					buf.WriteString(" or ")
+				}
+				buf.WriteString("instr(lower(" + f.name + "), lower(?)) > 0")
+				args = append(args, a)
+			}
+		}
+		buf.WriteString(")")
+	}
+	return args
+}
@@ -0,0 +1,521 @@
+package scan
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// fuzzyFields are the fields whose words are matched approximately by fuzzy queries and suggestions.
+var fuzzyFields = []string{"artist", "album", "title"}
+
+// maxVariants is the most words a fuzzy query term is expanded to.
+const maxVariants = 10
+
+// rebuildInterval is the shortest time between rebuilds of the fuzzy index. While the library
+// changes faster than this, like during a scan, queries use the older index.
+var rebuildInterval = 5 * time.Second
+
+// Suggestion is a value of a field that completes text typed by a user.
+type Suggestion struct {
+	// The field completed: "artist", "album" or "title"
+	Field string
+	Value string
+	// Number of mp3s with the value
+	Count int
+	// Number of edits needed to make the words of the text match the value; 0 if it matched exactly
+	Distance int
+}
+
+// splitWords returns the lowercase words in `s`. Words are runs of letters and digits.
+func splitWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// maxDistance returns the number of edits allowed when fuzzy matching the word `w`. Short words
+// must match exactly, since a single edit changes them too much.
+func maxDistance(w string) int {
+	n := utf8.RuneCountInString(w)
+	switch {
+	case n < 4:
+		return 0
+	case n < 8:
+		return 1
+	}
+	return 2
+}
+
+// editDistance returns the number of insertions, deletions, substitutions and transpositions of
+// adjacent characters needed to change `a` into `b`. If it is more than `max`, max+1 is returned.
+func editDistance(a, b string, max int) int {
+	return distance(a, b, max, false)
+}
+
+// prefixDistance is like editDistance, but returns the fewest edits needed to change `a` into
+// any prefix of `b`.
+func prefixDistance(a, b string, max int) int {
+	return distance(a, b, max, true)
+}
+
+func distance(a, b string, max int, prefix bool) int {
+	ra, rb := []rune(a), []rune(b)
+	if d := len(ra) - len(rb); d > max || (!prefix && -d > max) {
+		return max + 1
+	}
+
+	// Rows i-2, i-1 and i of the distance matrix
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d := prev[j-1] + cost
+			if v := prev[j] + 1; v < d {
+				d = v
+			}
+			if v := cur[j-1] + 1; v < d {
+				d = v
+			}
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				if v := prev2[j-2] + 1; v < d {
+					d = v
+				}
+			}
+			cur[j] = d
+			if d < rowMin {
+				rowMin = d
+			}
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+
+	d := prev[len(rb)]
+	if prefix {
+		// The distance to each prefix of b is in the last row.
+		for _, v := range prev {
+			if v < d {
+				d = v
+			}
+		}
+	}
+	if d > max {
+		return max + 1
+	}
+	return d
+}
+
+// trigrams returns the distinct three character sequences of `w`, with its start marked by '$'.
+// If `whole` is true the end is marked too.
+func trigrams(w string, whole bool) []string {
+	r := append([]rune{'$'}, []rune(w)...)
+	if whole {
+		r = append(r, '$')
+	}
+
+	seen := make(map[string]bool)
+	t := make([]string, 0, len(r))
+	for i := 0; i+3 <= len(r); i++ {
+		s := string(r[i : i+3])
+		if !seen[s] {
+			seen[s] = true
+			t = append(t, s)
+		}
+	}
+	return t
+}
+
+// fieldIndex holds the distinct values of one field.
+type fieldIndex struct {
+	field  string
+	values []string
+	// The values in lowercase
+	lower []string
+	// Number of mp3s with each value
+	counts []int
+	// The ids of the values containing each word, by word id
+	postings map[int32][]int32
+}
+
+// fuzzyIndex finds words in the fuzzyFields that approximately match words typed by a user.
+// It is built from the mp3 table when first used, and rebuilt when the library changes.
+type fuzzyIndex struct {
+	mu sync.Mutex
+	// The library_version the index was built from, or -1 if it hasn't been built.
+	version int64
+	built   time.Time
+	// Distinct words of all the fuzzyFields, sorted
+	words []string
+	// The ids of the words containing each trigram
+	trigrams map[string][]int32
+	fields   []*fieldIndex
+}
+
+func newFuzzyIndex() *fuzzyIndex {
+	return &fuzzyIndex{version: -1}
+}
+
+// fuzzySource is where a fuzzyIndex gets the values of the fuzzyFields from.
+type fuzzySource interface {
+	// libraryVersion returns a number that changes whenever mp3s are added or removed, or their tags change.
+	libraryVersion() (int64, error)
+	// eachFuzzyValues calls `f` with the values of the fuzzyFields of each mp3.
+	eachFuzzyValues(f func(vals []string)) error
+}
+
+// update rebuilds the index if the library has changed since it was built.
+func (x *fuzzyIndex) update(src fuzzySource) error {
+	version, err := src.libraryVersion()
+	if err != nil {
+		return err
+	}
+	if version == x.version || (x.version >= 0 && time.Since(x.built) < rebuildInterval) {
+		return nil
+	}
+
+	counts := make([]map[string]int, len(fuzzyFields))
+	for i := range counts {
+		counts[i] = make(map[string]int)
+	}
+	err = src.eachFuzzyValues(func(vals []string) {
+		for i, v := range vals {
+			if len(v) > 0 {
+				counts[i][v]++
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	wordSet := make(map[string]bool)
+	for _, c := range counts {
+		for v := range c {
+			for _, w := range splitWords(v) {
+				wordSet[w] = true
+			}
+		}
+	}
+	words := make([]string, 0, len(wordSet))
+	for w := range wordSet {
+		words = append(words, w)
+	}
+	sort.Strings(words)
+
+	ids := make(map[string]int32, len(words))
+	tri := make(map[string][]int32)
+	for i, w := range words {
+		ids[w] = int32(i)
+		for _, t := range trigrams(w, true) {
+			tri[t] = append(tri[t], int32(i))
+		}
+	}
+
+	fields := make([]*fieldIndex, len(fuzzyFields))
+	for i, c := range counts {
+		f := &fieldIndex{field: fuzzyFields[i], postings: make(map[int32][]int32)}
+		for v := range c {
+			f.values = append(f.values, v)
+		}
+		sort.Strings(f.values)
+		f.counts = make([]int, len(f.values))
+		f.lower = make([]string, len(f.values))
+		for j, v := range f.values {
+			f.counts[j] = c[v]
+			f.lower[j] = strings.ToLower(v)
+			seen := make(map[int32]bool)
+			for _, w := range splitWords(v) {
+				id := ids[w]
+				if !seen[id] {
+					seen[id] = true
+					f.postings[id] = append(f.postings[id], int32(j))
+				}
+			}
+		}
+		fields[i] = f
+	}
+
+	x.words = words
+	x.trigrams = tri
+	x.fields = fields
+	x.version = version
+	x.built = time.Now()
+	return nil
+}
+
+// match returns the ids of the words that match `w`, with the edit distance of each. If `prefix` is
+// true `w` only has to match the start of the words.
+func (x *fuzzyIndex) match(w string, prefix bool) map[int32]int {
+	m := make(map[int32]int)
+
+	if prefix {
+		for i := sort.SearchStrings(x.words, w); i < len(x.words) && strings.HasPrefix(x.words[i], w); i++ {
+			m[int32(i)] = 0
+		}
+	} else if i := sort.SearchStrings(x.words, w); i < len(x.words) && x.words[i] == w {
+		m[int32(i)] = 0
+	}
+
+	max := maxDistance(w)
+	if max == 0 {
+		return m
+	}
+
+	// A word within `max` edits of w shares all but at most 4*max of its trigrams (a transposition
+	// changes up to four).
+	t := trigrams(w, !prefix)
+	need := len(t) - 4*max
+	if need < 1 {
+		need = 1
+	}
+	shared := make([]uint8, len(x.words))
+	for _, s := range t {
+		for _, id := range x.trigrams[s] {
+			shared[id]++
+		}
+	}
+
+	for i, c := range shared {
+		id := int32(i)
+		if int(c) < need {
+			continue
+		}
+		if _, ok := m[id]; ok {
+			continue
+		}
+
+		var d int
+		if prefix {
+			d = prefixDistance(w, x.words[id], max)
+		} else {
+			d = editDistance(w, x.words[id], max)
+		}
+		if d <= max {
+			m[id] = d
+		}
+	}
+	return m
+}
+
+// variants returns the words in the index, other than `w`, that are within the allowed edit
+// distance of it. The closest words are returned first.
+func (x *fuzzyIndex) variants(w string) []string {
+	m := x.match(w, false)
+	ids := make([]int32, 0, len(m))
+	for id, d := range m {
+		if d > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if m[ids[i]] != m[ids[j]] {
+			return m[ids[i]] < m[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	if len(ids) > maxVariants {
+		ids = ids[:maxVariants]
+	}
+
+	v := make([]string, len(ids))
+	for i, id := range ids {
+		v[i] = x.words[id]
+	}
+	return v
+}
+
+// suggest returns up to `limit` values of the `fields` whose words match the words of `text`.
+// The last word of the text may be incomplete, so it only has to match the start of a word.
+func (x *fuzzyIndex) suggest(text string, fields []string, limit int) []Suggestion {
+	words := splitWords(text)
+	if len(words) == 0 {
+		return []Suggestion{}
+	}
+	partial := !strings.HasSuffix(text, " ")
+
+	matches := make([]map[int32]int, len(words))
+	for i, w := range words {
+		matches[i] = x.match(w, partial && i == len(words)-1)
+	}
+
+	lower := strings.ToLower(strings.TrimSpace(text))
+
+	// Candidates are kept in order, and only the best `limit` of them are kept.
+	type candidate struct {
+		Suggestion
+		starts bool
+	}
+	better := func(a, b candidate) bool {
+		if a.Distance != b.Distance {
+			return a.Distance < b.Distance
+		}
+		if a.starts != b.starts {
+			return a.starts
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.Value != b.Value {
+			return a.Value < b.Value
+		}
+		return a.Field < b.Field
+	}
+	best := make([]candidate, 0)
+	add := func(c candidate) {
+		if limit > 0 && len(best) == limit {
+			if !better(c, best[limit-1]) {
+				return
+			}
+			best = best[:limit-1]
+		}
+		i := sort.Search(len(best), func(i int) bool { return better(c, best[i]) })
+		best = append(best, candidate{})
+		copy(best[i+1:], best[i:])
+		best[i] = c
+	}
+
+	for _, f := range x.fields {
+		if !containsString(fields, f.field) {
+			continue
+		}
+
+		// For each value, the number of words of the text matched so far, the total distance of
+		// those words and the distance of the current word.
+		hits := make([]int32, len(f.values))
+		dist := make([]int32, len(f.values))
+		wdist := make([]int32, len(f.values))
+		for i, m := range matches {
+			n := int32(i)
+			for wid, d := range m {
+				wd := int32(d)
+				for _, vid := range f.postings[wid] {
+					if hits[vid] == n {
+						hits[vid] = n + 1
+						dist[vid] += wd
+						wdist[vid] = wd
+					} else if hits[vid] == n+1 && wd < wdist[vid] {
+						dist[vid] -= wdist[vid] - wd
+						wdist[vid] = wd
+					}
+				}
+			}
+		}
+
+		for vid, h := range hits {
+			if int(h) == len(words) {
+				add(candidate{
+					Suggestion: Suggestion{Field: f.field, Value: f.values[vid], Count: f.counts[vid], Distance: int(dist[vid])},
+					starts:     strings.HasPrefix(f.lower[vid], lower),
+				})
+			}
+		}
+	}
+
+	result := make([]Suggestion, len(best))
+	for i, c := range best {
+		result[i] = c.Suggestion
+	}
+	return result
+}
+
+func containsString(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Suggest returns up to `limit` values of the artist, album and title fields that complete `text`,
+// as typed by a user. Each word of the text must match the start of a word of a value, allowing a
+// few typing mistakes in longer words. Values that match with fewer mistakes come first, then values
+// that begin with the text, then values shared by more mp3s. If `fields` is empty all three fields
+// are searched. If `limit` is 0 all the values found are returned.
+func (m Mp3Db) Suggest(text string, fields []string, limit int) ([]Suggestion, error) {
+	return suggest(m.fuzzy, m, text, fields, limit)
+}
+
+func (m Mp3Db) libraryVersion() (version int64, err error) {
+	err = m.DB.QueryRow("select version from library_version").Scan(&version)
+	return
+}
+
+func (m Mp3Db) eachFuzzyValues(f func(vals []string)) error {
+	rows, err := m.DB.Query("select " + makelist(fuzzyFields, ", ") + " from mp3")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	vals := make([]sql.NullString, len(fuzzyFields))
+	ptrs := make([]interface{}, len(fuzzyFields))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	strs := make([]string, len(fuzzyFields))
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		for i, v := range vals {
+			strs[i] = v.String
+		}
+		f(strs)
+	}
+	return rows.Err()
+}
+
+// suggest implements Library.Suggest using the index `x` built from `src`.
+func suggest(x *fuzzyIndex, src fuzzySource, text string, fields []string, limit int) ([]Suggestion, error) {
+	if len(fields) == 0 {
+		fields = fuzzyFields
+	}
+	for _, f := range fields {
+		if !containsString(fuzzyFields, f) {
+			return nil, fmt.Errorf("Suggestions are not supported for field '%s'", f)
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if err := x.update(src); err != nil {
+		return nil, fmt.Errorf("Updating the fuzzy index failed: %v", err)
+	}
+	return x.suggest(text, fields, limit), nil
+}
+
+// fuzzyVariants returns a function that returns the variants (see fuzzyIndex.variants) of a word
+// for building fuzzy queries, using the index `x` built from `src`.
+func fuzzyVariants(x *fuzzyIndex, src fuzzySource) (func(string) []string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if err := x.update(src); err != nil {
+		return nil, fmt.Errorf("Updating the fuzzy index failed: %v", err)
+	}
+
+	// Hold on to the words of the current index, which is replaced rather than modified when rebuilt.
+	current := &fuzzyIndex{words: x.words, trigrams: x.trigrams}
+	return current.variants, nil
+}
@@ -0,0 +1,217 @@
+package scan
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEditDistance(test *testing.T) {
+	cases := []struct {
+		a, b string
+		max  int
+		d    int
+	}{
+		{"radiohead", "radiohead", 2, 0},
+		{"radiohed", "radiohead", 2, 1},
+		{"raidohead", "radiohead", 2, 1},
+		{"rdiohed", "radiohead", 2, 2},
+		{"rdiohd", "radiohead", 2, 3},
+		{"björk", "bjork", 1, 1},
+		{"abc", "xyz", 1, 2},
+	}
+
+	for _, c := range cases {
+		if d := editDistance(c.a, c.b, c.max); d != c.d {
+			test.Errorf("Distance from '%s' to '%s': expected %d but got %d", c.a, c.b, c.d, d)
+		}
+	}
+}
+
+func TestSuggest(test *testing.T) {
+	db := createQueryTestDb(test)
+	defer db.Close()
+
+	_, err := db.DB.Exec(`insert into mp3(artist, album, title, tracknum, path) values
+		('Radiohead', 'OK Computer', 'Airbag', 1, '/r/1.mp3'),
+		('Radiohead', 'OK Computer', 'Paranoid Android', 2, '/r/2.mp3'),
+		('Radiohead', 'Kid A', 'Idioteque', 8, '/r/3.mp3'),
+		('Radio Birdman', 'Radios Appear', 'Aloha Steve and Danno', 1, '/b/1.mp3')`)
+	if err != nil {
+		test.Fatal("Inserting mp3s failed: ", err)
+	}
+
+	str := func(s []Suggestion) string {
+		l := make([]string, len(s))
+		for i, v := range s {
+			l[i] = fmt.Sprintf("%s:%s:%d:%d", v.Field, v.Value, v.Count, v.Distance)
+		}
+		return strings.Join(l, ",")
+	}
+
+	cases := []struct {
+		text     string
+		fields   []string
+		limit    int
+		expected string
+	}{
+		{"radioh", []string{"artist"}, 0, "artist:Radiohead:3:0,artist:Radio Birdman:1:1"},
+		{"radiohe", []string{"artist"}, 0, "artist:Radiohead:3:0"},
+		{"radio", nil, 0, "artist:Radiohead:3:0,artist:Radio Birdman:1:0,album:Radios Appear:1:0"},
+		{"radio", nil, 2, "artist:Radiohead:3:0,artist:Radio Birdman:1:0"},
+		{"radiohed", nil, 0, "artist:Radiohead:3:1"},
+		{"ok comp", nil, 0, "album:OK Computer:2:0"},
+		{"ok compuetr", nil, 0, "album:OK Computer:2:1"},
+		{"paranid andr", nil, 0, "title:Paranoid Android:1:1"},
+		{"beatles ", []string{"artist"}, 0, "artist:Beatles:2:0"},
+		{"beatle ", []string{"artist"}, 0, "artist:Beatles:2:1"},
+		{"xyzzy", nil, 0, ""},
+		{"  ", nil, 0, ""},
+	}
+
+	for _, c := range cases {
+		s, err := db.Suggest(c.text, c.fields, c.limit)
+		if err != nil {
+			test.Fatalf("Suggesting '%s' failed: %v", c.text, err)
+		}
+		if str(s) != c.expected {
+			test.Errorf("Suggesting '%s': expected '%s' but got '%s'", c.text, c.expected, str(s))
+		}
+	}
+
+	if _, err = db.Suggest("x", []string{"path"}, 0); err == nil {
+		test.Error("Suggesting paths was accepted")
+	}
+
+	// The index is rebuilt when the library changes.
+	defer func(d time.Duration) { rebuildInterval = d }(rebuildInterval)
+	rebuildInterval = 0
+	if _, err = db.DB.Exec("update mp3 set artist = 'Radiohead!' where path = '/r/3.mp3'"); err != nil {
+		test.Fatal("Updating mp3 failed: ", err)
+	}
+	s, err := db.Suggest("radiohead", []string{"artist"}, 0)
+	if err != nil || str(s) != "artist:Radiohead:2:0,artist:Radiohead!:1:0" {
+		test.Fatalf("Unexpected suggestions after update: %s (%v)", str(s), err)
+	}
+}
+
+func TestQueryFuzzy(test *testing.T) {
+	db := createQueryTestDb(test)
+	defer db.Close()
+
+	cases := []struct {
+		q        Query
+		expected string
+	}{
+		{Query{Where: []Condition{{"artist", Substring, "beatels"}}}, ""},
+		{Query{Fuzzy: true, Where: []Condition{{"artist", Substring, "beatels"}}}, "Come Together,Something"},
+		{Query{Fuzzy: true, Where: []Condition{{"album", Substring, "abey road"}}}, "Come Together,Something"},
+		{Query{Fuzzy: true, Where: []Condition{{"artist", Substring, "bea"}}}, "Come Together,Something,Wouldn't It Be Nice"},
+		{Query{Fuzzy: true, Where: []Condition{{"artist", Exact, "beatels"}}}, ""},
+		{Query{Fuzzy: true, Text: "beatels somthing"}, "Something"},
+		{Query{Fuzzy: true, Text: "pet sonds"}, "Wouldn't It Be Nice"},
+	}
+
+	for _, fullText := range []bool{false, db.FullText()} {
+		db.fullText = fullText
+		for _, c := range cases {
+			found := findTitles(test, db, &c.q)
+			sort.Strings(found)
+			if titles := strings.Join(found, ","); titles != c.expected {
+				test.Errorf("Query %+v (full text %v): expected '%s' but got '%s'", c.q, fullText, c.expected, titles)
+			}
+		}
+	}
+}
+
+func TestLibraryVersion(test *testing.T) {
+	db := createTestDb(test)
+	defer db.Close()
+
+	for _, lib := range []Library{db, NewMemLibrary()} {
+		src := lib.(fuzzySource)
+		if err := lib.PutTracks([]Track{{Path: "a.mp3", Artist: "A", Title: "One"}}); err != nil {
+			test.Fatal("Adding tracks failed: ", err)
+		}
+		before, err := src.libraryVersion()
+		if err != nil {
+			test.Fatal("Getting the library version failed: ", err)
+		}
+
+		// Playing and rating mp3s doesn't change the values of the indexes.
+		if err = lib.AddPlay(Play{Path: "a.mp3", Started: 100, Ended: 200, Completion: 1}); err != nil {
+			test.Fatal("Adding play failed: ", err)
+		}
+		if err = lib.Rate("", "a.mp3", 4); err != nil {
+			test.Fatal("Rating failed: ", err)
+		}
+		if err = lib.SetFavorite("", "a.mp3", true); err != nil {
+			test.Fatal("Setting favorite failed: ", err)
+		}
+		if after, err := src.libraryVersion(); err != nil || after != before {
+			test.Fatalf("Expected the library version to stay %d but it is %d (%v)", before, after, err)
+		}
+
+		// Changing the tags does.
+		if err = lib.PutTracks([]Track{{Path: "a.mp3", Artist: "A", Title: "Two"}}); err != nil {
+			test.Fatal("Updating tracks failed: ", err)
+		}
+		if after, err := src.libraryVersion(); err != nil || after == before {
+			test.Fatalf("Expected the library version to change from %d (%v)", before, err)
+		}
+		if found := findTitles(test, lib, &Query{Text: "two"}); len(found) != 1 {
+			test.Fatalf("Expected the new title to be found but got %v", found)
+		}
+	}
+}
+
+// BenchmarkSuggest measures the suggestions for each keystroke of typing an artist in a library of 100000 mp3s.
+func BenchmarkSuggest(b *testing.B) {
+	const tracks = 100000
+
+	db := createTestDb(b)
+	defer db.Close()
+
+	// Made up words, so that there are many similar words.
+	rnd := rand.New(rand.NewSource(1))
+	word := func() string {
+		const syllables = "ba be bi bo ka ke ki ko ra re ri ro sa se si so ta te ti to"
+		s := strings.Fields(syllables)
+		w := ""
+		for n := 2 + rnd.Intn(3); n > 0; n-- {
+			w += s[rnd.Intn(len(s))]
+		}
+		return w
+	}
+
+	tx, _ := db.DB.Begin()
+	for i := 0; i < tracks; i++ {
+		artist := fmt.Sprintf("%s %s", word(), word())
+		if i%50 == 0 {
+			artist = "Radiohead"
+		}
+		_, err := tx.Exec("insert into mp3(artist, album, title, tracknum, path) values(?,?,?,?,?)",
+			artist, word()+" "+word(), word()+" "+word()+" "+word(), i%12, fmt.Sprintf("/%d.mp3", i))
+		if err != nil {
+			b.Fatal("Inserting mp3 failed: ", err)
+		}
+	}
+	tx.Commit()
+
+	// Build the index
+	if _, err := db.Suggest("r", nil, 10); err != nil {
+		b.Fatal("Suggesting failed: ", err)
+	}
+
+	typed := "radiohed"
+	for j := 1; j <= len(typed); j++ {
+		b.Run(typed[:j], func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				db.Suggest(typed[:j], nil, 10)
+			}
+		})
+	}
+}
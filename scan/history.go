@@ -0,0 +1,213 @@
+package scan
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Play is a time an mp3 was played, as recorded in the listening history.
+type Play struct {
+	// The library root and path of the mp3 (see Track)
+	Library string
+	Path    string
+	// The artist, album and title of the mp3. They are only set by Plays, and are empty if the mp3
+	// is no longer in the library.
+	Artist string
+	Album  string
+	Title  string
+	// When the mp3 started and stopped playing, as unix times
+	Started int64
+	Ended   int64
+	// Fraction of the mp3 that had played when it stopped, from 0 to 1
+	Completion float64
+	// True if the mp3 was stopped before enough of it played for it to count as played. Skips are
+	// counted in Track.Skips instead of Track.Plays.
+	Skipped bool
+}
+
+// PlayQuery selects plays from the listening history.
+type PlayQuery struct {
+	// If Path is set only the plays of the mp3 in the library root Library with that path are selected.
+	Library string
+	Path    string
+	// Only plays that started at or after From and before To (unix times) are selected. Zero means no bound.
+	From int64
+	To   int64
+	// Which page of plays to return, or nil for all
+	Paging *Paging
+}
+
+// matches returns true if the play `p` is selected by the query.
+func (q *PlayQuery) matches(p *Play) bool {
+	return (len(q.Path) == 0 || (p.Library == q.Library && p.Path == q.Path)) &&
+		(q.From == 0 || p.Started >= q.From) && (q.To == 0 || p.Started < q.To)
+}
+
+// AddPlay records the play `p` in the listening history, and counts it in the Plays or Skips and the
+// LastPlayed of its mp3.
+func (m Mp3Db) AddPlay(p Play) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("creating transaction failed: %v", err)
+	}
+
+	_, err = tx.Exec("insert into plays(library, path, started, ended, completion, skipped) values(?,?,?,?,?,?)",
+		p.Library, p.Path, p.Started, p.Ended, p.Completion, p.Skipped)
+	if err == nil {
+		counter := "plays"
+		if p.Skipped {
+			counter = "skips"
+		}
+		_, err = tx.Exec("update mp3 set "+counter+" = "+counter+" + 1, last_played = max(last_played, ?) where library = ? and path = ?",
+			p.Started, p.Library, p.Path)
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("recording play failed: %v", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit failed: %v", err)
+	}
+	return nil
+}
+
+// Plays returns the plays in the listening history selected by the query `q`, most recent first.
+// If the query is paged, `hasMore` is true if there are more plays after the requested page.
+func (m Mp3Db) Plays(q *PlayQuery) (plays []Play, hasMore bool, err error) {
+	where := make([]string, 0)
+	args := make([]interface{}, 0)
+	if len(q.Path) > 0 {
+		where = append(where, "p.library = ? and p.path = ?")
+		args = append(args, q.Library, q.Path)
+	}
+	if q.From != 0 {
+		where = append(where, "p.started >= ?")
+		args = append(args, q.From)
+	}
+	if q.To != 0 {
+		where = append(where, "p.started < ?")
+		args = append(args, q.To)
+	}
+
+	s := `select p.library, p.path, coalesce(m.artist, ''), coalesce(m.album, ''), coalesce(m.title, ''),
+		p.started, p.ended, p.completion, p.skipped
+		from plays p left join mp3 m on m.library = p.library and m.path = p.path`
+	if len(where) > 0 {
+		s += " where " + strings.Join(where, " and ")
+	}
+	s += " order by p.started desc, p.id desc"
+	if q.Paging != nil {
+		// Read one more row than the page size to know if there are more.
+		s += " limit ? offset ?"
+		args = append(args, q.Paging.PageSize+1, q.Paging.Page*q.Paging.PageSize)
+	}
+
+	rows, err := m.DB.Query(s, args...)
+	if err != nil {
+		err = fmt.Errorf("Query failed: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	plays = make([]Play, 0)
+	for rows.Next() {
+		if q.Paging != nil && len(plays) == q.Paging.PageSize {
+			hasMore = true
+			break
+		}
+
+		var p Play
+		if err = rows.Scan(&p.Library, &p.Path, &p.Artist, &p.Album, &p.Title, &p.Started, &p.Ended, &p.Completion, &p.Skipped); err != nil {
+			err = fmt.Errorf("Reading query results failed: %v", err)
+			return
+		}
+		plays = append(plays, p)
+	}
+
+	if e := rows.Err(); e != nil {
+		err = fmt.Errorf("Query error: %v", e)
+	}
+	return
+}
+
+// movePlays moves the listening history and play counts of the mp3 in the library root `library`
+// from path `from` to path `to`.
+func movePlays(tx *sql.Tx, library, from, to string) error {
+	if _, err := tx.Exec("update plays set path = ? where library = ? and path = ?", to, library, from); err != nil {
+		return err
+	}
+
+	var plays, skips int
+	var last int64
+	err := tx.QueryRow("select plays, skips, last_played from mp3 where library = ? and path = ?", library, from).Scan(&plays, &skips, &last)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("update mp3 set plays = plays + ?, skips = skips + ?, last_played = max(last_played, ?) where library = ? and path = ?",
+		plays, skips, last, library, to)
+	return err
+}
+
+// PlayCount is the number of times an mp3 was played.
+type PlayCount struct {
+	Library string
+	Path    string
+	Artist  string
+	Album   string
+	Title   string
+	Plays   int
+}
+
+// MostPlayed returns up to `limit` of the mp3s played most often in the plays selected by `q`, most
+// played first. Skipped plays aren't counted. Paging in the query is ignored.
+func MostPlayed(lib Library, q *PlayQuery, limit int) ([]PlayCount, error) {
+	all := *q
+	all.Paging = nil
+	plays, _, err := lib.Plays(&all)
+	if err != nil {
+		return nil, err
+	}
+	return mostPlayed(plays, limit), nil
+}
+
+// mostPlayed returns up to `limit` of the mp3s played most often in `plays`, most played first.
+// Skipped plays aren't counted.
+func mostPlayed(plays []Play, limit int) []PlayCount {
+	counts := make(map[trackId]*PlayCount)
+	for _, p := range plays {
+		if p.Skipped {
+			continue
+		}
+		id := trackId{p.Library, p.Path}
+		c, ok := counts[id]
+		if !ok {
+			c = &PlayCount{Library: p.Library, Path: p.Path, Artist: p.Artist, Album: p.Album, Title: p.Title}
+			counts[id] = c
+		}
+		c.Plays++
+	}
+
+	l := make([]PlayCount, 0, len(counts))
+	for _, c := range counts {
+		l = append(l, *c)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].Plays != l[j].Plays {
+			return l[i].Plays > l[j].Plays
+		}
+		if l[i].Library != l[j].Library {
+			return l[i].Library < l[j].Library
+		}
+		return l[i].Path < l[j].Path
+	})
+	if limit > 0 && len(l) > limit {
+		l = l[:limit]
+	}
+	return l
+}
@@ -0,0 +1,82 @@
+package scan
+
+import (
+	"testing"
+)
+
+func TestHistory(test *testing.T) {
+	db := createTestDb(test)
+	defer db.Close()
+
+	for _, lib := range []Library{db, NewMemLibrary()} {
+		tracks := []Track{
+			{Library: "music", Path: "a.mp3", Artist: "A", Title: "One", Duration: 100},
+			{Library: "music", Path: "b.mp3", Artist: "B", Title: "Two", Duration: 200},
+		}
+		if err := lib.PutTracks(tracks); err != nil {
+			test.Fatal("Adding tracks failed: ", err)
+		}
+
+		plays := []Play{
+			{Library: "music", Path: "a.mp3", Started: 100, Ended: 200, Completion: 1},
+			{Library: "music", Path: "b.mp3", Started: 300, Ended: 310, Completion: 0.05, Skipped: true},
+			{Library: "music", Path: "a.mp3", Started: 400, Ended: 450, Completion: 0.5},
+			{Library: "music", Path: "b.mp3", Started: 500, Ended: 700, Completion: 1},
+			{Library: "music", Path: "gone.mp3", Started: 800, Ended: 900, Completion: 1},
+		}
+		for _, p := range plays {
+			if err := lib.AddPlay(p); err != nil {
+				test.Fatal("Adding play failed: ", err)
+			}
+		}
+
+		// Rescanning keeps the play counts.
+		if err := lib.PutTracks(tracks); err != nil {
+			test.Fatal("Updating tracks failed: ", err)
+		}
+
+		found, _, err := lib.FindTracks(&Query{Fields: []string{"path", "plays", "skips", "last_played"}, Order: []Sort{{"plays", true}, {"path", false}}})
+		if err != nil || len(found) != 2 {
+			test.Fatalf("Unexpected tracks %v (%v)", found, err)
+		}
+		if found[0].Path != "a.mp3" || found[0].Plays != 2 || found[0].Skips != 0 || found[0].LastPlayed != 400 ||
+			found[1].Plays != 1 || found[1].Skips != 1 || found[1].LastPlayed != 500 {
+			test.Fatalf("Unexpected play counts %+v", found)
+		}
+
+		h, hasMore, err := lib.Plays(&PlayQuery{From: 300, To: 800, Paging: &Paging{PageSize: 2, Page: 0}})
+		if err != nil || !hasMore || len(h) != 2 || h[0].Started != 500 || h[0].Title != "Two" || h[1].Started != 400 {
+			test.Fatalf("Unexpected first page of plays %+v (%v, %v)", h, hasMore, err)
+		}
+		h, hasMore, err = lib.Plays(&PlayQuery{From: 300, To: 800, Paging: &Paging{PageSize: 2, Page: 1}})
+		if err != nil || hasMore || len(h) != 1 || !h[0].Skipped {
+			test.Fatalf("Unexpected second page of plays %+v (%v, %v)", h, hasMore, err)
+		}
+
+		h, _, err = lib.Plays(&PlayQuery{Library: "music", Path: "a.mp3"})
+		if err != nil || len(h) != 2 || h[0].Completion != 0.5 {
+			test.Fatalf("Unexpected plays of a.mp3 %+v (%v)", h, err)
+		}
+
+		top, err := MostPlayed(lib, &PlayQuery{}, 2)
+		if err != nil || len(top) != 2 || top[0].Path != "a.mp3" || top[0].Plays != 2 || top[1].Path != "b.mp3" {
+			test.Fatalf("Unexpected most played %+v (%v)", top, err)
+		}
+
+		// Moving an mp3 moves its history.
+		if err = lib.PutTracks([]Track{{Library: "music", Path: "c.mp3", Artist: "A", Title: "One"}}); err != nil {
+			test.Fatal("Adding track failed: ", err)
+		}
+		if err = lib.RemoveTracks("music", nil, map[string]string{"a.mp3": "c.mp3"}); err != nil {
+			test.Fatal("Moving track failed: ", err)
+		}
+		found, _, err = lib.FindTracks(&Query{Fields: []string{"path", "plays"}, Where: []Condition{{"path", Exact, "c.mp3"}}})
+		if err != nil || len(found) != 1 || found[0].Plays != 2 {
+			test.Fatalf("Unexpected moved track %+v (%v)", found, err)
+		}
+		h, _, err = lib.Plays(&PlayQuery{Library: "music", Path: "c.mp3"})
+		if err != nil || len(h) != 2 {
+			test.Fatalf("Unexpected plays of the moved track %+v (%v)", h, err)
+		}
+	}
+}
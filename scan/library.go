@@ -0,0 +1,162 @@
+package scan
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Library stores the mp3s found by scans. Mp3Db stores them in a sqlite database, and MemLibrary
+// stores them in memory, which is useful for tests.
+//
+// Mp3s are identified by the name of the library root they are under and their path relative to
+// it (see Root). Mp3s that weren't scanned under a named root have an empty library name, and their
+// paths are the paths after the StringTransform used when scanning, if any.
+type Library interface {
+	// FindTracks returns the mp3s matching the query `q`. If the query is paged, `hasMore` is true if
+	// there are more mp3s after the requested page.
+	FindTracks(q *Query) (tracks []Track, hasMore bool, err error)
+
+	// Suggest returns up to `limit` values of the artist, album and title fields that complete
+	// `text`, as typed by a user. See Mp3Db.Suggest.
+	Suggest(text string, fields []string, limit int) ([]Suggestion, error)
+
+	// TracksUnder returns the mp3s in the library root `library` whose path is `dir`, or is under the
+	// directory dir, ordered by path. If dir is empty all the mp3s in the root are returned. At least
+	// Library, Path, Artist, Album, Title, Tracknum, Size and Mtime are set.
+	TracksUnder(library, dir string) ([]Track, error)
+
+	// PutTracks adds the mp3s to the library, replacing any with the same library root and path.
+	// Play counts and favorites are kept, and so is the rating if the Rating of the new mp3 is -1.
+	// Either all the mp3s are stored or, if an error is returned, none are.
+	PutTracks(tracks []Track) error
+
+	// RemoveTracks removes the mp3s in the library root `library` with the paths `removed`. The keys
+	// of `moved` are the paths of mp3s whose files were moved to the path of the value, which must
+	// already be in the library. They are removed too, but information kept about them (like play
+	// counts) is moved to their new path. Either all the changes are made or, if an error is
+	// returned, none are.
+	RemoveTracks(library string, removed []string, moved map[string]string) error
+
+	// ScanErrors returns the errors stored by the most recent scans, ordered by library and path.
+	ScanErrors() ([]*ScanError, error)
+
+	// StoreScanErrors updates the stored errors for the paths in the library root `library` under `dir`
+	// after a scan. `errs` are the errors of the scan and `ok` are the paths that were read without
+	// error; their old errors are removed. If the scan was complete `seen` holds the paths of all mp3s
+	// found, and errors for other paths under dir are removed too.
+	StoreScanErrors(library, dir string, errs []*ScanError, ok []string, seen map[string]bool) error
+
+	// Roots returns the named library roots that have been scanned, ordered by name.
+	Roots() ([]Root, error)
+
+	// PutRoot stores the library root `r`, replacing any with the same name.
+	PutRoot(r Root) error
+
+	// AddPlay records the play `p` in the listening history, and counts it in the Plays or Skips
+	// and the LastPlayed of its mp3.
+	AddPlay(p Play) error
+
+	// Stats returns statistics about the mp3s in the library roots selected by `opts`, which must
+	// not be nil. See LibraryStats.
+	Stats(opts *StatsOptions) (*Stats, error)
+
+	// Plays returns the plays in the listening history selected by the query `q`, most recent first.
+	// If the query is paged, `hasMore` is true if there are more plays after the requested page.
+	Plays(q *PlayQuery) (plays []Play, hasMore bool, err error)
+
+	// Rate sets the rating of the mp3 in the library root `library` with path `path` to `rating`
+	// stars, from 0 (unrated) to 5. ErrNoTrack is returned if there is no such mp3.
+	Rate(library, path string, rating int) error
+
+	// SetFavorite marks the mp3 in the library root `library` with path `path` as a favorite or
+	// not. ErrNoTrack is returned if there is no such mp3.
+	SetFavorite(library, path string, favorite bool) error
+
+	// Playlists returns the saved playlists without their tracks, ordered by name.
+	Playlists() ([]Playlist, error)
+
+	// Playlist returns the playlist with id `id` and its tracks. ErrNoPlaylist is returned if there is none.
+	Playlist(id int64) (*Playlist, error)
+
+	// CreatePlaylist saves a new playlist named `name` holding `tracks`, of which only the Library
+	// and Path are used, and returns its id. ErrPlaylistExists is returned if the name is already used.
+	CreatePlaylist(name string, tracks []Track) (int64, error)
+
+	// RenamePlaylist renames the playlist with id `id` to `name`. ErrNoPlaylist is returned if there
+	// is no such playlist, and ErrPlaylistExists if the name is already used by another.
+	RenamePlaylist(id int64, name string) error
+
+	// EditPlaylist calls `f` with the playlist with id `id` and then stores the tracks f leaves in it,
+	// in one transaction, so that concurrent edits aren't lost. See Mp3Db.EditPlaylist.
+	EditPlaylist(id int64, f func(p *Playlist) error) error
+
+	// SetPlaylistTracks replaces the tracks of the playlist with id `id` with `tracks`, of which only
+	// the Library and Path are used. ErrNoPlaylist is returned if there is no such playlist.
+	SetPlaylistTracks(id int64, tracks []Track) error
+
+	// SetPlaylistRules sets the rules of the playlist with id `id`, making it a smart playlist, or
+	// a static playlist if `rules` is empty. The tracks aren't changed; see SetSmartRules.
+	// ErrNoPlaylist is returned if there is no such playlist.
+	SetPlaylistRules(id int64, rules string) error
+
+	// DeletePlaylist deletes the playlist with id `id`. ErrNoPlaylist is returned if there is no such playlist.
+	DeletePlaylist(id int64) error
+
+	// ImportedFiles returns the playlist files in the library root `library` imported by ImportPlaylist
+	// whose path is `dir`, or is under the directory dir. If dir is empty all of them are returned.
+	ImportedFiles(library, dir string) ([]ImportedFile, error)
+
+	// ImportPlaylist stores the playlist named `name` holding `tracks` read from the playlist file `f`,
+	// replacing the tracks of the playlist previously imported from that file if there is one, and
+	// records f. `changed` is false if that playlist already held the same tracks. See Mp3Db.ImportPlaylist.
+	ImportPlaylist(f ImportedFile, name string, tracks []Track) (id int64, changed bool, err error)
+
+	Close()
+}
+
+// FindTracks returns the mp3s in `lib` matching the query `q`. If the query is paged, `hasMore` is true if
+// there are more mp3s after the requested page.
+func FindTracks(lib Library, q *Query) (tracks []Track, hasMore bool, err error) {
+	return lib.FindTracks(q)
+}
+
+// Root is a named directory that mp3s are stored relative to. Since only the relative paths are
+// stored, the same library can be mounted at different paths on different hosts, and several
+// libraries (like music and audiobooks) can be kept apart.
+type Root struct {
+	Name string
+	// The directory the root was scanned from
+	Path string
+}
+
+// Relative returns `path`, which is the root directory or is under it, relative to the root.
+// The root directory itself is the empty string. Paths that aren't under the root are returned unchanged.
+func (r Root) Relative(path string) string {
+	rel, err := filepath.Rel(r.Path, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return path
+	}
+	if rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Join returns the full path of the mp3 whose path relative to the root is `path`.
+func (r Root) Join(path string) string {
+	return filepath.Join(r.Path, filepath.FromSlash(path))
+}
+
+// isUnder returns true if `path` is `dir` or is under the directory dir. Every path is under the empty dir.
+func isUnder(path, dir string) bool {
+	if dir == "" {
+		return true
+	}
+	d := strings.TrimRight(dir, "/") + "/"
+	return path == dir || strings.HasPrefix(path, d)
+}
+
+var (
+	_ Library = Mp3Db{}
+	_ Library = (*MemLibrary)(nil)
+)
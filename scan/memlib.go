@@ -0,0 +1,828 @@
+package scan
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemLibrary is a Library that keeps mp3s in memory. It is meant for tests, so it favours simplicity
+// over speed. Queries are evaluated as by an Mp3Db without a full-text index: words of Query.Text
+// are matched as substrings and the results are not ranked.
+type MemLibrary struct {
+	mu     sync.Mutex
+	tracks map[trackId]Track
+	errs   map[trackId]*ScanError
+	roots  map[string]Root
+	// The listening history, in the order the plays were added
+	plays []Play
+	// Saved playlists by id. Their tracks only have Library and Path set.
+	playlists      map[int64]*Playlist
+	nextPlaylistId int64
+	// The playlist files imported by ImportPlaylist
+	imported map[trackId]ImportedFile
+	// Incremented whenever the tracks change
+	version int64
+	fuzzy   *fuzzyIndex
+}
+
+// trackId identifies an mp3 in a MemLibrary.
+type trackId struct {
+	library, path string
+}
+
+// NewMemLibrary returns an empty MemLibrary.
+func NewMemLibrary() *MemLibrary {
+	return &MemLibrary{
+		tracks: make(map[trackId]Track),
+		errs:   make(map[trackId]*ScanError),
+		roots:  make(map[string]Root),
+		fuzzy:  newFuzzyIndex(),
+
+		playlists:      make(map[int64]*Playlist),
+		nextPlaylistId: 1,
+		imported:       make(map[trackId]ImportedFile),
+	}
+}
+
+// text returns the value of the field `name` as text, as it is compared by Query conditions.
+func (t *Track) text(name string) string {
+	return t.Map([]string{name})[name]
+}
+
+// number returns the value of the numeric field `name`.
+func (t *Track) number(name string) float64 {
+	switch v := t.field(name).(type) {
+	case *int:
+		return float64(*v)
+	case *int64:
+		return float64(*v)
+	case *float64:
+		return *v
+	case *bool:
+		if *v {
+			return 1
+		}
+	}
+	return 0
+}
+
+// matches returns true if `t` matches the condition `c`. See condition.
+func (c *Condition) matches(t *Track, variants func(string) []string) bool {
+	v := strings.ToLower(t.text(c.Field))
+	want := strings.ToLower(c.Value)
+
+	switch c.Match {
+	case Substring:
+		if strings.Contains(v, want) {
+			return true
+		}
+		if variants == nil || !containsString(fuzzyFields, c.Field) {
+			return false
+		}
+		words := splitWords(c.Value)
+		for _, w := range words {
+			if !containsAny(v, append([]string{w}, variants(w)...)) {
+				return false
+			}
+		}
+		return len(words) > 0
+	case Prefix:
+		return strings.HasPrefix(v, want)
+	case Exact:
+		if columns[c.Field] == textColumn {
+			return v == want
+		}
+		f, err := strconv.ParseFloat(c.Value, 64)
+		return err == nil && t.number(c.Field) == f
+	}
+	return false
+}
+
+// containsAny returns true if `s` contains any of `subs`.
+func containsAny(s string, subs []string) bool {
+	for _, sub := range subs {
+		if strings.Contains(s, strings.ToLower(sub)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if `t` matches the query.
+func (q *Query) matches(t *Track, variants func(string) []string) bool {
+	for i := range q.Where {
+		if !q.Where[i].matches(t, variants) {
+			return false
+		}
+	}
+
+	for _, group := range q.Any {
+		any := len(group) == 0
+		for i := range group {
+			any = any || group[i].matches(t, variants)
+		}
+		if !any {
+			return false
+		}
+	}
+
+	for _, r := range q.Ranges {
+		n := t.number(r.Field)
+		if (r.Min != nil && n < *r.Min) || (r.Max != nil && n > *r.Max) {
+			return false
+		}
+	}
+
+	for _, term := range textTerms(q.Text) {
+		found := false
+		for _, f := range textFields {
+			found = found || containsAny(strings.ToLower(t.text(f.name)), alternatives(term, variants))
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// less returns true if `a` comes before `b` in the order of the query.
+func (q *Query) less(a, b *Track) bool {
+	order := q.Order
+	if len(order) == 0 {
+		order = defaultOrder
+	}
+
+	for _, s := range order {
+		var c int
+		if columns[s.Field] == textColumn {
+			c = strings.Compare(strings.ToLower(a.text(s.Field)), strings.ToLower(b.text(s.Field)))
+		} else if na, nb := a.number(s.Field), b.number(s.Field); na < nb {
+			c = -1
+		} else if na > nb {
+			c = 1
+		}
+
+		if s.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return false
+}
+
+// FindTracks returns the mp3s matching the query `q`. Like the query of an Mp3Db, mp3s whose
+// requested fields are the same as those of an earlier mp3 are left out.
+func (l *MemLibrary) FindTracks(q *Query) (tracks []Track, hasMore bool, err error) {
+	// Check the query is valid.
+	if _, _, err = q.build(false, nil); err != nil {
+		return
+	}
+
+	var variants func(string) []string
+	if q.Fuzzy {
+		if variants, err = fuzzyVariants(l.fuzzy, l); err != nil {
+			return
+		}
+	}
+
+	l.mu.Lock()
+	found := make([]Track, 0)
+	for _, t := range l.tracks {
+		if q.matches(&t, variants) {
+			found = append(found, t)
+		}
+	}
+	l.mu.Unlock()
+
+	sort.SliceStable(found, func(i, j int) bool { return q.less(&found[i], &found[j]) })
+
+	fields := q.fields()
+	seen := make(map[string]bool)
+	tracks = make([]Track, 0)
+	skip := 0
+	if q.Paging != nil {
+		skip = q.Paging.Page * q.Paging.PageSize
+	}
+
+	for i := range found {
+		var t Track
+		for _, f := range fields {
+			copyField(&t, &found[i], f)
+		}
+
+		key := strings.Join(mapValues(t.Map(fields), fields), "\x00")
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if q.Paging != nil && len(tracks) == q.Paging.PageSize {
+			hasMore = true
+			break
+		}
+		tracks = append(tracks, t)
+	}
+	return
+}
+
+// copyField copies the field `name` from `src` to `dst`.
+func copyField(dst, src *Track, name string) {
+	switch d := dst.field(name).(type) {
+	case *string:
+		*d = *src.field(name).(*string)
+	case *int:
+		*d = *src.field(name).(*int)
+	case *int64:
+		*d = *src.field(name).(*int64)
+	case *float64:
+		*d = *src.field(name).(*float64)
+	case *bool:
+		*d = *src.field(name).(*bool)
+	}
+}
+
+func mapValues(m map[string]string, keys []string) []string {
+	v := make([]string, len(keys))
+	for i, k := range keys {
+		v[i] = m[k]
+	}
+	return v
+}
+
+// Stats returns statistics about the mp3s. Use LibraryStats, which accepts nil options.
+func (l *MemLibrary) Stats(opts *StatsOptions) (*Stats, error) {
+	libraries, err := statsLibraries(l, opts)
+	if err != nil {
+		return nil, err
+	}
+	s := newStats(opts)
+
+	artists := make(map[string]bool)
+	genres := make(map[string]bool)
+	albums := make(map[[2]string]*AlbumStats)
+	decades := make(map[int]int)
+	durations := make(map[trackId]float64)
+
+	for _, library := range libraries {
+		tracks, err := l.TracksUnder(library, "")
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range tracks {
+			t := &tracks[i]
+			s.Tracks++
+			s.Duration += t.Duration
+			s.Size += t.Size
+			durations[trackId{t.Library, t.Path}] = t.Duration
+
+			missing := missingTags(t)
+			for _, f := range missing {
+				s.Missing[f]++
+			}
+			if len(missing) > 0 && len(s.MissingTracks) < opts.top() {
+				s.MissingTracks = append(s.MissingTracks, MissingTags{t.Library, t.Path, missing})
+			}
+
+			if !containsString(missing, "artist") {
+				artists[strings.ToLower(t.Artist)] = true
+			}
+			if !containsString(missing, "genre") {
+				genres[strings.ToLower(t.Genre)] = true
+			}
+			if !containsString(missing, "album") {
+				k := [2]string{strings.ToLower(t.Artist), strings.ToLower(t.Album)}
+				a, ok := albums[k]
+				if !ok {
+					a = &AlbumStats{Artist: t.Artist, Album: t.Album}
+					albums[k] = a
+				}
+				a.Tracks++
+				a.Duration += t.Duration
+			}
+			if t.Year > 0 {
+				decades[t.Year/10*10]++
+			}
+		}
+	}
+
+	s.Artists = len(artists)
+	s.Albums = len(albums)
+	s.Genres = len(genres)
+
+	for d, n := range decades {
+		s.Decades = append(s.Decades, DecadeCount{d, n})
+	}
+	sort.Slice(s.Decades, func(i, j int) bool { return s.Decades[i].Decade < s.Decades[j].Decade })
+
+	for _, a := range albums {
+		s.LargestAlbums = append(s.LargestAlbums, *a)
+	}
+	sort.Slice(s.LargestAlbums, func(i, j int) bool {
+		a, b := &s.LargestAlbums[i], &s.LargestAlbums[j]
+		if a.Tracks != b.Tracks {
+			return a.Tracks > b.Tracks
+		}
+		if a.Artist != b.Artist {
+			return a.Artist < b.Artist
+		}
+		return a.Album < b.Album
+	})
+	if len(s.LargestAlbums) > opts.top() {
+		s.LargestAlbums = s.LargestAlbums[:opts.top()]
+	}
+
+	plays, _, err := l.Plays(&PlayQuery{From: opts.From, To: opts.To})
+	if err != nil {
+		return nil, err
+	}
+	selected := make([]Play, 0, len(plays))
+	for _, p := range plays {
+		if !containsString(libraries, p.Library) {
+			continue
+		}
+		selected = append(selected, p)
+		if p.Skipped {
+			s.Listening.Skips++
+		} else {
+			s.Listening.Plays++
+		}
+		s.Listening.Duration += p.Completion * durations[trackId{p.Library, p.Path}]
+	}
+	s.Listening.MostPlayed = mostPlayed(selected, opts.top())
+
+	return s, nil
+}
+
+// Suggest returns up to `limit` values of the artist, album and title fields that complete `text`.
+// See Mp3Db.Suggest.
+func (l *MemLibrary) Suggest(text string, fields []string, limit int) ([]Suggestion, error) {
+	return suggest(l.fuzzy, l, text, fields, limit)
+}
+
+func (l *MemLibrary) libraryVersion() (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.version, nil
+}
+
+func (l *MemLibrary) eachFuzzyValues(f func(vals []string)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	vals := make([]string, len(fuzzyFields))
+	for _, t := range l.tracks {
+		for i, name := range fuzzyFields {
+			vals[i] = t.text(name)
+		}
+		f(vals)
+	}
+	return nil
+}
+
+// TracksUnder returns the mp3s in the library root `library` whose path is `dir`, or is under the
+// directory dir, ordered by path.
+func (l *MemLibrary) TracksUnder(library, dir string) ([]Track, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tracks := make([]Track, 0)
+	for id, t := range l.tracks {
+		if id.library == library && isUnder(id.path, dir) {
+			tracks = append(tracks, t)
+		}
+	}
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].Path < tracks[j].Path })
+	return tracks, nil
+}
+
+// PutTracks adds the mp3s to the library, replacing any with the same library root and path.
+func (l *MemLibrary) PutTracks(tracks []Track) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, t := range tracks {
+		id := trackId{t.Library, t.Path}
+		// Play counts and favorites aren't scanned, so they are kept.
+		old, ok := l.tracks[id]
+		if ok {
+			t.Plays, t.Skips, t.LastPlayed, t.Favorite = old.Plays, old.Skips, old.LastPlayed, old.Favorite
+		}
+		if t.Rating < 0 {
+			t.Rating = old.Rating
+		}
+		l.tracks[id] = t
+	}
+	l.version++
+	return nil
+}
+
+// RemoveTracks removes the mp3s in the library root `library` with the paths `removed`, and the mp3s
+// that were moved (the keys of `moved`).
+func (l *MemLibrary) RemoveTracks(library string, removed []string, moved map[string]string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, p := range removed {
+		delete(l.tracks, trackId{library, p})
+	}
+	for from, to := range moved {
+		old, ok := l.tracks[trackId{library, from}]
+		if t, exists := l.tracks[trackId{library, to}]; ok && exists {
+			t.Plays += old.Plays
+			t.Skips += old.Skips
+			if old.LastPlayed > t.LastPlayed {
+				t.LastPlayed = old.LastPlayed
+			}
+			if t.Rating <= 0 {
+				t.Rating = old.Rating
+			}
+			t.Favorite = t.Favorite || old.Favorite
+			l.tracks[trackId{library, to}] = t
+		}
+		for i := range l.plays {
+			if l.plays[i].Library == library && l.plays[i].Path == from {
+				l.plays[i].Path = to
+			}
+		}
+		for _, p := range l.playlists {
+			for i := range p.Tracks {
+				if p.Tracks[i].Library == library && p.Tracks[i].Path == from {
+					p.Tracks[i].Path = to
+				}
+			}
+		}
+		delete(l.tracks, trackId{library, from})
+	}
+	l.version++
+	return nil
+}
+
+// ScanErrors returns the errors stored by the most recent scans, ordered by library and path.
+func (l *MemLibrary) ScanErrors() ([]*ScanError, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	errs := make([]*ScanError, 0, len(l.errs))
+	for _, e := range l.errs {
+		c := *e
+		errs = append(errs, &c)
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		if errs[i].Library != errs[j].Library {
+			return errs[i].Library < errs[j].Library
+		}
+		return errs[i].Path < errs[j].Path
+	})
+	return errs, nil
+}
+
+// StoreScanErrors updates the stored errors for the paths under `dir` after a scan. See Library.
+func (l *MemLibrary) StoreScanErrors(library, dir string, errs []*ScanError, ok []string, seen map[string]bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if seen != nil {
+		for id := range l.errs {
+			if id.library == library && isUnder(id.path, dir) && !seen[id.path] {
+				delete(l.errs, id)
+			}
+		}
+	}
+	for _, p := range ok {
+		delete(l.errs, trackId{library, p})
+	}
+	for _, e := range errs {
+		c := *e
+		c.Library = library
+		l.errs[trackId{library, e.Path}] = &c
+	}
+	return nil
+}
+
+// Roots returns the named library roots that have been scanned, ordered by name.
+func (l *MemLibrary) Roots() ([]Root, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	roots := make([]Root, 0, len(l.roots))
+	for _, r := range l.roots {
+		roots = append(roots, r)
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].Name < roots[j].Name })
+	return roots, nil
+}
+
+// PutRoot stores the library root `r`, replacing any with the same name.
+func (l *MemLibrary) PutRoot(r Root) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.roots[r.Name] = r
+	return nil
+}
+
+// AddPlay records the play `p` in the listening history, and counts it in the Plays or Skips and the
+// LastPlayed of its mp3.
+func (l *MemLibrary) AddPlay(p Play) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p.Artist, p.Album, p.Title = "", "", ""
+	l.plays = append(l.plays, p)
+
+	id := trackId{p.Library, p.Path}
+	if t, ok := l.tracks[id]; ok {
+		if p.Skipped {
+			t.Skips++
+		} else {
+			t.Plays++
+		}
+		if p.Started > t.LastPlayed {
+			t.LastPlayed = p.Started
+		}
+		l.tracks[id] = t
+	}
+	return nil
+}
+
+// Plays returns the plays in the listening history selected by the query `q`, most recent first.
+func (l *MemLibrary) Plays(q *PlayQuery) (plays []Play, hasMore bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	plays = make([]Play, 0)
+	// Most recently added first, so that plays started at the same time are in the order of Mp3Db
+	for i := len(l.plays) - 1; i >= 0; i-- {
+		p := l.plays[i]
+		if !q.matches(&p) {
+			continue
+		}
+		if t, ok := l.tracks[trackId{p.Library, p.Path}]; ok {
+			p.Artist, p.Album, p.Title = t.Artist, t.Album, t.Title
+		}
+		plays = append(plays, p)
+	}
+	sort.SliceStable(plays, func(i, j int) bool { return plays[i].Started > plays[j].Started })
+
+	if q.Paging != nil {
+		start := q.Paging.Page * q.Paging.PageSize
+		if start > len(plays) {
+			start = len(plays)
+		}
+		end := start + q.Paging.PageSize
+		if end < len(plays) {
+			hasMore = true
+		} else {
+			end = len(plays)
+		}
+		plays = plays[start:end]
+	}
+	return
+}
+
+// Rate sets the rating of the mp3 in the library root `library` with path `path`.
+func (l *MemLibrary) Rate(library, path string, rating int) error {
+	if err := checkRating(rating); err != nil {
+		return err
+	}
+	return l.update(library, path, func(t *Track) { t.Rating = rating })
+}
+
+// SetFavorite marks the mp3 in the library root `library` with path `path` as a favorite or not.
+func (l *MemLibrary) SetFavorite(library, path string, favorite bool) error {
+	return l.update(library, path, func(t *Track) { t.Favorite = favorite })
+}
+
+// update calls `f` to change the mp3 in the library root `library` with path `path`.
+func (l *MemLibrary) update(library, path string, f func(t *Track)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	id := trackId{library, path}
+	t, ok := l.tracks[id]
+	if !ok {
+		return ErrNoTrack
+	}
+	f(&t)
+	l.tracks[id] = t
+	return nil
+}
+
+// Playlists returns the saved playlists without their tracks, ordered by name.
+func (l *MemLibrary) Playlists() ([]Playlist, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	playlists := make([]Playlist, 0, len(l.playlists))
+	for _, p := range l.playlists {
+		c := *p
+		c.Length = len(p.Tracks)
+		c.Tracks = nil
+		playlists = append(playlists, c)
+	}
+	sort.Slice(playlists, func(i, j int) bool {
+		if playlists[i].Name != playlists[j].Name {
+			return playlists[i].Name < playlists[j].Name
+		}
+		return playlists[i].Id < playlists[j].Id
+	})
+	return playlists, nil
+}
+
+// Playlist returns the playlist with id `id` and its tracks.
+func (l *MemLibrary) Playlist(id int64) (*Playlist, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, ok := l.playlists[id]
+	if !ok {
+		return nil, ErrNoPlaylist
+	}
+
+	c := *p
+	c.Length = len(p.Tracks)
+	c.Tracks = make([]Track, len(p.Tracks))
+	for i, t := range p.Tracks {
+		c.Tracks[i] = Track{Library: t.Library, Path: t.Path, Tracknum: -1}
+		if s, ok := l.tracks[trackId{t.Library, t.Path}]; ok {
+			c.Tracks[i].Artist, c.Tracks[i].Album, c.Tracks[i].Title = s.Artist, s.Album, s.Title
+			c.Tracks[i].Tracknum, c.Tracks[i].Duration = s.Tracknum, s.Duration
+		}
+	}
+	return &c, nil
+}
+
+// playlistTracks returns the Library and Path of `tracks`.
+func playlistTracks(tracks []Track) []Track {
+	l := make([]Track, len(tracks))
+	for i, t := range tracks {
+		l[i] = Track{Library: t.Library, Path: t.Path}
+	}
+	return l
+}
+
+// nameUsed returns true if a playlist other than the one with id `id` is named `name`.
+func (l *MemLibrary) nameUsed(name string, id int64) bool {
+	for _, p := range l.playlists {
+		if p.Name == name && p.Id != id {
+			return true
+		}
+	}
+	return false
+}
+
+// CreatePlaylist saves a new playlist named `name` holding `tracks` and returns its id.
+func (l *MemLibrary) CreatePlaylist(name string, tracks []Track) (int64, error) {
+	if err := checkPlaylistName(name); err != nil {
+		return 0, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.nameUsed(name, 0) {
+		return 0, ErrPlaylistExists
+	}
+
+	now := time.Now().Unix()
+	p := &Playlist{Id: l.nextPlaylistId, Name: name, Created: now, Modified: now, Tracks: playlistTracks(tracks)}
+	l.playlists[p.Id] = p
+	l.nextPlaylistId++
+	return p.Id, nil
+}
+
+// ImportedFiles returns the playlist files in the library root `library` imported by ImportPlaylist
+// whose path is `dir`, or is under the directory dir, ordered by path.
+func (l *MemLibrary) ImportedFiles(library, dir string) ([]ImportedFile, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	files := make([]ImportedFile, 0)
+	for id, f := range l.imported {
+		if id.library == library && isUnder(id.path, dir) {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// ImportPlaylist stores the playlist named `name` holding `tracks` read from the playlist file `f`.
+// See Mp3Db.ImportPlaylist.
+func (l *MemLibrary) ImportPlaylist(f ImportedFile, name string, tracks []Track) (id int64, changed bool, err error) {
+	if err = checkPlaylistName(name); err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.imported[trackId{f.Library, f.Path}] = f
+	now := time.Now().Unix()
+
+	for _, p := range l.playlists {
+		if p.FileLibrary == f.Library && p.File == f.Path {
+			if sameTracks(p.Tracks, tracks) {
+				return p.Id, false, nil
+			}
+			p.Tracks = playlistTracks(tracks)
+			p.Modified = now
+			return p.Id, true, nil
+		}
+	}
+
+	n := name
+	for i := 2; l.nameUsed(n, 0); i++ {
+		n = importedName(name, i)
+	}
+	p := &Playlist{Id: l.nextPlaylistId, Name: n, Created: now, Modified: now, FileLibrary: f.Library, File: f.Path, Tracks: playlistTracks(tracks)}
+	l.playlists[p.Id] = p
+	l.nextPlaylistId++
+	return p.Id, true, nil
+}
+
+// changePlaylist calls `f` to change the playlist with id `id`, and updates its modification time.
+func (l *MemLibrary) changePlaylist(id int64, f func(p *Playlist) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, ok := l.playlists[id]
+	if !ok {
+		return ErrNoPlaylist
+	}
+	if err := f(p); err != nil {
+		return err
+	}
+	p.Modified = time.Now().Unix()
+	return nil
+}
+
+// EditPlaylist calls `f` with the playlist with id `id` and then stores the tracks f leaves in it.
+// See Mp3Db.EditPlaylist.
+func (l *MemLibrary) EditPlaylist(id int64, f func(p *Playlist) error) error {
+	return l.changePlaylist(id, func(p *Playlist) error {
+		c := *p
+		c.Length = len(p.Tracks)
+		c.Tracks = playlistTracks(p.Tracks)
+		if err := f(&c); err != nil {
+			return err
+		}
+		p.Tracks = playlistTracks(c.Tracks)
+		return nil
+	})
+}
+
+// RenamePlaylist renames the playlist with id `id` to `name`.
+func (l *MemLibrary) RenamePlaylist(id int64, name string) error {
+	if err := checkPlaylistName(name); err != nil {
+		return err
+	}
+	return l.changePlaylist(id, func(p *Playlist) error {
+		if l.nameUsed(name, id) {
+			return ErrPlaylistExists
+		}
+		p.Name = name
+		return nil
+	})
+}
+
+// SetPlaylistTracks replaces the tracks of the playlist with id `id` with `tracks`.
+func (l *MemLibrary) SetPlaylistTracks(id int64, tracks []Track) error {
+	return l.changePlaylist(id, func(p *Playlist) error {
+		p.Tracks = playlistTracks(tracks)
+		return nil
+	})
+}
+
+// SetPlaylistRules sets the rules of the playlist with id `id`.
+func (l *MemLibrary) SetPlaylistRules(id int64, rules string) error {
+	return l.changePlaylist(id, func(p *Playlist) error {
+		p.Rules = rules
+		return nil
+	})
+}
+
+// DeletePlaylist deletes the playlist with id `id`.
+func (l *MemLibrary) DeletePlaylist(id int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.playlists[id]; !ok {
+		return ErrNoPlaylist
+	}
+	delete(l.playlists, id)
+	return nil
+}
+
+// Close does nothing; a MemLibrary has no resources to release.
+func (l *MemLibrary) Close() {}
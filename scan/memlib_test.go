@@ -0,0 +1,101 @@
+package scan
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestMemLibrary checks that a MemLibrary finds the same mp3s as an Mp3Db.
+func TestMemLibrary(test *testing.T) {
+	db := createQueryTestDb(test)
+	defer db.Close()
+
+	tracks, err := db.TracksUnder("", "/")
+	if err != nil || len(tracks) != 4 {
+		test.Fatalf("Unexpected tracks %v (%v)", tracks, err)
+	}
+
+	lib := NewMemLibrary()
+	if err = lib.PutTracks(tracks); err != nil {
+		test.Fatal("Adding tracks failed: ", err)
+	}
+
+	queries := []Query{
+		{Fields: []string{"artist"}},
+		{Fields: []string{"artist", "album"}, Order: []Sort{{"album", true}}},
+		{Fields: []string{"title"}, Paging: &Paging{PageSize: 1, Page: 2}},
+		{Text: "beatles abbey"},
+		{Fuzzy: true, Where: []Condition{{"artist", Substring, "beatels"}}},
+	}
+	for _, c := range queryTestCases {
+		queries = append(queries, c.q)
+	}
+
+	for i := range queries {
+		q := &queries[i]
+		expected, expectedMore, err := db.FindTracks(q)
+		if err != nil {
+			test.Fatalf("Query %+v failed: %v", q, err)
+		}
+		found, more, err := lib.FindTracks(q)
+		if err != nil {
+			test.Fatalf("Query %+v of the MemLibrary failed: %v", q, err)
+		}
+
+		e, f := make([]string, len(expected)), make([]string, len(found))
+		for j := range expected {
+			e[j] = strings.Join(mapValues(expected[j].Map(q.Fields), q.fields()), "|")
+		}
+		for j := range found {
+			f[j] = strings.Join(mapValues(found[j].Map(q.Fields), q.fields()), "|")
+		}
+		if q.Text != "" && len(q.Order) == 0 {
+			// A MemLibrary doesn't rank free-text searches.
+			sort.Strings(e)
+			sort.Strings(f)
+		}
+		if strings.Join(e, ",") != strings.Join(f, ",") || more != expectedMore {
+			test.Errorf("Query %+v: expected %v (more %v) but the MemLibrary found %v (more %v)", q, e, expectedMore, f, more)
+		}
+	}
+
+	if _, _, err = lib.FindTracks(&Query{Fields: []string{"nope"}}); err == nil {
+		test.Error("Expected an error for an unknown field")
+	}
+}
+
+func TestMemLibraryScan(test *testing.T) {
+	dir := createTestTree(test, "a/one.mp3", "a/two.mp3", "b/three.mp3")
+	defer os.RemoveAll(dir)
+
+	lib := NewMemLibrary()
+
+	sum := ScanMp3sToDbWithOptions(context.Background(), dir, lib, nil, nil, &Options{Prune: true})
+	if sum.Added != 3 {
+		test.Fatalf("First scan: unexpected summary %v", sum)
+	}
+
+	sum = ScanMp3sToDb(context.Background(), dir, lib, nil, nil)
+	if sum != (Summary{Found: 3, Unchanged: 3}) {
+		test.Fatalf("Second scan: unexpected summary %v", sum)
+	}
+
+	os.Remove(filepath.Join(dir, "a/one.mp3"))
+	sum = ScanMp3sToDbWithOptions(context.Background(), dir, lib, nil, nil, &Options{Prune: true})
+	if sum.Prune == nil || len(sum.Prune.Removed) != 1 {
+		test.Fatalf("Third scan: unexpected summary %v", sum)
+	}
+
+	if titles := strings.Join(findTitles(test, lib, &Query{Order: []Sort{{Field: "title"}}}), ","); titles != "three,two" {
+		test.Fatalf("Unexpected mp3s after pruning: %s", titles)
+	}
+
+	s, err := lib.Suggest("thr", nil, 0)
+	if err != nil || len(s) != 1 || s[0].Value != "three" {
+		test.Fatalf("Unexpected suggestions %v (%v)", s, err)
+	}
+}
@@ -0,0 +1,296 @@
+package scan
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrNoSchema is returned when opening a database that has no mp3 table, like an empty database
+// or a mistyped file name. Such a database must be created with CreateMp3Db.
+var ErrNoSchema = errors.New("The database has no mp3 table")
+
+// Migration describes a change to the schema of the mp3 database.
+type Migration struct {
+	// The schema version after the migration is applied
+	Version     int
+	Description string
+	// Statements that perform the migration
+	stmts []string
+}
+
+// migrations holds all the changes to the schema, in order. To change the schema, append a
+// migration here; never modify one that has been released, since databases may already have it applied.
+var migrations = []Migration{
+	{1, "create the mp3 table", []string{
+		`create table mp3(path text not null primary key, artist text, album text, title text, tracknum int)`,
+	}},
+	{2, "add the audio stream properties of mp3s", []string{
+		`alter table mp3 add column duration real not null default 0`,
+		`alter table mp3 add column bitrate int not null default 0`,
+		`alter table mp3 add column rate int not null default 0`,
+		`alter table mp3 add column channels int not null default 0`,
+		`alter table mp3 add column vbr int not null default 0`,
+	}},
+	{3, "add the file size and modification time of mp3s, for incremental scans", []string{
+		`alter table mp3 add column size int not null default 0`,
+		`alter table mp3 add column mtime int not null default 0`,
+	}},
+	{4, "create the scan_errors table", []string{
+		`create table scan_errors(path text not null primary key, phase text not null,
+			message text not null, time int not null default 0)`,
+	}},
+	{5, "add the genre and lyrics of mp3s", []string{
+		`alter table mp3 add column genre text not null default ''`,
+		`alter table mp3 add column lyrics text not null default ''`,
+	}},
+	{6, "count changes to the mp3 table, so that indexes built from it know when they are out of date", []string{
+		`create table library_version(version int not null)`,
+		`insert into library_version(version) values(0)`,
+		`create trigger library_version_insert after insert on mp3 begin
+			update library_version set version = version + 1;
+		end`,
+		`create trigger library_version_delete after delete on mp3 begin
+			update library_version set version = version + 1;
+		end`,
+		`create trigger library_version_update after update on mp3 begin
+			update library_version set version = version + 1;
+		end`,
+	}},
+	{7, "add named library roots; identify mp3s and scan errors by their library and their path relative to its root", []string{
+		`create table library_roots(name text not null primary key, path text not null)`,
+		`create table mp3_new(library text not null default '', path text not null, artist text, album text,
+			title text, tracknum int, duration real not null default 0, bitrate int not null default 0,
+			rate int not null default 0, channels int not null default 0, vbr int not null default 0,
+			size int not null default 0, mtime int not null default 0, genre text not null default '',
+			lyrics text not null default '', primary key(library, path))`,
+		`insert into mp3_new(path, artist, album, title, tracknum, duration, bitrate, rate, channels, vbr, size, mtime, genre, lyrics)
+			select path, artist, album, title, tracknum, duration, bitrate, rate, channels, vbr, size, mtime, genre, lyrics from mp3`,
+		// Dropping the table drops its triggers. The full-text index notices that its triggers are
+		// missing and is rebuilt when the database is opened (see ensureFullText).
+		`drop table mp3`,
+		`alter table mp3_new rename to mp3`,
+		`create trigger library_version_insert after insert on mp3 begin
+			update library_version set version = version + 1;
+		end`,
+		`create trigger library_version_delete after delete on mp3 begin
+			update library_version set version = version + 1;
+		end`,
+		`create trigger library_version_update after update on mp3 begin
+			update library_version set version = version + 1;
+		end`,
+		`update library_version set version = version + 1`,
+		`create table scan_errors_new(library text not null default '', path text not null, phase text not null,
+			message text not null, time int not null default 0, primary key(library, path))`,
+		`insert into scan_errors_new(path, phase, message, time) select path, phase, message, time from scan_errors`,
+		`drop table scan_errors`,
+		`alter table scan_errors_new rename to scan_errors`,
+	}},
+	{8, "add the audio hash and acoustic fingerprint of mp3s, for finding duplicates", []string{
+		`alter table mp3 add column audio_hash text not null default ''`,
+		`alter table mp3 add column fingerprint text not null default ''`,
+		`create index mp3_audio_hash on mp3(audio_hash)`,
+	}},
+	{9, "add the year of release of mp3s", []string{
+		`alter table mp3 add column year int not null default 0`,
+	}},
+	{10, "create the plays table for the listening history, and count the plays and skips of mp3s", []string{
+		`create table plays(id integer primary key, library text not null default '', path text not null,
+			started int not null, ended int not null, completion real not null default 0, skipped int not null default 0)`,
+		`create index plays_started on plays(started)`,
+		`create index plays_track on plays(library, path)`,
+		`alter table mp3 add column plays int not null default 0`,
+		`alter table mp3 add column skips int not null default 0`,
+		`alter table mp3 add column last_played int not null default 0`,
+	}},
+	{11, "add the rating and favorite flag of mp3s", []string{
+		`alter table mp3 add column rating int not null default 0`,
+		`alter table mp3 add column favorite int not null default 0`,
+	}},
+	{12, "create the tables for saved playlists", []string{
+		`create table playlists(id integer primary key, name text not null unique, created int not null default 0,
+			modified int not null default 0)`,
+		`create table playlist_tracks(playlist int not null, position int not null, library text not null default '',
+			path text not null, primary key(playlist, position))`,
+		`create index playlist_tracks_track on playlist_tracks(library, path)`,
+	}},
+	{13, "add the playlist file that saved playlists were imported from", []string{
+		`alter table playlists add column file_library text not null default ''`,
+		`alter table playlists add column file text not null default ''`,
+	}},
+	{14, "add the rules of smart playlists", []string{
+		`alter table playlists add column rules text not null default ''`,
+	}},
+	{15, "create the table of imported playlist files", []string{
+		`create table imported_files(library text not null default '', path text not null, size int not null,
+			mtime int not null, primary key(library, path))`,
+	}},
+	{16, "only count changes to the tags of mp3s in the library version, not to their plays or ratings", []string{
+		`drop trigger if exists library_version_update`,
+		`create trigger library_version_update after update of library, path, artist, album, title, genre, lyrics on mp3 begin
+			update library_version set version = version + 1;
+		end`,
+	}},
+	{17, "give mp3s an id that VACUUM doesn't renumber, for the full-text index to refer to them by", []string{
+		`create table mp3_new(id integer primary key, library text not null default '', path text not null, artist text,
+			album text, title text, tracknum int, duration real not null default 0, bitrate int not null default 0,
+			rate int not null default 0, channels int not null default 0, vbr int not null default 0,
+			size int not null default 0, mtime int not null default 0, genre text not null default '',
+			lyrics text not null default '', audio_hash text not null default '', fingerprint text not null default '',
+			year int not null default 0, plays int not null default 0, skips int not null default 0,
+			last_played int not null default 0, rating int not null default 0, favorite int not null default 0,
+			unique(library, path))`,
+		`insert into mp3_new(id, library, path, artist, album, title, tracknum, duration, bitrate, rate, channels, vbr, size, mtime, genre, lyrics, audio_hash, fingerprint, year, plays, skips, last_played, rating, favorite)
+			select rowid, library, path, artist, album, title, tracknum, duration, bitrate, rate, channels, vbr, size, mtime, genre, lyrics, audio_hash, fingerprint, year, plays, skips, last_played, rating, favorite from mp3`,
+		// As in version 7, the full-text index is rebuilt when the database is next opened.
+		`drop table mp3`,
+		`alter table mp3_new rename to mp3`,
+		`create index mp3_audio_hash on mp3(audio_hash)`,
+		`create trigger library_version_insert after insert on mp3 begin
+			update library_version set version = version + 1;
+		end`,
+		`create trigger library_version_delete after delete on mp3 begin
+			update library_version set version = version + 1;
+		end`,
+		`create trigger library_version_update after update of library, path, artist, album, title, genre, lyrics on mp3 begin
+			update library_version set version = version + 1;
+		end`,
+	}},
+}
+
+// SchemaVersion returns the version of the schema of the database `db`. An empty database has version 0.
+func SchemaVersion(db *sql.DB) (version int, err error) {
+	exists, err := tableExists(db, "schema_version")
+	if err != nil {
+		return
+	}
+
+	if exists {
+		err = db.QueryRow("select version from schema_version").Scan(&version)
+		return
+	}
+
+	return guessSchemaVersion(db)
+}
+
+// guessSchemaVersion finds the schema version of a database created before the schema was versioned.
+func guessSchemaVersion(db *sql.DB) (version int, err error) {
+	exists, err := tableExists(db, "mp3")
+	if err != nil || !exists {
+		return
+	}
+	version = 1
+
+	cols, err := tableColumns(db, "mp3")
+	if err != nil {
+		return
+	}
+	if cols["duration"] {
+		version = 2
+	}
+	if cols["mtime"] {
+		version = 3
+	}
+
+	exists, err = tableExists(db, "scan_errors")
+	if err == nil && exists {
+		version = 4
+	}
+	return
+}
+
+func tableExists(db *sql.DB, name string) (bool, error) {
+	var n int
+	err := db.QueryRow("select count(*) from sqlite_master where type = 'table' and name = ?", name).Scan(&n)
+	return n > 0, err
+}
+
+// tableColumns returns the set of the names of the columns of the table `name`.
+func tableColumns(db *sql.DB, name string) (cols map[string]bool, err error) {
+	rows, err := db.Query("select name from pragma_table_info(?)", name)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	cols = make(map[string]bool)
+	for rows.Next() {
+		var c string
+		if err = rows.Scan(&c); err != nil {
+			return
+		}
+		cols[c] = true
+	}
+	err = rows.Err()
+	return
+}
+
+// PendingMigrations returns the migrations that Migrate would apply to the database `db`.
+func PendingMigrations(db *sql.DB) (pending []Migration, err error) {
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return
+	}
+
+	if version > len(migrations) {
+		err = fmt.Errorf("The database schema version %d is newer than the latest version %d supported", version, len(migrations))
+		return
+	}
+
+	return migrations[version:], nil
+}
+
+// Migrate brings the schema of the database `db` up to date by applying the pending migrations
+// in order. Each migration is applied in its own transaction along with the update of the schema
+// version, so if a migration fails the database is left at the previous version. The migrations
+// that were applied are returned.
+func Migrate(db *sql.DB) (applied []Migration, err error) {
+	pending, err := PendingMigrations(db)
+	if err != nil {
+		return
+	}
+
+	for _, m := range pending {
+		if err = applyMigration(db, m); err != nil {
+			err = fmt.Errorf("Migrating the database to version %d (%s) failed: %v", m.Version, m.Description, err)
+			return
+		}
+		applied = append(applied, m)
+	}
+
+	if len(applied) == 0 && len(migrations) > 0 {
+		// Record the version of up to date databases created before the schema was versioned.
+		var exists bool
+		exists, err = tableExists(db, "schema_version")
+		if err == nil && !exists {
+			err = applyMigration(db, Migration{Version: len(migrations)})
+		}
+	}
+	return
+}
+
+func applyMigration(db *sql.DB, m Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmts := append([]string{
+		`create table if not exists schema_version(version int not null)`,
+		`delete from schema_version`,
+	}, m.stmts...)
+
+	for _, s := range stmts {
+		if _, err := tx.Exec(s); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("insert into schema_version(version) values(?)", m.Version); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,123 @@
+package scan
+
+import (
+	"context"
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate(test *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		test.Fatal("Opening database failed: ", err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+
+	// A database created before the schema was versioned
+	_, err = db.Exec(`create table mp3(path text not null primary key, artist text, album text, title text, tracknum int);
+		insert into mp3 values('/a/one.mp3', 'artist', 'album', 'one', 1);`)
+	if err != nil {
+		test.Fatal("Creating old database failed: ", err)
+	}
+
+	pending, err := PendingMigrations(db)
+	if err != nil || len(pending) != len(migrations)-1 || pending[0].Version != 2 {
+		test.Fatalf("Unexpected pending migrations %v (%v)", pending, err)
+	}
+
+	mp3db, err := OpenMp3Db(db)
+	if err != nil {
+		test.Fatal("Opening old database failed: ", err)
+	}
+
+	if v, err := SchemaVersion(db); err != nil || v != len(migrations) {
+		test.Fatalf("Expected schema version %d but got %d (%v)", len(migrations), v, err)
+	}
+
+	var title string
+	var size, id int64
+	err = mp3db.DB.QueryRow("select title, size, id from mp3 where path = '/a/one.mp3'").Scan(&title, &size, &id)
+	if err != nil || title != "one" || size != 0 || id != 1 {
+		test.Fatalf("Mp3 not kept after migrating: %v %v %v (%v)", title, size, id, err)
+	}
+
+	applied, err := Migrate(db)
+	if err != nil || len(applied) != 0 {
+		test.Fatalf("Migrating an up to date database applied %v (%v)", applied, err)
+	}
+}
+
+// TestOpenBaseline opens a database created by the version of CreateMp3Db from before the audio
+// properties and file attributes of mp3s were stored, and scans into it.
+func TestOpenBaseline(test *testing.T) {
+	dir := createTestTree(test, "a/one.mp3", "a/two.mp3")
+	defer os.RemoveAll(dir)
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		test.Fatal("Opening database failed: ", err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+
+	_, err = db.Exec(`create table mp3(path text not null primary key, artist text, album text, title text, tracknum int);`)
+	if err == nil {
+		_, err = db.Exec("insert into mp3 values(?, 'artist', 'album', 'one', 1)", filepath.Join(dir, "a/one.mp3"))
+	}
+	if err != nil {
+		test.Fatal("Creating baseline database failed: ", err)
+	}
+
+	mp3db, err := OpenMp3Db(db)
+	if err != nil {
+		test.Fatal("Opening baseline database failed: ", err)
+	}
+
+	// The mp3 from before has no file attributes, so it is read again.
+	sum := ScanMp3sToDb(context.Background(), dir, mp3db, nil, nil)
+	if sum.Added != 1 || sum.Updated != 1 || sum.Errors != 0 {
+		test.Fatalf("Scanning into the baseline database: unexpected summary %v", sum)
+	}
+	sum = ScanMp3sToDb(context.Background(), dir, mp3db, nil, nil)
+	if sum.Unchanged != 2 {
+		test.Fatalf("Rescanning the baseline database: unexpected summary %v", sum)
+	}
+
+	tracks, _, err := mp3db.FindTracks(&Query{Fields: []string{"path", "size", "mtime"}, Order: []Sort{{Field: "path"}}})
+	if err != nil || len(tracks) != 2 {
+		test.Fatalf("Unexpected mp3s %v (%v)", tracks, err)
+	}
+	for _, t := range tracks {
+		if t.Size == 0 || t.Mtime == 0 {
+			test.Fatalf("File attributes not stored for %+v", t)
+		}
+	}
+}
+
+func TestOpenEmpty(test *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		test.Fatal("Opening database failed: ", err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+
+	// Opening a database that was never created doesn't create it.
+	if _, err = OpenMp3Db(db); err != ErrNoSchema {
+		test.Fatalf("Expected ErrNoSchema opening an empty database but got %v", err)
+	}
+	if exists, err := tableExists(db, "schema_version"); err != nil || exists {
+		test.Fatalf("Opening an empty database changed it (%v)", err)
+	}
+
+	if _, err = CreateMp3Db(db); err != nil {
+		test.Fatal("Creating the database failed: ", err)
+	}
+	if _, err = OpenMp3Db(db); err != nil {
+		test.Fatal("Opening the created database failed: ", err)
+	}
+}
@@ -0,0 +1,526 @@
+package scan
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Playlist is a named, ordered list of mp3s saved in the library.
+type Playlist struct {
+	Id   int64
+	Name string
+	// When the playlist was created and last changed, as unix times
+	Created  int64
+	Modified int64
+	// Number of mp3s in the playlist
+	Length int
+	// If the playlist was imported from a playlist file found by a scan, the library root and path
+	// of the file (see Track). Otherwise they are empty.
+	FileLibrary string
+	File        string
+	// If the playlist is a smart playlist, the rules that select its mp3s as JSON (see SmartRules).
+	// Its tracks are the mp3s the rules selected when it was last refreshed. Empty for other playlists.
+	Rules string
+	// The mp3s, in order. They are only set by Library.Playlist. Library and Path are always set;
+	// Artist, Album, Title, Tracknum and Duration are set if the mp3 is still in the library.
+	Tracks []Track
+}
+
+var (
+	// ErrNoPlaylist is returned when reading or changing a playlist that doesn't exist.
+	ErrNoPlaylist = errors.New("No such playlist")
+	// ErrPlaylistExists is returned when creating or renaming a playlist to a name that is already used.
+	ErrPlaylistExists = errors.New("A playlist with that name already exists")
+)
+
+// checkPlaylistName returns an error if `name` can't be used as the name of a playlist.
+func checkPlaylistName(name string) error {
+	if len(strings.TrimSpace(name)) == 0 {
+		return errors.New("The playlist name is empty")
+	}
+	return nil
+}
+
+// Playlists returns the saved playlists without their tracks, ordered by name.
+func (m Mp3Db) Playlists() ([]Playlist, error) {
+	rows, err := m.DB.Query(`select p.id, p.name, p.created, p.modified, count(t.position), p.file_library, p.file, p.rules
+		from playlists p left join playlist_tracks t on t.playlist = p.id
+		group by p.id order by p.name, p.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	playlists := make([]Playlist, 0)
+	for rows.Next() {
+		var p Playlist
+		if err := rows.Scan(&p.Id, &p.Name, &p.Created, &p.Modified, &p.Length, &p.FileLibrary, &p.File, &p.Rules); err != nil {
+			return nil, err
+		}
+		playlists = append(playlists, p)
+	}
+	return playlists, rows.Err()
+}
+
+// Playlist returns the playlist with id `id` and its tracks. ErrNoPlaylist is returned if there is none.
+func (m Mp3Db) Playlist(id int64) (*Playlist, error) {
+	p := &Playlist{Id: id}
+	err := m.DB.QueryRow("select name, created, modified, file_library, file, rules from playlists where id = ?", id).Scan(
+		&p.Name, &p.Created, &p.Modified, &p.FileLibrary, &p.File, &p.Rules)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoPlaylist
+	} else if err != nil {
+		return nil, err
+	}
+
+	rows, err := m.DB.Query(`select t.library, t.path, coalesce(m.artist, ''), coalesce(m.album, ''), coalesce(m.title, ''),
+		coalesce(m.tracknum, -1), coalesce(m.duration, 0)
+		from playlist_tracks t left join mp3 m on m.library = t.library and m.path = t.path
+		where t.playlist = ? order by t.position`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	p.Tracks = make([]Track, 0)
+	for rows.Next() {
+		var t Track
+		if err := rows.Scan(&t.Library, &t.Path, &t.Artist, &t.Album, &t.Title, &t.Tracknum, &t.Duration); err != nil {
+			return nil, err
+		}
+		p.Tracks = append(p.Tracks, t)
+	}
+	p.Length = len(p.Tracks)
+	return p, rows.Err()
+}
+
+// CreatePlaylist saves a new playlist named `name` holding `tracks`, of which only the Library and
+// Path are used, and returns its id. ErrPlaylistExists is returned if the name is already used.
+func (m Mp3Db) CreatePlaylist(name string, tracks []Track) (id int64, err error) {
+	if err = checkPlaylistName(name); err != nil {
+		return
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("creating transaction failed: %v", err)
+	}
+
+	if err = checkNameFree(tx, name, 0); err != nil {
+		tx.Rollback()
+		return
+	}
+
+	now := time.Now().Unix()
+	r, err := tx.Exec("insert into playlists(name, created, modified) values(?,?,?)", name, now, now)
+	if err == nil {
+		id, err = r.LastInsertId()
+	}
+	if err == nil {
+		err = insertPlaylistTracks(tx, id, tracks)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("creating playlist failed: %v", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit failed: %v", err)
+	}
+	return
+}
+
+// checkNameFree returns ErrPlaylistExists if a playlist other than the one with id `id` is named `name`.
+func checkNameFree(tx *sql.Tx, name string, id int64) error {
+	var n int
+	if err := tx.QueryRow("select count(*) from playlists where name = ? and id != ?", name, id).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrPlaylistExists
+	}
+	return nil
+}
+
+// insertPlaylistTracks stores `tracks` as the tracks of the playlist with id `id`, which has none.
+func insertPlaylistTracks(tx *sql.Tx, id int64, tracks []Track) error {
+	stmt, err := tx.Prepare("insert into playlist_tracks(playlist, position, library, path) values(?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i, t := range tracks {
+		if _, err = stmt.Exec(id, i, t.Library, t.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportedFiles returns the playlist files in the library root `library` imported by ImportPlaylist
+// whose path is `dir`, or is under the directory dir, ordered by path.
+func (m Mp3Db) ImportedFiles(library, dir string) ([]ImportedFile, error) {
+	where, args := underDir(dir)
+	args = append([]interface{}{library}, args...)
+
+	rows, err := m.DB.Query("select library, path, size, mtime from imported_files where library = ? and "+where+" order by path", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make([]ImportedFile, 0)
+	for rows.Next() {
+		var f ImportedFile
+		if err := rows.Scan(&f.Library, &f.Path, &f.Size, &f.Mtime); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// ImportPlaylist stores the playlist named `name` holding `tracks` read from the playlist file `f`,
+// and records f so that scans can skip the file until it changes. If a playlist was already imported
+// from the file its tracks are replaced, and its name is kept in case it was renamed. Otherwise a
+// new playlist is created named `name`, or with a number appended if the name is used. `changed` is
+// false if the playlist already held the same tracks.
+func (m Mp3Db) ImportPlaylist(f ImportedFile, name string, tracks []Track) (id int64, changed bool, err error) {
+	if err = checkPlaylistName(name); err != nil {
+		return
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, false, fmt.Errorf("creating transaction failed: %v", err)
+	}
+
+	id, changed, err = importPlaylist(tx, f, name, tracks)
+	if err == nil {
+		_, err = tx.Exec("insert or replace into imported_files(library, path, size, mtime) values(?,?,?,?)", f.Library, f.Path, f.Size, f.Mtime)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, false, fmt.Errorf("importing playlist failed: %v", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, false, fmt.Errorf("commit failed: %v", err)
+	}
+	return
+}
+
+// importPlaylist stores the playlist for Mp3Db.ImportPlaylist.
+func importPlaylist(tx *sql.Tx, f ImportedFile, name string, tracks []Track) (id int64, changed bool, err error) {
+	now := time.Now().Unix()
+
+	err = tx.QueryRow("select id from playlists where file_library = ? and file = ?", f.Library, f.Path).Scan(&id)
+	if err == nil {
+		var old []Track
+		if old, err = storedPlaylistTracks(tx, id); err != nil || sameTracks(old, tracks) {
+			return
+		}
+		if _, err = tx.Exec("update playlists set modified = ? where id = ?", now, id); err != nil {
+			return
+		}
+		if _, err = tx.Exec("delete from playlist_tracks where playlist = ?", id); err != nil {
+			return
+		}
+		return id, true, insertPlaylistTracks(tx, id, tracks)
+	} else if err != sql.ErrNoRows {
+		return
+	}
+
+	for i := 1; ; i++ {
+		n := importedName(name, i)
+		if err = checkNameFree(tx, n, 0); err == ErrPlaylistExists {
+			continue
+		} else if err != nil {
+			return
+		}
+
+		var r sql.Result
+		r, err = tx.Exec("insert into playlists(name, created, modified, file_library, file) values(?,?,?,?,?)", n, now, now, f.Library, f.Path)
+		if err == nil {
+			id, err = r.LastInsertId()
+		}
+		if err == nil {
+			err = insertPlaylistTracks(tx, id, tracks)
+		}
+		return id, true, err
+	}
+}
+
+// storedPlaylistTracks returns the Library and Path of the tracks of the playlist with id `id`.
+func storedPlaylistTracks(tx *sql.Tx, id int64) ([]Track, error) {
+	rows, err := tx.Query("select library, path from playlist_tracks where playlist = ? order by position", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tracks := make([]Track, 0)
+	for rows.Next() {
+		var t Track
+		if err := rows.Scan(&t.Library, &t.Path); err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks, rows.Err()
+}
+
+// importedName returns the name to try for the `n`th attempt at creating a playlist named `name`.
+func importedName(name string, n int) string {
+	if n == 1 {
+		return name
+	}
+	return fmt.Sprintf("%s (%d)", name, n)
+}
+
+// sameTracks returns true if `a` and `b` hold the same mp3s in the same order.
+func sameTracks(a, b []Track) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Library != b[i].Library || a[i].Path != b[i].Path {
+			return false
+		}
+	}
+	return true
+}
+
+// changePlaylist calls `f` in a transaction to change the playlist with id `id`, and updates its
+// modification time. ErrNoPlaylist is returned if there is no such playlist.
+func (m Mp3Db) changePlaylist(id int64, f func(tx *sql.Tx) error) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("creating transaction failed: %v", err)
+	}
+
+	r, err := tx.Exec("update playlists set modified = ? where id = ?", time.Now().Unix(), id)
+	if err == nil {
+		var n int64
+		if n, err = r.RowsAffected(); err == nil && n == 0 {
+			err = ErrNoPlaylist
+		}
+	}
+	if err == nil {
+		err = f(tx)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit failed: %v", err)
+	}
+	return nil
+}
+
+// EditPlaylist calls `f` with the playlist with id `id` in a transaction, and then stores the tracks
+// f leaves in it. The tracks only have Library and Path set, and only they are stored. If f returns
+// an error nothing is changed and the error is returned. ErrNoPlaylist is returned if there is no
+// such playlist.
+func (m Mp3Db) EditPlaylist(id int64, f func(p *Playlist) error) error {
+	return m.changePlaylist(id, func(tx *sql.Tx) error {
+		p := &Playlist{Id: id}
+		err := tx.QueryRow("select name, created, modified, file_library, file, rules from playlists where id = ?", id).Scan(
+			&p.Name, &p.Created, &p.Modified, &p.FileLibrary, &p.File, &p.Rules)
+		if err != nil {
+			return err
+		}
+		if p.Tracks, err = storedPlaylistTracks(tx, id); err != nil {
+			return err
+		}
+		p.Length = len(p.Tracks)
+
+		if err = f(p); err != nil {
+			return err
+		}
+		if _, err = tx.Exec("delete from playlist_tracks where playlist = ?", id); err != nil {
+			return err
+		}
+		return insertPlaylistTracks(tx, id, p.Tracks)
+	})
+}
+
+// RenamePlaylist renames the playlist with id `id` to `name`. ErrNoPlaylist is returned if there is
+// no such playlist, and ErrPlaylistExists if the name is already used by another.
+func (m Mp3Db) RenamePlaylist(id int64, name string) error {
+	if err := checkPlaylistName(name); err != nil {
+		return err
+	}
+	return m.changePlaylist(id, func(tx *sql.Tx) error {
+		if err := checkNameFree(tx, name, id); err != nil {
+			return err
+		}
+		_, err := tx.Exec("update playlists set name = ? where id = ?", name, id)
+		return err
+	})
+}
+
+// SetPlaylistTracks replaces the tracks of the playlist with id `id` with `tracks`, of which only
+// the Library and Path are used. ErrNoPlaylist is returned if there is no such playlist.
+func (m Mp3Db) SetPlaylistTracks(id int64, tracks []Track) error {
+	return m.changePlaylist(id, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("delete from playlist_tracks where playlist = ?", id); err != nil {
+			return err
+		}
+		return insertPlaylistTracks(tx, id, tracks)
+	})
+}
+
+// SetPlaylistRules sets the rules of the playlist with id `id`, making it a smart playlist, or a
+// static playlist if `rules` is empty. The rules aren't checked, and the tracks aren't changed; see
+// SetSmartRules. ErrNoPlaylist is returned if there is no such playlist.
+func (m Mp3Db) SetPlaylistRules(id int64, rules string) error {
+	return m.changePlaylist(id, func(tx *sql.Tx) error {
+		_, err := tx.Exec("update playlists set rules = ? where id = ?", rules, id)
+		return err
+	})
+}
+
+// DeletePlaylist deletes the playlist with id `id`. ErrNoPlaylist is returned if there is no such playlist.
+func (m Mp3Db) DeletePlaylist(id int64) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("creating transaction failed: %v", err)
+	}
+
+	r, err := tx.Exec("delete from playlists where id = ?", id)
+	if err == nil {
+		var n int64
+		if n, err = r.RowsAffected(); err == nil && n == 0 {
+			err = ErrNoPlaylist
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec("delete from playlist_tracks where playlist = ?", id)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit failed: %v", err)
+	}
+	return nil
+}
+
+// movePlaylistTracks points the playlist entries for the mp3 in the library root `library` with
+// path `from` to path `to`.
+func movePlaylistTracks(tx *sql.Tx, library, from, to string) error {
+	_, err := tx.Exec("update playlist_tracks set path = ? where library = ? and path = ?", to, library, from)
+	return err
+}
+
+// editStaticPlaylist replaces the tracks of the playlist with id `id` with the ones `f` returns,
+// given its current tracks, in one transaction. ErrSmartPlaylist is returned if it's a smart
+// playlist, whose tracks can't be changed directly.
+func editStaticPlaylist(lib Library, id int64, f func(l []Track) []Track) error {
+	return lib.EditPlaylist(id, func(p *Playlist) error {
+		if len(p.Rules) > 0 {
+			return ErrSmartPlaylist
+		}
+		p.Tracks = f(p.Tracks)
+		return nil
+	})
+}
+
+// AddToPlaylist inserts `tracks` into the playlist with id `id` before the track at `position`.
+// If position is negative or past the end the tracks are appended.
+// ErrSmartPlaylist is returned for smart playlists.
+func AddToPlaylist(lib Library, id int64, tracks []Track, position int) error {
+	return editStaticPlaylist(lib, id, func(old []Track) []Track {
+		if position < 0 || position > len(old) {
+			position = len(old)
+		}
+		l := make([]Track, 0, len(old)+len(tracks))
+		l = append(l, old[:position]...)
+		l = append(l, tracks...)
+		return append(l, old[position:]...)
+	})
+}
+
+// RemoveFromPlaylist removes the tracks at the positions `indexes` from the playlist with id `id`.
+// Positions that are out of range are ignored.
+// ErrSmartPlaylist is returned for smart playlists.
+func RemoveFromPlaylist(lib Library, id int64, indexes []int) error {
+	remove := make(map[int]bool, len(indexes))
+	for _, i := range indexes {
+		remove[i] = true
+	}
+	return editStaticPlaylist(lib, id, func(old []Track) []Track {
+		l := make([]Track, 0, len(old))
+		for i, t := range old {
+			if !remove[i] {
+				l = append(l, t)
+			}
+		}
+		return l
+	})
+}
+
+// MovePlaylistTracks moves the tracks at the positions `indexes` in the playlist with id `id` by
+// `delta` positions, keeping their order. Tracks stop at the start or end of the playlist.
+// ErrSmartPlaylist is returned for smart playlists.
+func MovePlaylistTracks(lib Library, id int64, indexes []int, delta int) error {
+	return editStaticPlaylist(lib, id, func(l []Track) []Track {
+		moving := make([]bool, len(l))
+		for _, i := range indexes {
+			if i >= 0 && i < len(l) {
+				moving[i] = true
+			}
+		}
+
+		step := 1
+		if delta < 0 {
+			step, delta = -1, -delta
+		}
+		// No track can move further than the length of the playlist.
+		if delta > len(l) {
+			delta = len(l)
+		}
+		for n := 0; n < delta; n++ {
+			// Move the tracks nearest the direction of travel first, so that they make room for the others.
+			for k := range l {
+				i := k
+				if step > 0 {
+					i = len(l) - 1 - k
+				}
+				j := i + step
+				if !moving[i] || j < 0 || j >= len(l) || moving[j] {
+					continue
+				}
+				l[i], l[j] = l[j], l[i]
+				moving[i], moving[j] = moving[j], moving[i]
+			}
+		}
+		return l
+	})
+}
+
+// DuplicatePlaylist saves a copy of the playlist with id `id` named `name`, and returns the id of the
+// copy. The copy of a smart playlist is a smart playlist with the same rules.
+func DuplicatePlaylist(lib Library, id int64, name string) (int64, error) {
+	p, err := lib.Playlist(id)
+	if err != nil {
+		return 0, err
+	}
+	copyId, err := lib.CreatePlaylist(name, p.Tracks)
+	if err == nil && len(p.Rules) > 0 {
+		if err = lib.SetPlaylistRules(copyId, p.Rules); err != nil {
+			lib.DeletePlaylist(copyId)
+			return 0, err
+		}
+	}
+	return copyId, err
+}
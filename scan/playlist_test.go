@@ -0,0 +1,154 @@
+package scan
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// playlistPaths returns the paths of the tracks of the playlist with id `id`.
+func playlistPaths(test *testing.T, lib Library, id int64) []string {
+	p, err := lib.Playlist(id)
+	if err != nil {
+		test.Fatal("Reading playlist failed: ", err)
+	}
+	paths := make([]string, len(p.Tracks))
+	for i, t := range p.Tracks {
+		paths[i] = t.Path
+	}
+	return paths
+}
+
+func samePaths(a []string, b ...string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPlaylists(test *testing.T) {
+	db := createTestDb(test)
+	defer db.Close()
+
+	for _, lib := range []Library{db, NewMemLibrary()} {
+		lib.PutTracks([]Track{{Path: "/a.mp3", Title: "A"}, {Path: "/b.mp3", Title: "B"}})
+
+		id, err := lib.CreatePlaylist("mix", []Track{{Path: "/a.mp3"}, {Path: "/b.mp3"}, {Path: "/c.mp3"}})
+		if err != nil {
+			test.Fatal("Creating playlist failed: ", err)
+		}
+		if _, err = lib.CreatePlaylist("mix", nil); err != ErrPlaylistExists {
+			test.Fatalf("Expected ErrPlaylistExists but got %v", err)
+		}
+
+		p, err := lib.Playlist(id)
+		if err != nil || p.Name != "mix" || p.Length != 3 || p.Tracks[0].Title != "A" || p.Tracks[2].Title != "" {
+			test.Fatalf("Unexpected playlist %+v (%v)", p, err)
+		}
+
+		if err = AddToPlaylist(lib, id, []Track{{Path: "/d.mp3"}, {Path: "/e.mp3"}}, 1); err != nil {
+			test.Fatal("Adding to playlist failed: ", err)
+		}
+		if paths := playlistPaths(test, lib, id); !samePaths(paths, "/a.mp3", "/d.mp3", "/e.mp3", "/b.mp3", "/c.mp3") {
+			test.Fatalf("Unexpected tracks after adding %v", paths)
+		}
+
+		if err = MovePlaylistTracks(lib, id, []int{1, 2}, -1); err != nil {
+			test.Fatal("Moving tracks failed: ", err)
+		}
+		if paths := playlistPaths(test, lib, id); !samePaths(paths, "/d.mp3", "/e.mp3", "/a.mp3", "/b.mp3", "/c.mp3") {
+			test.Fatalf("Unexpected tracks after moving up %v", paths)
+		}
+		if err = MovePlaylistTracks(lib, id, []int{0, 3}, 2); err != nil {
+			test.Fatal("Moving tracks failed: ", err)
+		}
+		if paths := playlistPaths(test, lib, id); !samePaths(paths, "/e.mp3", "/a.mp3", "/d.mp3", "/c.mp3", "/b.mp3") {
+			test.Fatalf("Unexpected tracks after moving down %v", paths)
+		}
+		// Huge moves stop at the end of the playlist.
+		if err = MovePlaylistTracks(lib, id, []int{0}, 1e15); err != nil {
+			test.Fatal("Moving tracks failed: ", err)
+		}
+		if paths := playlistPaths(test, lib, id); !samePaths(paths, "/a.mp3", "/d.mp3", "/c.mp3", "/b.mp3", "/e.mp3") {
+			test.Fatalf("Unexpected tracks after moving to the end %v", paths)
+		}
+		if err = MovePlaylistTracks(lib, id, []int{4}, -1e15); err != nil {
+			test.Fatal("Moving tracks failed: ", err)
+		}
+
+		if err = RemoveFromPlaylist(lib, id, []int{0, 3, 9}); err != nil {
+			test.Fatal("Removing tracks failed: ", err)
+		}
+		if paths := playlistPaths(test, lib, id); !samePaths(paths, "/a.mp3", "/d.mp3", "/b.mp3") {
+			test.Fatalf("Unexpected tracks after removing %v", paths)
+		}
+
+		copyId, err := DuplicatePlaylist(lib, id, "copy")
+		if err != nil || copyId == id {
+			test.Fatalf("Duplicating playlist failed: %v", err)
+		}
+		if err = lib.RenamePlaylist(id, "copy"); err != ErrPlaylistExists {
+			test.Fatalf("Expected ErrPlaylistExists but got %v", err)
+		}
+		if err = lib.RenamePlaylist(id, "a mix"); err != nil {
+			test.Fatal("Renaming playlist failed: ", err)
+		}
+
+		// Moving an mp3 updates the playlists.
+		lib.PutTracks([]Track{{Path: "/f.mp3"}})
+		if err = lib.RemoveTracks("", nil, map[string]string{"/a.mp3": "/f.mp3"}); err != nil {
+			test.Fatal("Moving track failed: ", err)
+		}
+
+		l, err := lib.Playlists()
+		if err != nil || len(l) != 2 || l[0].Name != "a mix" || l[0].Length != 3 || l[1].Name != "copy" || l[1].Tracks != nil {
+			test.Fatalf("Unexpected playlists %+v (%v)", l, err)
+		}
+		if paths := playlistPaths(test, lib, copyId); !samePaths(paths, "/f.mp3", "/d.mp3", "/b.mp3") {
+			test.Fatalf("Unexpected tracks of the copy %v", paths)
+		}
+
+		if err = lib.DeletePlaylist(id); err != nil {
+			test.Fatal("Deleting playlist failed: ", err)
+		}
+		if _, err = lib.Playlist(id); err != ErrNoPlaylist {
+			test.Fatalf("Expected ErrNoPlaylist but got %v", err)
+		}
+		if err = lib.SetPlaylistTracks(id, nil); err != ErrNoPlaylist {
+			test.Fatalf("Expected ErrNoPlaylist but got %v", err)
+		}
+	}
+}
+
+func TestConcurrentPlaylistEdits(test *testing.T) {
+	db := createTestDb(test)
+	defer db.Close()
+
+	for _, lib := range []Library{db, NewMemLibrary()} {
+		id, err := lib.CreatePlaylist("mix", nil)
+		if err != nil {
+			test.Fatal("Creating playlist failed: ", err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if err := AddToPlaylist(lib, id, []Track{{Path: fmt.Sprintf("/%d.mp3", i)}}, 0); err != nil {
+					test.Error("Adding to playlist failed: ", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if p, err := lib.Playlist(id); err != nil || p.Length != 10 {
+			test.Fatalf("Expected all 10 additions in the playlist but it is %+v (%v)", p, err)
+		}
+	}
+}
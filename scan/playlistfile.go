@@ -0,0 +1,474 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Formats of playlist files. Scans import playlist files in these formats as saved playlists, and
+// WritePlaylist writes playlists in them.
+const (
+	// Extended M3U. The encoding of .m3u files isn't specified; they are read as UTF-8 if they are
+	// valid UTF-8 and as Latin-1 otherwise, and are written as UTF-8.
+	FormatM3U = "m3u"
+	// Extended M3U encoded as UTF-8
+	FormatM3U8 = "m3u8"
+	// The PLS format used by Winamp and many players
+	FormatPLS = "pls"
+	// XML Shareable Playlist Format, see https://xspf.org
+	FormatXSPF = "xspf"
+)
+
+// PlaylistFormats are all the formats of playlist files.
+var PlaylistFormats = []string{FormatM3U, FormatM3U8, FormatPLS, FormatXSPF}
+
+var playlistRegexp *regexp.Regexp = regexp.MustCompile(`(?i)\.(m3u8?|pls|xspf)$`)
+
+// PlaylistFormat returns the format of the playlist file `path` from its extension, or the empty
+// string if it isn't a playlist file.
+func PlaylistFormat(path string) string {
+	m := playlistRegexp.FindStringSubmatch(path)
+	if m == nil {
+		return ""
+	}
+	return strings.ToLower(m[1])
+}
+
+// PlaylistContentType returns the MIME type of playlist files in the format `format`.
+func PlaylistContentType(format string) string {
+	switch format {
+	case FormatM3U:
+		return "audio/x-mpegurl"
+	case FormatM3U8:
+		return "audio/x-mpegurl; charset=utf-8"
+	case FormatPLS:
+		return "audio/x-scpls"
+	case FormatXSPF:
+		return "application/xspf+xml"
+	}
+	return "application/octet-stream"
+}
+
+// PlaylistFile is the contents of a playlist file.
+type PlaylistFile struct {
+	// Title of the playlist, or empty if the file doesn't have one
+	Title string
+	// The entries of the playlist in order, as written in the file. They may be absolute paths,
+	// paths relative to the directory of the file, or URLs.
+	Entries []string
+}
+
+// ReadPlaylistFile reads the playlist file `path`. Its format is found from its extension.
+func ReadPlaylistFile(path string) (*PlaylistFile, error) {
+	format := PlaylistFormat(path)
+	if len(format) == 0 {
+		return nil, fmt.Errorf("%s is not a playlist file", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadPlaylist(f, format)
+}
+
+// ReadPlaylist reads a playlist in the format `format` from `r`.
+func ReadPlaylist(r io.Reader, format string) (*PlaylistFile, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FormatM3U, FormatM3U8:
+		return readM3U(data), nil
+	case FormatPLS:
+		return readPLS(data), nil
+	case FormatXSPF:
+		return readXSPF(data)
+	}
+	return nil, fmt.Errorf("Unknown playlist format '%s'", format)
+}
+
+// textLines returns the lines of the text file `data`, decoding it as Latin-1 if it isn't valid UTF-8.
+func textLines(data []byte) []string {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	text := string(data)
+	if !utf8.Valid(data) {
+		r := make([]rune, len(data))
+		for i, b := range data {
+			r[i] = rune(b)
+		}
+		text = string(r)
+	}
+
+	lines := make([]string, 0)
+	s := bufio.NewScanner(strings.NewReader(text))
+	s.Buffer(nil, len(text)+1)
+	for s.Scan() {
+		lines = append(lines, strings.TrimSpace(s.Text()))
+	}
+	return lines
+}
+
+func readM3U(data []byte) *PlaylistFile {
+	p := &PlaylistFile{Entries: make([]string, 0)}
+	for _, line := range textLines(data) {
+		if strings.HasPrefix(line, "#PLAYLIST:") {
+			p.Title = strings.TrimSpace(strings.TrimPrefix(line, "#PLAYLIST:"))
+		} else if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			p.Entries = append(p.Entries, line)
+		}
+	}
+	return p
+}
+
+var plsFileRegexp *regexp.Regexp = regexp.MustCompile(`(?i)^file(\d+)$`)
+
+func readPLS(data []byte) *PlaylistFile {
+	type entry struct {
+		n    int
+		file string
+	}
+	entries := make([]entry, 0)
+
+	p := &PlaylistFile{Entries: make([]string, 0)}
+	for _, line := range textLines(data) {
+		i := strings.Index(line, "=")
+		if i < 0 {
+			continue
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if m := plsFileRegexp.FindStringSubmatch(key); m != nil && len(value) > 0 {
+			n, _ := strconv.Atoi(m[1])
+			entries = append(entries, entry{n, value})
+		} else if strings.EqualFold(key, "X-GNOME-Title") || strings.EqualFold(key, "Title") {
+			// Not part of the format, but written by some players.
+			p.Title = value
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].n < entries[j].n })
+	for _, e := range entries {
+		p.Entries = append(p.Entries, e.file)
+	}
+	return p
+}
+
+// xspfPlaylist is the XML of an XSPF playlist.
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"playlist"`
+	Version string      `xml:"version,attr"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location []string `xml:"location"`
+	Title    string   `xml:"title,omitempty"`
+	Creator  string   `xml:"creator,omitempty"`
+	Album    string   `xml:"album,omitempty"`
+	TrackNum int      `xml:"trackNum,omitempty"`
+	// Duration in milliseconds
+	Duration int64 `xml:"duration,omitempty"`
+}
+
+func readXSPF(data []byte) (*PlaylistFile, error) {
+	var x xspfPlaylist
+	if err := xml.Unmarshal(data, &x); err != nil {
+		return nil, fmt.Errorf("Parsing XSPF failed: %v", err)
+	}
+
+	p := &PlaylistFile{Title: strings.TrimSpace(x.Title), Entries: make([]string, 0, len(x.Tracks))}
+	for _, t := range x.Tracks {
+		// A track may have several locations for the same resource; use the first.
+		if len(t.Location) == 0 || len(strings.TrimSpace(t.Location[0])) == 0 {
+			continue
+		}
+		l := strings.TrimSpace(t.Location[0])
+		// Locations are URIs, so relative paths are escaped.
+		if !strings.Contains(l, "://") {
+			if u, err := url.PathUnescape(l); err == nil {
+				l = u
+			}
+		}
+		p.Entries = append(p.Entries, l)
+	}
+	return p, nil
+}
+
+// entryPath returns the path of the file named by the playlist entry `entry` in a playlist file
+// in the directory `dir`. Relative paths are relative to dir. `ok` is false if the entry isn't a
+// local file, like an http URL.
+func entryPath(entry, dir string) (path string, ok bool) {
+	if i := strings.Index(entry, "://"); i > 0 {
+		if !strings.EqualFold(entry[:i], "file") {
+			return "", false
+		}
+		u, err := url.Parse(entry)
+		if err != nil || len(u.Path) == 0 {
+			return "", false
+		}
+		return filepath.Clean(u.Path), true
+	}
+
+	// Playlists written on Windows use backslashes.
+	if strings.Contains(entry, `\`) && !strings.Contains(entry, "/") {
+		entry = strings.Replace(entry, `\`, "/", -1)
+	}
+	if !filepath.IsAbs(entry) {
+		entry = filepath.Join(dir, entry)
+	}
+	return filepath.Clean(entry), true
+}
+
+// PlaylistEntry is an mp3 to write in a playlist file.
+type PlaylistEntry struct {
+	// Path of the mp3 as it should appear in the file
+	Path   string
+	Artist string
+	Album  string
+	Title  string
+	// Track number, or -1 if it isn't known
+	Tracknum int
+	// Duration in seconds, or 0 if it isn't known
+	Duration float64
+}
+
+// label returns the text players show for the entry.
+func (e *PlaylistEntry) label() string {
+	if len(e.Artist) > 0 && len(e.Title) > 0 {
+		return e.Artist + " - " + e.Title
+	}
+	if len(e.Title) > 0 {
+		return e.Title
+	}
+	return filepath.Base(e.Path)
+}
+
+// length returns the duration of the entry in whole seconds, or -1 if it isn't known, as written in M3U and PLS files.
+func (e *PlaylistEntry) length() int {
+	if e.Duration <= 0 {
+		return -1
+	}
+	return int(e.Duration + 0.5)
+}
+
+// WritePlaylist writes a playlist titled `title` holding `entries` to `w` in the format `format`.
+func WritePlaylist(w io.Writer, format, title string, entries []PlaylistEntry) error {
+	b := bufio.NewWriter(w)
+
+	switch format {
+	case FormatM3U, FormatM3U8:
+		fmt.Fprintf(b, "#EXTM3U\n")
+		if len(title) > 0 {
+			fmt.Fprintf(b, "#PLAYLIST:%s\n", oneLine(title))
+		}
+		for i := range entries {
+			e := &entries[i]
+			fmt.Fprintf(b, "#EXTINF:%d,%s\n%s\n", e.length(), oneLine(e.label()), e.Path)
+		}
+	case FormatPLS:
+		fmt.Fprintf(b, "[playlist]\n")
+		for i := range entries {
+			e := &entries[i]
+			fmt.Fprintf(b, "File%d=%s\nTitle%d=%s\nLength%d=%d\n", i+1, e.Path, i+1, oneLine(e.label()), i+1, e.length())
+		}
+		fmt.Fprintf(b, "NumberOfEntries=%d\nVersion=2\n", len(entries))
+	case FormatXSPF:
+		x := xspfPlaylist{Version: "1", Xmlns: "http://xspf.org/ns/0/", Title: title, Tracks: make([]xspfTrack, len(entries))}
+		for i := range entries {
+			e := &entries[i]
+			// Locations are URIs; relative paths are relative references.
+			u := url.URL{Path: e.Path}
+			if filepath.IsAbs(e.Path) {
+				u.Scheme = "file"
+			}
+			x.Tracks[i] = xspfTrack{Location: []string{u.String()}, Title: e.Title, Creator: e.Artist, Album: e.Album,
+				Duration: int64(e.Duration * 1000)}
+			if e.Tracknum > 0 {
+				x.Tracks[i].TrackNum = e.Tracknum
+			}
+		}
+		b.WriteString(xml.Header)
+		enc := xml.NewEncoder(b)
+		enc.Indent("", "  ")
+		if err := enc.Encode(x); err != nil {
+			return err
+		}
+		b.WriteString("\n")
+	default:
+		return fmt.Errorf("Unknown playlist format '%s'", format)
+	}
+
+	return b.Flush()
+}
+
+// oneLine replaces the line breaks in `s` with spaces.
+func oneLine(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// ImportedFile is a playlist file imported as a saved playlist by a scan. Scans only import it again
+// once its size or modification time change, so changes made to the playlist in the meantime, or
+// deleting it, aren't undone by scanning.
+type ImportedFile struct {
+	// The library root and path of the file (see Track)
+	Library string
+	Path    string
+	// The size and modification time (a unix time) of the file when it was imported
+	Size  int64
+	Mtime int64
+}
+
+// playlistImport imports the playlist files found by a scan as saved playlists.
+type playlistImport struct {
+	db Library
+	// The directory scanned, and the library root and path transform the scan stores mp3s with
+	basedir       string
+	library       string
+	pathTransform StringTransform
+	opts          *Options
+	// The named library roots, for entries outside the directory scanned
+	roots []Root
+	// The playlist files imported before, keyed by the path they are stored with
+	known map[string]ImportedFile
+}
+
+// newPlaylistImport returns a playlistImport for the scan of `basedir`. `root` is basedir as it
+// is stored (after applying pathTransform or making it relative to the library root).
+func newPlaylistImport(db Library, basedir, root, library string, pathTransform StringTransform, opts *Options) (*playlistImport, error) {
+	imp := &playlistImport{db: db, basedir: basedir, library: library, pathTransform: pathTransform, opts: opts}
+	// If the roots can't be read, entries outside the directory scanned are stored without a root.
+	imp.roots, _ = db.Roots()
+
+	files, err := db.ImportedFiles(library, root)
+	if err != nil {
+		return nil, err
+	}
+	imp.known = make(map[string]ImportedFile, len(files))
+	for _, f := range files {
+		imp.known[f.Path] = f
+	}
+	return imp, nil
+}
+
+// store returns the library root and path that the file with the full path `path` is stored with.
+// Files under the directory scanned are stored as the scan stores mp3s, and other files under the
+// named root that contains them.
+func (imp *playlistImport) store(path string) (library, p string) {
+	if imp.opts.Root != nil && isUnder(path, imp.opts.Root.Path) {
+		return imp.opts.Root.Name, imp.opts.Root.Relative(path)
+	}
+
+	if imp.opts.Root == nil && isUnder(path, imp.basedir) {
+		p = path
+		if imp.pathTransform != nil {
+			p = imp.pathTransform(p)
+		}
+		return "", p
+	}
+
+	var root *Root
+	for i := range imp.roots {
+		r := &imp.roots[i]
+		if isUnder(path, r.Path) && (root == nil || len(r.Path) > len(root.Path)) {
+			root = r
+		}
+	}
+	if root != nil {
+		return root.Name, root.Relative(path)
+	}
+
+	p = path
+	if imp.opts.Root == nil && imp.pathTransform != nil {
+		p = imp.pathTransform(p)
+	}
+	return "", p
+}
+
+// resolve returns the path of the file named by the entry `entry` of a playlist file in the
+// directory `dir`. Relative entries are looked for in dir, then in the library root directories.
+// If the file isn't found it is assumed to be in dir.
+func (imp *playlistImport) resolve(entry, dir string) (path string, ok bool) {
+	path, ok = entryPath(entry, dir)
+	if !ok || filepath.IsAbs(entry) || strings.Contains(entry, "://") {
+		return
+	}
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+
+	bases := []string{imp.basedir}
+	if imp.opts.Root != nil {
+		bases = append(bases, imp.opts.Root.Path)
+	}
+	for _, r := range imp.roots {
+		bases = append(bases, r.Path)
+	}
+	for _, b := range bases {
+		if p, _ := entryPath(entry, b); len(p) > 0 {
+			if _, err := os.Stat(p); err == nil {
+				return p, true
+			}
+		}
+	}
+	return
+}
+
+// importFile reads the playlist file `path` and stores it as a saved playlist, unless it is
+// unchanged since it was last imported. The path the file is stored with is returned, and whether
+// the saved playlist was created or changed.
+func (imp *playlistImport) importFile(path string) (stored string, changed bool, err error) {
+	library, stored := imp.store(path)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	imported := ImportedFile{Library: library, Path: stored, Size: fi.Size(), Mtime: fi.ModTime().Unix()}
+	if known, ok := imp.known[stored]; ok && known == imported && !imp.opts.Full {
+		return
+	}
+
+	f, err := ReadPlaylistFile(path)
+	if err != nil {
+		return
+	}
+
+	name := f.Title
+	if len(strings.TrimSpace(name)) == 0 {
+		name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	tracks := make([]Track, 0, len(f.Entries))
+	for _, e := range f.Entries {
+		if full, ok := imp.resolve(e, filepath.Dir(path)); ok {
+			var t Track
+			t.Library, t.Path = imp.store(full)
+			tracks = append(tracks, t)
+		}
+	}
+
+	_, changed, err = imp.db.ImportPlaylist(imported, name, tracks)
+	return
+}
@@ -0,0 +1,176 @@
+package scan
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadPlaylist(test *testing.T) {
+	files := []struct {
+		format, data string
+	}{
+		{FormatM3U, "#EXTM3U\n#PLAYLIST:Mix\n#EXTINF:100,A - One\na/one.mp3\r\n\nhttp://radio/stream\n/music/b/caf\xe9.mp3\n"},
+		{FormatPLS, "[playlist]\nFile2=http://radio/stream\nFile3=/music/b/café.mp3\nFile1=a/one.mp3\nTitle1=One\nNumberOfEntries=3\n"},
+		{FormatXSPF, `<?xml version="1.0" encoding="UTF-8"?>
+<playlist version="1" xmlns="http://xspf.org/ns/0/">
+  <title>Mix</title>
+  <trackList>
+    <track><location>a/one.mp3</location></track>
+    <track><location>http://radio/stream</location></track>
+    <track><location>file:///music/b/caf%C3%A9.mp3</location></track>
+  </trackList>
+</playlist>`},
+	}
+
+	for _, f := range files {
+		p, err := ReadPlaylist(strings.NewReader(f.data), f.format)
+		if err != nil {
+			test.Fatalf("Reading %s failed: %v", f.format, err)
+		}
+		if len(p.Entries) != 3 {
+			test.Fatalf("Unexpected %s entries %q", f.format, p.Entries)
+		}
+
+		paths := make([]string, 0)
+		for _, e := range p.Entries {
+			if path, ok := entryPath(e, "/music/lists"); ok {
+				paths = append(paths, path)
+			}
+		}
+		if strings.Join(paths, ",") != "/music/lists/a/one.mp3,/music/b/café.mp3" {
+			test.Fatalf("Unexpected %s paths %q", f.format, paths)
+		}
+	}
+}
+
+func TestImportPlaylists(test *testing.T) {
+	dir := createTestTree(test, "a/one.mp3", "a/two.mp3", "b/three.mp3")
+	defer os.RemoveAll(dir)
+
+	db := createTestDb(test)
+	defer db.Close()
+
+	for _, lib := range []Library{db, NewMemLibrary()} {
+		// Relative entries are found in the playlist's directory or the library root.
+		lists := map[string]string{
+			"a/list.m3u":   "#EXTM3U\n#PLAYLIST:Mix\ntwo.mp3\nb/three.mp3\n",
+			"lists/b.pls":  "[playlist]\nFile1=" + filepath.Join(dir, "a/one.mp3") + "\n",
+			"lists/c.xspf": `<playlist version="1" xmlns="http://xspf.org/ns/0/"><title>Mix</title><trackList></trackList></playlist>`,
+		}
+		for n, data := range lists {
+			os.MkdirAll(filepath.Dir(filepath.Join(dir, n)), 0755)
+			if err := ioutil.WriteFile(filepath.Join(dir, n), []byte(data), 0644); err != nil {
+				test.Fatal("Writing playlist failed: ", err)
+			}
+		}
+
+		opts := &Options{Root: &Root{Name: "music", Path: dir}, MinSize: 1000}
+		sum := ScanMp3sToDbWithOptions(context.Background(), dir, lib, nil, nil, opts)
+		if sum.Playlists != 3 || sum.Errors != 0 {
+			test.Fatalf("Unexpected summary %v", sum)
+		}
+
+		playlists, err := lib.Playlists()
+		if err != nil || len(playlists) != 3 {
+			test.Fatalf("Unexpected playlists %+v (%v)", playlists, err)
+		}
+		// The name of the second playlist titled Mix is made unique.
+		names := []string{playlists[0].Name, playlists[1].Name, playlists[2].Name}
+		if strings.Join(names, ",") != "Mix,Mix (2),b" {
+			test.Fatalf("Unexpected playlist names %v", names)
+		}
+
+		var mix *Playlist
+		for _, p := range playlists {
+			if p.File == "a/list.m3u" {
+				if mix, err = lib.Playlist(p.Id); err != nil {
+					test.Fatal("Reading playlist failed: ", err)
+				}
+			}
+		}
+		if mix == nil || mix.FileLibrary != "music" || len(mix.Tracks) != 2 ||
+			mix.Tracks[0] != (Track{Library: "music", Path: "a/two.mp3", Tracknum: -1}) || mix.Tracks[1].Path != "b/three.mp3" {
+			test.Fatalf("Unexpected imported playlist %+v", mix)
+		}
+
+		// Rescanning keeps the name, and only changes playlists whose files changed.
+		if err = lib.RenamePlaylist(mix.Id, "Renamed"); err != nil {
+			test.Fatal("Renaming playlist failed: ", err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, "a/list.m3u"), []byte("one.mp3\n"), 0644); err != nil {
+			test.Fatal("Writing playlist failed: ", err)
+		}
+		sum = ScanMp3sToDbWithOptions(context.Background(), dir, lib, nil, nil, opts)
+		if sum.Playlists != 1 {
+			test.Fatalf("Unexpected summary of rescan %v", sum)
+		}
+		mix, err = lib.Playlist(mix.Id)
+		if err != nil || mix.Name != "Renamed" || len(mix.Tracks) != 1 || mix.Tracks[0].Path != "a/one.mp3" {
+			test.Fatalf("Unexpected reimported playlist %+v (%v)", mix, err)
+		}
+
+		// Playlists whose files haven't changed aren't imported again, so editing or deleting them sticks.
+		for _, p := range playlists {
+			if p.File == "lists/b.pls" {
+				err = AddToPlaylist(lib, p.Id, []Track{{Library: "music", Path: "b/three.mp3"}}, -1)
+			} else if p.File == "lists/c.xspf" {
+				err = lib.DeletePlaylist(p.Id)
+			}
+			if err != nil {
+				test.Fatal("Changing imported playlist failed: ", err)
+			}
+		}
+		sum = ScanMp3sToDbWithOptions(context.Background(), dir, lib, nil, nil, opts)
+		if sum.Playlists != 0 {
+			test.Fatalf("Unexpected summary of rescan of unchanged playlists %v", sum)
+		}
+		if playlists, err = lib.Playlists(); err != nil || len(playlists) != 2 || playlists[1].File != "lists/b.pls" || playlists[1].Length != 2 {
+			test.Fatalf("Unexpected playlists after rescan %+v (%v)", playlists, err)
+		}
+
+		sum = ScanMp3sToDbWithOptions(context.Background(), dir, lib, nil, nil, &Options{Root: opts.Root, IgnorePlaylists: true})
+		if sum.Playlists != 0 {
+			test.Fatalf("Unexpected summary when ignoring playlists %v", sum)
+		}
+	}
+}
+
+func TestWritePlaylist(test *testing.T) {
+	entries := []PlaylistEntry{
+		{Path: "/music/a/one.mp3", Artist: "A", Album: "X", Title: "One", Tracknum: 1, Duration: 99.6},
+		{Path: "/music/b/café #1.mp3", Tracknum: -1},
+		{Path: "c/two: 50%.mp3", Tracknum: -1},
+	}
+
+	for _, format := range PlaylistFormats {
+		var b bytes.Buffer
+		if err := WritePlaylist(&b, format, "Mix", entries); err != nil {
+			test.Fatalf("Writing %s failed: %v", format, err)
+		}
+
+		p, err := ReadPlaylist(&b, format)
+		if err != nil {
+			test.Fatalf("Reading written %s failed: %v", format, err)
+		}
+		if len(p.Entries) != len(entries) {
+			test.Fatalf("Unexpected entries in written %s: %q", format, p.Entries)
+		}
+		for i, e := range p.Entries {
+			if path, ok := entryPath(e, ""); !ok || path != entries[i].Path {
+				test.Fatalf("Unexpected entry in written %s: %s", format, e)
+			}
+		}
+		if format != FormatPLS && p.Title != "Mix" {
+			test.Fatalf("Unexpected title in written %s: %s", format, p.Title)
+		}
+	}
+
+	if err := WritePlaylist(&bytes.Buffer{}, "wpl", "Mix", entries); err == nil {
+		test.Fatal("Expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,216 @@
+package scan
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+)
+
+// PruneReport describes the changes made to the database when pruning mp3s whose files no longer exist.
+type PruneReport struct {
+	// Paths of mp3s whose files no longer exist and were removed.
+	Removed []string
+	// Mp3s whose files were moved, keyed by their old path. The values are the new paths.
+	Moved map[string]string
+	// Err is set if pruning failed. In that case no changes were made.
+	Err error
+}
+
+func (r PruneReport) String() string {
+	if r.Err != nil {
+		return r.Err.Error()
+	}
+	return fmt.Sprintf("%d removed, %d moved", len(r.Removed), len(r.Moved))
+}
+
+// PruneMp3sInDb removes the mp3s under the directory `basedir` from `db` whose files no longer exist.
+// `pathTransform` must be the same transform that was used when scanning basedir into the database.
+// Mp3s scanned under a named library root are pruned with PruneMp3sInDbWithOptions, passing the root in the options.
+//
+// When pruning after a scan (see Options.Prune), a missing mp3 is considered to have been moved if
+// the scan added an mp3 with the same audio (or, if the audio hash of the missing mp3 isn't known,
+// the same size and tags). In that case information about the mp3 that is kept in other tables
+// (like play counts) is moved to the new path rather than removed. An mp3 that was already in the
+// database is never the new path of a move, so removing one of two copies of a file doesn't give its
+// play counts to the other. PruneMp3sInDb doesn't scan, so it removes moved mp3s like any other missing mp3.
+//
+// If basedir doesn't exist (for example because it is an unmounted network share), or a directory
+// under it can't be read, nothing is pruned.
+func PruneMp3sInDb(basedir string, db Library, pathTransform StringTransform) PruneReport {
+	return PruneMp3sInDbWithOptions(basedir, db, pathTransform, nil)
+}
+
+// PruneMp3sInDbWithOptions is the same as PruneMp3sInDb, but mp3s whose files are excluded from
+// scanning by `opts` are also removed. If opts is nil the defaults are used.
+func PruneMp3sInDbWithOptions(basedir string, db Library, pathTransform StringTransform, opts *Options) PruneReport {
+	library, pathTransform := opts.target(pathTransform)
+	seen := make(map[string]bool)
+
+	paths, errs := listMp3Paths(context.Background(), basedir, opts)
+	for _, path := range paths {
+		if pathTransform != nil {
+			path = pathTransform(path)
+		}
+		seen[path] = true
+	}
+
+	return prune(basedir, db, library, pathTransform, seen, nil, len(errs))
+}
+
+// trackKey holds the fields that identify an mp3 that was moved: either the hash of its audio,
+// or its size and tags.
+type trackKey struct {
+	audioHash            string
+	size                 int64
+	artist, album, title string
+	tracknum             int
+}
+
+// hashKey returns the key that identifies `t` by its audio, or false if its audio hash isn't known.
+func hashKey(t *Track) (trackKey, bool) {
+	return trackKey{audioHash: t.AudioHash}, len(t.AudioHash) > 0
+}
+
+// tagKey returns the key that identifies `t` by its size and tags, or false if its size isn't known.
+func tagKey(t *Track) (trackKey, bool) {
+	return trackKey{size: t.Size, artist: t.Artist, album: t.Album, title: t.Title, tracknum: t.Tracknum}, t.Size > 0
+}
+
+// prune removes the mp3s in the library root `library` under `basedir` from `db` that are not in
+// `seen`, a set of the paths (after applying pathTransform) of all the mp3s currently under basedir.
+// `added` is the set of the paths that the scan being pruned after added to the database; only they
+// can be the new path of a moved mp3. It is nil if there was no scan.
+// `unreadable` is the number of directories under basedir that couldn't be read when listing the
+// mp3s. The mp3s in them weren't seen, so if there are any nothing is pruned.
+func prune(basedir string, db Library, library string, pathTransform StringTransform, seen, added map[string]bool, unreadable int) (r PruneReport) {
+	r.Moved = make(map[string]string)
+
+	if _, err := os.Stat(basedir); err != nil {
+		r.Err = fmt.Errorf("Not pruning %s: %v", basedir, err)
+		return
+	}
+	if unreadable > 0 {
+		r.Err = fmt.Errorf("Not pruning %s: %d directories couldn't be read", basedir, unreadable)
+		return
+	}
+
+	root := basedir
+	if pathTransform != nil {
+		root = pathTransform(root)
+	}
+
+	tracks, err := db.TracksUnder(library, root)
+	if err != nil {
+		r.Err = fmt.Errorf("Pruning %s: reading mp3s failed: %v", basedir, err)
+		return
+	}
+
+	// The mp3s added by the scan, by the fields used to recognize a moved mp3
+	present := make(map[trackKey][]string)
+	gone := make([]*Track, 0)
+	for i := range tracks {
+		t := &tracks[i]
+		if !seen[t.Path] {
+			gone = append(gone, t)
+		} else if added[t.Path] {
+			for _, key := range []func(*Track) (trackKey, bool){hashKey, tagKey} {
+				if k, ok := key(t); ok {
+					present[k] = append(present[k], t.Path)
+				}
+			}
+		}
+	}
+
+	if len(gone) == 0 {
+		return
+	}
+
+	// New paths that have already been matched to a moved mp3
+	targets := make(map[string]bool)
+	removed := make([]string, 0)
+
+	for _, t := range gone {
+		if to := findMovedMp3(t, present, targets); len(to) > 0 {
+			targets[to] = true
+			r.Moved[t.Path] = to
+		} else {
+			removed = append(removed, t.Path)
+		}
+	}
+
+	if err := db.RemoveTracks(library, removed, r.Moved); err != nil {
+		return PruneReport{Moved: map[string]string{}, Err: fmt.Errorf("Pruning %s failed: %v", basedir, err)}
+	}
+	r.Removed = removed
+	return
+}
+
+// findMovedMp3 looks for an mp3 with the same audio as the missing mp3 `t`, or if its audio hash
+// isn't known the same size and tags, that was added by the scan (is in `present`) and is not
+// already the target of a move. If one is found its path is returned, otherwise the empty string is returned.
+func findMovedMp3(t *Track, present map[trackKey][]string, targets map[string]bool) string {
+	k, ok := hashKey(t)
+	if !ok {
+		if k, ok = tagKey(t); !ok {
+			return ""
+		}
+	}
+
+	for _, path := range present[k] {
+		if !targets[path] {
+			return path
+		}
+	}
+	return ""
+}
+
+// RemoveTracks removes the mp3s in the library root `library` with the paths `removed`, and the mp3s
+// that were moved (the keys of `moved`), from the database in one transaction.
+func (m Mp3Db) RemoveTracks(library string, removed []string, moved map[string]string) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("creating transaction failed: %v", err)
+	}
+
+	for _, p := range removed {
+		if err = removeMp3(tx, library, p); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("removing %s failed: %v", p, err)
+		}
+	}
+
+	for from, to := range moved {
+		if err = moveMp3(tx, library, from, to); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("moving %s failed: %v", from, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("commit failed: %v", err)
+	}
+	return nil
+}
+
+// removeMp3 removes the mp3 in the library root `library` with path `path` from the database.
+func removeMp3(tx *sql.Tx, library, path string) error {
+	_, err := tx.Exec("delete from mp3 where library = ? and path = ?", library, path)
+	return err
+}
+
+// moveMp3 handles an mp3 in the library root `library` that was moved from path `from` to path `to`,
+// where the new path has already been scanned into the database. The row for the old path is removed.
+// Tables that keep information about an mp3 by path should have that information moved to the new path here.
+func moveMp3(tx *sql.Tx, library, from, to string) error {
+	if err := movePlays(tx, library, from, to); err != nil {
+		return err
+	}
+	if err := moveRating(tx, library, from, to); err != nil {
+		return err
+	}
+	if err := movePlaylistTracks(tx, library, from, to); err != nil {
+		return err
+	}
+	return removeMp3(tx, library, from)
+}
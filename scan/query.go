@@ -0,0 +1,348 @@
+package scan
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// columnType is the type of a column of the mp3 table.
+type columnType int
+
+const (
+	textColumn columnType = iota
+	numericColumn
+)
+
+// columns lists the columns of the mp3 table that may be used in a Query. Field names are
+// only ever written into SQL after being looked up here. Each column must have a field in Track.
+var columns = map[string]columnType{
+	"artist":      textColumn,
+	"album":       textColumn,
+	"title":       textColumn,
+	"path":        textColumn,
+	"library":     textColumn,
+	"genre":       textColumn,
+	"lyrics":      textColumn,
+	"audio_hash":  textColumn,
+	"fingerprint": textColumn,
+	"tracknum":    numericColumn,
+	"year":        numericColumn,
+	"duration":    numericColumn,
+	"bitrate":     numericColumn,
+	"rate":        numericColumn,
+	"channels":    numericColumn,
+	"vbr":         numericColumn,
+	"size":        numericColumn,
+	"mtime":       numericColumn,
+	"plays":       numericColumn,
+	"skips":       numericColumn,
+	"last_played": numericColumn,
+	"rating":      numericColumn,
+	"favorite":    numericColumn,
+}
+
+// Match is how a Condition compares a field to its value. Text comparisons ignore case.
+type Match int
+
+const (
+	// The field contains the value
+	Substring Match = iota
+	// The field is equal to the value
+	Exact
+	// The field begins with the value
+	Prefix
+)
+
+var matchNames = []string{"substring", "exact", "prefix"}
+
+func (m Match) String() string {
+	if m < 0 || int(m) >= len(matchNames) {
+		return "unknown"
+	}
+	return matchNames[m]
+}
+
+// ParseMatch returns the Match named `s` ("substring", "exact" or "prefix").
+func ParseMatch(s string) (Match, error) {
+	for i, n := range matchNames {
+		if s == n {
+			return Match(i), nil
+		}
+	}
+	return Substring, fmt.Errorf("Unknown match type '%s'", s)
+}
+
+// Condition selects the mp3s whose field `Field` matches `Value`.
+type Condition struct {
+	Field string
+	Match Match
+	Value string
+}
+
+// Range selects the mp3s whose numeric field `Field` is between Min and Max, inclusive.
+// A nil bound means the range is unbounded on that side.
+type Range struct {
+	Field string
+	Min   *float64
+	Max   *float64
+}
+
+// Sort orders results by the field `Field`. Text fields are ordered ignoring case.
+type Sort struct {
+	Field string
+	Desc  bool
+}
+
+// ParseSort parses a sort of the form "field" (ascending) or "-field" (descending).
+func ParseSort(s string) Sort {
+	if strings.HasPrefix(s, "-") {
+		return Sort{Field: s[1:], Desc: true}
+	}
+	return Sort{Field: s}
+}
+
+// Query describes which mp3s to find, and which of their fields to return.
+type Query struct {
+	// Fields to return. If empty, all fields are returned.
+	Fields []string
+	// Every condition must match.
+	Where []Condition
+	// At least one condition of each group must match.
+	Any [][]Condition
+	// The mp3s must be within every range.
+	Ranges []Range
+	// Free text to search for. Each word must begin a word in the artist, album, title, genre, path
+	// or lyrics, ignoring case and diacritics. See ensureFullText for how this works when the
+	// full-text index isn't available.
+	Text string
+	// If true, words of Text and of Substring conditions on the artist, album and title may also
+	// match words in those fields that differ by a few typing mistakes, like "radiohed" for "Radiohead".
+	Fuzzy bool
+	// Order of the results. If empty the results are ordered by artist, album, tracknum, title and path;
+	// if Text is set, the results that match Text best come first.
+	Order []Sort
+	// The page of results to return. If nil all results are returned.
+	Paging *Paging
+}
+
+// defaultOrder is the order of results when a Query doesn't specify one.
+var defaultOrder = []Sort{{Field: "artist"}, {Field: "album"}, {Field: "tracknum"}, {Field: "title"}, {Field: "path"}}
+
+func checkColumn(name string) (columnType, error) {
+	t, ok := columns[name]
+	if !ok {
+		return t, fmt.Errorf("Unknown field '%s'", name)
+	}
+	return t, nil
+}
+
+// fields returns the fields the query returns.
+func (q *Query) fields() []string {
+	if len(q.Fields) == 0 {
+		return allFields
+	}
+	return q.Fields
+}
+
+// condition writes the SQL for `c` to `buf` and returns its arguments. If `variants` is not nil
+// Substring conditions on the fuzzyFields also match when each word of the value, or one of its
+// variants, is in the field.
+func condition(buf *bytes.Buffer, c Condition, variants func(string) []string) ([]interface{}, error) {
+	t, err := checkColumn(c.Field)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Match == Substring && variants != nil && containsString(fuzzyFields, c.Field) {
+		return fuzzyCondition(buf, c, variants), nil
+	}
+
+	switch c.Match {
+	case Substring:
+		buf.WriteString("instr(lower(" + c.Field + "), lower(?)) > 0")
+	case Prefix:
+		buf.WriteString("instr(lower(" + c.Field + "), lower(?)) = 1")
+	case Exact:
+		if t == textColumn {
+			buf.WriteString("lower(" + c.Field + ") = lower(?)")
+		} else {
+			buf.WriteString(c.Field + " = ?")
+		}
+	default:
+		return nil, fmt.Errorf("Unknown match type %d for field '%s'", c.Match, c.Field)
+	}
+	return []interface{}{c.Value}, nil
+}
+
+// fuzzyCondition writes the SQL for the Substring condition `c` with fuzzy matching to `buf` and
+// returns its arguments.
+func fuzzyCondition(buf *bytes.Buffer, c Condition, variants func(string) []string) []interface{} {
+	in := "instr(lower(" + c.Field + "), lower(?)) > 0"
+	buf.WriteString("(" + in)
+	args := []interface{}{c.Value}
+
+	words := splitWords(c.Value)
+	fuzzy := false
+	for _, w := range words {
+		fuzzy = fuzzy || len(variants(w)) > 0
+	}
+	if fuzzy {
+		buf.WriteString(" or (")
+		for i, w := range words {
+			if i > 0 {
+				buf.WriteString(" and ")
+			}
+			buf.WriteString("(")
+			for j, a := range append([]string{w}, variants(w)...) {
+				if j > 0 {
+					buf.WriteString(" or ")
+				}
+				buf.WriteString(in)
+				args = append(args, a)
+			}
+			buf.WriteString(")")
+		}
+		buf.WriteString(")")
+	}
+	buf.WriteString(")")
+	return args
+}
+
+// Build returns the SQL statement for the query and its arguments. All values are passed as
+// arguments; an error is returned if the query refers to an unknown field. The statement uses
+// the full-text index for Text; FindTracks builds a statement that doesn't if the index isn't available.
+func (q *Query) Build() (string, []interface{}, error) {
+	return q.build(true, nil)
+}
+
+// build returns the SQL statement for the query. `fullText` is whether the full-text index is available,
+// and if Fuzzy is set `variants` returns the variants of a word (see fuzzyIndex.variants).
+func (q *Query) build(fullText bool, variants func(string) []string) (string, []interface{}, error) {
+	if !q.Fuzzy {
+		variants = nil
+	}
+
+	var sql bytes.Buffer
+	args := make([]interface{}, 0)
+	terms := textTerms(q.Text)
+	ranked := fullText && len(terms) > 0
+
+	fields := q.fields()
+	for _, f := range fields {
+		if _, err := checkColumn(f); err != nil {
+			return "", nil, err
+		}
+	}
+
+	sql.WriteString("select distinct ")
+	sql.WriteString(makelist(fields, ", "))
+	sql.WriteString(" from mp3")
+
+	if ranked {
+		join, a := fullTextJoin(terms, variants)
+		sql.WriteString(join)
+		args = append(args, a...)
+	}
+
+	clauses := make([]string, 0)
+	var where bytes.Buffer
+
+	if len(terms) > 0 && !fullText {
+		args = append(args, substringText(&where, terms, variants)...)
+		clauses = append(clauses, where.String())
+		where.Reset()
+	}
+
+	for _, c := range q.Where {
+		a, err := condition(&where, c, variants)
+		if err != nil {
+			return "", nil, err
+		}
+		args = append(args, a...)
+		clauses = append(clauses, where.String())
+		where.Reset()
+	}
+
+	for _, group := range q.Any {
+		if len(group) == 0 {
+			continue
+		}
+		where.WriteString("(")
+		for i, c := range group {
+			if i > 0 {
+				where.WriteString(" or ")
+			}
+			a, err := condition(&where, c, variants)
+			if err != nil {
+				return "", nil, err
+			}
+			args = append(args, a...)
+		}
+		where.WriteString(")")
+		clauses = append(clauses, where.String())
+		where.Reset()
+	}
+
+	for _, r := range q.Ranges {
+		t, err := checkColumn(r.Field)
+		if err != nil {
+			return "", nil, err
+		}
+		if t != numericColumn {
+			return "", nil, fmt.Errorf("Field '%s' is not numeric", r.Field)
+		}
+		if r.Min != nil {
+			clauses = append(clauses, r.Field+" >= ?")
+			args = append(args, *r.Min)
+		}
+		if r.Max != nil {
+			clauses = append(clauses, r.Field+" <= ?")
+			args = append(args, *r.Max)
+		}
+	}
+
+	if len(clauses) != 0 {
+		sql.WriteString(" where ")
+		sql.WriteString(makelist(clauses, " and "))
+	}
+
+	order := q.Order
+	if len(order) == 0 {
+		order = defaultOrder
+	}
+
+	sorts := make([]string, len(order))
+	for i, s := range order {
+		t, err := checkColumn(s.Field)
+		if err != nil {
+			return "", nil, err
+		}
+
+		// Only use the lower() function on string fields
+		if t == textColumn {
+			sorts[i] = "lower(" + s.Field + ")"
+		} else {
+			sorts[i] = s.Field
+		}
+		if s.Desc {
+			sorts[i] += " desc"
+		}
+	}
+	if ranked && len(q.Order) == 0 {
+		// bm25 scores are lower for better matches.
+		sorts = append([]string{"fts_rank"}, sorts...)
+	}
+	sql.WriteString(" order by ")
+	sql.WriteString(makelist(sorts, ", "))
+
+	if q.Paging != nil {
+		// Read one more row than the requested size.
+		// If we end up reading an actual PageSize+1 rows of data, then
+		// we know we are not at EOF, otherwise we are.
+		sql.WriteString(" limit ? offset ?")
+		args = append(args, q.Paging.PageSize+1, q.Paging.Page*q.Paging.PageSize)
+	}
+
+	return sql.String(), args, nil
+}
@@ -0,0 +1,227 @@
+package scan
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// createQueryTestDb creates a database with a few mp3s to query.
+func createQueryTestDb(test *testing.T) Mp3Db {
+	db := createTestDb(test)
+
+	mp3s := []struct {
+		artist, album, title string
+		tracknum             int
+		duration             float64
+	}{
+		{"Beatles", "Abbey Road", "Come Together", 1, 259},
+		{"Beatles", "Abbey Road", "Something", 2, 182},
+		{"Beach Boys", "Pet Sounds", "Wouldn't It Be Nice", 1, 153},
+		{"O'Connor", "100% Pure", "Under_score", 3, 400},
+	}
+	for _, m := range mp3s {
+		_, err := db.DB.Exec("insert into mp3(artist, album, title, tracknum, duration, path) values(?,?,?,?,?,?)",
+			m.artist, m.album, m.title, m.tracknum, m.duration, "/"+m.artist+"/"+m.album+"/"+m.title+".mp3")
+		if err != nil {
+			test.Fatal("Inserting mp3 failed: ", err)
+		}
+	}
+	return db
+}
+
+// findTitles runs the query and returns the titles found.
+func findTitles(test *testing.T, db Library, q *Query) []string {
+	var errs strings.Builder
+	ch := make(chan map[string]string)
+	go FindMp3s(db, q, ch, &errs)
+
+	titles := make([]string, 0)
+	for m := range ch {
+		if _, ok := m["eof"]; !ok {
+			titles = append(titles, m["title"])
+		}
+	}
+
+	if errs.Len() > 0 {
+		test.Fatalf("Query %v failed: %s", q, errs.String())
+	}
+	return titles
+}
+
+func f64(v float64) *float64 { return &v }
+
+// queryTestCases are queries of the database created by createQueryTestDb, and the titles they find.
+var queryTestCases = []struct {
+	q        Query
+	expected string
+}{
+	{Query{Where: []Condition{{"artist", Substring, "bea"}}}, "Wouldn't It Be Nice,Come Together,Something"},
+	{Query{Where: []Condition{{"artist", Prefix, "beat"}}}, "Come Together,Something"},
+	{Query{Where: []Condition{{"artist", Prefix, "atles"}}}, ""},
+	{Query{Where: []Condition{{"artist", Exact, "beatles"}, {"tracknum", Exact, "2"}}}, "Something"},
+	{Query{Any: [][]Condition{{{"title", Substring, "nice"}, {"album", Exact, "abbey road"}}}}, "Wouldn't It Be Nice,Come Together,Something"},
+	{Query{Ranges: []Range{{"duration", f64(180), f64(260)}}}, "Come Together,Something"},
+	{Query{Ranges: []Range{{"duration", f64(300), nil}}}, "Under_score"},
+	{Query{Where: []Condition{{"artist", Exact, "beatles"}}, Order: []Sort{{"title", true}}}, "Something,Come Together"},
+	{Query{Order: []Sort{{"duration", true}}, Paging: &Paging{PageSize: 2, Page: 0}}, "Under_score,Come Together"},
+	// Values are never interpreted as SQL or as patterns
+	{Query{Where: []Condition{{"artist", Substring, "o'c"}}}, "Under_score"},
+	{Query{Where: []Condition{{"album", Prefix, "100%"}}}, "Under_score"},
+	{Query{Where: []Condition{{"album", Substring, "%"}, {"title", Substring, "_"}}}, "Under_score"},
+	{Query{Where: []Condition{{"title", Substring, "') > 0 or 1=1 --"}}}, ""},
+	{Query{Where: []Condition{{"title", Exact, "x' or '1'='1"}}}, ""},
+}
+
+func TestQuery(test *testing.T) {
+	db := createQueryTestDb(test)
+	defer db.Close()
+
+	for _, c := range queryTestCases {
+		titles := strings.Join(findTitles(test, db, &c.q), ",")
+		if titles != c.expected {
+			test.Errorf("Query %+v: expected '%s' but got '%s'", c.q, c.expected, titles)
+		}
+	}
+}
+
+func TestQueryHostileFields(test *testing.T) {
+	db := createQueryTestDb(test)
+	defer db.Close()
+
+	hostile := []string{
+		"artist) > 0; drop table mp3; --",
+		"artist, (select sql from sqlite_master)",
+		"1=1 or artist",
+		"lower(artist)",
+		"",
+	}
+
+	for _, h := range hostile {
+		queries := []Query{
+			{Fields: []string{"title", h}},
+			{Where: []Condition{{h, Substring, "x"}}},
+			{Any: [][]Condition{{{"title", Substring, "x"}, {h, Exact, "x"}}}},
+			{Ranges: []Range{{Field: h}}},
+			{Order: []Sort{{Field: h}}},
+		}
+		for _, q := range queries {
+			if _, _, err := q.Build(); err == nil {
+				test.Errorf("Query %+v with field '%s' was accepted", q, h)
+			}
+		}
+	}
+
+	// Ranges are only allowed on numeric fields.
+	q := Query{Ranges: []Range{{Field: "title"}}}
+	if _, _, err := q.Build(); err == nil {
+		test.Error("Range on a text field was accepted")
+	}
+
+	var cnt int
+	db.DB.QueryRow("select count(*) from mp3").Scan(&cnt)
+	if cnt != 4 {
+		test.Fatalf("Expected 4 mp3s in the database but there are %d", cnt)
+	}
+}
+
+func TestFindTracks(test *testing.T) {
+	db := createQueryTestDb(test)
+	defer db.Close()
+
+	q := &Query{Order: []Sort{{Field: "duration"}}, Paging: &Paging{PageSize: 3, Page: 0}}
+	tracks, hasMore, err := FindTracks(db, q)
+	if err != nil || len(tracks) != 3 || !hasMore {
+		test.Fatalf("Unexpected first page %v %v (%v)", tracks, hasMore, err)
+	}
+	if tracks[0].Title != "Wouldn't It Be Nice" || tracks[0].Duration != 153 || tracks[0].Tracknum != 1 {
+		test.Fatalf("Unexpected first track %+v", tracks[0])
+	}
+
+	q.Paging.Page = 1
+	tracks, hasMore, err = FindTracks(db, q)
+	if err != nil || len(tracks) != 1 || hasMore {
+		test.Fatalf("Unexpected last page %v %v (%v)", tracks, hasMore, err)
+	}
+	if m := tracks[0].Map([]string{"title", "duration"}); len(m) != 2 || m["duration"] != "400" {
+		test.Fatalf("Unexpected map %v", m)
+	}
+
+	if _, _, err = FindTracks(db, &Query{Fields: []string{"nope"}}); err == nil {
+		test.Fatal("Expected an error for an unknown field")
+	}
+}
+
+func TestQueryText(test *testing.T) {
+	db := createQueryTestDb(test)
+	defer db.Close()
+
+	_, err := db.DB.Exec(`insert into mp3(artist, album, title, tracknum, genre, lyrics, path)
+		values('Sigur Rós', 'Ágætis byrjun', 'Svefn-g-englar', 4, 'Post-Rock', 'Tjú tjú', '/sigur/svefn.mp3')`)
+	if err == nil {
+		_, err = db.DB.Exec(`update mp3 set lyrics = 'Here comes the sun, something in the way' where title = 'Wouldn''t It Be Nice'`)
+	}
+	if err != nil {
+		test.Fatal("Updating mp3s failed: ", err)
+	}
+
+	// Unless the results are ranked they are compared in any order.
+	cases := []struct {
+		text, expected string
+		// Only expected when the full-text index is available
+		ranked bool
+	}{
+		{"beatles abbey", "Come Together,Something", false},
+		{"BEAT abb", "Come Together,Something", false},
+		{"beatles pet", "", false},
+		{"post-rock", "Svefn-g-englar", false},
+		{"here comes the sun", "Wouldn't It Be Nice", false},
+		{`"  "`, "Come Together,Something,Svefn-g-englar,Under_score,Wouldn't It Be Nice", false},
+		{"NEAR(beatles) OR *", "", false},
+		// Titles rank above lyrics
+		{"something", "Something,Wouldn't It Be Nice", true},
+		{"sigur ros agætis", "Svefn-g-englar", true},
+		{"tju", "Svefn-g-englar", true},
+	}
+
+	for _, fullText := range []bool{false, db.FullText()} {
+		db.fullText = fullText
+		for _, c := range cases {
+			if c.ranked && !fullText {
+				continue
+			}
+			found := findTitles(test, db, &Query{Text: c.text})
+			if !c.ranked {
+				sort.Strings(found)
+			}
+			titles := strings.Join(found, ",")
+			if titles != c.expected {
+				test.Errorf("Text '%s' (full text %v): expected '%s' but got '%s'", c.text, fullText, c.expected, titles)
+			}
+		}
+	}
+
+	if !db.FullText() {
+		test.Skip("Full-text index not available; build with -tags sqlite_fts5 to test it")
+	}
+
+	// The index follows changes to the mp3 table.
+	if _, err = db.DB.Exec("update mp3 set title = 'Something Else' where title = 'Something'"); err == nil {
+		_, err = db.DB.Exec("delete from mp3 where title = 'Come Together'")
+	}
+	if err != nil {
+		test.Fatal("Changing mp3s failed: ", err)
+	}
+	q := &Query{Text: "beatles", Fields: []string{"title"}}
+	if titles := strings.Join(findTitles(test, db, q), ","); titles != "Something Else" {
+		test.Fatalf("Expected the index to be updated, but found '%s'", titles)
+	}
+
+	// VACUUM keeps the ids of the mp3s that the index refers to.
+	if _, err = db.DB.Exec("vacuum"); err != nil {
+		test.Fatal("Vacuuming failed: ", err)
+	}
+	if titles := strings.Join(findTitles(test, db, q), ","); titles != "Something Else" {
+		test.Fatalf("Expected the index to be kept by vacuuming, but found '%s'", titles)
+	}
+}
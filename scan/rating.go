@@ -0,0 +1,64 @@
+package scan
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// MaxRating is the highest rating of an mp3, in stars.
+const MaxRating = 5
+
+// checkRating returns an error if `rating` isn't a valid number of stars.
+func checkRating(rating int) error {
+	if rating < 0 || rating > MaxRating {
+		return fmt.Errorf("The rating must be from 0 to %d stars", MaxRating)
+	}
+	return nil
+}
+
+// Rate sets the rating of the mp3 in the library root `library` with path `path` to `rating`
+// stars, from 0 (unrated) to 5. ErrNoTrack is returned if there is no such mp3.
+func (m Mp3Db) Rate(library, path string, rating int) error {
+	if err := checkRating(rating); err != nil {
+		return err
+	}
+	return m.update(library, path, "rating", rating)
+}
+
+// SetFavorite marks the mp3 in the library root `library` with path `path` as a favorite or
+// not. ErrNoTrack is returned if there is no such mp3.
+func (m Mp3Db) SetFavorite(library, path string, favorite bool) error {
+	return m.update(library, path, "favorite", favorite)
+}
+
+// moveRating moves the rating and favorite flag of the mp3 in the library root `library` from path
+// `from` to path `to`, unless the mp3 at `to` already has them.
+func moveRating(tx *sql.Tx, library, from, to string) error {
+	var rating, favorite int
+	err := tx.QueryRow("select rating, favorite from mp3 where library = ? and path = ?", library, from).Scan(&rating, &favorite)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("update mp3 set rating = case when rating = 0 then ? else rating end, favorite = max(favorite, ?) where library = ? and path = ?",
+		rating, favorite, library, to)
+	return err
+}
+
+// update sets the column `column` of the mp3 in the library root `library` with path `path` to `value`.
+func (m Mp3Db) update(library, path, column string, value interface{}) error {
+	r, err := m.DB.Exec("update mp3 set "+column+" = ? where library = ? and path = ?", value, library, path)
+	if err != nil {
+		return fmt.Errorf("updating %s failed: %v", column, err)
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("updating %s failed: %v", column, err)
+	}
+	if n == 0 {
+		return ErrNoTrack
+	}
+	return nil
+}
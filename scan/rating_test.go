@@ -0,0 +1,74 @@
+package scan
+
+import (
+	"testing"
+)
+
+func TestRatings(test *testing.T) {
+	db := createTestDb(test)
+	defer db.Close()
+
+	for _, lib := range []Library{db, NewMemLibrary()} {
+		err := lib.PutTracks([]Track{
+			{Path: "/a.mp3", Rating: -1},
+			{Path: "/b.mp3", Rating: 3},
+			{Path: "/c.mp3", Rating: -1},
+		})
+		if err != nil {
+			test.Fatal("Adding tracks failed: ", err)
+		}
+
+		if err = lib.Rate("", "/a.mp3", 5); err != nil {
+			test.Fatal("Rating failed: ", err)
+		}
+		if err = lib.SetFavorite("", "/c.mp3", true); err != nil {
+			test.Fatal("Setting favorite failed: ", err)
+		}
+		if err = lib.Rate("", "/missing.mp3", 1); err != ErrNoTrack {
+			test.Fatalf("Expected ErrNoTrack rating a missing mp3 but got %v", err)
+		}
+		if err = lib.Rate("", "/a.mp3", 6); err == nil {
+			test.Fatal("Expected an error for a rating of 6 stars")
+		}
+
+		// Rescanning keeps the rating unless the mp3 has one in its tags, and keeps favorites.
+		err = lib.PutTracks([]Track{
+			{Path: "/a.mp3", Rating: -1},
+			{Path: "/b.mp3", Rating: 4},
+			{Path: "/c.mp3", Rating: -1},
+		})
+		if err != nil {
+			test.Fatal("Updating tracks failed: ", err)
+		}
+
+		min := 1.0
+		found, _, err := lib.FindTracks(&Query{
+			Fields: []string{"path", "rating", "favorite"},
+			Ranges: []Range{{Field: "rating", Min: &min}},
+			Order:  []Sort{{"rating", true}},
+		})
+		if err != nil || len(found) != 2 || found[0].Path != "/a.mp3" || found[0].Rating != 5 ||
+			found[1].Path != "/b.mp3" || found[1].Rating != 4 {
+			test.Fatalf("Unexpected rated tracks %+v (%v)", found, err)
+		}
+
+		found, _, err = lib.FindTracks(&Query{Fields: []string{"path"}, Where: []Condition{{"favorite", Exact, "1"}}})
+		if err != nil || len(found) != 1 || found[0].Path != "/c.mp3" {
+			test.Fatalf("Unexpected favorites %+v (%v)", found, err)
+		}
+
+		// Moving mp3s keeps their rating and favorite flag.
+		if err = lib.PutTracks([]Track{{Path: "/d.mp3", Rating: -1}, {Path: "/e.mp3", Rating: -1}}); err != nil {
+			test.Fatal("Adding moved tracks failed: ", err)
+		}
+		if err = lib.RemoveTracks("", nil, map[string]string{"/a.mp3": "/d.mp3", "/c.mp3": "/e.mp3"}); err != nil {
+			test.Fatal("Moving tracks failed: ", err)
+		}
+		found, _, err = lib.FindTracks(&Query{Fields: []string{"path", "rating", "favorite"}, Order: []Sort{{"path", false}}})
+		if err != nil || len(found) != 3 || found[0].Path != "/b.mp3" ||
+			found[1].Path != "/d.mp3" || found[1].Rating != 5 || found[1].Favorite ||
+			found[2].Path != "/e.mp3" || found[2].Rating != 0 || !found[2].Favorite {
+			test.Fatalf("Unexpected moved tracks %+v (%v)", found, err)
+		}
+	}
+}
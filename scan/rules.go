@@ -0,0 +1,272 @@
+package scan
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// IgnoreFile is the name of the file that lists glob patterns of entries to exclude from
+	// scanning in the directory that contains it. If it has no patterns the whole directory is excluded.
+	IgnoreFile = ".wwwmp3ignore"
+	// NoMediaFile is the name of the file that excludes the directory that contains it from scanning.
+	NoMediaFile = ".nomedia"
+)
+
+// rule excludes or includes the paths that match a glob pattern.
+//
+// A pattern without a '/' is matched against the last element of a path. A pattern with a '/'
+// is matched against the end of a path: for example "Podcasts/old" matches "/music/Podcasts/old".
+// Patterns read from an ignore file are instead anchored at the directory containing the file.
+type rule struct {
+	// Directory containing the ignore file the rule was read from, or empty
+	dir     string
+	pattern string
+}
+
+func (r rule) matches(path string) bool {
+	if !strings.Contains(strings.TrimRight(r.pattern, "/"), "/") {
+		ok, _ := filepath.Match(strings.TrimRight(r.pattern, "/"), filepath.Base(path))
+		return ok
+	}
+
+	pattern := strings.Trim(r.pattern, "/")
+	if len(r.dir) > 0 {
+		if !strings.HasPrefix(path, r.dir+"/") {
+			return false
+		}
+		ok, _ := filepath.Match(pattern, path[len(r.dir)+1:])
+		return ok
+	}
+
+	n := strings.Count(pattern, "/") + 1
+	parts := strings.Split(path, "/")
+	if len(parts) < n {
+		return false
+	}
+	ok, _ := filepath.Match(pattern, strings.Join(parts[len(parts)-n:], "/"))
+	return ok
+}
+
+// CheckPatterns returns an error if any of the glob patterns are malformed.
+func CheckPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return fmt.Errorf("Bad pattern '%s': %v", p, err)
+		}
+	}
+	return nil
+}
+
+// readIgnoreFiles reads the ignore files in the directory `dir`. It returns the rules in the
+// IgnoreFile, and true if the whole directory should be excluded.
+func readIgnoreFiles(dir string) (rules []rule, ignoreAll bool) {
+	if _, err := os.Lstat(dir + "/" + NoMediaFile); err == nil {
+		return nil, true
+	}
+
+	file, err := os.Open(dir + "/" + IgnoreFile)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rules = append(rules, rule{dir: dir, pattern: line})
+	}
+
+	return rules, len(rules) == 0
+}
+
+// ancestorRules reads the ignore files of the directories that contain `path`, so that scanning
+// part of a tree excludes the same files as scanning the whole tree.
+func ancestorRules(path string) (rules []rule, ignoreAll bool) {
+	dirs := make([]string, 0)
+	for d := filepath.Dir(path); ; d = filepath.Dir(d) {
+		dirs = append(dirs, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		r, all := readIgnoreFiles(dirs[i])
+		if all {
+			return nil, true
+		}
+		rules = append(rules, r...)
+	}
+	return
+}
+
+// Excluded returns true if scanning the directory tree `root` with the options `o` skips `path`, a
+// file or directory under root, because it or a directory containing it matches an Exclude pattern
+// or is excluded by an ignore file. Include and MinSize aren't considered. If o is nil the defaults are used.
+func (o *Options) Excluded(root, path string) bool {
+	// The root directory "/" becomes "", whose ignore files are read at the first step below.
+	root = strings.TrimRight(root, "/")
+	if !strings.HasPrefix(path, root+"/") {
+		return false
+	}
+
+	var rules []rule
+	if len(root) > 0 {
+		var all bool
+		if rules, all = ancestorRules(root); all {
+			return true
+		}
+	}
+	if o != nil {
+		for _, p := range o.Exclude {
+			rules = append(rules, rule{pattern: p})
+		}
+	}
+
+	// Check each directory on the way down to path, as the scan would.
+	dir := root
+	for _, e := range strings.Split(path[len(root)+1:], "/") {
+		r, all := readIgnoreFiles(dir)
+		if all {
+			return true
+		}
+		rules = append(rules, r...)
+
+		dir += "/" + e
+		for _, r := range rules {
+			if r.matches(dir) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fileId uniquely identifies a file on the system.
+type fileId struct {
+	dev, ino uint64
+}
+
+func getFileId(fi os.FileInfo) (id fileId, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if ok {
+		id = fileId{uint64(st.Dev), uint64(st.Ino)}
+	}
+	return
+}
+
+// walker scans a directory tree applying the exclusion rules of the scan options.
+type walker struct {
+	opts    *Options
+	send    func(path string) error
+	onError func(*ScanError)
+	// Directories already scanned. Used to avoid symlink loops and scanning a directory twice.
+	visited map[fileId]bool
+}
+
+func newWalker(opts *Options, send func(path string) error, onError func(*ScanError)) *walker {
+	return &walker{opts: opts, send: send, onError: onError, visited: make(map[fileId]bool)}
+}
+
+func (w *walker) fail(path string, err error) {
+	if w.onError != nil {
+		w.onError(newScanError(path, PhaseList, err))
+	}
+}
+
+func (w *walker) excluded(path string, rules []rule) bool {
+	for _, r := range rules {
+		if r.matches(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *walker) included(path string) bool {
+	if len(w.opts.Include) == 0 {
+		return true
+	}
+	for _, p := range w.opts.Include {
+		if (rule{pattern: p}).matches(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// walk scans the directory `dir`, whose info is `fi`. Entries that match one of `rules` are skipped.
+func (w *walker) walk(dir string, fi os.FileInfo, rules []rule) error {
+	if id, ok := getFileId(fi); ok {
+		if w.visited[id] {
+			return nil
+		}
+		w.visited[id] = true
+	}
+
+	r, all := readIgnoreFiles(dir)
+	if all {
+		return nil
+	}
+	rules = append(rules[:len(rules):len(rules)], r...)
+
+	file, err := os.Open(dir)
+	if err != nil {
+		w.fail(dir, err)
+		return nil
+	}
+	defer file.Close()
+
+	for {
+		fi, err := file.Readdir(256)
+
+		for _, fin := range fi {
+			path := dir + "/" + fin.Name()
+			if w.excluded(path, rules) {
+				continue
+			}
+
+			if fin.Mode()&os.ModeSymlink != 0 {
+				// Follow the link. Dangling links are ignored.
+				st, err := os.Stat(path)
+				if err != nil {
+					continue
+				}
+				fin = st
+			}
+
+			if fin.IsDir() {
+				// Errors reading subdirectories are ignored, so this only fails if the scan was stopped.
+				if err := w.walk(path, fin, rules); err != nil {
+					return err
+				}
+			} else if fin.Mode().IsRegular() {
+				// The size and include patterns select mp3s; playlist files are always scanned.
+				if !playlistRegexp.MatchString(path) && (fin.Size() < w.opts.MinSize || !w.included(path)) {
+					continue
+				}
+				if err := w.send(path); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			w.fail(dir, err)
+			break
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package scan
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestScanRules(test *testing.T) {
+	dir := createTestTree(test,
+		"a/one.mp3",
+		"a/@eaDir/one.mp3",
+		"a/x.mp3",
+		"Podcasts/old/ep1.mp3",
+		"Podcasts/new/ep2.mp3",
+		"b/"+NoMediaFile,
+		"b/three.mp3",
+		"c/"+IgnoreFile,
+		"c/keep.mp3",
+		"c/skip.mp3",
+		"c/sub/skip.mp3",
+	)
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "c", IgnoreFile), []byte("# comment\nskip.mp3\n"), 0644); err != nil {
+		test.Fatal("Writing ignore file failed: ", err)
+	}
+	// Symlink loop
+	if err := os.Symlink(dir, filepath.Join(dir, "a/loop")); err != nil {
+		test.Fatal("Creating symlink failed: ", err)
+	}
+
+	opts := &Options{Exclude: []string{"@eaDir", "Podcasts/old"}, MinSize: int64(len("a/one.mp3"))}
+	paths, _ := listMp3Paths(context.Background(), dir, opts)
+
+	for i, p := range paths {
+		paths[i] = strings.TrimPrefix(p, dir+"/")
+	}
+	sort.Strings(paths)
+
+	expected := []string{"Podcasts/new/ep2.mp3", "a/one.mp3", "c/keep.mp3"}
+	if strings.Join(paths, ",") != strings.Join(expected, ",") {
+		test.Fatalf("Expected %v but scanned %v", expected, paths)
+	}
+
+	// Scanning a subdirectory must honor the ignore files of its parents.
+	paths, _ = listMp3Paths(context.Background(), filepath.Join(dir, "c/sub"), nil)
+	if len(paths) != 0 {
+		test.Fatalf("Expected the ignore file in the parent to apply but scanned %v", paths)
+	}
+
+	// Excluded agrees with the scan.
+	cases := []struct {
+		path     string
+		excluded bool
+	}{
+		{"a", false},
+		{"a/one.mp3", false},
+		{"a/@eaDir", true},
+		{"a/@eaDir/one.mp3", true},
+		{"Podcasts/old/ep1.mp3", true},
+		{"Podcasts/new/ep2.mp3", false},
+		{"b", false},
+		{"b/three.mp3", true},
+		{"b/new/four.mp3", true},
+		{"c/keep.mp3", false},
+		{"c/skip.mp3", true},
+		{"c/sub/skip.mp3", true},
+		{"c/sub/keep.mp3", false},
+	}
+	for _, c := range cases {
+		if e := opts.Excluded(dir, filepath.Join(dir, c.path)); e != c.excluded {
+			test.Errorf("Expected %s to be excluded %v but got %v", c.path, c.excluded, e)
+		}
+	}
+	if opts.Excluded(filepath.Join(dir, "b"), filepath.Join(dir, "a/one.mp3")) {
+		test.Error("A path outside the scanned directory was excluded")
+	}
+}
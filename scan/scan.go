@@ -3,17 +3,90 @@ package scan
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"github.com/jeffwilliams/wwwmp3/play"
 	"os"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // Metadata represents mp3 id3 metainformation as well as a filesystem path to the mp3 file.
+// It also holds the properties of the audio stream (like duration and bitrate) found by
+// decoding the file, and the file's size and modification time.
 type Metadata struct {
 	play.Metadata
+	play.Info
 	Path string
+	// Size of the file in bytes
+	Size int64
+	// Modification time of the file in seconds since the Unix epoch
+	Mtime int64
+	// Hash of the file without its tags
+	AudioHash string
+	// Acoustic fingerprint; only set if Options.Fingerprint is set.
+	Fingerprint string
+	// Names of the fields that were missing from the id3 tags and were instead derived from the path.
+	PathFields []string `json:",omitempty"`
+}
+
+// Options controls how mp3s are scanned. The zero value is usable.
+type Options struct {
+	// Templates used to derive metadata from the path of files that have missing id3 tags.
+	// The first template that matches is used.
+	PathTemplates []*PathTemplate
+	// If true, ScanMp3sToDb re-reads all files, even those that are unchanged since the last scan.
+	Full bool
+	// If true, after scanning ScanMp3sToDb removes mp3s from the database whose files no longer exist.
+	// See PruneMp3sInDb.
+	Prune bool
+	// Number of files whose tags are read concurrently. If zero, the number of CPUs is used.
+	Workers int
+	// Maximum number of mp3s ScanMp3sToDb writes to the database in one transaction. If zero, 100 is used.
+	BatchSize int
+	// If not empty, only mp3s that match one of these glob patterns are scanned.
+	Include []string
+	// Files and directories that match one of these glob patterns are not scanned. Patterns
+	// without a '/' match the last element of a path; patterns with a '/' match the end of a path.
+	Exclude []string
+	// Mp3s smaller than this many bytes are not scanned.
+	MinSize int64
+	// If set, ScanMp3sToDb stores the mp3s in this library root, with paths relative to it, and
+	// the path transform passed to it is not used. The directory scanned must be the root
+	// directory or be under it.
+	Root *Root
+	// If true, the acoustic fingerprint of each mp3 read is computed, so that different rips of the
+	// same recording can be found by FindDuplicates. This decodes the whole mp3, which is slow.
+	Fingerprint bool
+	// If true, ScanMp3sToDb doesn't import the playlist files it finds (see PlaylistFormats) as
+	// saved playlists.
+	IgnorePlaylists bool
+}
+
+// target returns the name of the library root that mp3s are stored in and the transform from
+// the path of a file to the path stored, given the path transform passed to a scan.
+func (o *Options) target(pathTransform StringTransform) (library string, t StringTransform) {
+	if o == nil || o.Root == nil {
+		return "", pathTransform
+	}
+	return o.Root.Name, o.Root.Relative
+}
+
+func (o *Options) workers() int {
+	if o.Workers > 0 {
+		return o.Workers
+	}
+	return runtime.NumCPU()
+}
+
+func (o *Options) batchSize() int {
+	if o.BatchSize > 0 {
+		return o.BatchSize
+	}
+	return 100
 }
 
 // Return a human readable version of the metadata.
@@ -36,10 +109,37 @@ func (m Metadata) String() string {
 // Scan scans a directory tree for files and passes the full path of all files to the `files` chan.
 // If reading basedir fails, an error is returned.
 func Scan(path string, files chan string) error {
+	return ScanContext(context.Background(), path, files)
+}
+
+// ScanContext is the same as Scan, but stops scanning when `ctx` is done. In that
+// case ctx.Err() is returned.
+func ScanContext(ctx context.Context, path string, files chan string) error {
+	return scanWithOptions(ctx, path, files, nil, nil)
+}
+
+// scanWithOptions is the same as ScanContext, but skips the files excluded by the options.
+// Directories containing a NoMediaFile, and the entries that match the patterns in an IgnoreFile,
+// are always skipped. Symlinks are followed, but each directory is only scanned once.
+// If `onError` is not nil it is called for each directory that can't be read.
+func scanWithOptions(ctx context.Context, path string, files chan string, opts *Options, onError func(*ScanError)) error {
 	defer func() {
 		close(files)
 	}()
 
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	send := func(path string) error {
+		select {
+		case files <- path:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
 	// Special case: user passed a file
 	fi, err := os.Stat(path)
 	if err != nil {
@@ -47,41 +147,22 @@ func Scan(path string, files chan string) error {
 	}
 
 	if !fi.IsDir() {
-		files <- path
-		return nil
+		return send(path)
 	}
 
-	var scan func(dir string) error
-
-	scan = func(dir string) error {
-
-		file, err := os.Open(dir)
-		if err != nil {
-			//return fmt.Errorf("Opening directory %v failed: %v", dir, err)
-			// TODO: Log a message here.
-		}
-
-		for {
-			fi, err := file.Readdir(10)
-
-			if err != nil {
-				break
-			}
-
-			for _, fin := range fi {
-				if fin.IsDir() {
-					// Ignore errors reading subdirectories
-					scan(dir + "/" + fin.Name())
-				} else {
-					files <- dir + "/" + fin.Name()
-				}
-			}
-		}
+	if len(path) > 1 {
+		path = strings.TrimRight(path, "/")
+	}
 
+	w := newWalker(opts, send, onError)
+	rules, all := ancestorRules(path)
+	if all {
 		return nil
 	}
-
-	return scan(path)
+	for _, p := range opts.Exclude {
+		rules = append(rules, rule{pattern: p})
+	}
+	return w.walk(path, fi, rules)
 }
 
 var mp3Regexp *regexp.Regexp = regexp.MustCompile(`\.[mM][pP]3$`)
@@ -89,24 +170,124 @@ var mp3Regexp *regexp.Regexp = regexp.MustCompile(`\.[mM][pP]3$`)
 // ScanMp3s scans a directory tree for mp3 files. It passes the mp3 Metadata to the chan `meta`.
 // As a special case, if path is a file it alone is scanned.
 func ScanMp3s(path string, meta chan Metadata) {
+	ScanMp3sWithOptions(path, meta, nil)
+}
+
+// ScanMp3sWithOptions is the same as ScanMp3s, but scans using the specified options.
+// If opts is nil the defaults are used.
+func ScanMp3sWithOptions(path string, meta chan Metadata, opts *Options) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
 	c := make(chan string)
 
 	defer func() {
 		close(meta)
 	}()
 
-	go Scan(path, c)
+	go scanMp3Paths(path, c, opts)
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range c {
+				m, _ := readMetadata(f, opts)
+				meta <- m
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// scanMp3Paths scans a directory tree for mp3 files not excluded by `opts` and passes their paths to `paths`.
+func scanMp3Paths(path string, paths chan string, opts *Options) {
+	c := make(chan string)
+
+	defer func() {
+		close(paths)
+	}()
+
+	go scanWithOptions(context.Background(), path, c, opts, nil)
 
 	for f := range c {
 		if mp3Regexp.MatchString(f) {
-			m := play.GetMetadata(f)
-			rectify(&m)
-			f = strings.Replace(f, "//", "/", -1)
-			meta <- Metadata{m, f}
+			paths <- strings.Replace(f, "//", "/", -1)
 		}
 	}
 }
 
+// listMp3Paths scans a directory tree for mp3 files not excluded by `opts` and returns their paths,
+// and errors for the directories that couldn't be read. If `ctx` is done before the scan completes
+// the paths found so far are returned.
+func listMp3Paths(ctx context.Context, path string, opts *Options) (paths []string, errs []*ScanError) {
+	paths, _, errs = listFiles(ctx, path, opts)
+	return
+}
+
+// listFiles is the same as listMp3Paths, but also returns the paths of the playlist files found.
+func listFiles(ctx context.Context, path string, opts *Options) (paths, playlists []string, errs []*ScanError) {
+	c := make(chan string)
+	// onError is called from the scanning goroutine, before it closes c.
+	go scanWithOptions(ctx, path, c, opts, func(e *ScanError) {
+		errs = append(errs, e)
+	})
+
+	paths = make([]string, 0)
+	playlists = make([]string, 0)
+	for f := range c {
+		if mp3Regexp.MatchString(f) {
+			paths = append(paths, strings.Replace(f, "//", "/", -1))
+		} else if playlistRegexp.MatchString(f) {
+			playlists = append(playlists, strings.Replace(f, "//", "/", -1))
+		}
+	}
+	return
+}
+
+// readMetadata reads the id3 tags, audio stream properties and file attributes of the mp3 `path`.
+// If the file can't be decoded the stream properties are left as zero and a PhaseDecode error is returned.
+func readMetadata(path string, opts *Options) (m Metadata, err error) {
+	m = Metadata{Metadata: play.GetTags(path), Path: path}
+	applyPathTemplates(&m, opts.PathTemplates)
+	rectify(&m.Metadata)
+
+	if info, e := play.GetFileInfo(path); e == nil {
+		m.Info = info
+	} else {
+		err = newScanError(path, PhaseDecode, e)
+	}
+
+	if fi, err := os.Stat(path); err == nil {
+		m.Size = fi.Size()
+		m.Mtime = fi.ModTime().Unix()
+	}
+
+	if h, e := audioHash(path); e == nil {
+		m.AudioHash = h
+	} else if err == nil {
+		err = newScanError(path, PhaseDecode, fmt.Errorf("hashing the audio failed: %v", e))
+	}
+
+	if opts.Fingerprint {
+		if fp, e := fingerprint(path); e == nil {
+			m.Fingerprint = fp
+		} else if err == nil {
+			err = newScanError(path, PhaseDecode, fmt.Errorf("fingerprinting failed: %v", e))
+		}
+	}
+
+	// The decoder reports the bitrate of the first frame. For variable bitrate
+	// files store the average over the whole file instead.
+	if m.Vbr && m.Duration > 0 && m.Size > 0 {
+		m.BitRate = int(float64(m.Size) * 8 / m.Duration / 1000)
+	}
+
+	return
+}
+
 func rectify(m *play.Metadata) {
 	if len(m.Title) == 0 {
 		m.Title = "Unknown"
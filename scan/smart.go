@@ -0,0 +1,411 @@
+package scan
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SmartRules selects the mp3s of a smart playlist, like "genre is Jazz and rating is at least 4 and
+// not played in the last 30 days, 50 in random order". Smart playlists store their rules as JSON,
+// in the format described by SmartRulesSchema.
+type SmartRules struct {
+	// The mp3s must match every rule.
+	Rules []SmartRule `json:"rules"`
+	// Order of the mp3s: a field, a field prefixed with '-' for descending order, or "random". If
+	// empty the mp3s are ordered like the results of a Query.
+	Order string `json:"order,omitempty"`
+	// Maximum number of mp3s. If zero all the mp3s matching the rules are selected.
+	Limit int `json:"limit,omitempty"`
+}
+
+// SmartRule is a rule of a smart playlist. Either Field, Op and Value are set, or Any is.
+type SmartRule struct {
+	// Field of the mp3 to compare (see SmartFields), how to compare it (see SmartOps) and what to
+	// compare it to: a string for text fields, and a number for the others.
+	Field string      `json:"field,omitempty"`
+	Op    string      `json:"op,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+	// If set, the rule matches if any of these rules do. They must use the "is", "contains" or
+	// "starts_with" ops.
+	Any []SmartRule `json:"any,omitempty"`
+}
+
+// SmartOps are the ways a SmartRule may compare a field to its value:
+//
+//	is, contains, starts_with:  the field is, contains or starts with the value. Text is compared ignoring case.
+//	at_least, at_most:          the numeric field is at least or at most the value.
+//	in_last_days:               the time field (last_played or mtime) is in the last `value` days.
+//	not_in_last_days:           the time field isn't in the last `value` days. Mp3s never played match.
+var SmartOps = []string{"is", "contains", "starts_with", "at_least", "at_most", "in_last_days", "not_in_last_days"}
+
+// SmartFields are the fields of the mp3s that smart playlist rules may use.
+var SmartFields = []string{"artist", "album", "title", "path", "library", "genre", "lyrics", "tracknum", "year",
+	"duration", "bitrate", "rate", "channels", "vbr", "size", "mtime", "plays", "skips", "last_played", "rating", "favorite"}
+
+// timeFields are the fields holding unix times, which the *_days ops compare.
+var timeFields = []string{"mtime", "last_played"}
+
+// RandomOrder is the SmartRules.Order that shuffles the mp3s.
+const RandomOrder = "random"
+
+var (
+	// ErrSmartPlaylist is returned when changing the tracks of a smart playlist directly.
+	ErrSmartPlaylist = errors.New("The tracks of a smart playlist are selected by its rules")
+	// ErrNotSmart is returned when refreshing a playlist that isn't a smart playlist.
+	ErrNotSmart = errors.New("The playlist is not a smart playlist")
+)
+
+// SmartRulesSchema is a JSON schema describing the JSON format of SmartRules.
+const SmartRulesSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "Smart playlist rules",
+  "description": "Selects the mp3s of a smart playlist. The mp3s must match every rule.",
+  "type": "object",
+  "required": ["rules"],
+  "additionalProperties": false,
+  "properties": {
+    "rules": {
+      "type": "array",
+      "items": {
+        "oneOf": [
+          {"$ref": "#/definitions/textRule"},
+          {"$ref": "#/definitions/numberRule"},
+          {"$ref": "#/definitions/timeRule"},
+          {
+            "description": "Matches if any of the rules do.",
+            "type": "object",
+            "required": ["any"],
+            "additionalProperties": false,
+            "properties": {
+              "any": {"type": "array", "minItems": 1, "items": {"$ref": "#/definitions/anyRule"}}
+            }
+          }
+        ]
+      }
+    },
+    "order": {
+      "description": "A field to order by, the field prefixed with '-' for descending order, or 'random'.",
+      "type": "string",
+      "pattern": "^(random|-?(artist|album|title|path|library|genre|lyrics|tracknum|year|duration|bitrate|rate|channels|vbr|size|mtime|plays|skips|last_played|rating|favorite))$"
+    },
+    "limit": {
+      "description": "Maximum number of mp3s; 0 or missing for all of them.",
+      "type": "integer",
+      "minimum": 0
+    }
+  },
+  "definitions": {
+    "textField": {"enum": ["artist", "album", "title", "path", "library", "genre", "lyrics"]},
+    "numberField": {"enum": ["tracknum", "year", "duration", "bitrate", "rate", "channels", "vbr", "size", "mtime", "plays", "skips", "last_played", "rating", "favorite"]},
+    "timeField": {"enum": ["mtime", "last_played"]},
+    "textRule": {
+      "description": "Compares a text field, ignoring case.",
+      "type": "object",
+      "required": ["field", "op", "value"],
+      "additionalProperties": false,
+      "properties": {
+        "field": {"$ref": "#/definitions/textField"},
+        "op": {"enum": ["is", "contains", "starts_with"]},
+        "value": {"type": "string"}
+      }
+    },
+    "numberRule": {
+      "type": "object",
+      "required": ["field", "op", "value"],
+      "additionalProperties": false,
+      "properties": {
+        "field": {"$ref": "#/definitions/numberField"},
+        "op": {"enum": ["is", "at_least", "at_most"]},
+        "value": {"type": "number"}
+      }
+    },
+    "timeRule": {
+      "description": "Compares a time field to the number of days before the playlist is refreshed.",
+      "type": "object",
+      "required": ["field", "op", "value"],
+      "additionalProperties": false,
+      "properties": {
+        "field": {"$ref": "#/definitions/timeField"},
+        "op": {"enum": ["in_last_days", "not_in_last_days"]},
+        "value": {"type": "number", "exclusiveMinimum": 0}
+      }
+    },
+    "anyRule": {
+      "oneOf": [
+        {
+          "type": "object",
+          "required": ["field", "op", "value"],
+          "additionalProperties": false,
+          "properties": {
+            "field": {"$ref": "#/definitions/textField"},
+            "op": {"enum": ["is", "contains", "starts_with"]},
+            "value": {"type": "string"}
+          }
+        },
+        {
+          "type": "object",
+          "required": ["field", "op", "value"],
+          "additionalProperties": false,
+          "properties": {
+            "field": {"$ref": "#/definitions/numberField"},
+            "op": {"enum": ["is"]},
+            "value": {"type": "number"}
+          }
+        }
+      ]
+    }
+  }
+}
+`
+
+// ParseSmartRules parses and checks the rules of a smart playlist encoded as JSON.
+func ParseSmartRules(data []byte) (*SmartRules, error) {
+	var r SmartRules
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&r); err != nil {
+		return nil, fmt.Errorf("Parsing the smart playlist rules failed: %v", err)
+	}
+	if err := r.Check(); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// JSON returns the rules encoded as JSON.
+func (r *SmartRules) JSON() string {
+	d, _ := json.Marshal(r)
+	return string(d)
+}
+
+// Check returns an error if the rules aren't valid.
+func (r *SmartRules) Check() error {
+	for i := range r.Rules {
+		if err := r.Rules[i].check(false); err != nil {
+			return err
+		}
+	}
+
+	if r.Order != RandomOrder && len(r.Order) > 0 {
+		if f := strings.TrimPrefix(r.Order, "-"); !containsString(SmartFields, f) {
+			return fmt.Errorf("Can't order a smart playlist by '%s'", f)
+		}
+	}
+	if r.Limit < 0 {
+		return fmt.Errorf("The limit of a smart playlist can't be negative")
+	}
+	return nil
+}
+
+// check returns an error if the rule isn't valid. `inAny` is true if the rule is in the Any of another.
+func (r *SmartRule) check(inAny bool) error {
+	if len(r.Any) > 0 {
+		if inAny {
+			return fmt.Errorf("Rules with 'any' can't be nested")
+		}
+		if len(r.Field) > 0 || len(r.Op) > 0 || r.Value != nil {
+			return fmt.Errorf("A rule with 'any' can't have a field, op or value")
+		}
+		for i := range r.Any {
+			if err := r.Any[i].check(true); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !containsString(SmartFields, r.Field) {
+		return fmt.Errorf("Unknown smart playlist field '%s'", r.Field)
+	}
+	if !containsString(SmartOps, r.Op) {
+		return fmt.Errorf("Unknown smart playlist op '%s'", r.Op)
+	}
+	if inAny && r.Op != "is" && r.Op != "contains" && r.Op != "starts_with" {
+		return fmt.Errorf("The op '%s' can't be used in a rule with 'any'", r.Op)
+	}
+
+	if columns[r.Field] == textColumn {
+		if _, ok := r.Value.(string); !ok {
+			return fmt.Errorf("The value of the text field '%s' must be a string", r.Field)
+		}
+		if r.Op != "is" && r.Op != "contains" && r.Op != "starts_with" {
+			return fmt.Errorf("The op '%s' can't be used with the text field '%s'", r.Op, r.Field)
+		}
+		return nil
+	}
+
+	n, ok := r.Value.(float64)
+	if !ok {
+		return fmt.Errorf("The value of the field '%s' must be a number", r.Field)
+	}
+	switch r.Op {
+	case "contains", "starts_with":
+		return fmt.Errorf("The op '%s' can only be used with text fields", r.Op)
+	case "in_last_days", "not_in_last_days":
+		if !containsString(timeFields, r.Field) {
+			return fmt.Errorf("The op '%s' can only be used with the fields %s", r.Op, strings.Join(timeFields, " and "))
+		}
+		if n <= 0 {
+			return fmt.Errorf("The number of days must be positive")
+		}
+	}
+	return nil
+}
+
+// condition returns the Condition for the rule, which uses the is, contains or starts_with op.
+func (r *SmartRule) condition() Condition {
+	c := Condition{Field: r.Field, Match: Exact}
+	if r.Op == "contains" {
+		c.Match = Substring
+	} else if r.Op == "starts_with" {
+		c.Match = Prefix
+	}
+	if s, ok := r.Value.(string); ok {
+		c.Value = s
+	} else {
+		c.Value = strconv.FormatFloat(r.Value.(float64), 'f', -1, 64)
+	}
+	return c
+}
+
+// Query returns the query that finds the mp3s matching the rules at the time `now`. The order and
+// limit are only applied if they can be done by the query; see SmartTracks. Only the Library and
+// Path fields are returned.
+func (r *SmartRules) Query(now time.Time) (*Query, error) {
+	if err := r.Check(); err != nil {
+		return nil, err
+	}
+
+	q := &Query{Fields: []string{"library", "path"}}
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if len(rule.Any) > 0 {
+			group := make([]Condition, len(rule.Any))
+			for j := range rule.Any {
+				group[j] = rule.Any[j].condition()
+			}
+			q.Any = append(q.Any, group)
+			continue
+		}
+
+		var bound float64
+		if n, ok := rule.Value.(float64); ok {
+			bound = n
+			if rule.Op == "in_last_days" || rule.Op == "not_in_last_days" {
+				bound = float64(now.Add(-time.Duration(n * float64(24*time.Hour))).Unix())
+			}
+		}
+		switch rule.Op {
+		case "at_least", "in_last_days":
+			q.Ranges = append(q.Ranges, Range{Field: rule.Field, Min: &bound})
+		case "at_most":
+			q.Ranges = append(q.Ranges, Range{Field: rule.Field, Max: &bound})
+		case "not_in_last_days":
+			// Ranges are inclusive; exclude the bound itself.
+			bound--
+			q.Ranges = append(q.Ranges, Range{Field: rule.Field, Max: &bound})
+		default:
+			q.Where = append(q.Where, rule.condition())
+		}
+	}
+
+	if len(r.Order) > 0 && r.Order != RandomOrder {
+		s := ParseSort(r.Order)
+		// Order mp3s that are equal in the order field like the default order.
+		q.Order = append([]Sort{s}, defaultOrder...)
+	}
+	if r.Limit > 0 && r.Order != RandomOrder {
+		q.Paging = &Paging{PageSize: r.Limit}
+	}
+	return q, nil
+}
+
+// SmartTracks returns the mp3s in `lib` selected by the rules `r` at the time `now`. Only the
+// Library and Path are set.
+func SmartTracks(lib Library, r *SmartRules, now time.Time) ([]Track, error) {
+	q, err := r.Query(now)
+	if err != nil {
+		return nil, err
+	}
+	tracks, _, err := lib.FindTracks(q)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Order == RandomOrder {
+		rnd := rand.New(rand.NewSource(now.UnixNano()))
+		rnd.Shuffle(len(tracks), func(i, j int) { tracks[i], tracks[j] = tracks[j], tracks[i] })
+		if r.Limit > 0 && len(tracks) > r.Limit {
+			tracks = tracks[:r.Limit]
+		}
+	}
+	return tracks, nil
+}
+
+// SmartRules returns the rules of the playlist if it's a smart playlist, or nil if it isn't.
+func (p *Playlist) SmartRules() (*SmartRules, error) {
+	if len(p.Rules) == 0 {
+		return nil, nil
+	}
+	return ParseSmartRules([]byte(p.Rules))
+}
+
+// CreateSmartPlaylist saves a new smart playlist named `name` selecting its mp3s with the rules
+// `r`, and returns its id. Its tracks are the mp3s the rules select now. ErrPlaylistExists is
+// returned if the name is already used.
+func CreateSmartPlaylist(lib Library, name string, r *SmartRules) (int64, error) {
+	tracks, err := SmartTracks(lib, r, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := lib.CreatePlaylist(name, tracks)
+	if err != nil {
+		return 0, err
+	}
+	if err = lib.SetPlaylistRules(id, r.JSON()); err != nil {
+		lib.DeletePlaylist(id)
+		return 0, err
+	}
+	return id, nil
+}
+
+// SetSmartRules changes the rules of the playlist with id `id` to `r`, making it a smart playlist
+// if it wasn't, and refreshes its tracks.
+func SetSmartRules(lib Library, id int64, r *SmartRules) error {
+	tracks, err := SmartTracks(lib, r, time.Now())
+	if err != nil {
+		return err
+	}
+	if err = lib.SetPlaylistRules(id, r.JSON()); err != nil {
+		return err
+	}
+	return lib.SetPlaylistTracks(id, tracks)
+}
+
+// RefreshSmartPlaylist replaces the tracks of the smart playlist with id `id` with the mp3s its
+// rules select now. ErrNotSmart is returned if it isn't a smart playlist.
+func RefreshSmartPlaylist(lib Library, id int64) error {
+	p, err := lib.Playlist(id)
+	if err != nil {
+		return err
+	}
+	r, err := p.SmartRules()
+	if err != nil {
+		return err
+	} else if r == nil {
+		return ErrNotSmart
+	}
+
+	tracks, err := SmartTracks(lib, r, time.Now())
+	if err != nil {
+		return err
+	}
+	return lib.SetPlaylistTracks(id, tracks)
+}
@@ -0,0 +1,131 @@
+package scan
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSmartRules(test *testing.T) {
+	bad := []string{
+		`{"rules": [{"field": "genre", "op": "at_least", "value": "Jazz"}]}`,
+		`{"rules": [{"field": "rating", "op": "is", "value": "4"}]}`,
+		`{"rules": [{"field": "rating", "op": "in_last_days", "value": 4}]}`,
+		`{"rules": [{"field": "audio_hash", "op": "is", "value": "x"}]}`,
+		`{"rules": [{"any": [{"field": "rating", "op": "at_least", "value": 4}]}]}`,
+		`{"rules": [{"any": [{"any": [{"field": "genre", "op": "is", "value": "Jazz"}]}]}]}`,
+		`{"rules": [], "order": "lyrics2"}`,
+		`{"rules": [], "limit": -1}`,
+		`{"rules": [], "shuffle": true}`,
+	}
+	for _, b := range bad {
+		if _, err := ParseSmartRules([]byte(b)); err == nil {
+			test.Fatalf("Expected an error parsing %s", b)
+		}
+	}
+
+	// The fields in the schema are the SmartFields.
+	var schema struct {
+		Definitions map[string]struct {
+			Enum []string
+		}
+	}
+	if err := json.Unmarshal([]byte(SmartRulesSchema), &schema); err != nil {
+		test.Fatal("Parsing the schema failed: ", err)
+	}
+	fields := append(schema.Definitions["textField"].Enum, schema.Definitions["numberField"].Enum...)
+	expected := append([]string{}, SmartFields...)
+	sort.Strings(fields)
+	sort.Strings(expected)
+	if strings.Join(fields, ",") != strings.Join(expected, ",") {
+		test.Fatalf("The schema fields %v aren't the smart playlist fields %v", fields, expected)
+	}
+}
+
+func TestSmartPlaylists(test *testing.T) {
+	db := createTestDb(test)
+	defer db.Close()
+
+	now := time.Now()
+	old := now.Add(-40 * 24 * time.Hour).Unix()
+
+	for _, lib := range []Library{db, NewMemLibrary()} {
+		err := lib.PutTracks([]Track{
+			{Path: "a.mp3", Artist: "A", Genre: "Jazz", Rating: 5},
+			{Path: "b.mp3", Artist: "B", Genre: "jazz", Rating: 4},
+			{Path: "c.mp3", Artist: "C", Genre: "Jazz", Rating: 2},
+			{Path: "d.mp3", Artist: "D", Genre: "Bebop", Rating: 4},
+			{Path: "e.mp3", Artist: "E", Genre: "Rock", Rating: 5},
+		})
+		if err != nil {
+			test.Fatal("Adding tracks failed: ", err)
+		}
+		for _, p := range []Play{{Path: "a.mp3", Started: now.Unix()}, {Path: "b.mp3", Started: old}} {
+			if err = lib.AddPlay(p); err != nil {
+				test.Fatal("Adding play failed: ", err)
+			}
+		}
+
+		r, err := ParseSmartRules([]byte(`{"rules": [
+			{"any": [{"field": "genre", "op": "is", "value": "Jazz"}, {"field": "genre", "op": "is", "value": "Bebop"}]},
+			{"field": "rating", "op": "at_least", "value": 4},
+			{"field": "last_played", "op": "not_in_last_days", "value": 30}
+		], "order": "-artist", "limit": 50}`))
+		if err != nil {
+			test.Fatal("Parsing rules failed: ", err)
+		}
+
+		id, err := CreateSmartPlaylist(lib, "Jazz", r)
+		if err != nil {
+			test.Fatal("Creating smart playlist failed: ", err)
+		}
+		p, err := lib.Playlist(id)
+		if err != nil || len(p.Tracks) != 2 || p.Tracks[0].Path != "d.mp3" || p.Tracks[1].Path != "b.mp3" {
+			test.Fatalf("Unexpected smart playlist %+v (%v)", p, err)
+		}
+		if sr, err := p.SmartRules(); err != nil || sr == nil || sr.Limit != 50 {
+			test.Fatalf("Unexpected rules %+v (%v)", sr, err)
+		}
+
+		if err = AddToPlaylist(lib, id, []Track{{Path: "e.mp3"}}, -1); err != ErrSmartPlaylist {
+			test.Fatalf("Expected ErrSmartPlaylist adding to a smart playlist but got %v", err)
+		}
+
+		// Refreshing picks up changes to the library.
+		if err = lib.Rate("", "c.mp3", 4); err != nil {
+			test.Fatal("Rating failed: ", err)
+		}
+		if err = RefreshSmartPlaylist(lib, id); err != nil {
+			test.Fatal("Refreshing failed: ", err)
+		}
+		if p, err = lib.Playlist(id); err != nil || len(p.Tracks) != 3 {
+			test.Fatalf("Unexpected refreshed playlist %+v (%v)", p, err)
+		}
+
+		r.Order, r.Limit = RandomOrder, 2
+		if err = SetSmartRules(lib, id, r); err != nil {
+			test.Fatal("Changing rules failed: ", err)
+		}
+		if p, err = lib.Playlist(id); err != nil || len(p.Tracks) != 2 {
+			test.Fatalf("Unexpected random playlist %+v (%v)", p, err)
+		}
+
+		copyId, err := DuplicatePlaylist(lib, id, "Jazz 2")
+		if err != nil {
+			test.Fatal("Duplicating failed: ", err)
+		}
+		if p, err = lib.Playlist(copyId); err != nil || p.Rules != r.JSON() {
+			test.Fatalf("Unexpected copy %+v (%v)", p, err)
+		}
+
+		static, err := lib.CreatePlaylist("Static", nil)
+		if err != nil {
+			test.Fatal("Creating playlist failed: ", err)
+		}
+		if err = RefreshSmartPlaylist(lib, static); err != ErrNotSmart {
+			test.Fatalf("Expected ErrNotSmart refreshing a static playlist but got %v", err)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package scan
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Stats summarizes the mp3s in a library. It is encoded as JSON by the server as it is.
+type Stats struct {
+	// Names of the library roots the statistics are for; all the mp3s if empty
+	Libraries []string
+	// Number of mp3s, and of the distinct artists, albums (by artist) and genres they have.
+	// Missing tags aren't counted as artists, albums or genres.
+	Tracks  int
+	Artists int
+	Albums  int
+	Genres  int
+	// Total duration in seconds and size in bytes of the mp3s
+	Duration float64
+	Size     int64
+	// Number of mp3s released in each decade, ordered by decade. Mp3s without a year aren't counted.
+	Decades []DecadeCount
+	// Number of mp3s missing each tag, keyed by field name: artist, album, title, tracknum, genre and year
+	Missing map[string]int
+	// Some of the mp3s missing tags, ordered by library and path
+	MissingTracks []MissingTags
+	// The albums with the most mp3s
+	LargestAlbums []AlbumStats
+	// What was listened to, from the listening history
+	Listening ListeningStats
+}
+
+// ListeningStats summarizes the plays in the listening history.
+type ListeningStats struct {
+	// Number of plays, not counting skips, and number of skips
+	Plays int
+	Skips int
+	// Time spent listening in seconds, estimated from how much of each mp3 played, including skips.
+	// Plays of mp3s that are no longer in the library aren't counted.
+	Duration float64
+	// The mp3s played most often
+	MostPlayed []PlayCount
+}
+
+// DecadeCount is the number of mp3s released in a decade.
+type DecadeCount struct {
+	// The first year of the decade, like 1970
+	Decade int
+	Tracks int
+}
+
+// MissingTags names the tags that an mp3 is missing.
+type MissingTags struct {
+	Library string
+	Path    string
+	Fields  []string
+}
+
+// AlbumStats describes an album.
+type AlbumStats struct {
+	Artist string
+	Album  string
+	Tracks int
+	// Total duration in seconds
+	Duration float64
+}
+
+// StatsOptions controls what LibraryStats reports. The zero value is usable.
+type StatsOptions struct {
+	// Only count the mp3s in these library roots. If empty all mp3s are counted. The empty
+	// string names the mp3s that aren't under a named root.
+	Libraries []string
+	// Number of mp3s missing tags, of albums and of most played mp3s to list. If zero, 10 is used.
+	Top int
+	// Only count the plays in the listening history that started at or after From and before To
+	// (unix times). Zero means no bound.
+	From int64
+	To   int64
+}
+
+func (o *StatsOptions) top() int {
+	if o.Top > 0 {
+		return o.Top
+	}
+	return 10
+}
+
+// unknown is the value that scans store for missing artists, albums and titles (see rectify).
+const unknown = "Unknown"
+
+// missingTags returns the names of the tags that the mp3 `t` is missing.
+func missingTags(t *Track) []string {
+	m := make([]string, 0)
+	for _, f := range []string{"artist", "album", "title"} {
+		if v := t.text(f); len(v) == 0 || v == unknown {
+			m = append(m, f)
+		}
+	}
+	if t.Tracknum < 0 {
+		m = append(m, "tracknum")
+	}
+	if len(t.Genre) == 0 {
+		m = append(m, "genre")
+	}
+	if t.Year <= 0 {
+		m = append(m, "year")
+	}
+	return m
+}
+
+// LibraryStats returns statistics about the mp3s in `lib`. If opts is nil the defaults are used.
+func LibraryStats(lib Library, opts *StatsOptions) (*Stats, error) {
+	if opts == nil {
+		opts = &StatsOptions{}
+	}
+	return lib.Stats(opts)
+}
+
+// statsLibraries returns the names of the library roots of `lib` whose mp3s are counted by the statistics.
+func statsLibraries(lib Library, opts *StatsOptions) ([]string, error) {
+	if len(opts.Libraries) > 0 {
+		return opts.Libraries, nil
+	}
+	roots, err := lib.Roots()
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{""}, rootNames(roots)...), nil
+}
+
+func newStats(opts *StatsOptions) *Stats {
+	return &Stats{
+		Libraries:     opts.Libraries,
+		Decades:       make([]DecadeCount, 0),
+		Missing:       make(map[string]int),
+		MissingTracks: make([]MissingTags, 0),
+		LargestAlbums: make([]AlbumStats, 0),
+	}
+}
+
+// missingConditions are the SQL conditions that select the mp3s missing each tag. See missingTags.
+var missingConditions = []struct {
+	field string
+	cond  string
+}{
+	{"artist", "coalesce(artist, '') in ('', '" + unknown + "')"},
+	{"album", "coalesce(album, '') in ('', '" + unknown + "')"},
+	{"title", "coalesce(title, '') in ('', '" + unknown + "')"},
+	{"tracknum", "coalesce(tracknum, 0) < 0"},
+	{"genre", "genre = ''"},
+	{"year", "year <= 0"},
+}
+
+// Stats returns statistics about the mp3s, computed by the database. Use LibraryStats, which accepts nil options.
+func (m Mp3Db) Stats(opts *StatsOptions) (*Stats, error) {
+	libraries, err := statsLibraries(m, opts)
+	if err != nil {
+		return nil, err
+	}
+	s := newStats(opts)
+
+	marks := make([]string, len(libraries))
+	args := make([]interface{}, len(libraries))
+	for i, l := range libraries {
+		marks[i], args[i] = "?", l
+	}
+	in := " in (" + makelist(marks, ",") + ")"
+	where := " where library" + in
+	// withTop returns the arguments of the libraries followed by the number of items to list.
+	withTop := func(args []interface{}) []interface{} {
+		return append(args[:len(args):len(args)], opts.top())
+	}
+
+	conds := make([]string, len(missingConditions))
+	sums := make([]string, len(missingConditions))
+	missing := make([]int, len(missingConditions))
+	dest := []interface{}{&s.Tracks, &s.Duration, &s.Size, &s.Artists, &s.Genres}
+	for i, c := range missingConditions {
+		conds[i] = c.cond
+		sums[i] = "coalesce(sum(" + c.cond + "), 0)"
+		dest = append(dest, &missing[i])
+	}
+
+	err = m.DB.QueryRow(`select count(*), coalesce(sum(duration), 0), coalesce(sum(size), 0),
+		count(distinct case when not (`+conds[0]+`) then lower(artist) end),
+		count(distinct case when not (`+conds[4]+`) then lower(genre) end), `+makelist(sums, ", ")+
+		" from mp3"+where, args...).Scan(dest...)
+	if err != nil {
+		return nil, fmt.Errorf("Counting mp3s failed: %v", err)
+	}
+	for i, c := range missingConditions {
+		if missing[i] > 0 {
+			s.Missing[c.field] = missing[i]
+		}
+	}
+
+	rows, err := m.DB.Query("select year / 10 * 10, count(*) from mp3"+where+" and year > 0 group by 1 order by 1", args...)
+	if err != nil {
+		return nil, fmt.Errorf("Counting decades failed: %v", err)
+	}
+	for rows.Next() {
+		var d DecadeCount
+		if err = rows.Scan(&d.Decade, &d.Tracks); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		s.Decades = append(s.Decades, d)
+	}
+	rows.Close()
+
+	rows, err = m.DB.Query(`select library, path, coalesce(artist, ''), coalesce(album, ''), coalesce(title, ''),
+		coalesce(tracknum, 0), genre, year from mp3`+where+" and ("+makelist(conds, " or ")+") order by library, path limit ?", withTop(args)...)
+	if err != nil {
+		return nil, fmt.Errorf("Finding mp3s missing tags failed: %v", err)
+	}
+	for rows.Next() {
+		var t Track
+		if err = rows.Scan(&t.Library, &t.Path, &t.Artist, &t.Album, &t.Title, &t.Tracknum, &t.Genre, &t.Year); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		s.MissingTracks = append(s.MissingTracks, MissingTags{t.Library, t.Path, missingTags(&t)})
+	}
+	rows.Close()
+
+	// Albums are told apart by artist, as in the Go loop of MemLibrary.Stats.
+	albums := " from mp3" + where + " and not (" + conds[1] + ") group by lower(coalesce(artist, '')), lower(album)"
+	if err = m.DB.QueryRow("select count(*) from (select 1"+albums+")", args...).Scan(&s.Albums); err != nil {
+		return nil, fmt.Errorf("Counting albums failed: %v", err)
+	}
+	rows, err = m.DB.Query("select coalesce(artist, ''), album, count(*), coalesce(sum(duration), 0)"+albums+
+		" order by count(*) desc, artist, album limit ?", withTop(args)...)
+	if err != nil {
+		return nil, fmt.Errorf("Finding the largest albums failed: %v", err)
+	}
+	for rows.Next() {
+		var a AlbumStats
+		if err = rows.Scan(&a.Artist, &a.Album, &a.Tracks, &a.Duration); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		s.LargestAlbums = append(s.LargestAlbums, a)
+	}
+	rows.Close()
+
+	plays := " from plays p left join mp3 m on m.library = p.library and m.path = p.path where p.library" + in
+	if opts.From != 0 {
+		plays += " and p.started >= ?"
+		args = append(args, opts.From)
+	}
+	if opts.To != 0 {
+		plays += " and p.started < ?"
+		args = append(args, opts.To)
+	}
+	l := &s.Listening
+	err = m.DB.QueryRow(`select coalesce(sum(not p.skipped), 0), coalesce(sum(p.skipped), 0),
+		coalesce(sum(p.completion * coalesce(m.duration, 0)), 0)`+plays, args...).Scan(&l.Plays, &l.Skips, &l.Duration)
+	if err != nil {
+		return nil, fmt.Errorf("Counting plays failed: %v", err)
+	}
+
+	l.MostPlayed = make([]PlayCount, 0)
+	rows, err = m.DB.Query(`select p.library, p.path, coalesce(m.artist, ''), coalesce(m.album, ''), coalesce(m.title, ''),
+		count(*)`+plays+" and not p.skipped group by p.library, p.path order by count(*) desc, p.library, p.path limit ?", withTop(args)...)
+	if err != nil {
+		return nil, fmt.Errorf("Finding the most played mp3s failed: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c PlayCount
+		if err = rows.Scan(&c.Library, &c.Path, &c.Artist, &c.Album, &c.Title, &c.Plays); err != nil {
+			return nil, err
+		}
+		l.MostPlayed = append(l.MostPlayed, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// seconds formats a duration in seconds for people to read.
+func seconds(d float64) string {
+	return time.Duration(d * float64(time.Second)).Round(time.Second).String()
+}
+
+// WriteText writes the statistics to `w` as text for people to read.
+func (s *Stats) WriteText(w io.Writer) {
+	if len(s.Libraries) > 0 {
+		fmt.Fprintf(w, "Libraries: %s\n", strings.Join(s.Libraries, ", "))
+	}
+	fmt.Fprintf(w, "Tracks:   %d\n", s.Tracks)
+	fmt.Fprintf(w, "Artists:  %d\n", s.Artists)
+	fmt.Fprintf(w, "Albums:   %d\n", s.Albums)
+	fmt.Fprintf(w, "Genres:   %d\n", s.Genres)
+	fmt.Fprintf(w, "Duration: %s\n", seconds(s.Duration))
+	fmt.Fprintf(w, "Size:     %.1f MB\n", float64(s.Size)/1e6)
+
+	if len(s.Decades) > 0 {
+		fmt.Fprintf(w, "\nTracks per decade:\n")
+		for _, d := range s.Decades {
+			fmt.Fprintf(w, "    %ds: %d\n", d.Decade, d.Tracks)
+		}
+	}
+
+	if len(s.Missing) > 0 {
+		fmt.Fprintf(w, "\nTracks missing tags:\n")
+		for _, f := range []string{"artist", "album", "title", "tracknum", "genre", "year"} {
+			if n := s.Missing[f]; n > 0 {
+				fmt.Fprintf(w, "    %s: %d\n", f, n)
+			}
+		}
+		for _, m := range s.MissingTracks {
+			p := m.Path
+			if len(m.Library) > 0 {
+				p = m.Library + ": " + p
+			}
+			fmt.Fprintf(w, "    %s (%s)\n", p, strings.Join(m.Fields, ", "))
+		}
+	}
+
+	if len(s.LargestAlbums) > 0 {
+		fmt.Fprintf(w, "\nLargest albums:\n")
+		for _, a := range s.LargestAlbums {
+			fmt.Fprintf(w, "    %s - %s: %d tracks, %s\n", a.Artist, a.Album, a.Tracks, seconds(a.Duration))
+		}
+	}
+
+	if l := &s.Listening; l.Plays+l.Skips > 0 {
+		fmt.Fprintf(w, "\nListening:\n")
+		fmt.Fprintf(w, "    Plays:    %d\n", l.Plays)
+		fmt.Fprintf(w, "    Skips:    %d\n", l.Skips)
+		fmt.Fprintf(w, "    Duration: %s\n", seconds(l.Duration))
+		if len(l.MostPlayed) > 0 {
+			fmt.Fprintf(w, "\nMost played:\n")
+			for _, c := range l.MostPlayed {
+				fmt.Fprintf(w, "    %s - %s: %d plays\n", c.Artist, c.Title, c.Plays)
+			}
+		}
+	}
+}
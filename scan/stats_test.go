@@ -0,0 +1,74 @@
+package scan
+
+import (
+	"testing"
+)
+
+func TestLibraryStats(test *testing.T) {
+	db := createTestDb(test)
+	defer db.Close()
+
+	for _, lib := range []Library{db, NewMemLibrary()} {
+		lib.PutRoot(Root{"music", "/music"})
+		lib.PutTracks([]Track{
+			{Path: "/old/a.mp3", Artist: "A", Album: "First", Title: "One", Tracknum: 1, Genre: "Rock", Year: 1975, Duration: 100, Size: 1000},
+			{Library: "music", Path: "a2.mp3", Artist: "A", Album: "First", Title: "Two", Tracknum: 2, Genre: "rock", Year: 1979, Duration: 200, Size: 2000},
+			{Library: "music", Path: "b.mp3", Artist: "B", Album: "Second", Title: "Three", Tracknum: 1, Genre: "Jazz", Year: 1981, Duration: 300, Size: 3000},
+			{Library: "music", Path: "c.mp3", Artist: "Unknown", Album: "Unknown", Title: "", Tracknum: -1, Duration: 50, Size: 500},
+		})
+
+		for _, p := range []Play{
+			{Library: "music", Path: "a2.mp3", Started: 100, Completion: 1},
+			{Library: "music", Path: "a2.mp3", Started: 200, Completion: 0.5},
+			{Library: "music", Path: "b.mp3", Started: 300, Completion: 0.1, Skipped: true},
+			{Library: "music", Path: "gone.mp3", Started: 400, Completion: 1},
+		} {
+			if err := lib.AddPlay(p); err != nil {
+				test.Fatal("Adding play failed: ", err)
+			}
+		}
+
+		s, err := LibraryStats(lib, nil)
+		if err != nil {
+			test.Fatal(err)
+		}
+
+		if s.Tracks != 4 || s.Artists != 2 || s.Albums != 2 || s.Genres != 2 || s.Duration != 650 || s.Size != 6500 {
+			test.Fatalf("Unexpected counts %+v", s)
+		}
+
+		if len(s.Decades) != 2 || s.Decades[0] != (DecadeCount{1970, 2}) || s.Decades[1] != (DecadeCount{1980, 1}) {
+			test.Fatalf("Unexpected decades %v", s.Decades)
+		}
+
+		for f, n := range map[string]int{"artist": 1, "album": 1, "title": 1, "tracknum": 1, "genre": 1, "year": 1} {
+			if s.Missing[f] != n {
+				test.Fatalf("Expected %d mp3s missing %s but got %d", n, f, s.Missing[f])
+			}
+		}
+		if len(s.MissingTracks) != 1 || s.MissingTracks[0].Path != "c.mp3" || len(s.MissingTracks[0].Fields) != 6 {
+			test.Fatalf("Unexpected mp3s missing tags %v", s.MissingTracks)
+		}
+
+		if len(s.LargestAlbums) != 2 || s.LargestAlbums[0].Album != "First" || s.LargestAlbums[0].Tracks != 2 ||
+			s.LargestAlbums[0].Duration != 300 {
+			test.Fatalf("Unexpected largest albums %v", s.LargestAlbums)
+		}
+
+		// Plays of mp3s that are no longer in the library are counted, but not in the duration.
+		l := s.Listening
+		if l.Plays != 3 || l.Skips != 1 || l.Duration != 330 || len(l.MostPlayed) != 2 ||
+			l.MostPlayed[0].Title != "Two" || l.MostPlayed[0].Plays != 2 || l.MostPlayed[1].Path != "gone.mp3" {
+			test.Fatalf("Unexpected listening stats %+v", l)
+		}
+		s, err = LibraryStats(lib, &StatsOptions{From: 150, To: 400})
+		if l = s.Listening; err != nil || l.Plays != 1 || l.Skips != 1 || l.Duration != 130 || len(l.MostPlayed) != 1 {
+			test.Fatalf("Unexpected listening stats from 150 to 400 %+v (%v)", l, err)
+		}
+
+		s, err = LibraryStats(lib, &StatsOptions{Libraries: []string{""}, Top: 1})
+		if err != nil || s.Tracks != 1 || s.Artists != 1 || len(s.LargestAlbums) != 1 || s.Listening.Plays != 0 {
+			test.Fatalf("Unexpected stats for the default library %+v (%v)", s, err)
+		}
+	}
+}
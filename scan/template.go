@@ -0,0 +1,143 @@
+package scan
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jeffwilliams/wwwmp3/play"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PathTemplate describes how metadata is laid out in the path of an mp3 file, for example
+// `{artist}/{album}/{track} - {title}.mp3`. It is used to fill in metadata for files
+// that have missing id3 tags.
+//
+// The following placeholders are supported; each matches text within one path element:
+//
+//	{artist}, {album}, {title}: the corresponding metadata field
+//	{track}: a track number (a sequence of digits)
+//	{*}: anything, which is ignored
+//
+// All other text must match literally, ignoring case. The template is matched against the
+// end of the path, so it need not describe the leading directories.
+type PathTemplate struct {
+	src    string
+	re     *regexp.Regexp
+	fields []string
+}
+
+var placeholderRegexp *regexp.Regexp = regexp.MustCompile(`\{[^}]*\}`)
+
+// ParsePathTemplate parses a path template. See PathTemplate for the format.
+func ParsePathTemplate(s string) (*PathTemplate, error) {
+	var re bytes.Buffer
+	t := &PathTemplate{src: s}
+
+	re.WriteString(`(?i)(?:^|/)`)
+
+	last := 0
+	for _, loc := range placeholderRegexp.FindAllStringIndex(s, -1) {
+		re.WriteString(regexp.QuoteMeta(s[last:loc[0]]))
+		last = loc[1]
+
+		name := s[loc[0]+1 : loc[1]-1]
+		switch name {
+		case "artist", "album", "title":
+			re.WriteString(`([^/]+?)`)
+		case "track":
+			re.WriteString(`(\d+)`)
+		case "*":
+			re.WriteString(`(?:[^/]*?)`)
+			continue
+		default:
+			return nil, fmt.Errorf("Path template %s contains unknown placeholder {%s}", s, name)
+		}
+
+		for _, f := range t.fields {
+			if f == name {
+				return nil, fmt.Errorf("Path template %s contains the placeholder {%s} more than once", s, name)
+			}
+		}
+		t.fields = append(t.fields, name)
+	}
+	re.WriteString(regexp.QuoteMeta(s[last:]))
+	re.WriteString(`$`)
+
+	var err error
+	t.re, err = regexp.Compile(re.String())
+	if err != nil {
+		return nil, fmt.Errorf("Path template %s is invalid: %v", s, err)
+	}
+
+	return t, nil
+}
+
+// ParsePathTemplates parses a list of path templates.
+func ParsePathTemplates(a []string) ([]*PathTemplate, error) {
+	r := make([]*PathTemplate, 0, len(a))
+	for _, s := range a {
+		t, err := ParsePathTemplate(s)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, t)
+	}
+	return r, nil
+}
+
+// String returns the template as it was passed to ParsePathTemplate.
+func (t *PathTemplate) String() string {
+	return t.src
+}
+
+// Match matches the template against `path`. If it matches, the values of the placeholders
+// are returned as a map keyed by the placeholder name (without the braces).
+func (t *PathTemplate) Match(path string) (vals map[string]string, ok bool) {
+	m := t.re.FindStringSubmatch(path)
+	if m == nil {
+		return
+	}
+
+	vals = make(map[string]string)
+	for i, f := range t.fields {
+		vals[f] = strings.TrimSpace(m[i+1])
+	}
+	ok = true
+	return
+}
+
+// applyPathTemplates sets the fields of `m` that were not present in the id3 tags from the first
+// template in `templates` that matches the path of `m`. As a last resort the title is set from the
+// filename. The names of the fields that were set are recorded in m.PathFields.
+func applyPathTemplates(m *Metadata, templates []*PathTemplate) {
+	set := func(field string, dst *string, val string) {
+		if len(*dst) == 0 && len(val) > 0 {
+			*dst = val
+			m.PathFields = append(m.PathFields, field)
+		}
+	}
+
+	missing := len(m.Artist) == 0 || len(m.Album) == 0 || len(m.Title) == 0 || m.Tracknum < 0
+	if missing {
+		for _, t := range templates {
+			vals, ok := t.Match(m.Path)
+			if !ok {
+				continue
+			}
+
+			set("artist", &m.Artist, vals["artist"])
+			set("album", &m.Album, vals["album"])
+			set("title", &m.Title, vals["title"])
+			if v, ok := vals["track"]; ok && m.Tracknum < 0 {
+				if n, err := strconv.Atoi(v); err == nil {
+					m.Tracknum = n
+					m.PathFields = append(m.PathFields, "tracknum")
+				}
+			}
+			break
+		}
+	}
+
+	set("title", &m.Title, play.TitleFromFilename(m.Path))
+}
@@ -0,0 +1,71 @@
+package scan
+
+import (
+	"github.com/jeffwilliams/wwwmp3/play"
+	"testing"
+)
+
+func TestPathTemplateMatch(test *testing.T) {
+	t, err := ParsePathTemplate("{artist}/{album}/{track} - {title}.mp3")
+	if err != nil {
+		test.Fatal("Parsing failed: ", err)
+	}
+
+	vals, ok := t.Match("/music/The Beatles/Abbey Road/01 - Come Together.MP3")
+	if !ok {
+		test.Fatal("Template didn't match")
+	}
+
+	expected := map[string]string{"artist": "The Beatles", "album": "Abbey Road", "track": "01", "title": "Come Together"}
+	for k, v := range expected {
+		if vals[k] != v {
+			test.Fatalf("Expected %s to be '%s' but got '%s'", k, v, vals[k])
+		}
+	}
+
+	if _, ok := t.Match("/music/Abbey Road/Come Together.mp3"); ok {
+		test.Fatal("Template matched a path with too few elements")
+	}
+}
+
+func TestPathTemplateBad(test *testing.T) {
+	for _, s := range []string{"{artist}/{bogus}.mp3", "{title}/{title}.mp3"} {
+		if _, err := ParsePathTemplate(s); err == nil {
+			test.Fatal("Expected an error parsing ", s)
+		}
+	}
+}
+
+func TestApplyPathTemplates(test *testing.T) {
+	templates, err := ParsePathTemplates([]string{"{artist}/{album}/{track} {title}.mp3", "{artist}/{*}/{title}.mp3"})
+	if err != nil {
+		test.Fatal("Parsing failed: ", err)
+	}
+
+	// Partially tagged: only the missing fields come from the path.
+	m := Metadata{Metadata: play.Metadata{Artist: "Tagged", Tracknum: -1}, Path: "/m/Artist/Album/03 Song.mp3"}
+	applyPathTemplates(&m, templates)
+
+	if m.Artist != "Tagged" || m.Album != "Album" || m.Title != "Song" || m.Tracknum != 3 {
+		test.Fatalf("Unexpected metadata %v", m)
+	}
+	if len(m.PathFields) != 3 {
+		test.Fatalf("Expected 3 fields derived from the path but got %v", m.PathFields)
+	}
+
+	// Falls through to the second template.
+	m = Metadata{Metadata: play.Metadata{Tracknum: -1}, Path: "/m/Artist/Whatever/Song.mp3"}
+	applyPathTemplates(&m, templates)
+
+	if m.Artist != "Artist" || m.Album != "" || m.Title != "Song" {
+		test.Fatalf("Unexpected metadata %v", m)
+	}
+
+	// No templates: only the title is taken from the filename.
+	m = Metadata{Metadata: play.Metadata{Tracknum: -1}, Path: "/m/a/b/Song.mp3"}
+	applyPathTemplates(&m, nil)
+
+	if m.Title != "Song" || len(m.PathFields) != 1 {
+		test.Fatalf("Unexpected metadata %v", m)
+	}
+}
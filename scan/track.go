@@ -0,0 +1,204 @@
+package scan
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ErrNoTrack is returned when changing an mp3 that isn't in the library.
+var ErrNoTrack = errors.New("The mp3 is not in the library")
+
+// Track is an mp3 stored in a Library. When found by FindTracks only the fields requested by the query are set.
+type Track struct {
+	// Name of the library root the mp3 is under, or empty if it isn't under a named root.
+	Library string
+	// Path of the mp3 relative to the library root, or the full path if Library is empty.
+	Path     string
+	Artist   string
+	Album    string
+	Title    string
+	Tracknum int
+	Genre    string
+	Lyrics   string
+	// Year of release, or -1 or 0 if unknown
+	Year int
+	// Duration in seconds
+	Duration float64
+	BitRate  int
+	Rate     int
+	Channels int
+	Vbr      bool
+	Size     int64
+	Mtime    int64
+	// Hash of the file without its tags. See FindDuplicates.
+	AudioHash string
+	// Acoustic fingerprint, if it was computed when scanning. See Options.Fingerprint.
+	Fingerprint string
+	// Number of times the mp3 was played and skipped, and when it last started playing (a unix time,
+	// or 0 if never). They are kept by the library, not scanned; see AddPlay.
+	Plays      int
+	Skips      int
+	LastPlayed int64
+	// Rating in stars, from 0 (unrated) to 5, and whether the mp3 is a favorite. They are kept by
+	// the library; see Rate and SetFavorite. When scanned, Rating is the rating in the POPM frame of
+	// the mp3, or -1 if it has none, in which case the stored rating is kept.
+	Rating   int
+	Favorite bool
+}
+
+// field returns a pointer to the field of the track for the database column `name`, or nil if
+// there is no such column.
+func (t *Track) field(name string) interface{} {
+	switch name {
+	case "library":
+		return &t.Library
+	case "path":
+		return &t.Path
+	case "artist":
+		return &t.Artist
+	case "album":
+		return &t.Album
+	case "title":
+		return &t.Title
+	case "tracknum":
+		return &t.Tracknum
+	case "genre":
+		return &t.Genre
+	case "lyrics":
+		return &t.Lyrics
+	case "year":
+		return &t.Year
+	case "duration":
+		return &t.Duration
+	case "bitrate":
+		return &t.BitRate
+	case "rate":
+		return &t.Rate
+	case "channels":
+		return &t.Channels
+	case "vbr":
+		return &t.Vbr
+	case "size":
+		return &t.Size
+	case "mtime":
+		return &t.Mtime
+	case "audio_hash":
+		return &t.AudioHash
+	case "fingerprint":
+		return &t.Fingerprint
+	case "plays":
+		return &t.Plays
+	case "skips":
+		return &t.Skips
+	case "last_played":
+		return &t.LastPlayed
+	case "rating":
+		return &t.Rating
+	case "favorite":
+		return &t.Favorite
+	}
+	return nil
+}
+
+// Map returns the named fields of the track as a map of database column names to values.
+// If fields is empty, all fields are returned.
+func (t *Track) Map(fields []string) map[string]string {
+	if len(fields) == 0 {
+		fields = allFields
+	}
+
+	m := make(map[string]string, len(fields))
+	for _, f := range fields {
+		switch v := t.field(f).(type) {
+		case *string:
+			m[f] = *v
+		case *int:
+			m[f] = strconv.Itoa(*v)
+		case *int64:
+			m[f] = strconv.FormatInt(*v, 10)
+		case *float64:
+			m[f] = strconv.FormatFloat(*v, 'f', -1, 64)
+		case *bool:
+			m[f] = "0"
+			if *v {
+				m[f] = "1"
+			}
+		}
+	}
+	return m
+}
+
+// FindTracks returns the mp3s in the database matching the query `q`. If the query is paged, `hasMore`
+// is true if there are more mp3s after the requested page.
+func (m Mp3Db) FindTracks(q *Query) (tracks []Track, hasMore bool, err error) {
+	var variants func(string) []string
+	if q.Fuzzy {
+		if variants, err = fuzzyVariants(m.fuzzy, m); err != nil {
+			return
+		}
+	}
+
+	sql, args, err := q.build(m.fullText, variants)
+	if err != nil {
+		return
+	}
+
+	rows, err := m.DB.Query(sql, args...)
+	if err != nil {
+		err = fmt.Errorf("Query failed: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	fields := q.fields()
+	tracks = make([]Track, 0)
+	for rows.Next() {
+		if q.Paging != nil && len(tracks) == q.Paging.PageSize {
+			// The query reads one more row than the page size.
+			hasMore = true
+			break
+		}
+
+		var t Track
+		ptrs := make([]interface{}, len(fields))
+		for i, f := range fields {
+			ptrs[i] = t.field(f)
+		}
+
+		if err = rows.Scan(ptrs...); err != nil {
+			err = fmt.Errorf("Reading query results failed: %v", err)
+			return
+		}
+		tracks = append(tracks, t)
+	}
+
+	if e := rows.Err(); e != nil {
+		err = fmt.Errorf("Query error: %v", e)
+	}
+	return
+}
+
+// track returns the Track stored for the scanned mp3 `m`.
+func (m *Metadata) track() Track {
+	return Track{
+		Path:        m.Path,
+		Artist:      m.Artist,
+		Album:       m.Album,
+		Title:       m.Title,
+		Tracknum:    m.Tracknum,
+		Genre:       m.Genre,
+		Lyrics:      m.Lyrics,
+		Year:        m.Year,
+		Duration:    m.Duration,
+		BitRate:     m.BitRate,
+		Rate:        m.Rate,
+		Channels:    m.Channels,
+		Vbr:         m.Vbr,
+		Size:        m.Size,
+		Mtime:       m.Mtime,
+		AudioHash:   m.AudioHash,
+		Fingerprint: m.Fingerprint,
+		Rating:      m.Rating,
+	}
+}
@@ -245,6 +245,7 @@ function MainCtrl($scope, $http, $timeout){
   $scope.artistCriteria = "";
   $scope.albumCriteria = "";
   $scope.titleCriteria = "";
+  $scope.searchCriteria = "";
 
   $scope.artistPage = 0;
   $scope.artistPageIsLast = true;
@@ -284,18 +285,41 @@ function MainCtrl($scope, $http, $timeout){
 
   $scope.playerEventsWebsock = null;
 
-  $scope.scannedMp3 = null;
+  // Progress of the current (or last) scan, as sent by the server
+  $scope.scanProgress = null;
 
   // Repeat mode is one of: DontRepeat, RepeatOne, or RepeatAll
   $scope.repeatMode = "DontRepeat";
 
-  // Get a printable version of the last scanned mp3
-  $scope.scannedMp3ForDisplay = function() {
-    if(null == $scope.scannedMp3){
+  // Get a printable version of the scan progress
+  $scope.scanProgressForDisplay = function() {
+    var p = $scope.scanProgress;
+    if(null == p){
       return "";
-    } else {
-      return $scope.scannedMp3.Title + " by " + $scope.scannedMp3.Artist;
     }
+
+    if(!p.Scanning){
+      var s = p.Cancelled ? "Scan cancelled" : "Scan complete";
+      if(p.Errors > 0){
+        s += " (" + p.Errors + " errors)";
+      }
+      return s;
+    }
+
+    var s = "Scanning " + p.Dir;
+    if(p.Dirs > 1){
+      s += " (" + (p.DirIndex+1) + " of " + p.Dirs + ")";
+    }
+    if(p.Found > 0){
+      s += ": " + p.Done + " of " + p.Found;
+    }
+    if(p.Errors > 0){
+      s += ", " + p.Errors + " errors";
+    }
+    if(p.Eta >= 0){
+      s += ", " + secondsToTime(p.Eta) + " left";
+    }
+    return s;
   }
 
   /**************** ERROR HANDLING ******************/
@@ -371,14 +395,19 @@ function MainCtrl($scope, $http, $timeout){
     });
   }
 
-  var handlePlayerScanEvent = function(meta){
-    console.log("Scan: got meta: ");
-    console.log(meta);
+  var handlePlayerScanProgressEvent = function(progress){
     $timeout(function(){
-      $scope.scannedMp3 = meta;
+      $scope.scanProgress = progress;
     });
   }
 
+  // A scan changed the database, so reload the lists.
+  var handleLibraryChangeEvent = function(change){
+    getArtists();
+    getAlbums();
+    getSongs();
+  }
+
   var handlePlayerStateEvent = function(state){
     /* State returned from the server is an enumeration with the values:
         0 = empty
@@ -450,8 +479,10 @@ function MainCtrl($scope, $http, $timeout){
         handlePlayerOffsetEvent(e["Offset"])
       if("Meta" in e) 
         handlePlayerMetaEvent(e["Meta"])
-      if("Scan" in e) 
-        handlePlayerScanEvent(e["Scan"])
+      if("ScanProgress" in e) 
+        handlePlayerScanProgressEvent(e["ScanProgress"])
+      if("LibraryChange" in e)
+        handleLibraryChangeEvent(e["LibraryChange"])
       if("State" in e) 
         handlePlayerStateEvent(e["State"])
       if("Queue" in e)
@@ -491,6 +522,8 @@ function MainCtrl($scope, $http, $timeout){
       'artist' : $scope.artistCriteria,
       'album' : $scope.albumCriteria,
       'title' : $scope.titleCriteria,
+      'q' : $scope.searchCriteria,
+      'fuzzy' : 1,
       'order' : orderFields.join()
     }
 
@@ -537,7 +570,9 @@ function MainCtrl($scope, $http, $timeout){
   }
 
   var getSongs = function(){
-    getMp3Data($scope.titlePage, null, ["tracknum", "title"], function(data){
+    // When searching, order the songs by how well they match.
+    var order = $scope.searchCriteria ? [] : ["tracknum", "title"];
+    getMp3Data($scope.titlePage, null, order, function(data){
       $scope.titlePageIsLast = false;
       $scope.songs = []
       for(var i = 0; i < data.length; i++){
@@ -584,6 +619,28 @@ function MainCtrl($scope, $http, $timeout){
     $scope.titleCriteria = s;
   }
 
+  $scope.setSearchCriteria = function(s) {
+    $scope.searchCriteria = s;
+  }
+
+  $scope.searchSuggestions = [];
+
+  // Get completions of the search text for the search box.
+  var getSearchSuggestions = function() {
+    if (!$scope.searchCriteria) {
+      $scope.searchSuggestions = [];
+      return;
+    }
+
+    $http.get("/songmeta/suggest", {'params' : {'q' : $scope.searchCriteria, 'limit' : 10}}).
+      success(function(data,status,headers,config){
+        $scope.searchSuggestions = data;
+      }).
+      error(function(data,status,headers,config){
+        console.log("Error: getting search suggestions failed: " + data);
+      });
+  }
+
   $scope.changeArtistPage = function(delta){
     var oldpage = $scope.artistPage;
     $scope.artistPage = $scope.artistPage + delta;
@@ -820,6 +877,27 @@ function MainCtrl($scope, $http, $timeout){
       });
   }
 
+  $scope.cancelScan = function(){
+    $http.get("/scan/cancel").
+      success(function(data,status,headers,config){
+      }).
+      error(function(data,status,headers,config){
+        console.log("Error: cancelling scan failed: " + data);
+      });
+  }
+
+  var getScanStatus = function(){
+    $http.get("/scan/status").
+      success(function(data,status,headers,config){
+        if(data.Scanning){
+          $scope.scanProgress = data;
+        }
+      }).
+      error(function(data,status,headers,config){
+        console.log("Error: getting scan status failed: " + data);
+      });
+  }
+
   $scope.sendPlayerSetRepeatModeRequest = function(mode){
     var parms = {
       'mode': mode
@@ -840,6 +918,7 @@ function MainCtrl($scope, $http, $timeout){
   getAlbums();
   getSongs();
   playerGetVolume();
+  getScanStatus();
 
   // Connect websocket
   playerEventsConnect();
@@ -879,6 +958,10 @@ function MainCtrl($scope, $http, $timeout){
   $scope.$watch('artistCriteria', artistFilterChanged);
   $scope.$watch('albumCriteria', albumFilterChanged);
   $scope.$watch('titleCriteria', titleFilterChanged);
+  $scope.$watch('searchCriteria', function(newValue, oldValue){
+    filtersChanged(newValue, oldValue, null);
+    getSearchSuggestions();
+  });
 
   $scope.volumeMouseup = function(){
     playerSetVolume();
@@ -1127,6 +1210,31 @@ function MainCtrl($scope, $http, $timeout){
     }
   }
 
+  // Total duration of the tracks in the play queue, in seconds
+  var queueSeconds = function() {
+    var total = 0;
+    for(var i = 0; i < $scope.playQueue.length; i++){
+      var d = parseFloat($scope.playQueue[i].duration);
+      if(d) {
+        total += d;
+      }
+    }
+    return total;
+  }
+
+  $scope.queueDuration = function() {
+    return secondsToTime(queueSeconds());
+  }
+
+  // The wall clock time at which the last track in the play queue will finish
+  $scope.queueEta = function() {
+    var remaining = queueSeconds();
+    if( $scope.playing && $scope.playing.duration && $scope.playing.sec_per_sample ) {
+      remaining += parseFloat($scope.playing.duration) - $scope.position*$scope.playing.sec_per_sample;
+    }
+    return new Date(Date.now() + remaining*1000).toLocaleTimeString();
+  }
+
   $scope.changeRepeatMode = function() {
     console.log("changeRepeatMode: called");
     if ($scope.repeatMode == "DontRepeat") {